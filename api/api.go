@@ -8,7 +8,12 @@ import (
 	"portal-server/api/controller/user"
 	"portal-server/api/middleware"
 	"portal-server/api/util"
+	"portal-server/archive"
+	"portal-server/blob"
+	"portal-server/bus"
+	"portal-server/events"
 	"portal-server/store"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -19,13 +24,21 @@ var (
 	dbPassword = os.Getenv("DB_API_PASSWORD")
 )
 
-// API returns a Gin router based on a given database.
-func API(store store.Store, httpClient *http.Client) *gin.Engine {
+var onlineThreshold = os.Getenv("DEVICE_ONLINE_THRESHOLD")
+
+// attachmentDir is where uploaded attachments are kept
+var attachmentDir = os.Getenv("ATTACHMENT_DIR")
+
+// API returns a Gin router based on a given database and attachment store.
+// Events are delivered to this process's clients by the hub.
+func API(store store.Store, blobs blob.BlobStore, hub *events.Hub, httpClient *http.Client) *gin.Engine {
 	r := gin.Default()
 	r.Use(middleware.CORSMiddleware())
 
 	// Set context variables
 	r.Use(middleware.SetStore(store))
+	r.Use(middleware.SetBlobStore(blobs))
+	r.Use(middleware.SetEvents(hub))
 	r.Use(middleware.SetWebClient(httpClient))
 
 	// Add swagger.json file
@@ -39,6 +52,8 @@ func API(store store.Store, httpClient *http.Client) *gin.Engine {
 			base.POST("/login", access.LoginEndpoint)
 			base.POST("/login/google", access.GoogleLoginEndpoint)
 			base.GET("/verify/:token", access.VerifyUserEndpoint)
+			base.POST("/pairing", user.StartPairingEndpoint)
+			base.POST("/pairing/:session_id/claim", user.ClaimPairingEndpoint)
 		}
 
 		secure := v1.Group("/user")
@@ -46,17 +61,70 @@ func API(store store.Store, httpClient *http.Client) *gin.Engine {
 		{
 			secure.POST("/devices", user.AddDeviceEndpoint)
 			secure.GET("/devices", user.GetDevicesEndpoint)
-			secure.GET("/messages/history", user.GetMessageHistoryEndpoint)
-			secure.GET("/messages/sync/:mid", user.SyncMessagesEndpoint)
+			secure.GET("/keys", user.GetKeysEndpoint)
+			secure.POST("/keys/rotate", user.RotateKeysEndpoint)
+			secure.GET("/keys/pending", user.GetPendingDevicesEndpoint)
+			secure.GET("/keys/wrapped/:device_id", user.GetWrappedKeysEndpoint)
+			secure.POST("/keys/wrapped/:device_id", user.UploadWrappedKeysEndpoint)
+			secure.GET("/encryption", user.GetEncryptionSettingsEndpoint)
+			secure.PUT("/encryption", user.UpdateEncryptionSettingsEndpoint)
+			secure.GET("/region", user.GetRegionEndpoint)
+			secure.PUT("/region", user.UpdateRegionEndpoint)
+			secure.POST("/messages", user.SendMessageEndpoint)
+			secure.POST("/messages/scheduled", user.ScheduleMessageEndpoint)
+			secure.GET("/messages/:mid", namedRoutes("mid", map[string]gin.HandlerFunc{
+				"history":   user.GetMessageHistoryEndpoint,
+				"changes":   user.GetMessageChangesEndpoint,
+				"search":    user.SearchMessagesEndpoint,
+				"scheduled": user.GetScheduledMessagesEndpoint,
+				"export":    user.ExportMessagesEndpoint,
+			}, user.GetMessageEndpoint))
+			secure.GET("/messages/:mid/:since", namedRoutes("mid", map[string]gin.HandlerFunc{
+				"sync": user.SyncMessagesEndpoint,
+			}, notFound))
+			secure.PUT("/messages/scheduled/:id", user.UpdateScheduledMessageEndpoint)
 			secure.DELETE("/messages/:mid", user.DeleteMessageEndpoint)
+			secure.DELETE("/messages/:mid/:id", namedRoutes("mid", map[string]gin.HandlerFunc{
+				"scheduled": user.CancelScheduledMessageEndpoint,
+			}, notFound))
+			secure.GET("/conversations", user.GetConversationsEndpoint)
+			secure.GET("/conversations/:id/messages", user.GetConversationMessagesEndpoint)
+			secure.POST("/conversations/:id/read", user.MarkConversationReadEndpoint)
+			secure.GET("/drafts/:conversation", user.GetDraftEndpoint)
+			secure.PUT("/drafts/:conversation", user.SaveDraftEndpoint)
+			secure.DELETE("/drafts/:conversation", user.DeleteDraftEndpoint)
+			secure.POST("/imports", user.ImportMessagesEndpoint)
+			secure.GET("/imports/:id", user.GetImportEndpoint)
+			secure.POST("/attachments", user.UploadAttachmentEndpoint)
+			secure.GET("/attachments/:id", user.GetAttachmentEndpoint)
 			secure.POST("/contacts", user.AddContactsEndpoint)
 			secure.GET("/contacts", user.GetContactsEndpoint)
+			secure.GET("/events", user.GetEventsEndpoint)
 			secure.POST("/signout", user.SignoutEndpoint)
+			secure.POST("/pairing/approve", user.ApprovePairingEndpoint)
 		}
 	}
 	return r
 }
 
+// namedRoutes dispatches on the value of a path parameter, falling back to
+// another handler. The router cannot have named segments alongside a
+// parameter, so routes such as /messages/history and /messages/:mid are
+// registered together this way. Message IDs are UUIDs and never collide.
+func namedRoutes(param string, routes map[string]gin.HandlerFunc, fallback gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if handler, found := routes[c.Param(param)]; found {
+			handler(c)
+			return
+		}
+		fallback(c)
+	}
+}
+
+func notFound(c *gin.Context) {
+	c.AbortWithStatus(http.StatusNotFound)
+}
+
 func main() {
 	if util.GcmApiKey == "" || util.GcmSenderID == "" {
 		log.Fatalln("Missing GCM_SENDER_ID or GCM_API_KEY environment variables")
@@ -66,7 +134,36 @@ func main() {
 		log.Fatalln("Missing DB_NAME, DB_API_USER, or DB_API_PASSWORD environment variables")
 	}
 
+	if onlineThreshold != "" {
+		threshold, err := time.ParseDuration(onlineThreshold)
+		if err != nil {
+			log.Fatalf("Invalid DEVICE_ONLINE_THRESHOLD: %v\n", err)
+		}
+		user.DeviceOnlineThreshold = threshold
+	}
+
+	if attachmentDir == "" {
+		attachmentDir = "attachments"
+	}
+	blobs, err := blob.NewFileStore(attachmentDir)
+	if err != nil {
+		log.Fatalf("Unable to use ATTACHMENT_DIR: %v\n", err)
+	}
+
+	conninfo := store.ConnInfo(dbName, dbUser, dbPassword)
 	store := store.GetStore(dbName, dbUser, dbPassword)
+	b, err := bus.NewPostgresBus(conninfo)
+	if err != nil {
+		log.Fatalf("Unable to connect to the event bus: %v\n", err)
+	}
+	hub := events.NewHub()
+	events.Forward(b, hub)
+	go func() {
+		log.Fatal(b.Listen())
+	}()
+	go bus.RelayEvery(store, b, bus.RelayInterval)
+	go archive.ResumeImports(store, blobs)
+
 	httpClient := http.DefaultClient
-	API(store, httpClient).Run(":8080")
+	API(store, blobs, hub, httpClient).Run(":8080")
 }
@@ -2,18 +2,25 @@ package main
 
 import (
 	"bytes"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"portal-server/blob"
+	"portal-server/events"
 	"portal-server/store"
 	"testing"
 
 	"github.com/franela/goblin"
+	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestAPI(t *testing.T) {
 	g := goblin.Goblin(t)
-	api := API(store.GetTestStore(), http.DefaultClient)
+	dir, _ := ioutil.TempDir("", "attachments")
+	defer os.RemoveAll(dir)
+	api := API(store.GetTestStore(), &blob.FileStore{Dir: dir}, events.NewHub(), http.DefaultClient)
 
 	g.Describe("API routes", func() {
 
@@ -59,6 +66,20 @@ func TestAPI(t *testing.T) {
 			assert.Equal(t, http.StatusBadRequest, w.Code)
 		})
 
+		g.It("Should allow a POST /pairing", func() {
+			req, _ := http.NewRequest("POST", "/v1/pairing", bytes.NewBufferString(""))
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+		})
+
+		g.It("Should allow a POST /pairing/:session_id/claim", func() {
+			req, _ := http.NewRequest("POST", "/v1/pairing/abc/claim", bytes.NewBufferString(""))
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+		})
+
 		g.It("Should allow a POST /user/devices", func() {
 			req, _ := http.NewRequest("POST", "/v1/user/devices", nil)
 			w := httptest.NewRecorder()
@@ -73,6 +94,76 @@ func TestAPI(t *testing.T) {
 			assert.Equal(t, http.StatusUnauthorized, w.Code)
 		})
 
+		g.It("Should allow a GET /user/keys", func() {
+			req, _ := http.NewRequest("GET", "/v1/user/keys", nil)
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+		})
+
+		g.It("Should allow a POST /user/keys/rotate", func() {
+			req, _ := http.NewRequest("POST", "/v1/user/keys/rotate", nil)
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+		})
+
+		g.It("Should allow a GET /user/keys/pending", func() {
+			req, _ := http.NewRequest("GET", "/v1/user/keys/pending", nil)
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+		})
+
+		g.It("Should allow a GET /user/keys/wrapped/:device_id", func() {
+			req, _ := http.NewRequest("GET", "/v1/user/keys/wrapped/5", nil)
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+		})
+
+		g.It("Should allow a POST /user/keys/wrapped/:device_id", func() {
+			req, _ := http.NewRequest("POST", "/v1/user/keys/wrapped/5", nil)
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+		})
+
+		g.It("Should allow a GET /user/encryption", func() {
+			req, _ := http.NewRequest("GET", "/v1/user/encryption", nil)
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+		})
+
+		g.It("Should allow a PUT /user/encryption", func() {
+			req, _ := http.NewRequest("PUT", "/v1/user/encryption", nil)
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+		})
+
+		g.It("Should allow a GET /user/region", func() {
+			req, _ := http.NewRequest("GET", "/v1/user/region", nil)
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+		})
+
+		g.It("Should allow a PUT /user/region", func() {
+			req, _ := http.NewRequest("PUT", "/v1/user/region", nil)
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+		})
+
+		g.It("Should allow a POST /user/messages", func() {
+			req, _ := http.NewRequest("POST", "/v1/user/messages", nil)
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+		})
+
 		g.It("Should allow a GET /user/messages/history", func() {
 			req, _ := http.NewRequest("GET", "/v1/user/messages/history", nil)
 			w := httptest.NewRecorder()
@@ -87,6 +178,27 @@ func TestAPI(t *testing.T) {
 			assert.Equal(t, http.StatusUnauthorized, w.Code)
 		})
 
+		g.It("Should allow a GET /user/messages/changes", func() {
+			req, _ := http.NewRequest("GET", "/v1/user/messages/changes?since=0", nil)
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+		})
+
+		g.It("Should allow a GET /user/messages/search", func() {
+			req, _ := http.NewRequest("GET", "/v1/user/messages/search?q=hello", nil)
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+		})
+
+		g.It("Should allow a GET /user/messages/:mid", func() {
+			req, _ := http.NewRequest("GET", "/v1/user/messages/5", nil)
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+		})
+
 		g.It("Should allow a DELETE /user/messages/:mid", func() {
 			req, _ := http.NewRequest("DELETE", "/v1/user/messages/5", nil)
 			w := httptest.NewRecorder()
@@ -94,6 +206,69 @@ func TestAPI(t *testing.T) {
 			assert.Equal(t, http.StatusUnauthorized, w.Code)
 		})
 
+		g.It("Should allow a POST /user/messages/scheduled", func() {
+			req, _ := http.NewRequest("POST", "/v1/user/messages/scheduled", nil)
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+		})
+
+		g.It("Should allow a GET /user/messages/scheduled", func() {
+			req, _ := http.NewRequest("GET", "/v1/user/messages/scheduled", nil)
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+		})
+
+		g.It("Should allow a GET /user/messages/export", func() {
+			req, _ := http.NewRequest("GET", "/v1/user/messages/export", nil)
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+		})
+
+		g.It("Should allow a PUT /user/messages/scheduled/:id", func() {
+			req, _ := http.NewRequest("PUT", "/v1/user/messages/scheduled/5", nil)
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+		})
+
+		g.It("Should allow a DELETE /user/messages/scheduled/:id", func() {
+			req, _ := http.NewRequest("DELETE", "/v1/user/messages/scheduled/5", nil)
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+		})
+
+		g.It("Should allow a GET /user/drafts/:conversation", func() {
+			req, _ := http.NewRequest("GET", "/v1/user/drafts/abc", nil)
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+		})
+
+		g.It("Should allow a PUT /user/drafts/:conversation", func() {
+			req, _ := http.NewRequest("PUT", "/v1/user/drafts/abc", nil)
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+		})
+
+		g.It("Should allow a DELETE /user/drafts/:conversation", func() {
+			req, _ := http.NewRequest("DELETE", "/v1/user/drafts/abc", nil)
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+		})
+
+		g.It("Should allow a GET /user/events", func() {
+			req, _ := http.NewRequest("GET", "/v1/user/events", nil)
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+		})
+
 		g.It("Should allow a POST /user/signout", func() {
 			req, _ := http.NewRequest("POST", "/v1/user/signout", bytes.NewBufferString(""))
 			w := httptest.NewRecorder()
@@ -101,6 +276,62 @@ func TestAPI(t *testing.T) {
 			assert.Equal(t, http.StatusUnauthorized, w.Code)
 		})
 
+		g.It("Should allow a POST /user/pairing/approve", func() {
+			req, _ := http.NewRequest("POST", "/v1/user/pairing/approve", bytes.NewBufferString(""))
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+		})
+
+		g.It("Should allow a GET /user/conversations", func() {
+			req, _ := http.NewRequest("GET", "/v1/user/conversations", nil)
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+		})
+
+		g.It("Should allow a GET /user/conversations/:id/messages", func() {
+			req, _ := http.NewRequest("GET", "/v1/user/conversations/abc/messages", nil)
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+		})
+
+		g.It("Should allow a POST /user/conversations/:id/read", func() {
+			req, _ := http.NewRequest("POST", "/v1/user/conversations/abc/read", bytes.NewBufferString("{}"))
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+		})
+
+		g.It("Should allow a POST /user/imports", func() {
+			req, _ := http.NewRequest("POST", "/v1/user/imports", nil)
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+		})
+
+		g.It("Should allow a GET /user/imports/:id", func() {
+			req, _ := http.NewRequest("GET", "/v1/user/imports/abc", nil)
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+		})
+
+		g.It("Should allow a POST /user/attachments", func() {
+			req, _ := http.NewRequest("POST", "/v1/user/attachments", nil)
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+		})
+
+		g.It("Should allow a GET /user/attachments/:id", func() {
+			req, _ := http.NewRequest("GET", "/v1/user/attachments/5", nil)
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+		})
+
 		g.It("Should allow a POST /user/contacts", func() {
 			req, _ := http.NewRequest("POST", "/v1/user/contacts", bytes.NewBufferString(""))
 			w := httptest.NewRecorder()
@@ -115,4 +346,30 @@ func TestAPI(t *testing.T) {
 			assert.Equal(t, http.StatusUnauthorized, w.Code)
 		})
 	})
+
+	g.Describe("Named routes", func() {
+		handler := func(name string) gin.HandlerFunc {
+			return func(c *gin.Context) {
+				c.String(http.StatusOK, name+" "+c.Param("mid"))
+			}
+		}
+		r := gin.New()
+		r.GET("/messages/:mid", namedRoutes("mid", map[string]gin.HandlerFunc{
+			"history": handler("history"),
+		}, handler("message")))
+
+		g.It("Should dispatch on the parameter value", func() {
+			req, _ := http.NewRequest("GET", "/messages/history", nil)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			assert.Equal(t, "history history", w.Body.String())
+		})
+
+		g.It("Should fall back for other values", func() {
+			req, _ := http.NewRequest("GET", "/messages/abc", nil)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			assert.Equal(t, "message abc", w.Body.String())
+		})
+	})
 }
@@ -60,7 +60,7 @@ func GoogleLoginEndpoint(c *gin.Context) {
 			return err
 		}
 
-		userToken, err = createUserToken(store, user)
+		userToken, err = CreateUserToken(store, user)
 		if err != nil {
 			controller.InternalServiceError(c, err)
 			return err
@@ -47,7 +47,7 @@ func LoginEndpoint(c *gin.Context) {
 		return
 	}
 
-	userToken, err := createUserToken(store, user)
+	userToken, err := CreateUserToken(store, user)
 	if err != nil {
 		controller.InternalServiceError(c, err)
 		return
@@ -8,7 +8,8 @@ import (
 	"time"
 )
 
-func createUserToken(store store.Store, user *model.User) (string, error) {
+// CreateUserToken issues a new non-expiring token for the user.
+func CreateUserToken(store store.Store, user *model.User) (string, error) {
 	token := make([]byte, 32)
 	if _, err := rand.Read(token); err != nil {
 		return "", err
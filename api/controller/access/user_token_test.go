@@ -16,7 +16,7 @@ func TestCreateUserToken(t *testing.T) {
 	}
 	userTokenStore.Users().CreateUser(user)
 
-	token, err := createUserToken(userTokenStore, user)
+	token, err := CreateUserToken(userTokenStore, user)
 	assert.NoError(t, err)
 	assert.Regexp(t, "^[a-fA-F0-9]+$", token)
 
@@ -0,0 +1,19 @@
+package context
+
+import (
+	"portal-server/blob"
+
+	"github.com/gin-gonic/gin"
+)
+
+const blobStoreKey = "blobStore"
+
+// BlobStoreToContext sets the value <blobStoreKey, blobs>
+func BlobStoreToContext(c *gin.Context, blobs blob.BlobStore) {
+	c.Set(blobStoreKey, blobs)
+}
+
+// BlobStoreFromContext retrieves the value <blobStoreKey>
+func BlobStoreFromContext(c *gin.Context) blob.BlobStore {
+	return c.MustGet(blobStoreKey).(blob.BlobStore)
+}
@@ -0,0 +1,25 @@
+package context
+
+import (
+	"portal-server/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+const deviceKey = "device"
+
+// DeviceToContext injects the linked device making the request into the
+// context <deviceKey, device>
+func DeviceToContext(c *gin.Context, device *model.Device) {
+	c.Set(deviceKey, device)
+}
+
+// DeviceFromContext retrieves the linked device making the request from the
+// current context, if it identified one
+func DeviceFromContext(c *gin.Context) (*model.Device, bool) {
+	device, found := c.Get(deviceKey)
+	if !found {
+		return nil, false
+	}
+	return device.(*model.Device), true
+}
@@ -0,0 +1,19 @@
+package context
+
+import (
+	"portal-server/events"
+
+	"github.com/gin-gonic/gin"
+)
+
+const eventHubKey = "eventHub"
+
+// EventHubToContext sets the value <eventHubKey, hub>
+func EventHubToContext(c *gin.Context, hub *events.Hub) {
+	c.Set(eventHubKey, hub)
+}
+
+// EventHubFromContext retrieves the value <eventHubKey>
+func EventHubFromContext(c *gin.Context) *events.Hub {
+	return c.MustGet(eventHubKey).(*events.Hub)
+}
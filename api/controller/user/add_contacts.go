@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"portal-server/api/controller"
 	"portal-server/api/controller/context"
+	"portal-server/bus"
 	"portal-server/model"
 	"portal-server/store"
 
@@ -30,6 +31,10 @@ func AddContactsEndpoint(c *gin.Context) {
 				return err
 			}
 		}
+		if err := bus.Enqueue(store, bus.ContactsChanged{UserID: user.ID}); err != nil {
+			controller.InternalServiceError(c, err)
+			return err
+		}
 		c.JSON(http.StatusOK, controller.RenderSuccess(true))
 		return nil
 	})
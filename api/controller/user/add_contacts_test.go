@@ -11,6 +11,7 @@ import (
 	"portal-server/api/errs"
 	"portal-server/api/middleware"
 	"portal-server/api/testutil"
+	"portal-server/bus"
 	"portal-server/model"
 	"portal-server/store"
 	"testing"
@@ -77,6 +78,7 @@ func TestAddContacts(t *testing.T) {
 				})
 				assert.Equal(t, 2, len(contact.PhoneNumbers))
 			}
+			assert.Equal(t, []bus.Event{bus.ContactsChanged{UserID: user.ID}}, enqueuedEvents(s))
 		})
 
 		g.It("Should return 400 on missing JSON fields", func() {
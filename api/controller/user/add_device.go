@@ -1,13 +1,12 @@
 package user
 
 import (
-	"crypto/rand"
-	"encoding/hex"
 	"net/http"
 	"portal-server/api/controller"
 	"portal-server/api/controller/context"
 	"portal-server/api/errs"
 	"portal-server/api/util"
+	"portal-server/bus"
 	"portal-server/model"
 	"portal-server/store"
 
@@ -15,22 +14,35 @@ import (
 	"github.com/satori/go.uuid"
 )
 
-var gcmEndpoint = "https://android.googleapis.com/gcm/notification"
+var gcmEndpoint = util.GcmNotificationEndpoint
 
 type addDevice struct {
 	RegistrationID string `json:"registration_id" valid:"required"`
 	Name           string `json:"name" valid:"required"`
 	Type           string `json:"type" valid:"required,matches(phone,chrome,desktop)"`
+	PublicKey      string `json:"public_key" valid:"base64,length(44|44)"`
 }
 
 type addDeviceResponse struct {
-	DeviceID        string `json:"device_id"`
-	EncryptionKey   string `json:"encryption_key"`
-	NotificationKey string `json:"notification_key"`
+	DeviceID             string              `json:"device_id"`
+	EncryptionKey        string              `json:"encryption_key"`
+	EncryptionKeyVersion int                 `json:"encryption_key_version"`
+	EncryptionKeys       []encryptionKeyBody `json:"encryption_keys"`
+	NotificationKey      string              `json:"notification_key"`
+	KeyState             string              `json:"key_state,omitempty"`
+}
+
+type devicePendingPayload struct {
+	DeviceID  string `json:"device_id"`
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	PublicKey string `json:"public_key"`
 }
 
 // AddDeviceEndpoint allows users to register new GCM devices, which returns encryption
-// and notification keys on success.
+// and notification keys on success. Devices registering a public key never receive
+// server held encryption keys: they wait for an existing device to wrap the user's
+// content key for them instead.
 func AddDeviceEndpoint(c *gin.Context) {
 	var body addDevice
 	if !controller.ValidJSON(c, &body) {
@@ -42,47 +54,100 @@ func AddDeviceEndpoint(c *gin.Context) {
 	wc := context.WebClientFromContext(c, gcmEndpoint)
 
 	s.Transaction(func(store store.Store) error {
-		var err error
-
-		if store.Devices().DeviceCount(&model.Device{RegistrationID: body.RegistrationID}) >= 1 {
-			err = errs.ErrDuplicateDeviceToken
-			c.JSON(http.StatusBadRequest, controller.RenderError(err))
-			return err
+		if pairingRequired(store, user) {
+			c.JSON(http.StatusForbidden, controller.RenderError(errs.ErrPairingRequired))
+			return errs.ErrPairingRequired
 		}
 
-		notificationKey, err := createNotificationKey(store, wc, user, body.RegistrationID)
-		if err, isGCMError := err.(errs.GCMError); isGCMError {
-			c.JSON(http.StatusBadRequest, controller.DetailError{
-				Error:  errs.ErrUnableToRegisterDevice.Error(),
-				Reason: err.Error(),
-			})
-			return err
-		}
-
-		device, err := createDevice(store, user, &body, notificationKey)
+		response, err := registerDevice(c, store, wc, user, &body)
 		if err != nil {
-			controller.InternalServiceError(c, err)
 			return err
 		}
+		c.JSON(http.StatusOK, response)
+		return nil
+	})
+}
 
-		if err != nil {
-			controller.InternalServiceError(c, err)
-			return err
-		}
+// pairingRequired is true when a device is added to an account which already
+// has a linked phone: it must be paired from the phone. Devices only say what
+// type they are, so a new phone is paired like any other device.
+func pairingRequired(store store.Store, user *model.User) bool {
+	return store.Devices().DeviceCount(&model.Device{
+		UserID: user.ID,
+		Type:   model.DeviceTypePhone,
+		State:  model.DeviceStateLinked,
+	}) > 0
+}
 
-		encryptionKey, err := getEncryptionKey(store, user)
-		if err != nil {
-			controller.InternalServiceError(c, err)
-			return err
-		}
+// registerDevice links a new device to the user and returns the keys it
+// needs. Failures are rendered to the client before being returned.
+func registerDevice(c *gin.Context, store store.Store, wc *util.WebClient, user *model.User, body *addDevice) (*addDeviceResponse, error) {
+	if store.Devices().DeviceCount(&model.Device{RegistrationID: body.RegistrationID}) >= 1 {
+		c.JSON(http.StatusBadRequest, controller.RenderError(errs.ErrDuplicateDeviceToken))
+		return nil, errs.ErrDuplicateDeviceToken
+	}
 
-		c.JSON(http.StatusOK, addDeviceResponse{
+	notificationKey, err := createNotificationKey(store, wc, user, body.RegistrationID)
+	if err, isGCMError := err.(errs.GCMError); isGCMError {
+		c.JSON(http.StatusBadRequest, controller.DetailError{
+			Error:  errs.ErrUnableToRegisterDevice.Error(),
+			Reason: err.Error(),
+		})
+		return nil, err
+	}
+	if err != nil {
+		controller.InternalServiceError(c, err)
+		return nil, err
+	}
+
+	device, err := createDevice(store, user, body, notificationKey)
+	if err != nil {
+		controller.InternalServiceError(c, err)
+		return nil, err
+	}
+	if err := bus.Enqueue(store, bus.DeviceLinked{UserID: user.ID, DeviceID: device.UUID}); err != nil {
+		controller.InternalServiceError(c, err)
+		return nil, err
+	}
+
+	if device.PublicKey != "" {
+		if device.KeyState == model.DeviceKeyStatePending {
+			if err := notifyDevices(c, store, user, notificationDevicePending, devicePendingPayload{
+				DeviceID:  device.UUID,
+				Name:      device.Name,
+				Type:      device.Type,
+				PublicKey: device.PublicKey,
+			}); err != nil {
+				c.Error(err)
+			}
+		}
+		return &addDeviceResponse{
 			DeviceID:        device.UUID,
-			EncryptionKey:   encryptionKey.Key,
 			NotificationKey: notificationKey.Key,
-		})
-		return nil
-	})
+			KeyState:        device.KeyState,
+		}, nil
+	}
+
+	encryptionKey, err := getEncryptionKey(store, user)
+	if err != nil {
+		controller.InternalServiceError(c, err)
+		return nil, err
+	}
+
+	// Include older keys so the device can decrypt existing messages
+	keySet, err := getKeySet(store, user)
+	if err != nil {
+		controller.InternalServiceError(c, err)
+		return nil, err
+	}
+
+	return &addDeviceResponse{
+		DeviceID:             device.UUID,
+		EncryptionKey:        encryptionKey.Key,
+		EncryptionKeyVersion: encryptionKey.Version,
+		EncryptionKeys:       keySet.Keys,
+		NotificationKey:      notificationKey.Key,
+	}, nil
 }
 
 func createDevice(store store.Store, user *model.User, body *addDevice, notificationKey *model.NotificationKey) (*model.Device, error) {
@@ -94,6 +159,19 @@ func createDevice(store store.Store, user *model.User, body *addDevice, notifica
 		Name:            body.Name,
 		Type:            body.Type,
 		State:           model.DeviceStateLinked,
+		PublicKey:       body.PublicKey,
+	}
+	if body.PublicKey != "" {
+		// The first device with a public key creates the content key itself,
+		// any later ones must be approved by an existing device
+		device.KeyState = model.DeviceKeyStateApproved
+		if store.Devices().DeviceCount(&model.Device{
+			UserID:   user.ID,
+			State:    model.DeviceStateLinked,
+			KeyState: model.DeviceKeyStateApproved,
+		}) > 0 {
+			device.KeyState = model.DeviceKeyStatePending
+		}
 	}
 	if err := store.Devices().CreateDevice(device); err != nil {
 		return nil, err
@@ -108,12 +186,11 @@ func createNotificationKey(store store.Store, wc *util.WebClient, user *model.Us
 
 	// If no notification key exists: create and register with GCM
 	if !found {
-		bytes := make([]byte, 48)
-		if _, err := rand.Read(bytes); err != nil {
+		groupName, err := util.NewNotificationGroupName()
+		if err != nil {
 			return nil, err
 		}
 
-		groupName := hex.EncodeToString(bytes)
 		key, err := util.CreateNotificationGroup(wc, groupName, registrationID)
 		if err != nil {
 			return nil, err
@@ -131,8 +208,12 @@ func createNotificationKey(store store.Store, wc *util.WebClient, user *model.Us
 		return notificationKey, nil
 	}
 
-	// If notification key exists: add device to notification group
+	// If notification key exists: add device to notification group,
+	// recovering the group if GCM no longer accepts the stored key
 	err := util.AddNotificationGroup(wc, notificationKey.GroupName, notificationKey.Key, registrationID)
+	if _, isGCMError := err.(errs.GCMError); isGCMError && err != errs.ErrGCMServiceUnavailable {
+		err = util.RecoverNotificationGroup(store, wc, notificationKey, registrationID)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -141,22 +222,16 @@ func createNotificationKey(store store.Store, wc *util.WebClient, user *model.Us
 }
 
 func getEncryptionKey(store store.Store, user *model.User) (*model.EncryptionKey, error) {
-	encryptionKey, found := store.EncryptionKeys().FindKey(&model.EncryptionKey{
-		UserID: user.ID,
+	encryptionKey, found, err := store.EncryptionKeys().FindKey(&model.EncryptionKey{
+		UserID:  user.ID,
+		Current: true,
 	})
-	// Create new key if not found
+	if err != nil {
+		return nil, err
+	}
+	// Create the first key version if not found
 	if !found {
-		key := make([]byte, 32)
-		if _, err := rand.Read(key); err != nil {
-			return nil, err
-		}
-		encryptionKey = &model.EncryptionKey{
-			User: *user,
-			Key:  hex.EncodeToString(key),
-		}
-		if err := store.EncryptionKeys().CreateKey(encryptionKey); err != nil {
-			return nil, err
-		}
+		return createEncryptionKey(store, user, 1)
 	}
 	return encryptionKey, nil
 }
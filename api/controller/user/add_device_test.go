@@ -3,6 +3,7 @@ package user
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -10,8 +11,10 @@ import (
 	"portal-server/api/middleware"
 	"portal-server/api/testutil"
 	"portal-server/api/util"
+	"portal-server/bus"
 	"portal-server/model"
 	"portal-server/store"
+	"strings"
 	"testing"
 
 	"github.com/franela/goblin"
@@ -56,6 +59,9 @@ func TestAddDevice(t *testing.T) {
 			assert.NotEmpty(t, res.DeviceID)
 			assert.NotEmpty(t, res.EncryptionKey)
 			assert.NotEmpty(t, res.NotificationKey)
+			assert.Equal(t, 1, res.EncryptionKeyVersion)
+			assert.Equal(t, 1, len(res.EncryptionKeys))
+			assert.Equal(t, res.EncryptionKey, res.EncryptionKeys[0].Key)
 
 			device, _ := s.Devices().FindDevice(&model.Device{UserID: user.ID})
 			assert.Equal(t, input.Type, device.Type)
@@ -63,13 +69,101 @@ func TestAddDevice(t *testing.T) {
 			assert.Equal(t, input.RegistrationID, device.RegistrationID)
 			assert.Equal(t, input.Name, device.Name)
 
-			encryptionKey, _ := s.EncryptionKeys().FindKey(&model.EncryptionKey{UserID: user.ID})
+			encryptionKey, _, _ := s.EncryptionKeys().FindKey(&model.EncryptionKey{UserID: user.ID})
 			assert.Regexp(t, "^[a-fA-F0-9]{64}$", encryptionKey.Key)
 
 			notifKey, _ := s.NotificationKeys().FindKey(&model.NotificationKey{UserID: user.ID})
 			assert.Equal(t, notificationKey, notifKey.Key)
+
+			assert.Equal(t, []bus.Event{bus.DeviceLinked{UserID: user.ID, DeviceID: res.DeviceID}}, enqueuedEvents(s))
+		})
+
+		g.It("Should not return encryption keys to a device with a public key", func() {
+			user := &model.User{
+				Email: "test@portal.com",
+				UUID:  "1",
+			}
+			s.Users().CreateUser(user)
+			googleResponse := map[string]string{
+				"notification_key": "key",
+			}
+			input := addDevice{
+				RegistrationID: "registration_id",
+				Name:           "Chrome",
+				Type:           "chrome",
+				PublicKey:      "cHVibGljX2tleV9wdWJsaWNfa2V5X3B1YmxpY19rZXk=",
+			}
+			w := testAddDevice(s, user, input, 200, googleResponse)
+			assert.Equal(t, 200, w.Code)
+
+			var res addDeviceResponse
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			assert.NotEmpty(t, res.DeviceID)
+			assert.Empty(t, res.EncryptionKey)
+			assert.Empty(t, res.EncryptionKeys)
+			assert.Equal(t, model.DeviceKeyStateApproved, res.KeyState)
+			assert.Equal(t, 0, s.EncryptionKeys().GetCount(&model.EncryptionKey{UserID: user.ID}))
+
+			// Later devices must be approved by an existing device
+			input.RegistrationID = "registration_id_2"
+			w = testAddDevice(s, user, input, 200, googleResponse)
+			assert.Equal(t, 200, w.Code)
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			assert.Equal(t, model.DeviceKeyStatePending, res.KeyState)
+
+			device, _ := s.Devices().FindDevice(&model.Device{UUID: res.DeviceID})
+			assert.Equal(t, input.PublicKey, device.PublicKey)
+			assert.Equal(t, model.DeviceKeyStatePending, device.KeyState)
+		})
+
+		g.It("Should require pairing to add a device to an account with a phone", func() {
+			user := &model.User{
+				Email: "test@portal.com",
+				UUID:  "1",
+			}
+			s.Users().CreateUser(user)
+			googleResponse := map[string]string{
+				"notification_key": "key",
+			}
+			input := addDevice{
+				RegistrationID: "registration_id",
+				Name:           "Nexus 5",
+				Type:           "phone",
+			}
+			w := testAddDevice(s, user, input, 200, googleResponse)
+			assert.Equal(t, 200, w.Code)
+
+			input = addDevice{
+				RegistrationID: "registration_id_2",
+				Name:           "Chrome",
+				Type:           "chrome",
+			}
+			w = testAddDevice(s, user, input, 200, googleResponse)
+			assert.Equal(t, 403, w.Code)
+			assert.Contains(t, w.Body.String(), "pairing_required")
+
+			// Saying it is a phone does not skip pairing
+			input.Type = model.DeviceTypePhone
+			w = testAddDevice(s, user, input, 200, googleResponse)
+			assert.Equal(t, 403, w.Code)
+			assert.Contains(t, w.Body.String(), "pairing_required")
 		})
 
+		g.It("Should reject an invalid public key", func() {
+			user := &model.User{
+				Email: "test@portal.com",
+				UUID:  "1",
+			}
+			s.Users().CreateUser(user)
+			input := addDevice{
+				RegistrationID: "registration_id",
+				Name:           "Nexus 5",
+				Type:           "phone",
+				PublicKey:      "too_short",
+			}
+			w := testAddDevice(s, user, input, 200, map[string]string{})
+			assert.Equal(t, 400, w.Code)
+		})
 	})
 
 	g.Describe("Data store functions", func() {
@@ -185,6 +279,43 @@ func TestAddDevice(t *testing.T) {
 			server.Close()
 		})
 
+		g.It("Should recover the notification group if the stored key is stale", func() {
+			user := &model.User{Email: "test5@portal.com"}
+			s.Users().CreateUser(user)
+			s.NotificationKeys().CreateKey(&model.NotificationKey{
+				User:      *user,
+				GroupName: "group",
+				Key:       "stale_key",
+			})
+
+			var operations []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == "GET" {
+					operations = append(operations, "get")
+					fmt.Fprint(w, `{"notification_key":"current_key"}`)
+					return
+				}
+				body, _ := ioutil.ReadAll(r.Body)
+				operations = append(operations, "add")
+				if strings.Contains(string(body), "stale_key") {
+					w.WriteHeader(http.StatusBadRequest)
+					fmt.Fprint(w, `{"error":"notification_key not found"}`)
+					return
+				}
+				fmt.Fprint(w, `{"notification_key":"current_key"}`)
+			}))
+			defer server.Close()
+			client := &util.WebClient{BaseURL: server.URL, HTTPClient: http.DefaultClient}
+
+			key, err := createNotificationKey(s, client, user, "registrationId")
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"add", "get", "add"}, operations)
+			assert.Equal(t, "current_key", key.Key)
+
+			fromDB, _ := s.NotificationKeys().FindKey(&model.NotificationKey{UserID: user.ID})
+			assert.Equal(t, "current_key", fromDB.Key)
+		})
+
 		g.It("Should create unique encryption keys per user", func() {
 			user := &model.User{Email: "test4@portal.com"}
 			s.Users().CreateUser(user)
@@ -207,6 +338,23 @@ func TestAddDevice(t *testing.T) {
 			count := s.EncryptionKeys().GetCount(&model.EncryptionKey{UserID: user.ID})
 			assert.Equal(t, 1, count)
 		})
+
+		g.It("Should not replace an encryption key it cannot read", func() {
+			db := store.GetTestDB()
+			defer store.TeardownTestDB(db)
+			user := &model.User{Email: "test5@portal.com"}
+			db.Create(user)
+			masterKey, _ := store.NewMasterKey(bytes.Repeat([]byte{1}, 32))
+			key, err := getEncryptionKey(store.NewWithMasterKey(db, masterKey), user)
+			assert.NoError(t, err)
+
+			// Without the master key it was sealed under
+			_, err = getEncryptionKey(store.New(db), user)
+			assert.Error(t, err)
+			count := store.New(db).EncryptionKeys().GetCount(&model.EncryptionKey{UserID: user.ID})
+			assert.Equal(t, 1, count)
+			assert.Equal(t, 1, key.Version)
+		})
 	})
 }
 
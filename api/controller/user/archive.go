@@ -0,0 +1,193 @@
+package user
+
+import (
+	"io"
+	"net/http"
+	"portal-server/api/controller"
+	"portal-server/api/controller/context"
+	"portal-server/api/errs"
+	"portal-server/archive"
+	"portal-server/blob"
+	"portal-server/model"
+	"portal-server/store"
+
+	"github.com/gin-gonic/gin"
+	"github.com/satori/go.uuid"
+)
+
+// exportBatch is how many messages are read at a time while exporting
+const exportBatch = 500
+
+// MaxArchiveSize is the largest archive that may be imported, in bytes.
+var MaxArchiveSize int64 = 128 << 20
+
+// runImport runs an import job. Jobs run in the background so that large
+// archives do not time out the upload.
+var runImport = func(s store.Store, blobs blob.BlobStore, job *model.ImportJob) {
+	go archive.Import(s, blobs, job)
+}
+
+type importBody struct {
+	ImportID  string `json:"id"`
+	Format    string `json:"format"`
+	Status    string `json:"status"`
+	Total     int    `json:"total"`
+	Processed int    `json:"processed"`
+	Imported  int    `json:"imported"`
+	Skipped   int    `json:"skipped"`
+	Error     string `json:"error,omitempty"`
+}
+
+// ExportMessagesEndpoint downloads the user's messages, newest first, as an
+// archive in the format given by the format query parameter: xml for SMS
+// Backup & Restore, which is the default, or csv. Encrypted messages cannot
+// be read by the server and are left out.
+func ExportMessagesEndpoint(c *gin.Context) {
+	format, ok := archiveFormat(c)
+	if !ok {
+		return
+	}
+	user := context.UserFromContext(c)
+	s := context.StoreFromContext(c)
+
+	c.Header("Content-Type", archive.ContentType(format))
+	c.Header("Content-Disposition", `attachment; filename="messages.`+format+`"`)
+	c.Status(http.StatusOK)
+	writer, err := archive.NewWriter(format, c.Writer, s.Messages().GetPlaintextCount(user))
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	page := store.MessagePage{Limit: exportBatch}
+	for {
+		messages, err := s.Messages().GetMessagesPage(user, page)
+		if err != nil {
+			// The response is under way, so it can only be cut short
+			c.Error(err)
+			return
+		}
+		for _, message := range messages {
+			if message.Encrypted() || message.Body == "" {
+				continue
+			}
+			if err := writer.Write(archive.NewRecord(message)); err != nil {
+				c.Error(err)
+				return
+			}
+		}
+		if len(messages) < exportBatch {
+			break
+		}
+		page.BeforeID = messages[len(messages)-1].ID
+	}
+	if err := writer.Close(); err != nil {
+		c.Error(err)
+	}
+}
+
+// ImportMessagesEndpoint starts importing the archive in the request body, in
+// the format given by the format query parameter, and returns the import for
+// its progress to be followed. Messages the user already has, by mid or by
+// content, are skipped.
+func ImportMessagesEndpoint(c *gin.Context) {
+	format, ok := archiveFormat(c)
+	if !ok {
+		return
+	}
+	user := context.UserFromContext(c)
+	if user.EncryptedMessages {
+		// Archives are plaintext, which the user has opted out of
+		c.JSON(http.StatusBadRequest, controller.RenderError(errs.ErrEncryptionRequired))
+		return
+	}
+	if c.Request.ContentLength > MaxArchiveSize {
+		c.JSON(http.StatusRequestEntityTooLarge, controller.RenderError(errs.ErrArchiveTooLarge))
+		return
+	}
+
+	s := context.StoreFromContext(c)
+	blobs := context.BlobStoreFromContext(c)
+	job := &model.ImportJob{
+		UserID: user.ID,
+		UUID:   uuid.NewV4().String(),
+		Format: format,
+		Status: model.ImportStatusPending,
+	}
+	// Read one byte past the limit to tell if the body exceeds it
+	content := &countingReader{Reader: io.LimitReader(c.Request.Body, MaxArchiveSize+1)}
+	if err := blobs.Put(archive.Key(job), content); err != nil {
+		controller.InternalServiceError(c, err)
+		return
+	}
+	if content.n > MaxArchiveSize || content.n == 0 {
+		blobs.Delete(archive.Key(job))
+		if content.n == 0 {
+			c.JSON(http.StatusBadRequest, controller.RenderError(errs.ErrEmptyArchive))
+		} else {
+			c.JSON(http.StatusRequestEntityTooLarge, controller.RenderError(errs.ErrArchiveTooLarge))
+		}
+		return
+	}
+	if err := s.ImportJobs().CreateImportJob(job); err != nil {
+		blobs.Delete(archive.Key(job))
+		controller.InternalServiceError(c, err)
+		return
+	}
+	body := renderImport(*job)
+	runImport(s, blobs, job)
+	c.JSON(http.StatusAccepted, body)
+}
+
+// GetImportEndpoint reports the progress of one of the user's imports.
+func GetImportEndpoint(c *gin.Context) {
+	user := context.UserFromContext(c)
+	s := context.StoreFromContext(c)
+	job, found := s.ImportJobs().FindImportJob(&model.ImportJob{
+		UserID: user.ID,
+		UUID:   c.Param("id"),
+	})
+	if !found {
+		c.JSON(http.StatusNotFound, controller.RenderError(errs.ErrImportNotFound))
+		return
+	}
+	c.JSON(http.StatusOK, renderImport(*job))
+}
+
+// archiveFormat reads the format query parameter, rendering an error unless
+// it names a supported format.
+func archiveFormat(c *gin.Context) (string, bool) {
+	format := c.Query("format")
+	if format == "" {
+		format = archive.FormatXML
+	}
+	if format != archive.FormatXML && format != archive.FormatCSV {
+		c.JSON(http.StatusBadRequest, controller.RenderError(errs.ErrInvalidArchiveFormat))
+		return "", false
+	}
+	return format, true
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+func renderImport(job model.ImportJob) importBody {
+	return importBody{
+		ImportID:  job.UUID,
+		Format:    job.Format,
+		Status:    job.Status,
+		Total:     job.Total,
+		Processed: job.Processed,
+		Imported:  job.Imported,
+		Skipped:   job.Skipped,
+		Error:     job.Error,
+	}
+}
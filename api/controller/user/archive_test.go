@@ -0,0 +1,218 @@
+package user
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"portal-server/api/controller"
+	"portal-server/api/controller/context"
+	"portal-server/api/errs"
+	"portal-server/api/middleware"
+	"portal-server/api/testutil"
+	"portal-server/archive"
+	"portal-server/blob"
+	"portal-server/model"
+	"portal-server/store"
+	"testing"
+	"time"
+
+	"github.com/franela/goblin"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArchive(t *testing.T) {
+	var (
+		s     store.Store
+		blobs *blob.FileStore
+		user  model.User
+	)
+	g := goblin.Goblin(t)
+	background := runImport
+
+	const csvArchive = "mid,date,direction,address,body,status,read\n" +
+		",2016-04-07T03:33:20Z,incoming,5551234,hi there,received,true\n" +
+		",2016-04-07T03:34:20Z,outgoing,5551234,hello,sent,true\n"
+
+	g.Describe("Archives", func() {
+		g.BeforeEach(func() {
+			s = store.GetTestStore()
+			dir, _ := ioutil.TempDir("", "archives")
+			blobs, _ = blob.NewFileStore(dir)
+			user = model.User{UUID: "1", Email: "test@portal.com"}
+			s.Users().CreateUser(&user)
+
+			// Run imports before responding so that tests see them finish
+			runImport = func(s store.Store, blobs blob.BlobStore, job *model.ImportJob) {
+				archive.Import(s, blobs, job)
+			}
+		})
+
+		g.AfterEach(func() {
+			store.TeardownTestStore(s)
+			os.RemoveAll(blobs.Dir)
+			runImport = background
+		})
+
+		g.Describe("GET /user/messages/export", func() {
+			g.BeforeEach(func() {
+				s.Messages().CreateMessage(&model.Message{
+					User:            user,
+					MessageID:       "1",
+					Direction:       model.MessageDirectionIncoming,
+					From:            "5551234",
+					Body:            "hi there",
+					Status:          model.MessageStatusReceived,
+					ClientCreatedAt: time.Unix(1460000000, 0),
+				})
+				s.Messages().CreateMessage(&model.Message{
+					User:            user,
+					MessageID:       "2",
+					To:              "5551234",
+					Body:            "ciphertext",
+					Status:          model.MessageStatusSent,
+					Nonce:           "nonce",
+					KeyVersion:      1,
+					ClientCreatedAt: time.Unix(1460000060, 0),
+				})
+			})
+
+			g.It("Should export readable messages for SMS Backup & Restore", func() {
+				w := testArchive(s, blobs, &user, "GET", "/export", "")
+				assert.Equal(t, http.StatusOK, w.Code)
+				assert.Equal(t, "application/xml; charset=utf-8", w.Header().Get("Content-Type"))
+				assert.Contains(t, w.Body.String(), `<smses count="1">`)
+				assert.Contains(t, w.Body.String(), `body="hi there"`)
+				assert.NotContains(t, w.Body.String(), "ciphertext")
+			})
+
+			g.It("Should export messages as CSV", func() {
+				w := testArchive(s, blobs, &user, "GET", "/export?format=csv", "")
+				assert.Equal(t, http.StatusOK, w.Code)
+				assert.Equal(t, "mid,date,direction,address,body,status,read\n"+
+					"1,2016-04-07T03:33:20Z,incoming,5551234,hi there,received,false\n", w.Body.String())
+			})
+
+			g.It("Should reject an unknown format", func() {
+				w := testArchive(s, blobs, &user, "GET", "/export?format=json", "")
+				assert.Equal(t, http.StatusBadRequest, w.Code)
+				var res controller.Error
+				json.Unmarshal(w.Body.Bytes(), &res)
+				assert.Equal(t, errs.ErrInvalidArchiveFormat.Error(), res.Error)
+			})
+		})
+
+		g.Describe("POST /user/imports", func() {
+			g.It("Should import an archive and report its progress", func() {
+				w := testArchive(s, blobs, &user, "POST", "/?format=csv", csvArchive)
+				assert.Equal(t, http.StatusAccepted, w.Code)
+				var res importBody
+				assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+				assert.Equal(t, archive.FormatCSV, res.Format)
+				assert.Equal(t, model.ImportStatusPending, res.Status)
+
+				w = testArchive(s, blobs, &user, "GET", "/"+res.ImportID, "")
+				assert.Equal(t, http.StatusOK, w.Code)
+				assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+				assert.Equal(t, model.ImportStatusCompleted, res.Status)
+				assert.Equal(t, 2, res.Total)
+				assert.Equal(t, 2, res.Imported)
+
+				messages, _ := s.Messages().GetMessagesPage(&user, store.MessagePage{Limit: 10})
+				assert.Len(t, messages, 2)
+
+				// Importing it again finds nothing new
+				w = testArchive(s, blobs, &user, "POST", "/?format=csv", csvArchive)
+				json.Unmarshal(w.Body.Bytes(), &res)
+				w = testArchive(s, blobs, &user, "GET", "/"+res.ImportID, "")
+				json.Unmarshal(w.Body.Bytes(), &res)
+				assert.Equal(t, 0, res.Imported)
+				assert.Equal(t, 2, res.Skipped)
+			})
+
+			g.It("Should report an archive it cannot read", func() {
+				w := testArchive(s, blobs, &user, "POST", "/?format=xml", csvArchive)
+				var res importBody
+				json.Unmarshal(w.Body.Bytes(), &res)
+				w = testArchive(s, blobs, &user, "GET", "/"+res.ImportID, "")
+				json.Unmarshal(w.Body.Bytes(), &res)
+				assert.Equal(t, model.ImportStatusFailed, res.Status)
+				assert.Equal(t, archive.ErrInvalidArchive.Error(), res.Error)
+			})
+
+			g.It("Should reject an archive that is too large", func() {
+				defer func(size int64) { MaxArchiveSize = size }(MaxArchiveSize)
+				MaxArchiveSize = 10
+
+				w := testArchive(s, blobs, &user, "POST", "/?format=csv", csvArchive)
+				assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+				var res controller.Error
+				json.Unmarshal(w.Body.Bytes(), &res)
+				assert.Equal(t, errs.ErrArchiveTooLarge.Error(), res.Error)
+			})
+
+			g.It("Should reject an empty archive", func() {
+				w := testArchive(s, blobs, &user, "POST", "/?format=csv", "")
+				assert.Equal(t, http.StatusBadRequest, w.Code)
+				var res controller.Error
+				json.Unmarshal(w.Body.Bytes(), &res)
+				assert.Equal(t, errs.ErrEmptyArchive.Error(), res.Error)
+			})
+
+			g.It("Should not import plaintext once the user opts in to encryption", func() {
+				user.EncryptedMessages = true
+				s.Users().SaveUser(&user)
+
+				w := testArchive(s, blobs, &user, "POST", "/?format=csv", csvArchive)
+				assert.Equal(t, http.StatusBadRequest, w.Code)
+				var res controller.Error
+				json.Unmarshal(w.Body.Bytes(), &res)
+				assert.Equal(t, errs.ErrEncryptionRequired.Error(), res.Error)
+			})
+		})
+
+		g.Describe("GET /user/imports/:id", func() {
+			g.It("Should not find another user's import", func() {
+				w := testArchive(s, blobs, &user, "POST", "/?format=csv", csvArchive)
+				var res importBody
+				json.Unmarshal(w.Body.Bytes(), &res)
+
+				other := model.User{Email: "other@portal.com"}
+				s.Users().CreateUser(&other)
+				w = testArchive(s, blobs, &other, "GET", "/"+res.ImportID, "")
+				assert.Equal(t, http.StatusNotFound, w.Code)
+				var errRes controller.Error
+				json.Unmarshal(w.Body.Bytes(), &errRes)
+				assert.Equal(t, errs.ErrImportNotFound.Error(), errRes.Error)
+			})
+		})
+	})
+}
+
+func testArchive(s store.Store, blobs blob.BlobStore, user *model.User, method, path, body string) *httptest.ResponseRecorder {
+	r := testutil.TestRouter(middleware.SetStore(s), middleware.SetBlobStore(blobs))
+
+	// Set the user context
+	r.Use(func(c *gin.Context) {
+		context.UserToContext(c, user)
+		c.Next()
+	})
+
+	r.GET("/:id", func(c *gin.Context) {
+		if c.Param("id") == "export" {
+			ExportMessagesEndpoint(c)
+			return
+		}
+		GetImportEndpoint(c)
+	})
+	r.POST("/", ImportMessagesEndpoint)
+	w := httptest.NewRecorder()
+
+	// Send the input
+	req, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+	r.ServeHTTP(w, req)
+	return w
+}
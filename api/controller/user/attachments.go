@@ -0,0 +1,125 @@
+package user
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"portal-server/api/controller"
+	"portal-server/api/controller/context"
+	"portal-server/api/errs"
+	"portal-server/model"
+	"portal-server/store"
+	"strconv"
+
+	"github.com/asaskevich/govalidator"
+	"github.com/gin-gonic/gin"
+	"github.com/satori/go.uuid"
+)
+
+// MaxAttachmentSize is the largest attachment that may be uploaded, in bytes.
+var MaxAttachmentSize int64 = 5 << 20
+
+// attachmentContentTypes are the media types carriers accept in MMS.
+var attachmentContentTypes = map[string]bool{
+	"image/jpeg":       true,
+	"image/png":        true,
+	"image/gif":        true,
+	"image/bmp":        true,
+	"video/3gpp":       true,
+	"video/mp4":        true,
+	"audio/amr":        true,
+	"audio/mpeg":       true,
+	"audio/mp4":        true,
+	"text/vcard":       true,
+	"text/x-vcard":     true,
+	"text/x-vcalendar": true,
+}
+
+// UploadAttachmentEndpoint stores the request body as a new attachment of
+// the type given by its Content-Type. Messages then refer to it by the
+// returned ID.
+func UploadAttachmentEndpoint(c *gin.Context) {
+	contentType, _, err := mime.ParseMediaType(c.Request.Header.Get("Content-Type"))
+	if err != nil || !attachmentContentTypes[contentType] {
+		c.JSON(http.StatusUnsupportedMediaType, controller.RenderError(errs.ErrUnsupportedContentType))
+		return
+	}
+	if c.Request.ContentLength > MaxAttachmentSize {
+		c.JSON(http.StatusRequestEntityTooLarge, controller.RenderError(errs.ErrAttachmentTooLarge))
+		return
+	}
+	// Read one byte past the limit to tell if the body exceeds it
+	content, err := ioutil.ReadAll(io.LimitReader(c.Request.Body, MaxAttachmentSize+1))
+	if err != nil {
+		controller.InternalServiceError(c, err)
+		return
+	}
+	if int64(len(content)) > MaxAttachmentSize {
+		c.JSON(http.StatusRequestEntityTooLarge, controller.RenderError(errs.ErrAttachmentTooLarge))
+		return
+	}
+	if len(content) == 0 {
+		c.JSON(http.StatusBadRequest, controller.RenderError(errs.ErrEmptyAttachment))
+		return
+	}
+
+	user := context.UserFromContext(c)
+	s := context.StoreFromContext(c)
+	blobs := context.BlobStoreFromContext(c)
+	attachment := &model.Attachment{
+		UserID:      user.ID,
+		UUID:        uuid.NewV4().String(),
+		ContentType: contentType,
+		Size:        int64(len(content)),
+	}
+	if err := blobs.Put(attachment.UUID, bytes.NewReader(content)); err != nil {
+		controller.InternalServiceError(c, err)
+		return
+	}
+	if err := s.Attachments().CreateAttachment(attachment); err != nil {
+		blobs.Delete(attachment.UUID)
+		controller.InternalServiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, attachment.Render())
+}
+
+// GetAttachmentEndpoint downloads the content of one of the user's
+// attachments. Its type is only declared by the uploader, so browsers are
+// told to save it rather than sniff or render it.
+func GetAttachmentEndpoint(c *gin.Context) {
+	user := context.UserFromContext(c)
+	s := context.StoreFromContext(c)
+	id := c.Param("id")
+	if !govalidator.IsUUIDv4(id) {
+		c.JSON(http.StatusNotFound, controller.RenderError(errs.ErrAttachmentNotFound))
+		return
+	}
+	attachment, err := s.Attachments().FindAttachment(&model.Attachment{
+		UserID: user.ID,
+		UUID:   id,
+	})
+	if err == store.ErrAttachmentNotFound {
+		c.JSON(http.StatusNotFound, controller.RenderError(errs.ErrAttachmentNotFound))
+		return
+	}
+	if err != nil {
+		controller.InternalServiceError(c, err)
+		return
+	}
+	content, err := context.BlobStoreFromContext(c).Get(attachment.UUID)
+	if err != nil {
+		controller.InternalServiceError(c, err)
+		return
+	}
+	defer content.Close()
+
+	c.Header("Content-Type", attachment.ContentType)
+	c.Header("Content-Length", strconv.FormatInt(attachment.Size, 10))
+	c.Header("Content-Disposition", "attachment")
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Status(http.StatusOK)
+	io.Copy(c.Writer, content)
+}
@@ -0,0 +1,149 @@
+package user
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"portal-server/api/controller"
+	"portal-server/api/controller/context"
+	"portal-server/api/errs"
+	"portal-server/api/middleware"
+	"portal-server/api/testutil"
+	"portal-server/blob"
+	"portal-server/model"
+	"portal-server/store"
+	"testing"
+
+	"github.com/franela/goblin"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAttachments(t *testing.T) {
+	var (
+		s     store.Store
+		blobs *blob.FileStore
+		user  model.User
+	)
+	g := goblin.Goblin(t)
+
+	g.Describe("Attachments", func() {
+		g.BeforeEach(func() {
+			s = store.GetTestStore()
+			dir, _ := ioutil.TempDir("", "attachments")
+			blobs, _ = blob.NewFileStore(dir)
+			user = model.User{Email: "test@portal.com"}
+			s.Users().CreateUser(&user)
+		})
+
+		g.AfterEach(func() {
+			store.TeardownTestStore(s)
+			os.RemoveAll(blobs.Dir)
+		})
+
+		g.It("Should upload and download an attachment", func() {
+			w := testAttachments(s, blobs, &user, "POST", "/", "image/png", "picture")
+			assert.Equal(t, http.StatusCreated, w.Code)
+			var res model.AttachmentBody
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			assert.Equal(t, "image/png", res.ContentType)
+			assert.Equal(t, int64(7), res.Size)
+
+			attachment, err := s.Attachments().FindAttachment(&model.Attachment{UUID: res.AttachmentID})
+			assert.NoError(t, err)
+			assert.Equal(t, user.ID, attachment.UserID)
+
+			w = testAttachments(s, blobs, &user, "GET", "/"+res.AttachmentID, "", "")
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, "image/png", w.Header().Get("Content-Type"))
+			assert.Equal(t, "attachment", w.Header().Get("Content-Disposition"))
+			assert.Equal(t, "nosniff", w.Header().Get("X-Content-Type-Options"))
+			assert.Equal(t, "picture", w.Body.String())
+		})
+
+		g.It("Should accept a content type with parameters", func() {
+			w := testAttachments(s, blobs, &user, "POST", "/", "text/vcard; charset=utf-8", "BEGIN:VCARD")
+			assert.Equal(t, http.StatusCreated, w.Code)
+		})
+
+		g.It("Should reject unsupported content types", func() {
+			w := testAttachments(s, blobs, &user, "POST", "/", "application/x-msdownload", "binary")
+			assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+			var res controller.Error
+			json.Unmarshal(w.Body.Bytes(), &res)
+			assert.Equal(t, errs.ErrUnsupportedContentType.Error(), res.Error)
+		})
+
+		g.It("Should reject empty and oversized attachments", func() {
+			w := testAttachments(s, blobs, &user, "POST", "/", "image/png", "")
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+
+			limit := MaxAttachmentSize
+			MaxAttachmentSize = 4
+			defer func() { MaxAttachmentSize = limit }()
+			w = testAttachments(s, blobs, &user, "POST", "/", "image/png", "picture")
+			assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+			var res controller.Error
+			json.Unmarshal(w.Body.Bytes(), &res)
+			assert.Equal(t, errs.ErrAttachmentTooLarge.Error(), res.Error)
+		})
+
+		g.It("Should give a 404 for another user's attachment", func() {
+			other := model.User{Email: "other@portal.com"}
+			s.Users().CreateUser(&other)
+			w := testAttachments(s, blobs, &other, "POST", "/", "image/png", "picture")
+			var res model.AttachmentBody
+			json.Unmarshal(w.Body.Bytes(), &res)
+
+			w = testAttachments(s, blobs, &user, "GET", "/"+res.AttachmentID, "", "")
+			assert.Equal(t, http.StatusNotFound, w.Code)
+
+			w = testAttachments(s, blobs, &user, "GET", "/not-an-id", "", "")
+			assert.Equal(t, http.StatusNotFound, w.Code)
+		})
+
+		g.It("Should include linked attachments in the message history", func() {
+			w := testAttachments(s, blobs, &user, "POST", "/", "image/jpeg", "picture")
+			var uploaded model.AttachmentBody
+			json.Unmarshal(w.Body.Bytes(), &uploaded)
+			message := &model.Message{
+				User:      user,
+				To:        "5551234",
+				MessageID: "1",
+				Status:    model.MessageStatusSent,
+			}
+			s.Messages().CreateMessage(message)
+			assert.NoError(t, s.Attachments().LinkAttachments(message, []string{uploaded.AttachmentID}))
+
+			w = testGetMessages(s, &user)
+			var res messageHistoryResponse
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			assert.Equal(t, []model.AttachmentBody{uploaded}, res.Messages[0].Attachments)
+		})
+	})
+}
+
+func testAttachments(s store.Store, blobs blob.BlobStore, user *model.User, method, path, contentType, body string) *httptest.ResponseRecorder {
+	r := testutil.TestRouter(middleware.SetStore(s), middleware.SetBlobStore(blobs))
+
+	// Set the user context
+	r.Use(func(c *gin.Context) {
+		context.UserToContext(c, user)
+		c.Next()
+	})
+
+	r.POST("/", UploadAttachmentEndpoint)
+	r.GET("/:id", GetAttachmentEndpoint)
+	w := httptest.NewRecorder()
+
+	// Send the input
+	req, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	r.ServeHTTP(w, req)
+	return w
+}
@@ -0,0 +1,172 @@
+package user
+
+import (
+	"net/http"
+	"portal-server/api/controller"
+	"portal-server/api/controller/context"
+	"portal-server/api/errs"
+	"portal-server/bus"
+	"portal-server/model"
+	"portal-server/store"
+
+	"github.com/gin-gonic/gin"
+)
+
+type conversationListResponse struct {
+	Conversations []conversationBody `json:"conversations"`
+}
+
+type conversationBody struct {
+	ConversationID string      `json:"conversation_id"`
+	Participant    string      `json:"participant"`
+	Participants   []string    `json:"participants"`
+	LastMessage    messageBody `json:"last_message"`
+	At             int64       `json:"at"`
+	UnreadCount    int         `json:"unread_count"`
+
+	// Contacts name the participants who are the user's contacts
+	Contacts []contactMatch `json:"contacts,omitempty"`
+}
+
+// GetConversationsEndpoint lists the user's conversations with their last
+// message, most recently active first.
+func GetConversationsEndpoint(c *gin.Context) {
+	user := context.UserFromContext(c)
+	s := context.StoreFromContext(c)
+	conversations, err := s.Conversations().GetConversationsByUser(user)
+	if err != nil {
+		controller.InternalServiceError(c, err)
+		return
+	}
+	conversationBodies, err := renderNamedConversations(s, user, conversations)
+	if err != nil {
+		controller.InternalServiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, conversationListResponse{
+		Conversations: conversationBodies,
+	})
+}
+
+// GetConversationMessagesEndpoint retrieves a page of a conversation's
+// messages, newest first, paginated like the message history.
+func GetConversationMessagesEndpoint(c *gin.Context) {
+	user := context.UserFromContext(c)
+	s := context.StoreFromContext(c)
+	conversation, found := s.Conversations().FindConversation(&model.Conversation{
+		UserID: user.ID,
+		UUID:   c.Param("id"),
+	})
+	if !found {
+		c.JSON(http.StatusNotFound, controller.RenderError(errs.ErrConversationNotFound))
+		return
+	}
+	page, err := pageFromQuery(c, messageHistoryLimit)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, controller.RenderError(err))
+		return
+	}
+	page.ConversationID = conversation.ID
+	renderMessagePage(c, s, user, page, conversation.UnreadCount)
+}
+
+type markRead struct {
+	// MessageID is the last message read, defaulting to the latest
+	MessageID string `json:"mid"`
+}
+
+// readPayload tells devices that a conversation was read through a message
+type readPayload struct {
+	ConversationID string `json:"conversation_id"`
+	MessageID      string `json:"mid"`
+	UnreadCount    int    `json:"unread_count"`
+}
+
+// MarkConversationReadEndpoint moves a conversation's read marker forward to
+// a message, marking the messages received up to it as read on every device.
+func MarkConversationReadEndpoint(c *gin.Context) {
+	var body markRead
+	if !controller.ValidJSON(c, &body) {
+		return
+	}
+	user := context.UserFromContext(c)
+	s := context.StoreFromContext(c)
+
+	var (
+		conversation *model.Conversation
+		through      *model.Message
+		moved        bool
+		marked       bool
+	)
+	s.Transaction(func(store store.Store) error {
+		var found bool
+		conversation, found = store.Conversations().FindConversation(&model.Conversation{
+			UserID: user.ID,
+			UUID:   c.Param("id"),
+		})
+		if !found {
+			c.JSON(http.StatusNotFound, controller.RenderError(errs.ErrConversationNotFound))
+			return errs.ErrConversationNotFound
+		}
+		through = &conversation.LastMessage
+		if body.MessageID != "" {
+			through, found = store.Messages().FindMessage(&model.Message{
+				UserID:         user.ID,
+				ConversationID: conversation.ID,
+				MessageID:      body.MessageID,
+			})
+			if !found {
+				c.JSON(http.StatusNotFound, controller.RenderError(errs.ErrMessageNotFound))
+				return errs.ErrMessageNotFound
+			}
+		}
+		var err error
+		if moved, err = store.Conversations().MarkRead(conversation, through); err != nil {
+			controller.InternalServiceError(c, err)
+			return err
+		}
+		if moved {
+			if err := bus.Enqueue(store, bus.ConversationRead{
+				UserID:         user.ID,
+				ConversationID: conversation.UUID,
+				MessageID:      through.MessageID,
+				UnreadCount:    conversation.UnreadCount,
+			}); err != nil {
+				controller.InternalServiceError(c, err)
+				return err
+			}
+		}
+		marked = true
+		return nil
+	})
+	if !marked {
+		return
+	}
+
+	if moved {
+		if err := notifyDevices(c, s, user, notificationConversationRead, readPayload{
+			ConversationID: conversation.UUID,
+			MessageID:      through.MessageID,
+			UnreadCount:    conversation.UnreadCount,
+		}); err != nil {
+			c.Error(err)
+		}
+	}
+	bodies, err := renderNamedConversations(s, user, []model.Conversation{*conversation})
+	if err != nil {
+		controller.InternalServiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, bodies[0])
+}
+
+func renderConversation(conversation model.Conversation) conversationBody {
+	return conversationBody{
+		ConversationID: conversation.UUID,
+		Participant:    conversation.Participant,
+		Participants:   conversation.Participants(),
+		LastMessage:    renderMessage(conversation.LastMessage),
+		At:             conversation.LastMessageAt.Unix(),
+		UnreadCount:    conversation.UnreadCount,
+	}
+}
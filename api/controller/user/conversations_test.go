@@ -0,0 +1,375 @@
+package user
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"portal-server/api/controller/context"
+	"portal-server/api/middleware"
+	"portal-server/api/testutil"
+	"portal-server/api/util"
+	"portal-server/bus"
+	"portal-server/model"
+	"portal-server/store"
+	"testing"
+
+	"github.com/franela/goblin"
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConversations(t *testing.T) {
+	var s store.Store
+	var user model.User
+	g := goblin.Goblin(t)
+
+	createMessage := func(mid, to string) {
+		s.Messages().CreateMessage(&model.Message{
+			User:      user,
+			To:        to,
+			MessageID: mid,
+			Body:      "message " + mid,
+			Status:    model.MessageStatusSent,
+		})
+	}
+
+	g.Describe("Conversations", func() {
+		g.BeforeEach(func() {
+			s = store.GetTestStore()
+			user = model.User{Email: "test@portal.com"}
+			s.Users().CreateUser(&user)
+		})
+
+		g.AfterEach(func() {
+			store.TeardownTestStore(s)
+		})
+
+		g.It("Should return an empty array for a user with no messages", func() {
+			w := testConversations(s, &user, "/")
+			assert.Equal(t, 200, w.Code)
+			assert.JSONEq(t, `{"conversations":[]}`, w.Body.String())
+		})
+
+		g.It("Should group messages by normalized participant", func() {
+			createMessage("1", "+1 (555) 123-4567")
+			createMessage("2", "5550000")
+			createMessage("3", "+15551234567")
+
+			var res conversationListResponse
+			w := testConversations(s, &user, "/")
+			assert.Equal(t, 200, w.Code)
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			assert.Equal(t, 2, len(res.Conversations))
+
+			// Most recently active first
+			latest := res.Conversations[0]
+			assert.Equal(t, "+15551234567", latest.Participant)
+			assert.Equal(t, "3", latest.LastMessage.MessageID)
+			assert.Equal(t, "message 3", latest.LastMessage.Body)
+			assert.NotZero(t, latest.At)
+			assert.Equal(t, 0, latest.UnreadCount)
+			assert.Equal(t, "5550000", res.Conversations[1].Participant)
+
+			// Deleting the last message falls back to the previous one
+			s.Messages().DeleteMessages(&model.Message{MessageID: "3"})
+			res = conversationListResponse{}
+			w = testConversations(s, &user, "/")
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			assert.Equal(t, "5550000", res.Conversations[0].Participant)
+			assert.Equal(t, "1", res.Conversations[1].LastMessage.MessageID)
+		})
+
+		g.It("Should name participants by the user's contacts", func() {
+			s.Contacts().CreateContact(&model.Contact{
+				UserID:       user.ID,
+				UUID:         "7c9e6679-7425-40de-944b-e07fc1f90ae7",
+				Name:         "Justin",
+				PhoneNumbers: []model.ContactPhone{{Type: "cell", Number: "555.123.4567"}},
+			})
+			createMessage("1", "+1 (555) 123-4567")
+			createMessage("2", "5550000")
+
+			var res conversationListResponse
+			w := testConversations(s, &user, "/")
+			assert.Equal(t, 200, w.Code)
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			match := []contactMatch{{
+				Number:    "+15551234567",
+				Name:      "Justin",
+				ContactID: "7c9e6679-7425-40de-944b-e07fc1f90ae7",
+			}}
+			assert.Equal(t, match, res.Conversations[1].Contacts)
+			assert.Equal(t, match, res.Conversations[1].LastMessage.Contacts)
+			assert.Nil(t, res.Conversations[0].Contacts)
+
+			var page messageHistoryResponse
+			w = testConversations(s, &user, "/"+res.Conversations[1].ConversationID+"/messages")
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+			assert.Equal(t, match, page.Messages[0].Contacts)
+		})
+
+		g.It("Should include received messages and count those unread", func() {
+			createMessage("1", "5551234")
+			for _, mid := range []string{"2", "3"} {
+				s.Messages().CreateMessage(&model.Message{
+					User:      user,
+					From:      "555-1234",
+					MessageID: mid,
+					Body:      "reply " + mid,
+					Status:    model.MessageStatusReceived,
+					Direction: model.MessageDirectionIncoming,
+				})
+			}
+
+			var res conversationListResponse
+			w := testConversations(s, &user, "/")
+			assert.Equal(t, 200, w.Code)
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			assert.Equal(t, 1, len(res.Conversations))
+			latest := res.Conversations[0]
+			assert.Equal(t, "5551234", latest.Participant)
+			assert.Equal(t, 2, latest.UnreadCount)
+			assert.Equal(t, model.MessageDirectionIncoming, latest.LastMessage.Direction)
+			assert.Equal(t, "5551234", latest.LastMessage.From)
+			assert.False(t, latest.LastMessage.Read)
+
+			s.Messages().DeleteMessages(&model.Message{MessageID: "3"})
+			res = conversationListResponse{}
+			w = testConversations(s, &user, "/")
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			assert.Equal(t, 1, res.Conversations[0].UnreadCount)
+
+			var page messageHistoryResponse
+			w = testConversations(s, &user, "/"+latest.ConversationID+"/messages")
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+			assert.Equal(t, 2, len(page.Messages))
+			assert.Equal(t, model.MessageDirectionIncoming, page.Messages[0].Direction)
+			assert.Equal(t, model.MessageDirectionOutgoing, page.Messages[1].Direction)
+			assert.True(t, page.Messages[1].Read)
+		})
+
+		g.It("Should return the recipients of group conversations", func() {
+			message := &model.Message{
+				User:      user,
+				MessageID: "1",
+				Body:      "hello all",
+				Status:    model.MessageStatusSent,
+			}
+			message.SetRecipients([]string{"555-6789", "5551234"})
+			s.Messages().CreateMessage(message)
+			createMessage("2", "5551234")
+
+			var res conversationListResponse
+			w := testConversations(s, &user, "/")
+			assert.Equal(t, 200, w.Code)
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			assert.Equal(t, 2, len(res.Conversations))
+			group := res.Conversations[1]
+			assert.Equal(t, []string{"5551234", "5556789"}, group.Participants)
+			assert.Equal(t, []string{"5556789", "5551234"}, group.LastMessage.Recipients)
+			assert.Equal(t, []string{"5551234"}, res.Conversations[0].Participants)
+			assert.Equal(t, []string{"5551234"}, res.Conversations[0].LastMessage.Recipients)
+
+			var page messageHistoryResponse
+			w = testConversations(s, &user, "/"+group.ConversationID+"/messages")
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+			assert.Equal(t, 1, len(page.Messages))
+			assert.Equal(t, []string{"5556789", "5551234"}, page.Messages[0].Recipients)
+		})
+
+		g.It("Should page through the messages of a conversation", func() {
+			createMessage("1", "5551234")
+			createMessage("2", "5550000")
+			createMessage("3", "555-1234")
+			createMessage("4", "555 1234")
+			conversation, _ := s.Conversations().FindConversation(&model.Conversation{Participant: "5551234"})
+
+			var res messageHistoryResponse
+			w := testConversations(s, &user, "/"+conversation.UUID+"/messages?limit=2")
+			assert.Equal(t, 200, w.Code)
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			assert.Equal(t, 2, len(res.Messages))
+			assert.Equal(t, "4", res.Messages[0].MessageID)
+			assert.Equal(t, "3", res.Messages[1].MessageID)
+
+			w = testConversations(s, &user, "/"+conversation.UUID+"/messages?limit=2&before="+res.NextCursor)
+			res = messageHistoryResponse{}
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			assert.Equal(t, 1, len(res.Messages))
+			assert.Equal(t, "1", res.Messages[0].MessageID)
+			assert.Empty(t, res.NextCursor)
+		})
+
+		g.It("Should give a 404 for another user's conversation", func() {
+			other := model.User{Email: "other@portal.com"}
+			s.Users().CreateUser(&other)
+			s.Messages().CreateMessage(&model.Message{
+				User:      other,
+				To:        "5551234",
+				MessageID: "1",
+				Body:      "hello",
+				Status:    model.MessageStatusSent,
+			})
+			conversation, _ := s.Conversations().FindConversation(&model.Conversation{UserID: other.ID})
+			w := testConversations(s, &user, "/"+conversation.UUID+"/messages")
+			assert.Equal(t, 404, w.Code)
+		})
+	})
+
+	g.Describe("POST /user/conversations/:id/read", func() {
+		var conversation *model.Conversation
+
+		receive := func(mid string) {
+			s.Messages().CreateMessage(&model.Message{
+				User:      user,
+				From:      "5551234",
+				MessageID: mid,
+				Body:      "reply " + mid,
+				Status:    model.MessageStatusReceived,
+				Direction: model.MessageDirectionIncoming,
+			})
+		}
+
+		g.BeforeEach(func() {
+			s = store.GetTestStore()
+			user = model.User{Email: "test@portal.com"}
+			s.Users().CreateUser(&user)
+			s.NotificationKeys().CreateKey(&model.NotificationKey{User: user, GroupName: "group", Key: "notification_key"})
+			receive("1")
+			receive("2")
+			createMessage("3", "5551234")
+			receive("4")
+			conversation, _ = s.Conversations().FindConversation(&model.Conversation{UserID: user.ID})
+		})
+
+		g.AfterEach(func() {
+			store.TeardownTestStore(s)
+		})
+
+		g.It("Should mark messages read through the given one and tell all devices", func() {
+			var notified readPayload
+			w := testMarkRead(s, &user, conversation.UUID, `{"mid":"2"}`, func(r *http.Request) {
+				var message struct {
+					To   string            `json:"to"`
+					Data map[string]string `json:"data"`
+				}
+				json.NewDecoder(r.Body).Decode(&message)
+				assert.Equal(t, "notification_key", message.To)
+				assert.Equal(t, notificationConversationRead, message.Data["type"])
+				json.Unmarshal([]byte(message.Data["payload"]), &notified)
+			})
+			assert.Equal(t, 200, w.Code)
+
+			var res conversationBody
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			assert.Equal(t, 1, res.UnreadCount)
+			assert.Equal(t, readPayload{ConversationID: conversation.UUID, MessageID: "2", UnreadCount: 1}, notified)
+
+			read, _ := s.Messages().FindMessage(&model.Message{MessageID: "1"})
+			assert.True(t, read.Read)
+			unread, _ := s.Messages().FindMessage(&model.Message{MessageID: "4"})
+			assert.False(t, unread.Read)
+
+			// Marked messages are synced as changes
+			changes, _ := s.Messages().GetChangesSince(&user, unread.Seq, 10)
+			assert.Equal(t, 2, len(changes))
+
+			assert.Equal(t, []bus.Event{bus.ConversationRead{
+				UserID:         user.ID,
+				ConversationID: conversation.UUID,
+				MessageID:      "2",
+				UnreadCount:    1,
+			}}, enqueuedEvents(s))
+		})
+
+		g.It("Should mark the whole conversation read by default", func() {
+			w := testMarkRead(s, &user, conversation.UUID, `{}`, func(*http.Request) {})
+			assert.Equal(t, 200, w.Code)
+
+			var res conversationBody
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			assert.Equal(t, 0, res.UnreadCount)
+
+			var page messageHistoryResponse
+			w = testConversations(s, &user, "/"+conversation.UUID+"/messages")
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+			assert.Equal(t, 0, page.UnreadCount)
+			for _, message := range page.Messages {
+				assert.True(t, message.Read)
+			}
+		})
+
+		g.It("Should not move the marker back", func() {
+			testMarkRead(s, &user, conversation.UUID, `{"mid":"4"}`, func(*http.Request) {})
+			notified := false
+			w := testMarkRead(s, &user, conversation.UUID, `{"mid":"1"}`, func(*http.Request) {
+				notified = true
+			})
+			assert.Equal(t, 200, w.Code)
+			assert.False(t, notified)
+
+			found, _ := s.Conversations().FindConversation(&model.Conversation{Model: gorm.Model{ID: conversation.ID}})
+			assert.Equal(t, 0, found.UnreadCount)
+			assert.Len(t, enqueuedEvents(s), 1)
+		})
+
+		g.It("Should give a 404 for a message in another conversation", func() {
+			createMessage("5", "5550000")
+			w := testMarkRead(s, &user, conversation.UUID, `{"mid":"5"}`, func(*http.Request) {})
+			assert.Equal(t, 404, w.Code)
+			assert.Empty(t, enqueuedEvents(s))
+		})
+
+		g.It("Should give a 404 for another user's conversation", func() {
+			other := model.User{Email: "other@portal.com"}
+			s.Users().CreateUser(&other)
+			w := testMarkRead(s, &other, conversation.UUID, `{}`, func(*http.Request) {})
+			assert.Equal(t, 404, w.Code)
+		})
+	})
+}
+
+func testConversations(s store.Store, user *model.User, path string) *httptest.ResponseRecorder {
+	r := testutil.TestRouter(middleware.SetStore(s))
+
+	// Set the user context
+	r.Use(func(c *gin.Context) {
+		context.UserToContext(c, user)
+		c.Next()
+	})
+
+	r.GET("/", GetConversationsEndpoint)
+	r.GET("/:id/messages", GetConversationMessagesEndpoint)
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequest("GET", path, nil)
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func testMarkRead(s store.Store, user *model.User, conversationID string, body string, requestTest func(*http.Request)) *httptest.ResponseRecorder {
+	// Setup mock Google server/client
+	server, client := util.TestHTTP(requestTest, 200, `{"success":1,"failure":0}`)
+	defer server.Close()
+	gcmSendEndpoint = server.URL
+
+	r := testutil.TestRouter(
+		middleware.SetWebClient(client.HTTPClient),
+		middleware.SetStore(s),
+	)
+
+	// Set the user context
+	r.Use(func(c *gin.Context) {
+		context.UserToContext(c, user)
+		c.Next()
+	})
+
+	r.POST("/:id/read", MarkConversationReadEndpoint)
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequest("POST", "/"+conversationID+"/read", bytes.NewBufferString(body))
+	r.ServeHTTP(w, req)
+	return w
+}
@@ -0,0 +1,134 @@
+package user
+
+import (
+	"net/http"
+	"portal-server/api/controller"
+	"portal-server/api/controller/context"
+	"portal-server/api/errs"
+	"portal-server/bus"
+	"portal-server/model"
+	"portal-server/store"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type saveDraft struct {
+	Body string `json:"body" valid:"required"`
+
+	// At is when the client made the edit, in Unix seconds
+	At int64 `json:"at" valid:"required"`
+
+	// Nonce and KeyVersion are sent with encrypted bodies
+	Nonce      string `json:"nonce"`
+	KeyVersion int    `json:"key_version"`
+}
+
+// GetDraftEndpoint retrieves the user's draft in a conversation.
+func GetDraftEndpoint(c *gin.Context) {
+	user := context.UserFromContext(c)
+	s := context.StoreFromContext(c)
+	conversation, found := s.Conversations().FindConversation(&model.Conversation{
+		UserID: user.ID,
+		UUID:   c.Param("conversation"),
+	})
+	if !found {
+		c.JSON(http.StatusNotFound, controller.RenderError(errs.ErrConversationNotFound))
+		return
+	}
+	draft, found := s.Drafts().FindDraft(&model.Draft{
+		UserID:         user.ID,
+		ConversationID: conversation.ID,
+	})
+	if !found || draft.Deleted() {
+		c.JSON(http.StatusNotFound, controller.RenderError(errs.ErrDraftNotFound))
+		return
+	}
+	c.JSON(http.StatusOK, draft.Render(*conversation))
+}
+
+// SaveDraftEndpoint replaces the user's draft in a conversation, unless
+// another device edited it later by the clients' clocks, and notifies the
+// user's devices of the change.
+func SaveDraftEndpoint(c *gin.Context) {
+	var body saveDraft
+	if !controller.ValidJSON(c, &body) {
+		return
+	}
+	changeDraft(c, &model.Draft{
+		Body:            body.Body,
+		ClientUpdatedAt: time.Unix(body.At, 0),
+		Nonce:           body.Nonce,
+		KeyVersion:      body.KeyVersion,
+	})
+}
+
+// DeleteDraftEndpoint deletes the user's draft in a conversation, such as
+// once it was sent, as of the time in the at query parameter.
+func DeleteDraftEndpoint(c *gin.Context) {
+	at, err := strconv.ParseInt(c.Query("at"), 10, 64)
+	if err != nil || at <= 0 {
+		c.JSON(http.StatusBadRequest, controller.RenderError(errs.ErrInvalidDraftTime))
+		return
+	}
+	changeDraft(c, &model.Draft{ClientUpdatedAt: time.Unix(at, 0)})
+}
+
+// changeDraft saves an edit to the draft in the conversation named by the
+// conversation parameter, rendering the resulting draft.
+func changeDraft(c *gin.Context, edit *model.Draft) {
+	user := context.UserFromContext(c)
+	s := context.StoreFromContext(c)
+
+	var (
+		conversation *model.Conversation
+		saved        bool
+	)
+	s.Transaction(func(store store.Store) error {
+		var found bool
+		conversation, found = store.Conversations().FindConversation(&model.Conversation{
+			UserID: user.ID,
+			UUID:   c.Param("conversation"),
+		})
+		if !found {
+			c.JSON(http.StatusNotFound, controller.RenderError(errs.ErrConversationNotFound))
+			return errs.ErrConversationNotFound
+		}
+		edit.UserID = user.ID
+		edit.ConversationID = conversation.ID
+		if !edit.Deleted() {
+			if err := store.EncryptionKeys().CheckEnvelope(user, edit.Message()); err != nil {
+				c.JSON(http.StatusBadRequest, controller.RenderError(err))
+				return err
+			}
+		}
+		var err error
+		if saved, err = store.Drafts().SaveDraft(edit); err != nil {
+			controller.InternalServiceError(c, err)
+			return err
+		}
+		if !saved {
+			c.JSON(http.StatusConflict, controller.RenderError(errs.ErrStaleDraft))
+			return errs.ErrStaleDraft
+		}
+		if err := bus.Enqueue(store, bus.DraftChanged{
+			UserID:         user.ID,
+			ConversationID: conversation.UUID,
+			Deleted:        edit.Deleted(),
+		}); err != nil {
+			controller.InternalServiceError(c, err)
+			return err
+		}
+		return nil
+	})
+	if !saved {
+		return
+	}
+
+	draft := edit.Render(*conversation)
+	if err := notifyDevices(c, s, user, notificationDraftChanged, draft); err != nil {
+		c.Error(err)
+	}
+	c.JSON(http.StatusOK, draft)
+}
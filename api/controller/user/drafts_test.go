@@ -0,0 +1,197 @@
+package user
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"portal-server/api/controller"
+	"portal-server/api/controller/context"
+	"portal-server/api/errs"
+	"portal-server/api/middleware"
+	"portal-server/api/testutil"
+	"portal-server/api/util"
+	"portal-server/bus"
+	"portal-server/model"
+	"portal-server/store"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/franela/goblin"
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDrafts(t *testing.T) {
+	var s store.Store
+	var user model.User
+	var conversation *model.Conversation
+	g := goblin.Goblin(t)
+
+	now := time.Now().Unix()
+	draftJSON := func(body string, at int64) string {
+		return `{"body":"` + body + `","at":` + strconv.FormatInt(at, 10) + `}`
+	}
+
+	g.Describe("Drafts", func() {
+		g.BeforeEach(func() {
+			s = store.GetTestStore()
+			user = model.User{Email: "test@portal.com"}
+			s.Users().CreateUser(&user)
+			s.NotificationKeys().CreateKey(&model.NotificationKey{
+				User:      user,
+				GroupName: "group",
+				Key:       "notification_key",
+			})
+			message := &model.Message{
+				User:      user,
+				To:        "5551234",
+				MessageID: "1",
+				Body:      "hello",
+				Status:    model.MessageStatusSent,
+			}
+			s.Messages().CreateMessage(message)
+			conversation, _ = s.Conversations().FindConversation(&model.Conversation{Model: gorm.Model{ID: message.ConversationID}})
+		})
+
+		g.AfterEach(func() {
+			store.TeardownTestStore(s)
+		})
+
+		g.It("Should save a draft and notify the user's devices", func() {
+			notified := false
+			w := testDrafts(s, &user, "PUT", "/"+conversation.UUID, draftJSON("hel", now), func(r *http.Request) {
+				body, _ := ioutil.ReadAll(r.Body)
+				var message struct {
+					To   string            `json:"to"`
+					Data map[string]string `json:"data"`
+				}
+				json.Unmarshal(body, &message)
+				assert.Equal(t, "notification_key", message.To)
+				assert.Equal(t, notificationDraftChanged, message.Data["type"])
+
+				var payload model.DraftBody
+				assert.NoError(t, json.Unmarshal([]byte(message.Data["payload"]), &payload))
+				assert.Equal(t, conversation.UUID, payload.ConversationID)
+				assert.Equal(t, []string{"5551234"}, payload.Participants)
+				assert.Equal(t, "hel", payload.Body)
+				notified = true
+			})
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.True(t, notified)
+
+			queued := enqueuedEvents(s)
+			assert.Equal(t, bus.DraftChanged{UserID: user.ID, ConversationID: conversation.UUID}, queued[len(queued)-1])
+
+			w = testDrafts(s, &user, "GET", "/"+conversation.UUID, "", func(*http.Request) {})
+			assert.Equal(t, http.StatusOK, w.Code)
+			var res model.DraftBody
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			assert.Equal(t, "hel", res.Body)
+			assert.Equal(t, now, res.At)
+			assert.False(t, res.Deleted)
+		})
+
+		g.It("Should keep the latest edit by the clients' clocks", func() {
+			testDrafts(s, &user, "PUT", "/"+conversation.UUID, draftJSON("hello", now), func(*http.Request) {})
+
+			w := testDrafts(s, &user, "PUT", "/"+conversation.UUID, draftJSON("hel", now-5), func(*http.Request) {
+				t.Fail() // Should not notify devices of a stale edit
+			})
+			assert.Equal(t, http.StatusConflict, w.Code)
+			var res controller.Error
+			json.Unmarshal(w.Body.Bytes(), &res)
+			assert.Equal(t, errs.ErrStaleDraft.Error(), res.Error)
+
+			w = testDrafts(s, &user, "GET", "/"+conversation.UUID, "", func(*http.Request) {})
+			var draft model.DraftBody
+			json.Unmarshal(w.Body.Bytes(), &draft)
+			assert.Equal(t, "hello", draft.Body)
+		})
+
+		g.It("Should delete a draft without older edits bringing it back", func() {
+			testDrafts(s, &user, "PUT", "/"+conversation.UUID, draftJSON("hello", now), func(*http.Request) {})
+
+			w := testDrafts(s, &user, "DELETE", "/"+conversation.UUID+"?at="+strconv.FormatInt(now+1, 10), "", func(r *http.Request) {
+				body, _ := ioutil.ReadAll(r.Body)
+				var message struct {
+					Data map[string]string `json:"data"`
+				}
+				json.Unmarshal(body, &message)
+				var payload model.DraftBody
+				json.Unmarshal([]byte(message.Data["payload"]), &payload)
+				assert.True(t, payload.Deleted)
+			})
+			assert.Equal(t, http.StatusOK, w.Code)
+
+			w = testDrafts(s, &user, "GET", "/"+conversation.UUID, "", func(*http.Request) {})
+			assert.Equal(t, http.StatusNotFound, w.Code)
+			var res controller.Error
+			json.Unmarshal(w.Body.Bytes(), &res)
+			assert.Equal(t, errs.ErrDraftNotFound.Error(), res.Error)
+
+			w = testDrafts(s, &user, "PUT", "/"+conversation.UUID, draftJSON("hello", now), func(*http.Request) {})
+			assert.Equal(t, http.StatusConflict, w.Code)
+		})
+
+		g.It("Should require the time of a deletion", func() {
+			w := testDrafts(s, &user, "DELETE", "/"+conversation.UUID, "", func(*http.Request) {})
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+			var res controller.Error
+			json.Unmarshal(w.Body.Bytes(), &res)
+			assert.Equal(t, errs.ErrInvalidDraftTime.Error(), res.Error)
+		})
+
+		g.It("Should not find a draft in another user's conversation", func() {
+			other := model.User{Email: "other@portal.com"}
+			s.Users().CreateUser(&other)
+
+			w := testDrafts(s, &other, "PUT", "/"+conversation.UUID, draftJSON("hello", now), func(*http.Request) {})
+			assert.Equal(t, http.StatusNotFound, w.Code)
+			var res controller.Error
+			json.Unmarshal(w.Body.Bytes(), &res)
+			assert.Equal(t, errs.ErrConversationNotFound.Error(), res.Error)
+		})
+
+		g.It("Should require encrypted drafts once the user opts in", func() {
+			user.EncryptedMessages = true
+			s.Users().SaveUser(&user)
+
+			w := testDrafts(s, &user, "PUT", "/"+conversation.UUID, draftJSON("hello", now), func(*http.Request) {})
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+			var res controller.Error
+			json.Unmarshal(w.Body.Bytes(), &res)
+			assert.Equal(t, errs.ErrEncryptionRequired.Error(), res.Error)
+		})
+	})
+}
+
+func testDrafts(s store.Store, user *model.User, method string, path string, body string, requestTest func(*http.Request)) *httptest.ResponseRecorder {
+	// Setup mock Google server/client
+	server, client := util.TestHTTP(requestTest, 200, `{"success":1,"failure":0}`)
+	defer server.Close()
+	gcmSendEndpoint = server.URL
+
+	r := testutil.TestRouter(
+		middleware.SetWebClient(client.HTTPClient),
+		middleware.SetStore(s),
+	)
+
+	// Set the user context
+	r.Use(func(c *gin.Context) {
+		context.UserToContext(c, user)
+		c.Next()
+	})
+
+	r.GET("/:conversation", GetDraftEndpoint)
+	r.PUT("/:conversation", SaveDraftEndpoint)
+	r.DELETE("/:conversation", DeleteDraftEndpoint)
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+	r.ServeHTTP(w, req)
+	return w
+}
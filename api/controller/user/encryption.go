@@ -0,0 +1,92 @@
+package user
+
+import (
+	"net/http"
+	"portal-server/api/controller"
+	"portal-server/api/controller/context"
+	"portal-server/model"
+	"portal-server/store"
+
+	"github.com/gin-gonic/gin"
+)
+
+type encryptionSettingsBody struct {
+	Enabled           bool `json:"enabled"`
+	KeyVersion        int  `json:"key_version"`
+	PlaintextMessages int  `json:"plaintext_messages"`
+}
+
+type updateEncryptionSettings struct {
+	Enabled bool `json:"enabled"`
+}
+
+// GetEncryptionSettingsEndpoint reports whether the user's devices encrypt
+// message bodies, the key version to seal them with, and how many messages
+// remain to be encrypted.
+func GetEncryptionSettingsEndpoint(c *gin.Context) {
+	user := context.UserFromContext(c)
+	s := context.StoreFromContext(c)
+	settings, err := getEncryptionSettings(s, user)
+	if err != nil {
+		controller.InternalServiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, settings)
+}
+
+// UpdateEncryptionSettingsEndpoint opts the user in or out of encrypted
+// messages and tells their devices. Once opted in, devices must upload
+// message bodies as ciphertext and re-upload history recorded in plaintext,
+// while server side features that read bodies, such as search, are
+// unavailable. Opting out leaves encrypted messages as they are.
+func UpdateEncryptionSettingsEndpoint(c *gin.Context) {
+	var body updateEncryptionSettings
+	if !controller.ValidJSON(c, &body) {
+		return
+	}
+	user := context.UserFromContext(c)
+	s := context.StoreFromContext(c)
+	s.Transaction(func(store store.Store) error {
+		// Devices need a key to seal messages with
+		if body.Enabled {
+			if _, err := getEncryptionKey(store, user); err != nil {
+				controller.InternalServiceError(c, err)
+				return err
+			}
+		}
+		user.EncryptedMessages = body.Enabled
+		if err := store.Users().SaveUser(user); err != nil {
+			controller.InternalServiceError(c, err)
+			return err
+		}
+
+		settings, err := getEncryptionSettings(store, user)
+		if err != nil {
+			controller.InternalServiceError(c, err)
+			return err
+		}
+		if err := notifyDevices(c, store, user, notificationEncryptionChanged, settings); err != nil {
+			c.Error(err)
+		}
+		c.JSON(http.StatusOK, settings)
+		return nil
+	})
+}
+
+func getEncryptionSettings(store store.Store, user *model.User) (encryptionSettingsBody, error) {
+	settings := encryptionSettingsBody{
+		Enabled:           user.EncryptedMessages,
+		PlaintextMessages: store.Messages().GetPlaintextCount(user),
+	}
+	key, found, err := store.EncryptionKeys().FindKey(&model.EncryptionKey{
+		UserID:  user.ID,
+		Current: true,
+	})
+	if err != nil {
+		return settings, err
+	}
+	if found {
+		settings.KeyVersion = key.Version
+	}
+	return settings, nil
+}
@@ -0,0 +1,122 @@
+package user
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"portal-server/api/controller/context"
+	"portal-server/api/middleware"
+	"portal-server/api/testutil"
+	"portal-server/api/util"
+	"portal-server/model"
+	"portal-server/store"
+	"testing"
+
+	"github.com/franela/goblin"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncryptionSettings(t *testing.T) {
+	var s store.Store
+	var user model.User
+	g := goblin.Goblin(t)
+
+	g.Describe("Encryption settings", func() {
+		g.BeforeEach(func() {
+			s = store.GetTestStore()
+			user = model.User{Email: "test@portal.com"}
+			s.Users().CreateUser(&user)
+			s.Messages().CreateMessage(&model.Message{
+				User:      user,
+				MessageID: "1",
+				To:        "5551234",
+				Body:      "hello",
+				Status:    model.MessageStatusSent,
+			})
+			s.Messages().CreateMessage(&model.Message{
+				User:       user,
+				MessageID:  "2",
+				To:         "5551234",
+				Body:       "c2VhbGVkIG1lc3NhZ2UgYm9keQ==",
+				Nonce:      "AAECAwQFBgcICQoL",
+				KeyVersion: 1,
+				Status:     model.MessageStatusSent,
+			})
+		})
+
+		g.AfterEach(func() {
+			store.TeardownTestStore(s)
+		})
+
+		g.It("Should report encryption disabled by default", func() {
+			w := testEncryptionSettings(s, &user, "GET", GetEncryptionSettingsEndpoint, "", func(*http.Request) {})
+			assert.Equal(t, 200, w.Code)
+			assert.JSONEq(t, `{"enabled":false,"key_version":0,"plaintext_messages":1}`, w.Body.String())
+		})
+
+		g.It("Should opt in and notify devices", func() {
+			s.NotificationKeys().CreateKey(&model.NotificationKey{
+				User:      user,
+				GroupName: "group",
+				Key:       "notification_key",
+			})
+
+			notified := false
+			w := testEncryptionSettings(s, &user, "PUT", UpdateEncryptionSettingsEndpoint, `{"enabled":true}`, func(r *http.Request) {
+				body, _ := ioutil.ReadAll(r.Body)
+				var message struct {
+					Data map[string]string `json:"data"`
+				}
+				json.Unmarshal(body, &message)
+				assert.Equal(t, notificationEncryptionChanged, message.Data["type"])
+				assert.JSONEq(t, `{"enabled":true,"key_version":1,"plaintext_messages":1}`, message.Data["payload"])
+				notified = true
+			})
+			assert.Equal(t, 200, w.Code)
+			assert.True(t, notified)
+			assert.JSONEq(t, `{"enabled":true,"key_version":1,"plaintext_messages":1}`, w.Body.String())
+
+			fromDB, _ := s.Users().FindUser(&model.User{Email: "test@portal.com"})
+			assert.True(t, fromDB.EncryptedMessages)
+		})
+
+		g.It("Should opt out leaving encrypted messages as they are", func() {
+			testEncryptionSettings(s, &user, "PUT", UpdateEncryptionSettingsEndpoint, `{"enabled":true}`, func(*http.Request) {})
+			w := testEncryptionSettings(s, &user, "PUT", UpdateEncryptionSettingsEndpoint, `{"enabled":false}`, func(*http.Request) {})
+			assert.Equal(t, 200, w.Code)
+			assert.JSONEq(t, `{"enabled":false,"key_version":1,"plaintext_messages":1}`, w.Body.String())
+
+			fromDB, _ := s.Messages().FindMessage(&model.Message{MessageID: "2"})
+			assert.True(t, fromDB.Encrypted())
+		})
+	})
+}
+
+func testEncryptionSettings(s store.Store, user *model.User, method string, endpoint gin.HandlerFunc, body string, requestTest func(*http.Request)) *httptest.ResponseRecorder {
+	// Setup mock Google server/client
+	server, client := util.TestHTTP(requestTest, 200, `{"success":1,"failure":0}`)
+	defer server.Close()
+	gcmSendEndpoint = server.URL
+
+	r := testutil.TestRouter(
+		middleware.SetWebClient(client.HTTPClient),
+		middleware.SetStore(s),
+	)
+
+	// Set the user context
+	r.Use(func(c *gin.Context) {
+		context.UserToContext(c, user)
+		c.Next()
+	})
+
+	r.Handle(method, "/", endpoint)
+	w := httptest.NewRecorder()
+
+	// Send the input
+	req, _ := http.NewRequest(method, "/", bytes.NewBufferString(body))
+	r.ServeHTTP(w, req)
+	return w
+}
@@ -0,0 +1,49 @@
+package user
+
+import (
+	"io"
+	"net/http"
+	"portal-server/api/controller/context"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// EventKeepAlive is how often an idle event stream sends a comment, so that
+// proxies do not close it.
+var EventKeepAlive = 30 * time.Second
+
+// GetEventsEndpoint streams the user's events as Server-Sent Events until the
+// client disconnects. Each event is named by its type, with JSON data saying
+// what changed. A client which falls behind has its stream ended, and should
+// catch up from the message changes feed when it reconnects.
+func GetEventsEndpoint(c *gin.Context) {
+	user := context.UserFromContext(c)
+	sub := context.EventHubFromContext(c).Subscribe(user.ID)
+	defer sub.Close()
+
+	// Send the headers straight away so the client knows it is subscribed
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Writer.WriteHeader(http.StatusOK)
+	c.Writer.WriteHeaderNow()
+	c.Writer.Flush()
+
+	keepAlive := time.NewTicker(EventKeepAlive)
+	defer keepAlive.Stop()
+	clientGone := c.Writer.CloseNotify()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case event, open := <-sub.Events:
+			if !open {
+				return false
+			}
+			c.SSEvent(event.Type, event.Data)
+		case <-keepAlive.C:
+			io.WriteString(w, ":\n\n")
+		case <-clientGone:
+			return false
+		}
+		return true
+	})
+}
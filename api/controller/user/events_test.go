@@ -0,0 +1,96 @@
+package user
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"portal-server/api/controller/context"
+	"portal-server/api/middleware"
+	"portal-server/api/testutil"
+	"portal-server/bus"
+	"portal-server/events"
+	"portal-server/model"
+	"portal-server/store"
+	"testing"
+	"time"
+
+	"github.com/franela/goblin"
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEvents(t *testing.T) {
+	var (
+		hub    *events.Hub
+		server *httptest.Server
+		user   model.User
+	)
+	g := goblin.Goblin(t)
+
+	g.Describe("GET /user/events", func() {
+		g.BeforeEach(func() {
+			user = model.User{Model: gorm.Model{ID: 1}}
+			hub = events.NewHub()
+			server = testEventStream(hub, &user)
+		})
+
+		g.AfterEach(func() {
+			server.Close()
+			EventKeepAlive = 30 * time.Second
+		})
+
+		g.It("Should stream the user's events", func() {
+			res, err := http.Get(server.URL)
+			assert.NoError(t, err)
+			defer res.Body.Close()
+			assert.Equal(t, 200, res.StatusCode)
+			assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+
+			// The client is subscribed once the headers arrive
+			b := bus.NewMemoryBus()
+			events.Forward(b, hub)
+			b.Publish(bus.MessageDeleted{UserID: 2, MessageID: "other"})
+			b.Publish(bus.MessageDeleted{UserID: user.ID, MessageID: "mid"})
+			stream := bufio.NewReader(res.Body)
+			line, _ := stream.ReadString('\n')
+			assert.Equal(t, "event:message_deleted\n", line)
+			line, _ = stream.ReadString('\n')
+			assert.Equal(t, "data:{\"mid\":\"mid\"}\n", line)
+		})
+
+		g.It("Should keep an idle stream alive", func() {
+			EventKeepAlive = 10 * time.Millisecond
+			res, err := http.Get(server.URL)
+			assert.NoError(t, err)
+			defer res.Body.Close()
+
+			line, _ := bufio.NewReader(res.Body).ReadString('\n')
+			assert.Equal(t, ":\n", line)
+		})
+	})
+}
+
+func testEventStream(hub *events.Hub, user *model.User) *httptest.Server {
+	r := testutil.TestRouter(middleware.SetEvents(hub))
+
+	// Set the user context
+	r.Use(func(c *gin.Context) {
+		context.UserToContext(c, user)
+		c.Next()
+	})
+
+	r.GET("/", GetEventsEndpoint)
+	return httptest.NewServer(r)
+}
+
+// enqueuedEvents decodes the events the endpoints under test added to the
+// outbox.
+func enqueuedEvents(s store.Store) []bus.Event {
+	pending, _ := s.Outbox().GetUnrelayedEvents(100)
+	queued := make([]bus.Event, len(pending))
+	for i, event := range pending {
+		queued[i], _ = bus.Decode(event.Topic, []byte(event.Payload))
+	}
+	return queued
+}
@@ -4,20 +4,28 @@ import (
 	"net/http"
 	"portal-server/api/controller"
 	"portal-server/api/controller/context"
+	"portal-server/model"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
+// DeviceOnlineThreshold is how recently a device must have been seen
+// to be reported as online.
+var DeviceOnlineThreshold = 5 * time.Minute
+
 type deviceListResponse struct {
 	Devices []linkedDevice `json:"devices"`
 }
 
 type linkedDevice struct {
-	DeviceID  string `json:"device_id"`
-	CreatedAt int64  `json:"created_at"`
-	UpdatedAt int64  `json:"updated_at"`
-	Name      string `json:"name"`
-	Type      string `json:"type"`
+	DeviceID   string `json:"device_id"`
+	CreatedAt  int64  `json:"created_at"`
+	UpdatedAt  int64  `json:"updated_at"`
+	LastSeenAt int64  `json:"last_seen_at"`
+	Status     string `json:"status"`
+	Name       string `json:"name"`
+	Type       string `json:"type"`
 }
 
 // GetDevicesEndpoint retrieves connected user devices.
@@ -29,17 +37,31 @@ func GetDevicesEndpoint(c *gin.Context) {
 		controller.InternalServiceError(c, err)
 		return
 	}
+	now := time.Now()
 	linkedDevices := make([]linkedDevice, 0, len(devices))
 	for _, value := range devices {
+		var lastSeenAt int64
+		if !value.LastSeenAt.IsZero() {
+			lastSeenAt = value.LastSeenAt.Unix()
+		}
 		linkedDevices = append(linkedDevices, linkedDevice{
-			DeviceID:  value.UUID,
-			CreatedAt: value.CreatedAt.Unix(),
-			UpdatedAt: value.UpdatedAt.Unix(),
-			Name:      value.Name,
-			Type:      value.Type,
+			DeviceID:   value.UUID,
+			CreatedAt:  value.CreatedAt.Unix(),
+			UpdatedAt:  value.UpdatedAt.Unix(),
+			LastSeenAt: lastSeenAt,
+			Status:     devicePresence(&value, now),
+			Name:       value.Name,
+			Type:       value.Type,
 		})
 	}
 	c.JSON(http.StatusOK, deviceListResponse{
 		Devices: linkedDevices,
 	})
 }
+
+func devicePresence(device *model.Device, now time.Time) string {
+	if device.LastSeenAt.IsZero() || now.Sub(device.LastSeenAt) > DeviceOnlineThreshold {
+		return model.DevicePresenceOffline
+	}
+	return model.DevicePresenceOnline
+}
@@ -10,6 +10,7 @@ import (
 	"portal-server/model"
 	"portal-server/store"
 	"testing"
+	"time"
 
 	"github.com/franela/goblin"
 	"github.com/gin-gonic/gin"
@@ -81,6 +82,65 @@ func TestGetDevices(t *testing.T) {
 			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
 			assert.Equal(t, 2, len(res.Devices))
 		})
+
+		g.It("Should report devices as online or offline by last seen time", func() {
+			user := model.User{Email: "test@portal.com"}
+			s.Users().CreateUser(&user)
+			key := model.NotificationKey{
+				User:      user,
+				Key:       "key",
+				GroupName: "name",
+			}
+			s.NotificationKeys().CreateKey(&key)
+			lastSeen := time.Now().Add(-time.Minute)
+			s.Devices().CreateDevice(&model.Device{
+				User:            user,
+				NotificationKey: key,
+				UUID:            "online",
+				Name:            "Nexus 6P",
+				Type:            "phone",
+				RegistrationID:  "1",
+				State:           model.DeviceStateLinked,
+				LastSeenAt:      lastSeen,
+			})
+			s.Devices().CreateDevice(&model.Device{
+				User:            user,
+				NotificationKey: key,
+				UUID:            "stale",
+				Name:            "Chrome 4.2",
+				Type:            "chrome",
+				RegistrationID:  "2",
+				State:           model.DeviceStateLinked,
+				LastSeenAt:      time.Now().Add(-2 * DeviceOnlineThreshold),
+			})
+			s.Devices().CreateDevice(&model.Device{
+				User:            user,
+				NotificationKey: key,
+				UUID:            "never",
+				Name:            "Desktop",
+				Type:            "desktop",
+				RegistrationID:  "3",
+				State:           model.DeviceStateLinked,
+			})
+			w := testGetDevices(s, &user)
+			assert.Equal(t, 200, w.Code)
+
+			var res deviceListResponse
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			assert.Equal(t, 3, len(res.Devices))
+			for _, device := range res.Devices {
+				switch device.DeviceID {
+				case "online":
+					assert.Equal(t, model.DevicePresenceOnline, device.Status)
+					assert.Equal(t, lastSeen.Unix(), device.LastSeenAt)
+				case "stale":
+					assert.Equal(t, model.DevicePresenceOffline, device.Status)
+				case "never":
+					assert.Equal(t, model.DevicePresenceOffline, device.Status)
+					assert.Equal(t, int64(0), device.LastSeenAt)
+				}
+			}
+		})
 	})
 }
 
@@ -0,0 +1,120 @@
+package user
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"portal-server/api/controller"
+	"portal-server/api/controller/context"
+	"portal-server/model"
+	"portal-server/store"
+
+	"github.com/gin-gonic/gin"
+)
+
+type keySetResponse struct {
+	CurrentVersion int                 `json:"current_version"`
+	Keys           []encryptionKeyBody `json:"keys"`
+}
+
+type encryptionKeyBody struct {
+	Version int    `json:"version"`
+	Key     string `json:"key"`
+	Current bool   `json:"current"`
+}
+
+type keyRotatedPayload struct {
+	Version int `json:"version"`
+}
+
+// GetKeysEndpoint retrieves every version of the user's encryption key.
+func GetKeysEndpoint(c *gin.Context) {
+	user := context.UserFromContext(c)
+	s := context.StoreFromContext(c)
+	keySet, err := getKeySet(s, user)
+	if err != nil {
+		controller.InternalServiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, keySet)
+}
+
+// RotateKeysEndpoint creates a new current version of the user's encryption
+// key and notifies linked devices of the rotation. Older versions are kept so
+// that existing messages can still be decrypted.
+func RotateKeysEndpoint(c *gin.Context) {
+	user := context.UserFromContext(c)
+	s := context.StoreFromContext(c)
+	s.Transaction(func(store store.Store) error {
+		key, err := rotateEncryptionKey(store, user)
+		if err != nil {
+			controller.InternalServiceError(c, err)
+			return err
+		}
+
+		keySet, err := getKeySet(store, user)
+		if err != nil {
+			controller.InternalServiceError(c, err)
+			return err
+		}
+
+		if err := notifyDevices(c, store, user, notificationKeyRotated, keyRotatedPayload{
+			Version: key.Version,
+		}); err != nil {
+			c.Error(err)
+		}
+
+		c.JSON(http.StatusOK, keySet)
+		return nil
+	})
+}
+
+func rotateEncryptionKey(store store.Store, user *model.User) (*model.EncryptionKey, error) {
+	current, err := getEncryptionKey(store, user)
+	if err != nil {
+		return nil, err
+	}
+	current.Current = false
+	if err := store.EncryptionKeys().SaveKey(current); err != nil {
+		return nil, err
+	}
+	return createEncryptionKey(store, user, current.Version+1)
+}
+
+func createEncryptionKey(store store.Store, user *model.User, version int) (*model.EncryptionKey, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	encryptionKey := &model.EncryptionKey{
+		User:    *user,
+		Version: version,
+		Current: true,
+		Key:     hex.EncodeToString(key),
+	}
+	if err := store.EncryptionKeys().CreateKey(encryptionKey); err != nil {
+		return nil, err
+	}
+	return encryptionKey, nil
+}
+
+func getKeySet(store store.Store, user *model.User) (*keySetResponse, error) {
+	keys, err := store.EncryptionKeys().GetKeysByUser(user)
+	if err != nil {
+		return nil, err
+	}
+	keySet := &keySetResponse{
+		Keys: make([]encryptionKeyBody, 0, len(keys)),
+	}
+	for _, key := range keys {
+		if key.Current {
+			keySet.CurrentVersion = key.Version
+		}
+		keySet.Keys = append(keySet.Keys, encryptionKeyBody{
+			Version: key.Version,
+			Key:     key.Key,
+			Current: key.Current,
+		})
+	}
+	return keySet, nil
+}
@@ -0,0 +1,125 @@
+package user
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"portal-server/api/controller/context"
+	"portal-server/api/middleware"
+	"portal-server/api/testutil"
+	"portal-server/api/util"
+	"portal-server/model"
+	"portal-server/store"
+	"testing"
+
+	"github.com/franela/goblin"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeys(t *testing.T) {
+	var s store.Store
+	var user model.User
+	g := goblin.Goblin(t)
+
+	g.Describe("Encryption keys", func() {
+		g.BeforeEach(func() {
+			s = store.GetTestStore()
+			user = model.User{Email: "test@portal.com"}
+			s.Users().CreateUser(&user)
+		})
+
+		g.AfterEach(func() {
+			store.TeardownTestStore(s)
+		})
+
+		g.It("Should return an empty key set for a user with no keys", func() {
+			w := testKeys(s, &user, "GET", GetKeysEndpoint, func(*http.Request) {})
+			assert.Equal(t, 200, w.Code)
+			assert.JSONEq(t, `{"current_version":0,"keys":[]}`, w.Body.String())
+		})
+
+		g.It("Should create a new current key version on rotation", func() {
+			first, _ := getEncryptionKey(s, &user)
+			s.NotificationKeys().CreateKey(&model.NotificationKey{
+				User:      user,
+				GroupName: "group",
+				Key:       "notification_key",
+			})
+
+			notified := false
+			w := testKeys(s, &user, "POST", RotateKeysEndpoint, func(r *http.Request) {
+				body, _ := ioutil.ReadAll(r.Body)
+				var message struct {
+					To   string            `json:"to"`
+					Data map[string]string `json:"data"`
+				}
+				json.Unmarshal(body, &message)
+				assert.Equal(t, "notification_key", message.To)
+				assert.Equal(t, notificationKeyRotated, message.Data["type"])
+				assert.JSONEq(t, `{"version":2}`, message.Data["payload"])
+				notified = true
+			})
+			assert.Equal(t, 200, w.Code)
+			assert.True(t, notified)
+
+			var res keySetResponse
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			assert.Equal(t, 2, res.CurrentVersion)
+			assert.Equal(t, 2, len(res.Keys))
+			assert.Equal(t, first.Key, res.Keys[0].Key)
+			assert.False(t, res.Keys[0].Current)
+			assert.NotEqual(t, first.Key, res.Keys[1].Key)
+			assert.True(t, res.Keys[1].Current)
+
+			current, _ := getEncryptionKey(s, &user)
+			assert.Equal(t, 2, current.Version)
+			assert.Equal(t, res.Keys[1].Key, current.Key)
+		})
+
+		g.It("Should return every key version", func() {
+			getEncryptionKey(s, &user)
+			rotateEncryptionKey(s, &user)
+			rotateEncryptionKey(s, &user)
+
+			w := testKeys(s, &user, "GET", GetKeysEndpoint, func(*http.Request) {})
+			assert.Equal(t, 200, w.Code)
+
+			var res keySetResponse
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			assert.Equal(t, 3, res.CurrentVersion)
+			assert.Equal(t, 3, len(res.Keys))
+			for i, key := range res.Keys {
+				assert.Equal(t, i+1, key.Version)
+				assert.Regexp(t, "^[a-fA-F0-9]{64}$", key.Key)
+			}
+		})
+	})
+}
+
+func testKeys(s store.Store, user *model.User, method string, endpoint gin.HandlerFunc, requestTest func(*http.Request)) *httptest.ResponseRecorder {
+	// Setup mock Google server/client
+	server, client := util.TestHTTP(requestTest, 200, `{"success":1,"failure":0}`)
+	defer server.Close()
+	gcmSendEndpoint = server.URL
+
+	r := testutil.TestRouter(
+		middleware.SetWebClient(client.HTTPClient),
+		middleware.SetStore(s),
+	)
+
+	// Set the user context
+	r.Use(func(c *gin.Context) {
+		context.UserToContext(c, user)
+		c.Next()
+	})
+
+	r.Handle(method, "/", endpoint)
+	w := httptest.NewRecorder()
+
+	// Send the input
+	req, _ := http.NewRequest(method, "/", nil)
+	r.ServeHTTP(w, req)
+	return w
+}
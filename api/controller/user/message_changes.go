@@ -0,0 +1,79 @@
+package user
+
+import (
+	"net/http"
+	"portal-server/api/controller"
+	"portal-server/api/controller/context"
+	"portal-server/api/errs"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// messageChangesLimit bounds the number of changes returned at once
+const messageChangesLimit = 1000
+
+type messageChangesResponse struct {
+	Seq        uint64        `json:"seq"`
+	Upserts    []messageBody `json:"upserts"`
+	Tombstones []string      `json:"tombstones"`
+	HasMore    bool          `json:"has_more"`
+	FullResync bool          `json:"full_resync"`
+}
+
+// GetMessageChangesEndpoint returns the messages created, updated or deleted
+// after the change sequence number in since. Clients continue from the
+// returned seq. If changes the client has not seen were pruned, it is told
+// to discard its messages and resync from the message history instead.
+func GetMessageChangesEndpoint(c *gin.Context) {
+	user := context.UserFromContext(c)
+	s := context.StoreFromContext(c)
+
+	var since uint64
+	if value := c.Query("since"); value != "" {
+		var err error
+		if since, err = strconv.ParseUint(value, 10, 64); err != nil {
+			c.JSON(http.StatusBadRequest, controller.RenderError(errs.ErrInvalidSequence))
+			return
+		}
+	}
+
+	sequence, err := s.Messages().GetChangeSequence(user)
+	if err != nil {
+		controller.InternalServiceError(c, err)
+		return
+	}
+	if since < sequence.PrunedSeq || since > sequence.Seq {
+		c.JSON(http.StatusOK, messageChangesResponse{
+			Seq:        sequence.Seq,
+			Upserts:    []messageBody{},
+			Tombstones: []string{},
+			FullResync: true,
+		})
+		return
+	}
+
+	messages, err := s.Messages().GetChangesSince(user, since, messageChangesLimit+1)
+	if err != nil {
+		controller.InternalServiceError(c, err)
+		return
+	}
+	res := messageChangesResponse{
+		Seq:        since,
+		Upserts:    []messageBody{},
+		Tombstones: []string{},
+	}
+	if len(messages) > messageChangesLimit {
+		messages = messages[:messageChangesLimit]
+		res.HasMore = true
+	}
+	for _, message := range messages {
+		res.Seq = message.Seq
+		if message.DeletedAt != nil {
+			res.Tombstones = append(res.Tombstones, message.MessageID)
+			continue
+		}
+		res.Upserts = append(res.Upserts, renderMessage(message))
+	}
+	c.JSON(http.StatusOK, res)
+}
@@ -0,0 +1,142 @@
+package user
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"portal-server/api/controller/context"
+	"portal-server/api/middleware"
+	"portal-server/api/testutil"
+	"portal-server/model"
+	"portal-server/store"
+	"testing"
+	"time"
+
+	"github.com/franela/goblin"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageChanges(t *testing.T) {
+	var s store.Store
+	var user model.User
+	g := goblin.Goblin(t)
+	g.Describe("GET /user/messages/changes", func() {
+		g.BeforeEach(func() {
+			s = store.GetTestStore()
+			user = model.User{Email: "test@portal.com"}
+			s.Users().CreateUser(&user)
+		})
+
+		g.AfterEach(func() {
+			store.TeardownTestStore(s)
+		})
+
+		g.It("Should return an empty change set for a user with no messages", func() {
+			w := testMessageChanges(s, &user, "?since=0")
+			assert.Equal(t, 200, w.Code)
+			assert.JSONEq(t, `{"seq":0,"upserts":[],"tombstones":[],"has_more":false,"full_resync":false}`, w.Body.String())
+		})
+
+		g.It("Should return upserts and tombstones since a sequence number", func() {
+			for _, mid := range []string{"1", "2", "3"} {
+				s.Messages().CreateMessage(&model.Message{
+					User:      user,
+					To:        "justin",
+					MessageID: mid,
+					Body:      "hello",
+					Status:    model.MessageStatusStarted,
+				})
+			}
+
+			var res messageChangesResponse
+			w := testMessageChanges(s, &user, "?since=0")
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			assert.Equal(t, uint64(3), res.Seq)
+			assert.Equal(t, 3, len(res.Upserts))
+
+			// Updating an older message and deleting another are both changes
+			message, _ := s.Messages().FindMessage(&model.Message{MessageID: "1"})
+			message.Status = model.MessageStatusSent
+			s.Messages().SaveMessage(message)
+			s.Messages().DeleteMessages(&model.Message{MessageID: "2"})
+
+			res = messageChangesResponse{}
+			w = testMessageChanges(s, &user, "?since=3")
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			assert.Equal(t, uint64(5), res.Seq)
+			assert.Equal(t, 1, len(res.Upserts))
+			assert.Equal(t, "1", res.Upserts[0].MessageID)
+			assert.Equal(t, model.MessageStatusSent, res.Upserts[0].Status)
+			assert.Equal(t, []string{"2"}, res.Tombstones)
+			assert.False(t, res.FullResync)
+		})
+
+		g.It("Should ask clients behind pruned tombstones to resync", func() {
+			for _, mid := range []string{"1", "2"} {
+				s.Messages().CreateMessage(&model.Message{
+					User:      user,
+					To:        "justin",
+					MessageID: mid,
+					Body:      "hello",
+					Status:    model.MessageStatusStarted,
+				})
+			}
+			deleted, _ := s.Messages().FindMessage(&model.Message{MessageID: "1"})
+			s.Attachments().CreateAttachment(&model.Attachment{
+				User:        user,
+				MessageID:   deleted.ID,
+				UUID:        "0f8e7c2a-3b1d-4a5e-9c6f-7d8e9f0a1b2c",
+				ContentType: "image/png",
+				Size:        3,
+			})
+			events, _ := s.Messages().GetStatusEvents(deleted)
+			assert.NotEmpty(t, events)
+			s.Messages().DeleteMessages(&model.Message{MessageID: "1"})
+			pruned, attachments, err := s.Messages().PruneDeletedMessages(time.Now().Add(time.Second))
+			assert.NoError(t, err)
+			assert.Equal(t, 1, pruned)
+			assert.Equal(t, []string{"0f8e7c2a-3b1d-4a5e-9c6f-7d8e9f0a1b2c"}, attachments)
+
+			// Nothing of the pruned message is left behind
+			left, _ := s.Attachments().GetAttachments(deleted)
+			assert.Empty(t, left)
+			events, _ = s.Messages().GetStatusEvents(deleted)
+			assert.Empty(t, events)
+
+			var res messageChangesResponse
+			w := testMessageChanges(s, &user, "?since=2")
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			assert.True(t, res.FullResync)
+			assert.Equal(t, uint64(3), res.Seq)
+
+			// Clients past the pruned tombstone are unaffected
+			res = messageChangesResponse{}
+			w = testMessageChanges(s, &user, "?since=3")
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			assert.False(t, res.FullResync)
+		})
+
+		g.It("Should reject an invalid sequence number", func() {
+			w := testMessageChanges(s, &user, "?since=abc")
+			assert.Equal(t, 400, w.Code)
+		})
+	})
+}
+
+func testMessageChanges(s store.Store, user *model.User, query string) *httptest.ResponseRecorder {
+	r := testutil.TestRouter(middleware.SetStore(s))
+
+	// Set the user context
+	r.Use(func(c *gin.Context) {
+		context.UserToContext(c, user)
+		c.Next()
+	})
+
+	r.GET("/", GetMessageChangesEndpoint)
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequest("GET", "/"+query, nil)
+	r.ServeHTTP(w, req)
+	return w
+}
@@ -5,23 +5,36 @@ import (
 	"portal-server/api/controller"
 	"portal-server/api/controller/context"
 	"portal-server/api/errs"
+	"portal-server/bus"
 	"portal-server/model"
+	"portal-server/store"
 
 	"github.com/gin-gonic/gin"
 )
 
 func DeleteMessageEndpoint(c *gin.Context) {
 	user := context.UserFromContext(c)
-	store := context.StoreFromContext(c)
+	s := context.StoreFromContext(c)
 	messageID := c.Param("mid")
 
-	rows := store.Messages().DeleteMessages(&model.Message{
-		UserID:    user.ID,
-		MessageID: messageID,
+	s.Transaction(func(store store.Store) error {
+		rows, err := store.Messages().DeleteMessages(&model.Message{
+			UserID:    user.ID,
+			MessageID: messageID,
+		})
+		if err != nil {
+			controller.InternalServiceError(c, err)
+			return err
+		}
+		if rows == 0 {
+			c.JSON(http.StatusNotFound, controller.RenderError(errs.ErrMessageNotFound))
+			return errs.ErrMessageNotFound
+		}
+		if err := bus.Enqueue(store, bus.MessageDeleted{UserID: user.ID, MessageID: messageID}); err != nil {
+			controller.InternalServiceError(c, err)
+			return err
+		}
+		c.JSON(http.StatusOK, controller.RenderSuccess(true))
+		return nil
 	})
-	if rows == 0 {
-		c.JSON(http.StatusNotFound, controller.RenderError(errs.ErrMessageNotFound))
-		return
-	}
-	c.JSON(http.StatusOK, controller.RenderSuccess(true))
 }
@@ -9,6 +9,7 @@ import (
 	"portal-server/api/errs"
 	"portal-server/api/middleware"
 	"portal-server/api/testutil"
+	"portal-server/bus"
 	"portal-server/model"
 	"portal-server/store"
 	"testing"
@@ -67,9 +68,11 @@ func TestMessageDelete(t *testing.T) {
 			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
 			assert.Equal(t, true, res.Success)
 
-			messages, _ := s.Messages().GetMessagesByUser(&user, 10)
+			messages, _ := s.Messages().GetMessagesPage(&user, store.MessagePage{Limit: 10})
 			assert.Equal(t, 1, len(messages))
 			assert.Equal(t, "1", messages[0].MessageID)
+
+			assert.Equal(t, []bus.Event{bus.MessageDeleted{UserID: user.ID, MessageID: "2"}}, enqueuedEvents(s))
 		})
 	})
 }
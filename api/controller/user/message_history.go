@@ -4,45 +4,93 @@ import (
 	"net/http"
 	"portal-server/api/controller"
 	"portal-server/api/controller/context"
+	"portal-server/model"
+	"portal-server/store"
 
 	"github.com/gin-gonic/gin"
 )
 
+// messageHistoryLimit is the default and maximum page size
 const messageHistoryLimit = 1000
 
 type messageHistoryResponse struct {
-	Messages []messageBody `json:"messages"`
+	Messages    []messageBody `json:"messages"`
+	NextCursor  string        `json:"next_cursor,omitempty"`
+	UnreadCount int           `json:"unread_count"`
 }
 
+// A messageBody is a message as the api renders it, which may name its
+// participants.
 type messageBody struct {
-	MessageID string `json:"mid"`
-	To        string `json:"to"`
-	Status    string `json:"status"`
-	Body      string `json:"body"`
-	At        int64  `json:"at"`
+	model.MessageBody
+
+	// Contacts name the participants who are the user's contacts, where
+	// the response says so
+	Contacts []contactMatch `json:"contacts,omitempty"`
 }
 
-// GetMessageHistoryEndpoint retrieves user messages up to a
-// given limit.
+// GetMessageHistoryEndpoint retrieves a page of user messages, newest first.
+// Pages are selected with opaque before or after cursors and a limit; the
+// next_cursor continues paging in the same direction while more remain.
 func GetMessageHistoryEndpoint(c *gin.Context) {
+	page, err := pageFromQuery(c, messageHistoryLimit)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, controller.RenderError(err))
+		return
+	}
+	s := context.StoreFromContext(c)
 	user := context.UserFromContext(c)
-	store := context.StoreFromContext(c)
-	messages, err := store.Messages().GetMessagesByUser(user, messageHistoryLimit)
+	unread, err := s.Conversations().GetUnreadCount(user)
 	if err != nil {
 		controller.InternalServiceError(c, err)
 		return
 	}
-	messageBodies := make([]messageBody, 0, len(messages))
-	for _, value := range messages {
-		messageBodies = append(messageBodies, messageBody{
-			MessageID: value.MessageID,
-			To:        value.To,
-			Status:    value.Status,
-			Body:      value.Body,
-			At:        value.UpdatedAt.Unix(),
-		})
+	renderMessagePage(c, s, user, page, unread)
+}
+
+// renderMessagePage writes a page of the user's messages, named by their
+// contacts, with the cursor continuing it and how many messages in view are
+// unread.
+func renderMessagePage(c *gin.Context, s store.Store, user *model.User, page store.MessagePage, unread int) {
+	// Fetch one extra message to tell whether another page follows
+	limit := page.Limit
+	page.Limit++
+	messages, err := s.Messages().GetMessagesPage(user, page)
+	if err != nil {
+		controller.InternalServiceError(c, err)
+		return
+	}
+
+	var nextCursor string
+	if len(messages) > limit {
+		if page.AfterID != 0 {
+			messages = messages[1:]
+			nextCursor = encodeCursor(messages[0].ID)
+		} else {
+			messages = messages[:limit]
+			nextCursor = encodeCursor(messages[limit-1].ID)
+		}
+	}
+	bodies, err := renderNamedMessages(s, user, messages)
+	if err != nil {
+		controller.InternalServiceError(c, err)
+		return
 	}
 	c.JSON(http.StatusOK, messageHistoryResponse{
-		Messages: messageBodies,
+		Messages:    bodies,
+		NextCursor:  nextCursor,
+		UnreadCount: unread,
 	})
 }
+
+func renderMessages(messages []model.Message) []messageBody {
+	messageBodies := make([]messageBody, 0, len(messages))
+	for _, value := range messages {
+		messageBodies = append(messageBodies, renderMessage(value))
+	}
+	return messageBodies
+}
+
+func renderMessage(message model.Message) messageBody {
+	return messageBody{MessageBody: message.Render()}
+}
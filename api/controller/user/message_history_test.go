@@ -10,6 +10,7 @@ import (
 	"portal-server/api/testutil"
 	"portal-server/model"
 	"portal-server/store"
+	"strconv"
 	"testing"
 
 	"github.com/franela/goblin"
@@ -32,7 +33,7 @@ func TestMessageHistory(t *testing.T) {
 		g.It("Should return an empty array for a user with no messages", func() {
 			w := testGetMessages(s, &model.User{})
 			assert.Equal(t, 200, w.Code)
-			assert.JSONEq(t, `{"messages":[]}`, w.Body.String())
+			assert.JSONEq(t, `{"messages":[],"unread_count":0}`, w.Body.String())
 		})
 
 		g.It("Should return all messages for a user", func() {
@@ -58,6 +59,58 @@ func TestMessageHistory(t *testing.T) {
 			assert.Equal(t, message.UpdatedAt.Unix(), res.Messages[0].At)
 		})
 
+		g.It("Should name participants by the user's contacts", func() {
+			user := model.User{Email: "test@portal.com", Region: "GB"}
+			s.Users().CreateUser(&user)
+			s.Contacts().CreateContact(&model.Contact{
+				UserID:       user.ID,
+				UUID:         "7c9e6679-7425-40de-944b-e07fc1f90ae7",
+				Name:         "Justin",
+				PhoneNumbers: []model.ContactPhone{{Type: "cell", Number: "+44 7700 900123"}},
+			})
+			message := &model.Message{
+				User:      user,
+				MessageID: "1",
+				Body:      "hello all",
+				Status:    model.MessageStatusDelivered,
+			}
+			message.SetRecipients([]string{"07700 900123", "61234"})
+			s.Messages().CreateMessage(message)
+
+			w := testGetMessages(s, &user)
+			assert.Equal(t, 200, w.Code)
+			var res messageHistoryResponse
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			assert.Equal(t, []string{"+447700900123", "61234"}, res.Messages[0].Recipients)
+			assert.Equal(t, []contactMatch{{
+				Number:    "+447700900123",
+				Name:      "Justin",
+				ContactID: "7c9e6679-7425-40de-944b-e07fc1f90ae7",
+			}}, res.Messages[0].Contacts)
+		})
+
+		g.It("Should count unread messages across conversations", func() {
+			user := model.User{Email: "test@portal.com"}
+			s.Users().CreateUser(&user)
+			for i, from := range []string{"5551234", "5550000", "5550000"} {
+				s.Messages().CreateMessage(&model.Message{
+					User:      user,
+					From:      from,
+					MessageID: strconv.Itoa(i + 1),
+					Body:      "hello",
+					Status:    model.MessageStatusReceived,
+					Direction: model.MessageDirectionIncoming,
+					Read:      i == 0,
+				})
+			}
+			w := testGetMessages(s, &user)
+			assert.Equal(t, 200, w.Code)
+			var res messageHistoryResponse
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			assert.Equal(t, 3, len(res.Messages))
+			assert.Equal(t, 2, res.UnreadCount)
+		})
+
 		g.It("Should return at most messageHistoryLimit messages", func() {
 			user := model.User{Email: "test@portal.com"}
 			s.Users().CreateUser(&user)
@@ -85,10 +138,74 @@ func TestMessageHistory(t *testing.T) {
 				assert.Equal(t, "delivered", res.Messages[0].Status)
 			}
 		})
+
+		g.It("Should page backwards and forwards with cursors", func() {
+			user := model.User{Email: "test@portal.com"}
+			s.Users().CreateUser(&user)
+			for i := 1; i <= 5; i++ {
+				s.Messages().CreateMessage(&model.Message{
+					User:      user,
+					To:        "myself",
+					MessageID: fmt.Sprintf("message%d", i),
+					Body:      "hello",
+					Status:    model.MessageStatusDelivered,
+				})
+			}
+			mids := func(res messageHistoryResponse) []string {
+				var result []string
+				for _, m := range res.Messages {
+					result = append(result, m.MessageID)
+				}
+				return result
+			}
+
+			var res messageHistoryResponse
+			w := testGetMessagesQuery(s, &user, "?limit=2")
+			assert.Equal(t, 200, w.Code)
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			assert.Equal(t, []string{"message5", "message4"}, mids(res))
+			assert.NotEmpty(t, res.NextCursor)
+
+			w = testGetMessagesQuery(s, &user, "?limit=2&before="+res.NextCursor)
+			res = messageHistoryResponse{}
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			assert.Equal(t, []string{"message3", "message2"}, mids(res))
+			before := res.NextCursor
+
+			w = testGetMessagesQuery(s, &user, "?limit=2&before="+before)
+			res = messageHistoryResponse{}
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			assert.Equal(t, []string{"message1"}, mids(res))
+			assert.Empty(t, res.NextCursor)
+
+			// Paging forward returns the messages closest to the cursor first
+			w = testGetMessagesQuery(s, &user, "?limit=1&after="+before)
+			res = messageHistoryResponse{}
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			assert.Equal(t, []string{"message3"}, mids(res))
+			w = testGetMessagesQuery(s, &user, "?after="+res.NextCursor)
+			res = messageHistoryResponse{}
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			assert.Equal(t, []string{"message5", "message4"}, mids(res))
+			assert.Empty(t, res.NextCursor)
+		})
+
+		g.It("Should reject invalid cursors and limits", func() {
+			user := model.User{Email: "test@portal.com"}
+			s.Users().CreateUser(&user)
+			for _, query := range []string{"?before=abc", "?after=" + encodeCursor(0), "?limit=0", "?limit=abc", "?before=" + encodeCursor(1) + "&after=" + encodeCursor(1)} {
+				w := testGetMessagesQuery(s, &user, query)
+				assert.Equal(t, 400, w.Code, query)
+			}
+		})
 	})
 }
 
 func testGetMessages(s store.Store, user *model.User) *httptest.ResponseRecorder {
+	return testGetMessagesQuery(s, user, "")
+}
+
+func testGetMessagesQuery(s store.Store, user *model.User, query string) *httptest.ResponseRecorder {
 	r := testutil.TestRouter(middleware.SetStore(s))
 
 	// Set the user context
@@ -101,7 +218,7 @@ func testGetMessages(s store.Store, user *model.User) *httptest.ResponseRecorder
 	w := httptest.NewRecorder()
 
 	// Send the input
-	req, _ := http.NewRequest("GET", "/", nil)
+	req, _ := http.NewRequest("GET", "/"+query, nil)
 	r.ServeHTTP(w, req)
 	return w
 }
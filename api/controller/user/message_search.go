@@ -0,0 +1,113 @@
+package user
+
+import (
+	"net/http"
+	"portal-server/api/controller"
+	"portal-server/api/controller/context"
+	"portal-server/api/errs"
+	"portal-server/model"
+	"portal-server/store"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// messageSearchLimit is the default and maximum number of search results
+const messageSearchLimit = 100
+
+type messageSearchResponse struct {
+	Results    []searchResultBody `json:"results"`
+	NextCursor string             `json:"next_cursor,omitempty"`
+}
+
+type searchResultBody struct {
+	messageBody
+	Snippet string `json:"snippet"`
+}
+
+// SearchMessagesEndpoint searches the bodies of the user's messages, newest
+// first. Results may be filtered by conversation and a from/to range of unix
+// times, and are paged with before cursors like the message history. The
+// server cannot read the bodies of users who opted in to encrypted messages,
+// so they cannot search.
+func SearchMessagesEndpoint(c *gin.Context) {
+	user := context.UserFromContext(c)
+	s := context.StoreFromContext(c)
+	if user.EncryptedMessages {
+		c.JSON(http.StatusConflict, controller.RenderError(errs.ErrSearchUnavailable))
+		return
+	}
+
+	search := store.MessageSearch{Query: strings.TrimSpace(c.Query("q"))}
+	if search.Query == "" {
+		c.JSON(http.StatusBadRequest, controller.RenderError(errs.ErrInvalidSearchQuery))
+		return
+	}
+	page, err := pageFromQuery(c, messageSearchLimit)
+	if err == nil && page.AfterID != 0 {
+		err = errs.ErrInvalidCursor
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, controller.RenderError(err))
+		return
+	}
+	search.BeforeID = page.BeforeID
+	if search.Since, err = timeFromQuery(c, "from"); err != nil {
+		c.JSON(http.StatusBadRequest, controller.RenderError(err))
+		return
+	}
+	if search.Until, err = timeFromQuery(c, "to"); err != nil {
+		c.JSON(http.StatusBadRequest, controller.RenderError(err))
+		return
+	}
+	if id := c.Query("conversation"); id != "" {
+		conversation, found := s.Conversations().FindConversation(&model.Conversation{
+			UserID: user.ID,
+			UUID:   id,
+		})
+		if !found {
+			c.JSON(http.StatusNotFound, controller.RenderError(errs.ErrConversationNotFound))
+			return
+		}
+		search.ConversationID = conversation.ID
+	}
+
+	// Fetch one extra result to tell whether another page follows
+	search.Limit = page.Limit + 1
+	matches, err := s.Messages().SearchMessages(user, search)
+	if err != nil {
+		controller.InternalServiceError(c, err)
+		return
+	}
+	var nextCursor string
+	if len(matches) > page.Limit {
+		matches = matches[:page.Limit]
+		nextCursor = encodeCursor(matches[page.Limit-1].ID)
+	}
+	results := make([]searchResultBody, 0, len(matches))
+	for _, match := range matches {
+		results = append(results, searchResultBody{
+			messageBody: renderMessage(match.Message),
+			Snippet:     match.Snippet,
+		})
+	}
+	c.JSON(http.StatusOK, messageSearchResponse{
+		Results:    results,
+		NextCursor: nextCursor,
+	})
+}
+
+// timeFromQuery reads an optional unix time query parameter.
+func timeFromQuery(c *gin.Context, key string) (time.Time, error) {
+	value := c.Query(key)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, errs.ErrInvalidDateRange
+	}
+	return time.Unix(seconds, 0), nil
+}
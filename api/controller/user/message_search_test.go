@@ -0,0 +1,196 @@
+package user
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"portal-server/api/controller/context"
+	"portal-server/api/middleware"
+	"portal-server/api/testutil"
+	"portal-server/model"
+	"portal-server/store"
+	"testing"
+	"time"
+
+	"github.com/franela/goblin"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageSearch(t *testing.T) {
+	var s store.Store
+	var user model.User
+	g := goblin.Goblin(t)
+
+	createMessage := func(mid, to, body string) {
+		s.Messages().CreateMessage(&model.Message{
+			User:      user,
+			To:        to,
+			MessageID: mid,
+			Body:      body,
+			Status:    model.MessageStatusSent,
+		})
+	}
+	search := func(query string) messageSearchResponse {
+		var res messageSearchResponse
+		w := testSearchMessages(s, &user, query)
+		assert.Equal(t, 200, w.Code)
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+		return res
+	}
+
+	g.Describe("GET /user/messages/search", func() {
+		g.BeforeEach(func() {
+			s = store.GetTestStore()
+			user = model.User{Email: "test@portal.com"}
+			s.Users().CreateUser(&user)
+			createMessage("1", "5551234", "Are we still on for dinner tonight?")
+			createMessage("2", "5550000", "Dinner was great, thanks")
+			createMessage("3", "5551234", "Running late")
+		})
+
+		g.AfterEach(func() {
+			store.TeardownTestStore(s)
+		})
+
+		g.It("Should return matching messages with highlighted snippets", func() {
+			res := search("?q=dinner")
+			assert.Equal(t, 2, len(res.Results))
+			assert.Equal(t, "2", res.Results[0].MessageID)
+			assert.Equal(t, "Dinner was great, thanks", res.Results[0].Body)
+			assert.Contains(t, res.Results[0].Snippet, "<b>Dinner</b>")
+			assert.Equal(t, "1", res.Results[1].MessageID)
+			assert.Empty(t, res.NextCursor)
+
+			// All terms must match
+			res = search("?q=dinner+tonight")
+			assert.Equal(t, 1, len(res.Results))
+			assert.Equal(t, "1", res.Results[0].MessageID)
+		})
+
+		g.It("Should escape message bodies in snippets", func() {
+			createMessage("4", "5551234", `<img src=x onerror="alert(1)"> pizza & wings`)
+			res := search("?q=pizza")
+			assert.Equal(t, 1, len(res.Results))
+			assert.Equal(t, "&lt;img src=x onerror=&#34;alert(1)&#34;&gt; <b>pizza</b> &amp; wings", res.Results[0].Snippet)
+
+			// Markers in a body are not mistaken for matches
+			createMessage("5", "5551234", "burgers \x02later\x03")
+			res = search("?q=burgers")
+			assert.Equal(t, 1, len(res.Results))
+			assert.Equal(t, "burgers later", res.Results[0].Snippet)
+		})
+
+		g.It("Should not return deleted or other users' messages", func() {
+			other := model.User{Email: "other@portal.com"}
+			s.Users().CreateUser(&other)
+			s.Messages().CreateMessage(&model.Message{
+				User:      other,
+				To:        "5551234",
+				MessageID: "4",
+				Body:      "dinner",
+				Status:    model.MessageStatusSent,
+			})
+			s.Messages().DeleteMessages(&model.Message{MessageID: "2"})
+			res := search("?q=dinner")
+			assert.Equal(t, 1, len(res.Results))
+			assert.Equal(t, "1", res.Results[0].MessageID)
+		})
+
+		g.It("Should not match encrypted message bodies", func() {
+			s.Messages().CreateMessage(&model.Message{
+				User:       user,
+				To:         "5551234",
+				MessageID:  "4",
+				Body:       "ZGlubmVyIGlzIHJlYWR5IG5vdw==",
+				Nonce:      "AAECAwQFBgcICQoL",
+				KeyVersion: 1,
+				Status:     model.MessageStatusSent,
+			})
+			res := search("?q=ZGlubmVyIGlzIHJlYWR5IG5vdw")
+			assert.Equal(t, 0, len(res.Results))
+		})
+
+		g.It("Should be unavailable once the user opts in to encrypted messages", func() {
+			user.EncryptedMessages = true
+			s.Users().SaveUser(&user)
+			w := testSearchMessages(s, &user, "?q=dinner")
+			assert.Equal(t, 409, w.Code)
+			assert.JSONEq(t, `{"error":"search_unavailable"}`, w.Body.String())
+		})
+
+		g.It("Should filter by conversation and date range", func() {
+			conversation, _ := s.Conversations().FindConversation(&model.Conversation{Participant: "5550000"})
+			res := search("?q=dinner&conversation=" + conversation.UUID)
+			assert.Equal(t, 1, len(res.Results))
+			assert.Equal(t, "2", res.Results[0].MessageID)
+
+			now := time.Now().Unix()
+			res = search(fmt.Sprintf("?q=dinner&from=%d", now+60))
+			assert.Equal(t, 0, len(res.Results))
+			res = search(fmt.Sprintf("?q=dinner&from=%d&to=%d", now-60, now+60))
+			assert.Equal(t, 2, len(res.Results))
+
+			// Imported messages are dated by the phone that sent them
+			lastWeek := time.Now().Add(-7 * 24 * time.Hour)
+			s.Messages().CreateMessage(&model.Message{
+				User:            user,
+				To:              "5550000",
+				MessageID:       "imported",
+				Body:            "dinner last week",
+				Status:          model.MessageStatusSent,
+				ClientCreatedAt: lastWeek,
+			})
+			res = search(fmt.Sprintf("?q=dinner&from=%d&to=%d", now-60, now+60))
+			assert.Equal(t, 2, len(res.Results))
+			res = search(fmt.Sprintf("?q=dinner&to=%d", lastWeek.Unix()+60))
+			assert.Equal(t, 1, len(res.Results))
+			assert.Equal(t, "imported", res.Results[0].MessageID)
+
+			w := testSearchMessages(s, &user, "?q=dinner&conversation=unknown")
+			assert.Equal(t, 404, w.Code)
+		})
+
+		g.It("Should page through results", func() {
+			res := search("?q=dinner&limit=1")
+			assert.Equal(t, 1, len(res.Results))
+			assert.Equal(t, "2", res.Results[0].MessageID)
+			assert.NotEmpty(t, res.NextCursor)
+
+			res = search("?q=dinner&limit=1&before=" + res.NextCursor)
+			assert.Equal(t, 1, len(res.Results))
+			assert.Equal(t, "1", res.Results[0].MessageID)
+			assert.Empty(t, res.NextCursor)
+		})
+
+		g.It("Should reject invalid queries", func() {
+			for _, query := range []string{"", "?q=", "?q=dinner&from=abc", "?q=dinner&after=" + encodeCursor(1)} {
+				w := testSearchMessages(s, &user, query)
+				assert.Equal(t, 400, w.Code, query)
+			}
+		})
+
+		g.It("Should treat query syntax literally", func() {
+			res := search(`?q=%22dinner+OR+late`)
+			assert.Equal(t, 0, len(res.Results))
+		})
+	})
+}
+
+func testSearchMessages(s store.Store, user *model.User, query string) *httptest.ResponseRecorder {
+	r := testutil.TestRouter(middleware.SetStore(s))
+
+	// Set the user context
+	r.Use(func(c *gin.Context) {
+		context.UserToContext(c, user)
+		c.Next()
+	})
+
+	r.GET("/", SearchMessagesEndpoint)
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequest("GET", "/"+query, nil)
+	r.ServeHTTP(w, req)
+	return w
+}
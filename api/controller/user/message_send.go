@@ -0,0 +1,147 @@
+package user
+
+import (
+	"net/http"
+	"portal-server/api/controller"
+	"portal-server/api/controller/context"
+	"portal-server/api/errs"
+	"portal-server/bus"
+	"portal-server/model"
+	"portal-server/store"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type sendMessage struct {
+	MessageID string           `json:"mid" valid:"required,uuidv4"`
+	To        model.Recipients `json:"to" valid:"required"`
+	Body      string           `json:"body" valid:"required"`
+
+	// Nonce and KeyVersion are sent with encrypted bodies
+	Nonce      string `json:"nonce"`
+	KeyVersion int    `json:"key_version"`
+}
+
+// SendMessageEndpoint queues a message for the user's phone to send. The
+// phone is told to send it through the user's notification group, and then
+// reports its progress like any other message. Sending the same message again
+// returns it unchanged, so that clients may safely retry, and tells the phone
+// again while it has not sent it. Users who opted in to encrypted messages
+// must send the body as ciphertext.
+func SendMessageEndpoint(c *gin.Context) {
+	var body sendMessage
+	if !controller.ValidJSON(c, &body) {
+		return
+	}
+	user := context.UserFromContext(c)
+	s := context.StoreFromContext(c)
+
+	if s.Devices().DeviceCount(&model.Device{
+		UserID: user.ID,
+		Type:   model.DeviceTypePhone,
+		State:  model.DeviceStateLinked,
+	}) == 0 {
+		c.JSON(http.StatusBadRequest, controller.RenderError(errs.ErrNoLinkedPhone))
+		return
+	}
+
+	// Recipients are recorded in E.164 format, so compare retries in it too
+	to := model.E164Addresses(body.To, user.PhoneRegion())
+
+	var message *model.Message
+	created := false
+	s.Transaction(func(store store.Store) error {
+		if existing, found := store.Messages().FindMessageByMessageID(body.MessageID); found {
+			if err := store.Messages().LoadDetails(existing); err != nil {
+				controller.InternalServiceError(c, err)
+				return err
+			}
+			if existing.UserID != user.ID || !sameAddresses(existing.RecipientAddresses(), to) || existing.Body != body.Body || existing.Nonce != body.Nonce {
+				c.JSON(http.StatusConflict, controller.RenderError(errs.ErrMessageConflict))
+				return errs.ErrMessageConflict
+			}
+			message = existing
+			return nil
+		}
+		if _, found := store.ScheduledMessages().FindScheduledMessage(&model.ScheduledMessage{
+			MessageID: body.MessageID,
+		}); found {
+			// Scheduled messages are sent under their own mid when due
+			c.JSON(http.StatusConflict, controller.RenderError(errs.ErrMessageConflict))
+			return errs.ErrMessageConflict
+		}
+		proto := &model.Message{
+			UserID:     user.ID,
+			MessageID:  body.MessageID,
+			Status:     model.MessageStatusQueued,
+			Body:       body.Body,
+			Nonce:      body.Nonce,
+			KeyVersion: body.KeyVersion,
+		}
+		proto.SetRecipients(to)
+		if err := store.EncryptionKeys().CheckEnvelope(user, proto); err != nil {
+			c.JSON(http.StatusBadRequest, controller.RenderError(err))
+			return err
+		}
+		if err := store.Messages().CreateMessage(proto); err != nil {
+			controller.InternalServiceError(c, err)
+			return err
+		}
+		if err := enqueueSend(store, proto); err != nil {
+			controller.InternalServiceError(c, err)
+			return err
+		}
+		message = proto
+		created = true
+		return nil
+	})
+	if message == nil {
+		return
+	}
+
+	// The phone may report back as soon as it is told, so only tell it once
+	// the message is committed. Unsent messages expire and fail, so a retry
+	// tells it again for as long as the message has left, in case it missed
+	// the first notification.
+	ttl := model.QueuedMessageTTL
+	if !created {
+		ttl -= time.Since(message.CreatedAt)
+	}
+	if message.Status == model.MessageStatusQueued && ttl > 0 {
+		if err := notifyDevicesExpiring(c, s, user, notificationSendMessage, renderMessage(*message), ttl); err != nil {
+			c.Error(err)
+		}
+	}
+	if !created {
+		c.JSON(http.StatusOK, renderMessage(*message))
+		return
+	}
+	c.JSON(http.StatusCreated, renderMessage(*message))
+}
+
+// enqueueSend records that a message was queued, and that the phone must
+// send it before it expires.
+func enqueueSend(store store.Store, message *model.Message) error {
+	if err := bus.Enqueue(store, bus.NewMessageRecorded(message)); err != nil {
+		return err
+	}
+	return bus.Enqueue(store, bus.CommandQueued{
+		UserID:    message.UserID,
+		MessageID: message.MessageID,
+		Command:   bus.CommandSend,
+		Expires:   message.CreatedAt.Add(model.QueuedMessageTTL),
+	})
+}
+
+func sameAddresses(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
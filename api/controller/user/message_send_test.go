@@ -0,0 +1,254 @@
+package user
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"portal-server/api/controller"
+	"portal-server/api/controller/context"
+	"portal-server/api/errs"
+	"portal-server/api/middleware"
+	"portal-server/api/testutil"
+	"portal-server/api/util"
+	"portal-server/bus"
+	"portal-server/model"
+	"portal-server/store"
+	"testing"
+	"time"
+
+	"github.com/franela/goblin"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageSend(t *testing.T) {
+	var s store.Store
+	var user model.User
+	g := goblin.Goblin(t)
+
+	g.Describe("POST /user/messages", func() {
+		mid := "2b1d2b8e-5a4f-4c36-9d4a-0c2f2f5a8f11"
+
+		g.BeforeEach(func() {
+			s = store.GetTestStore()
+			user = model.User{Email: "test@portal.com"}
+			s.Users().CreateUser(&user)
+			key := model.NotificationKey{
+				User:      user,
+				GroupName: "group",
+				Key:       "notification_key",
+			}
+			s.NotificationKeys().CreateKey(&key)
+			s.Devices().CreateDevice(&model.Device{
+				User:            user,
+				NotificationKey: key,
+				RegistrationID:  "phone",
+				Type:            model.DeviceTypePhone,
+				State:           model.DeviceStateLinked,
+			})
+		})
+
+		g.AfterEach(func() {
+			store.TeardownTestStore(s)
+		})
+
+		g.It("Should queue the message and tell the phone to send it", func() {
+			notified := false
+			w := testSendMessage(s, &user, `{"mid":"`+mid+`","to":"justin","body":"hello"}`, func(r *http.Request) {
+				body, _ := ioutil.ReadAll(r.Body)
+				var message struct {
+					To         string            `json:"to"`
+					Data       map[string]string `json:"data"`
+					TimeToLive int               `json:"time_to_live"`
+				}
+				json.Unmarshal(body, &message)
+				assert.Equal(t, "notification_key", message.To)
+				assert.Equal(t, notificationSendMessage, message.Data["type"])
+				assert.Equal(t, int(model.QueuedMessageTTL.Seconds()), message.TimeToLive)
+
+				var payload messageBody
+				assert.NoError(t, json.Unmarshal([]byte(message.Data["payload"]), &payload))
+				assert.Equal(t, mid, payload.MessageID)
+				assert.Equal(t, "justin", payload.To)
+				assert.Equal(t, "hello", payload.Body)
+				notified = true
+			})
+			assert.Equal(t, http.StatusCreated, w.Code)
+			assert.True(t, notified)
+
+			var res messageBody
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			assert.Equal(t, mid, res.MessageID)
+			assert.Equal(t, model.MessageStatusQueued, res.Status)
+
+			fromDB, found := s.Messages().FindMessage(&model.Message{UserID: user.ID, MessageID: mid})
+			assert.True(t, found)
+			assert.Equal(t, model.MessageStatusQueued, fromDB.Status)
+			assert.NotZero(t, fromDB.ConversationID)
+
+			queued := enqueuedEvents(s)
+			assert.Len(t, queued, 2)
+			assert.Equal(t, bus.MessageRecorded{
+				UserID:    user.ID,
+				MessageID: mid,
+				Status:    model.MessageStatusQueued,
+				Seq:       fromDB.Seq,
+			}, queued[0])
+			command := queued[1].(bus.CommandQueued)
+			assert.Equal(t, mid, command.MessageID)
+			assert.Equal(t, bus.CommandSend, command.Command)
+			assert.WithinDuration(t, fromDB.CreatedAt.Add(model.QueuedMessageTTL), command.Expires, time.Second)
+		})
+
+		g.It("Should queue a message to several recipients", func() {
+			w := testSendMessage(s, &user, `{"mid":"`+mid+`","to":["justin","5551234"],"body":"hello"}`, func(*http.Request) {})
+			assert.Equal(t, http.StatusCreated, w.Code)
+			var res messageBody
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			assert.Equal(t, []string{"justin", "5551234"}, res.Recipients)
+
+			w = testSendMessage(s, &user, `{"mid":"`+mid+`","to":["justin","5551234"],"body":"hello"}`, func(*http.Request) {})
+			assert.Equal(t, http.StatusOK, w.Code)
+		})
+
+		g.It("Should return a repeated message without queueing it again", func() {
+			body := `{"mid":"` + mid + `","to":"justin","body":"hello"}`
+			testSendMessage(s, &user, body, func(*http.Request) {})
+
+			// The phone may have missed being told while the message is queued
+			notified := false
+			w := testSendMessage(s, &user, body, func(r *http.Request) {
+				var message struct {
+					Data       map[string]string `json:"data"`
+					TimeToLive int               `json:"time_to_live"`
+				}
+				json.NewDecoder(r.Body).Decode(&message)
+				assert.Equal(t, notificationSendMessage, message.Data["type"])
+				assert.True(t, message.TimeToLive > 0)
+				assert.True(t, message.TimeToLive <= int(model.QueuedMessageTTL.Seconds()))
+				notified = true
+			})
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.True(t, notified)
+			var res messageBody
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			assert.Equal(t, mid, res.MessageID)
+			assert.Len(t, enqueuedEvents(s), 2)
+
+			// Once it is sent there is nothing to tell
+			message, _ := s.Messages().FindMessageByMessageID(mid)
+			assert.NoError(t, s.Messages().UpdateMessageStatus(message, model.MessageStatusSent, time.Now()))
+			w = testSendMessage(s, &user, body, func(*http.Request) {
+				t.Fail() // Should not tell the phone to send it again
+			})
+			assert.Equal(t, http.StatusOK, w.Code)
+		})
+
+		g.It("Should reject a conflicting message id", func() {
+			testSendMessage(s, &user, `{"mid":"`+mid+`","to":"justin","body":"hello"}`, func(*http.Request) {})
+
+			w := testSendMessage(s, &user, `{"mid":"`+mid+`","to":"justin","body":"goodbye"}`, func(*http.Request) {})
+			assert.Equal(t, http.StatusConflict, w.Code)
+			var res controller.Error
+			json.Unmarshal(w.Body.Bytes(), &res)
+			assert.Equal(t, errs.ErrMessageConflict.Error(), res.Error)
+
+			fromDB, _ := s.Messages().FindMessage(&model.Message{MessageID: mid})
+			assert.Equal(t, "hello", fromDB.Body)
+		})
+
+		g.It("Should require a linked phone", func() {
+			other := model.User{Email: "other@portal.com"}
+			s.Users().CreateUser(&other)
+
+			w := testSendMessage(s, &other, `{"mid":"`+mid+`","to":"justin","body":"hello"}`, func(*http.Request) {})
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+			var res controller.Error
+			json.Unmarshal(w.Body.Bytes(), &res)
+			assert.Equal(t, errs.ErrNoLinkedPhone.Error(), res.Error)
+
+			_, found := s.Messages().FindMessage(&model.Message{MessageID: mid})
+			assert.False(t, found)
+		})
+
+		g.It("Should queue an encrypted message untouched", func() {
+			s.EncryptionKeys().CreateKey(&model.EncryptionKey{User: user, Version: 1, Current: true, Key: "key"})
+			user.EncryptedMessages = true
+			s.Users().SaveUser(&user)
+
+			body := `{"mid":"` + mid + `","to":"justin","body":"c2VhbGVkIG1lc3NhZ2UgYm9keQ==","nonce":"AAECAwQFBgcICQoL","key_version":1}`
+			w := testSendMessage(s, &user, body, func(*http.Request) {})
+			assert.Equal(t, http.StatusCreated, w.Code)
+			var res messageBody
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			assert.Equal(t, "c2VhbGVkIG1lc3NhZ2UgYm9keQ==", res.Body)
+			assert.Equal(t, "AAECAwQFBgcICQoL", res.Nonce)
+			assert.Equal(t, 1, res.KeyVersion)
+
+			fromDB, _ := s.Messages().FindMessage(&model.Message{MessageID: mid})
+			assert.True(t, fromDB.Encrypted())
+		})
+
+		g.It("Should require encryption once the user opts in", func() {
+			user.EncryptedMessages = true
+			s.Users().SaveUser(&user)
+
+			w := testSendMessage(s, &user, `{"mid":"`+mid+`","to":"justin","body":"hello"}`, func(*http.Request) {
+				t.Fail() // Should not tell the phone to send it
+			})
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+			var res controller.Error
+			json.Unmarshal(w.Body.Bytes(), &res)
+			assert.Equal(t, errs.ErrEncryptionRequired.Error(), res.Error)
+		})
+
+		g.It("Should reject a malformed envelope or unknown key version", func() {
+			s.EncryptionKeys().CreateKey(&model.EncryptionKey{User: user, Version: 1, Current: true, Key: "key"})
+			for _, envelope := range []string{
+				`"body":"hello","nonce":"AAECAwQFBgcICQoL","key_version":1`,
+				`"body":"c2VhbGVkIG1lc3NhZ2UgYm9keQ==","nonce":"AAEC","key_version":1`,
+				`"body":"c2VhbGVkIG1lc3NhZ2UgYm9keQ==","nonce":"AAECAwQFBgcICQoL"`,
+				`"body":"c2VhbGVkIG1lc3NhZ2UgYm9keQ==","nonce":"AAECAwQFBgcICQoL","key_version":2`,
+			} {
+				w := testSendMessage(s, &user, `{"mid":"`+mid+`","to":"justin",`+envelope+`}`, func(*http.Request) {})
+				assert.Equal(t, http.StatusBadRequest, w.Code, envelope)
+				var res controller.Error
+				json.Unmarshal(w.Body.Bytes(), &res)
+				assert.Equal(t, errs.ErrInvalidEnvelope.Error(), res.Error, envelope)
+			}
+		})
+
+		g.It("Should require a valid message id", func() {
+			w := testSendMessage(s, &user, `{"mid":"1","to":"justin","body":"hello"}`, func(*http.Request) {})
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+		})
+	})
+}
+
+func testSendMessage(s store.Store, user *model.User, body string, requestTest func(*http.Request)) *httptest.ResponseRecorder {
+	// Setup mock Google server/client
+	server, client := util.TestHTTP(requestTest, 200, `{"success":1,"failure":0}`)
+	defer server.Close()
+	gcmSendEndpoint = server.URL
+
+	r := testutil.TestRouter(
+		middleware.SetWebClient(client.HTTPClient),
+		middleware.SetStore(s),
+	)
+
+	// Set the user context
+	r.Use(func(c *gin.Context) {
+		context.UserToContext(c, user)
+		c.Next()
+	})
+
+	r.POST("/", SendMessageEndpoint)
+	w := httptest.NewRecorder()
+
+	// Send the input
+	req, _ := http.NewRequest("POST", "/", bytes.NewBufferString(body))
+	r.ServeHTTP(w, req)
+	return w
+}
@@ -14,7 +14,7 @@ import (
 func SyncMessagesEndpoint(c *gin.Context) {
 	user := context.UserFromContext(c)
 	store := context.StoreFromContext(c)
-	messageID := c.Param("mid")
+	messageID := c.Param("since")
 	messages, err := store.Messages().GetMessagesSince(user, messageID)
 	if err == gorm.RecordNotFound {
 		c.JSON(http.StatusNotFound, controller.RenderError(errs.ErrMessageNotFound))
@@ -24,17 +24,12 @@ func SyncMessagesEndpoint(c *gin.Context) {
 		controller.InternalServiceError(c, err)
 		return
 	}
-	messageBodies := make([]messageBody, 0, len(messages))
-	for _, value := range messages {
-		messageBodies = append(messageBodies, messageBody{
-			MessageID: value.MessageID,
-			To:        value.To,
-			Status:    value.Status,
-			Body:      value.Body,
-			At:        value.UpdatedAt.Unix(),
-		})
+	bodies, err := renderNamedMessages(store, user, messages)
+	if err != nil {
+		controller.InternalServiceError(c, err)
+		return
 	}
 	c.JSON(http.StatusOK, messageHistoryResponse{
-		Messages: messageBodies,
+		Messages: bodies,
 	})
 }
@@ -85,6 +85,39 @@ func TestMessageSync(t *testing.T) {
 			assert.Equal(t, "hello", res.Messages[0].Body)
 			assert.Equal(t, "delivered", res.Messages[0].Status)
 			assert.Equal(t, message.UpdatedAt.Unix(), res.Messages[0].At)
+			assert.Nil(t, res.Messages[0].Contacts)
+		})
+
+		g.It("Should name the sender by the user's contacts", func() {
+			user := model.User{Email: "test@portal.com"}
+			s.Users().CreateUser(&user)
+			s.Contacts().CreateContact(&model.Contact{
+				UserID:       user.ID,
+				UUID:         "7c9e6679-7425-40de-944b-e07fc1f90ae7",
+				Name:         "Justin",
+				PhoneNumbers: []model.ContactPhone{{Type: "cell", Number: "(555) 123-4567"}},
+			})
+			for _, mid := range []string{"1", "2"} {
+				s.Messages().CreateMessage(&model.Message{
+					User:      user,
+					From:      "1-555-123-4567",
+					MessageID: mid,
+					Body:      "hello",
+					Status:    model.MessageStatusReceived,
+					Direction: model.MessageDirectionIncoming,
+				})
+			}
+
+			w := testSyncMessages(s, &user, "1")
+			assert.Equal(t, 200, w.Code)
+			var res messageHistoryResponse
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			assert.Equal(t, "+15551234567", res.Messages[0].From)
+			assert.Equal(t, []contactMatch{{
+				Number:    "+15551234567",
+				Name:      "Justin",
+				ContactID: "7c9e6679-7425-40de-944b-e07fc1f90ae7",
+			}}, res.Messages[0].Contacts)
 		})
 	})
 }
@@ -98,7 +131,7 @@ func testSyncMessages(s store.Store, user *model.User, messageID string) *httpte
 		c.Next()
 	})
 
-	r.GET("/:mid", SyncMessagesEndpoint)
+	r.GET("/:since", SyncMessagesEndpoint)
 	w := httptest.NewRecorder()
 
 	// Send the input
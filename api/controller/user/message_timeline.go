@@ -0,0 +1,63 @@
+package user
+
+import (
+	"net/http"
+	"portal-server/api/controller"
+	"portal-server/api/controller/context"
+	"portal-server/api/errs"
+	"portal-server/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+type messageTimelineResponse struct {
+	messageBody
+	Events []statusEventBody `json:"events"`
+}
+
+type statusEventBody struct {
+	Status     string `json:"status"`
+	At         int64  `json:"at"`
+	ReceivedAt int64  `json:"received_at"`
+}
+
+// GetMessageEndpoint retrieves a message with the timeline of its statuses.
+// Each event has the time reported by the client, or 0 if it did not say,
+// and the time the server received it.
+func GetMessageEndpoint(c *gin.Context) {
+	user := context.UserFromContext(c)
+	s := context.StoreFromContext(c)
+	message, found := s.Messages().FindMessage(&model.Message{
+		UserID:    user.ID,
+		MessageID: c.Param("mid"),
+	})
+	if !found {
+		c.JSON(http.StatusNotFound, controller.RenderError(errs.ErrMessageNotFound))
+		return
+	}
+	events, err := s.Messages().GetStatusEvents(message)
+	if err != nil {
+		controller.InternalServiceError(c, err)
+		return
+	}
+	if err := s.Messages().LoadDetails(message); err != nil {
+		controller.InternalServiceError(c, err)
+		return
+	}
+	eventBodies := make([]statusEventBody, 0, len(events))
+	for _, event := range events {
+		var at int64
+		if !event.ClientAt.IsZero() {
+			at = event.ClientAt.Unix()
+		}
+		eventBodies = append(eventBodies, statusEventBody{
+			Status:     event.Status,
+			At:         at,
+			ReceivedAt: event.CreatedAt.Unix(),
+		})
+	}
+	c.JSON(http.StatusOK, messageTimelineResponse{
+		messageBody: renderMessage(*message),
+		Events:      eventBodies,
+	})
+}
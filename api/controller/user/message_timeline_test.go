@@ -0,0 +1,102 @@
+package user
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"portal-server/api/controller/context"
+	"portal-server/api/middleware"
+	"portal-server/api/testutil"
+	"portal-server/model"
+	"portal-server/store"
+	"testing"
+	"time"
+
+	"github.com/franela/goblin"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageTimeline(t *testing.T) {
+	var s store.Store
+	var user model.User
+	g := goblin.Goblin(t)
+	g.Describe("GET /user/messages/:mid", func() {
+		g.BeforeEach(func() {
+			s = store.GetTestStore()
+			user = model.User{Email: "test@portal.com"}
+			s.Users().CreateUser(&user)
+		})
+
+		g.AfterEach(func() {
+			store.TeardownTestStore(s)
+		})
+
+		g.It("Should give a 404 for a non-existent message id", func() {
+			w := testMessageTimeline(s, &user, "bad_mid")
+			assert.Equal(t, 404, w.Code)
+		})
+
+		g.It("Should return the message with its status timeline", func() {
+			message := &model.Message{
+				User:            user,
+				To:              "justin",
+				MessageID:       "1",
+				Body:            "hello",
+				Status:          model.MessageStatusStarted,
+				ClientCreatedAt: time.Unix(1351700000, 0),
+			}
+			s.Messages().CreateMessage(message)
+			s.Messages().UpdateMessageStatus(message, model.MessageStatusSent, time.Unix(1351700010, 0))
+			s.Messages().UpdateMessageStatus(message, model.MessageStatusDelivered, time.Time{})
+
+			w := testMessageTimeline(s, &user, "1")
+			assert.Equal(t, 200, w.Code)
+			var res messageTimelineResponse
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			assert.Equal(t, "1", res.MessageID)
+			assert.Equal(t, model.MessageStatusDelivered, res.Status)
+			assert.Equal(t, int64(1351700000), res.At)
+
+			assert.Equal(t, 3, len(res.Events))
+			assert.Equal(t, model.MessageStatusStarted, res.Events[0].Status)
+			assert.Equal(t, int64(1351700000), res.Events[0].At)
+			assert.Equal(t, model.MessageStatusSent, res.Events[1].Status)
+			assert.Equal(t, int64(1351700010), res.Events[1].At)
+			assert.Equal(t, model.MessageStatusDelivered, res.Events[2].Status)
+			assert.Equal(t, int64(0), res.Events[2].At)
+			assert.NotZero(t, res.Events[2].ReceivedAt)
+		})
+
+		g.It("Should not return another user's message", func() {
+			other := model.User{Email: "other@portal.com"}
+			s.Users().CreateUser(&other)
+			s.Messages().CreateMessage(&model.Message{
+				User:      other,
+				To:        "justin",
+				MessageID: "1",
+				Body:      "hello",
+				Status:    model.MessageStatusStarted,
+			})
+			w := testMessageTimeline(s, &user, "1")
+			assert.Equal(t, 404, w.Code)
+		})
+	})
+}
+
+func testMessageTimeline(s store.Store, user *model.User, messageID string) *httptest.ResponseRecorder {
+	r := testutil.TestRouter(middleware.SetStore(s))
+
+	// Set the user context
+	r.Use(func(c *gin.Context) {
+		context.UserToContext(c, user)
+		c.Next()
+	})
+
+	r.GET("/:mid", GetMessageEndpoint)
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequest("GET", "/"+messageID, nil)
+	r.ServeHTTP(w, req)
+	return w
+}
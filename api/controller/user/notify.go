@@ -0,0 +1,51 @@
+package user
+
+import (
+	"encoding/json"
+	"portal-server/api/controller/context"
+	"portal-server/api/util"
+	"portal-server/model"
+	"portal-server/store"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var gcmSendEndpoint = util.GcmSendEndpoint
+
+// Downstream notification types
+const (
+	notificationKeyRotated        = "key_rotated"
+	notificationDevicePending     = "device_pending"
+	notificationDeviceApproved    = "device_approved"
+	notificationSendMessage       = "send"
+	notificationEncryptionChanged = "encryption_changed"
+	notificationConversationRead  = "conversation_read"
+	notificationDraftChanged      = "draft_changed"
+)
+
+// notifyDevices sends a downstream message to every device in the user's
+// notification group. The message mirrors the upstream format, with a type
+// discriminator and a JSON encoded payload.
+func notifyDevices(c *gin.Context, s store.Store, user *model.User, messageType string, payload interface{}) error {
+	return notifyDevicesExpiring(c, s, user, messageType, payload, 0)
+}
+
+// notifyDevicesExpiring notifies the user's devices with a message that is
+// dropped if it cannot be delivered within ttl.
+func notifyDevicesExpiring(c *gin.Context, s store.Store, user *model.User, messageType string, payload interface{}, ttl time.Duration) error {
+	key, found := s.NotificationKeys().FindKey(&model.NotificationKey{UserID: user.ID})
+	if !found {
+		// No devices have been registered yet
+		return nil
+	}
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	wc := context.WebClientFromContext(c, gcmSendEndpoint)
+	return util.SendExpiringDownstream(wc, key.Key, map[string]string{
+		"type":    messageType,
+		"payload": string(encoded),
+	}, ttl)
+}
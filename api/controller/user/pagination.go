@@ -0,0 +1,63 @@
+package user
+
+import (
+	"encoding/base64"
+	"portal-server/api/errs"
+	"portal-server/store"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// cursorPrefix versions cursors so their encoding can change later
+const cursorPrefix = "m1:"
+
+// encodeCursor returns an opaque cursor for a message row ID.
+func encodeCursor(id uint) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(cursorPrefix + strconv.FormatUint(uint64(id), 10)))
+}
+
+// decodeCursor returns the message row ID of a cursor.
+func decodeCursor(cursor string) (uint, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || !strings.HasPrefix(string(decoded), cursorPrefix) {
+		return 0, errs.ErrInvalidCursor
+	}
+	id, err := strconv.ParseUint(strings.TrimPrefix(string(decoded), cursorPrefix), 10, 32)
+	if err != nil || id == 0 {
+		return 0, errs.ErrInvalidCursor
+	}
+	return uint(id), nil
+}
+
+// pageFromQuery reads the before, after and limit query parameters. The
+// limit defaults to and is capped at maxLimit.
+func pageFromQuery(c *gin.Context, maxLimit int) (store.MessagePage, error) {
+	page := store.MessagePage{Limit: maxLimit}
+	before, after := c.Query("before"), c.Query("after")
+	if before != "" && after != "" {
+		return page, errs.ErrInvalidCursor
+	}
+	var err error
+	if before != "" {
+		if page.BeforeID, err = decodeCursor(before); err != nil {
+			return page, err
+		}
+	}
+	if after != "" {
+		if page.AfterID, err = decodeCursor(after); err != nil {
+			return page, err
+		}
+	}
+	if limit := c.Query("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			return page, errs.ErrInvalidLimit
+		}
+		if n < maxLimit {
+			page.Limit = n
+		}
+	}
+	return page, nil
+}
@@ -0,0 +1,221 @@
+package user
+
+import (
+	"encoding/json"
+	"net/http"
+	"portal-server/api/controller"
+	"portal-server/api/controller/access"
+	"portal-server/api/controller/context"
+	"portal-server/api/errs"
+	"portal-server/api/util"
+	"portal-server/model"
+	"portal-server/pairing"
+	"portal-server/store"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+// Downstream notification sent to a device once its pairing is approved
+const notificationPairingApproved = "pairing_approved"
+
+type startPairing struct {
+	RegistrationID string `json:"registration_id" valid:"required"`
+	Name           string `json:"name" valid:"required"`
+	Type           string `json:"type" valid:"required,matches(^phone$|^chrome$|^desktop$)"`
+	PublicKey      string `json:"public_key" valid:"base64,length(44|44)"`
+}
+
+type startPairingResponse struct {
+	SessionID string `json:"session_id"`
+	Code      string `json:"code"`
+	Secret    string `json:"secret"`
+	QRPayload string `json:"qr_payload"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+type approvePairing struct {
+	SessionID string `json:"session_id"`
+	Code      string `json:"code" valid:"required"`
+}
+
+type approvePairingResponse struct {
+	SessionID string `json:"session_id"`
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+}
+
+type claimPairing struct {
+	Secret string `json:"secret" valid:"required"`
+}
+
+type claimPairingResponse struct {
+	addDeviceResponse
+	UserID    string `json:"user_id"`
+	UserToken string `json:"user_token"`
+}
+
+type pairingPendingResponse struct {
+	State string `json:"state"`
+}
+
+type pairingApprovedPayload struct {
+	SessionID string `json:"session_id"`
+}
+
+// StartPairingEndpoint begins pairing a new device. The returned code and QR
+// payload are shown to the user, who approves them from their phone, while
+// the secret is kept by the device to claim the session.
+func StartPairingEndpoint(c *gin.Context) {
+	var body startPairing
+	if !controller.ValidJSON(c, &body) {
+		return
+	}
+
+	s := context.StoreFromContext(c)
+	session, err := pairing.Start(s, pairing.Device{
+		RegistrationID: body.RegistrationID,
+		Name:           body.Name,
+		Type:           body.Type,
+		PublicKey:      body.PublicKey,
+	})
+	if err != nil {
+		controller.InternalServiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, startPairingResponse{
+		SessionID: session.UUID,
+		Code:      session.Code,
+		Secret:    session.Secret,
+		QRPayload: pairing.QRPayload(session),
+		ExpiresAt: session.ExpiresAt.Unix(),
+	})
+}
+
+// ApprovePairingEndpoint approves a pairing session from one of the user's
+// linked phones, using either the scanned session and code or a typed code.
+// The approving phone is the device making the request.
+func ApprovePairingEndpoint(c *gin.Context) {
+	var body approvePairing
+	if !controller.ValidJSON(c, &body) {
+		return
+	}
+
+	s := context.StoreFromContext(c)
+
+	s.Transaction(func(store store.Store) error {
+		approver, found := context.DeviceFromContext(c)
+		if !found {
+			c.JSON(http.StatusNotFound, controller.RenderError(errs.ErrDeviceNotFound))
+			return errs.ErrDeviceNotFound
+		}
+
+		session, err := pairing.Approve(store, approver, body.SessionID, body.Code)
+		if err != nil {
+			// Keep failed attempts so guessing codes eventually expires the session
+			return renderPairingError(c, err)
+		}
+
+		wc := context.WebClientFromContext(c, gcmSendEndpoint)
+		if err := notifyPairingApproved(wc, session); err != nil {
+			c.Error(err)
+		}
+		c.JSON(http.StatusOK, approvePairingResponse{
+			SessionID: session.UUID,
+			Name:      session.Name,
+			Type:      session.Type,
+		})
+		return nil
+	})
+}
+
+// ClaimPairingEndpoint registers the device of an approved pairing session
+// and signs it in. Until the session is approved it responds with 202 so the
+// device can keep polling.
+func ClaimPairingEndpoint(c *gin.Context) {
+	var body claimPairing
+	if !controller.ValidJSON(c, &body) {
+		return
+	}
+
+	s := context.StoreFromContext(c)
+	wc := context.WebClientFromContext(c, gcmEndpoint)
+
+	s.Transaction(func(store store.Store) error {
+		session, err := pairing.Claim(store, c.Param("session_id"), body.Secret)
+		if err == pairing.ErrNotApproved {
+			c.JSON(http.StatusAccepted, pairingPendingResponse{State: model.PairingStatePending})
+			return nil
+		}
+		if err != nil {
+			// Keep failed attempts so guessing secrets eventually expires the session
+			return renderPairingError(c, err)
+		}
+
+		user, found := store.Users().FindUser(&model.User{Model: gorm.Model{ID: session.UserID}})
+		if !found {
+			c.JSON(http.StatusNotFound, controller.RenderError(pairing.ErrSessionNotFound))
+			return pairing.ErrSessionNotFound
+		}
+
+		// Failing to register rolls back the claim so the device can retry
+		response, err := registerDevice(c, store, wc, user, &addDevice{
+			RegistrationID: session.RegistrationID,
+			Name:           session.Name,
+			Type:           session.Type,
+			PublicKey:      session.PublicKey,
+		})
+		if err != nil {
+			return err
+		}
+
+		userToken, err := access.CreateUserToken(store, user)
+		if err != nil {
+			controller.InternalServiceError(c, err)
+			return err
+		}
+
+		c.JSON(http.StatusOK, claimPairingResponse{
+			addDeviceResponse: *response,
+			UserID:            user.UUID,
+			UserToken:         userToken,
+		})
+		return nil
+	})
+}
+
+// renderPairingError writes the response for an error from the pairing
+// package. Expected failures are rendered as client errors and return nil so
+// that any recorded attempt is kept.
+func renderPairingError(c *gin.Context, err error) error {
+	switch err {
+	case pairing.ErrSessionNotFound:
+		c.JSON(http.StatusNotFound, controller.RenderError(err))
+	case pairing.ErrSessionExpired:
+		c.JSON(http.StatusGone, controller.RenderError(err))
+	case pairing.ErrInvalidCode:
+		c.JSON(http.StatusBadRequest, controller.RenderError(err))
+	case pairing.ErrInvalidSecret, pairing.ErrApproverNotPhone:
+		c.JSON(http.StatusForbidden, controller.RenderError(err))
+	case pairing.ErrAlreadyApproved:
+		c.JSON(http.StatusConflict, controller.RenderError(err))
+	case pairing.ErrTooManyAttempts:
+		c.JSON(http.StatusTooManyRequests, controller.RenderError(err))
+	default:
+		controller.InternalServiceError(c, err)
+		return err
+	}
+	return nil
+}
+
+// notifyPairingApproved tells the waiting device it can claim its session.
+func notifyPairingApproved(wc *util.WebClient, session *model.PairingSession) error {
+	encoded, err := json.Marshal(pairingApprovedPayload{SessionID: session.UUID})
+	if err != nil {
+		return err
+	}
+	return util.SendDownstream(wc, session.RegistrationID, map[string]string{
+		"type":    notificationPairingApproved,
+		"payload": string(encoded),
+	})
+}
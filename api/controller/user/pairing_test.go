@@ -0,0 +1,144 @@
+package user
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"portal-server/api/controller"
+	"portal-server/api/controller/context"
+	"portal-server/api/middleware"
+	"portal-server/api/testutil"
+	"portal-server/api/util"
+	"portal-server/model"
+	"portal-server/pairing"
+	"portal-server/store"
+	"testing"
+
+	"github.com/franela/goblin"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPairingEndpoints(t *testing.T) {
+	var s store.Store
+	var user model.User
+	var phone model.Device
+	g := goblin.Goblin(t)
+
+	g.Describe("Pairing", func() {
+		g.BeforeEach(func() {
+			s = store.GetTestStore()
+			user = model.User{Email: "test@portal.com", UUID: "user"}
+			s.Users().CreateUser(&user)
+			phone = model.Device{
+				User:           user,
+				UUID:           "phone",
+				RegistrationID: "phone_registration",
+				Type:           model.DeviceTypePhone,
+				State:          model.DeviceStateLinked,
+			}
+			s.Devices().CreateDevice(&phone)
+		})
+
+		g.AfterEach(func() {
+			store.TeardownTestStore(s)
+		})
+
+		g.It("Should pair a new device approved from the phone", func() {
+			w := testPairing(s, &user, nil, "/start", startPairing{
+				RegistrationID: "chrome_registration",
+				Name:           "Chrome",
+				Type:           model.DeviceTypeChrome,
+			})
+			assert.Equal(t, http.StatusOK, w.Code)
+			var started startPairingResponse
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &started))
+			assert.NotEmpty(t, started.Code)
+			assert.Contains(t, started.QRPayload, started.SessionID)
+
+			// Claiming before approval asks the device to keep polling
+			w = testPairing(s, &user, nil, "/claim/"+started.SessionID, claimPairing{Secret: started.Secret})
+			assert.Equal(t, http.StatusAccepted, w.Code)
+
+			w = testPairing(s, &user, &phone, "/approve", approvePairing{Code: started.Code})
+			assert.Equal(t, http.StatusOK, w.Code)
+			var approved approvePairingResponse
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &approved))
+			assert.Equal(t, started.SessionID, approved.SessionID)
+			assert.Equal(t, "Chrome", approved.Name)
+
+			w = testPairing(s, &user, nil, "/claim/"+started.SessionID, claimPairing{Secret: started.Secret})
+			assert.Equal(t, http.StatusOK, w.Code)
+			var claimed claimPairingResponse
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &claimed))
+			assert.Equal(t, user.UUID, claimed.UserID)
+			assert.NotEmpty(t, claimed.UserToken)
+			assert.NotEmpty(t, claimed.DeviceID)
+			assert.NotEmpty(t, claimed.EncryptionKey)
+
+			device, found := s.Devices().FindDevice(&model.Device{UUID: claimed.DeviceID})
+			assert.True(t, found)
+			assert.Equal(t, user.ID, device.UserID)
+			assert.Equal(t, "chrome_registration", device.RegistrationID)
+			_, found = s.UserTokens().FindToken(&model.UserToken{Token: claimed.UserToken})
+			assert.True(t, found)
+		})
+
+		g.It("Should reject approvals from unknown devices and wrong codes", func() {
+			// Requests from unknown devices carry none
+			w := testPairing(s, &user, nil, "/approve", approvePairing{Code: "ABCDEFGH"})
+			assert.Equal(t, http.StatusNotFound, w.Code)
+
+			browser := model.Device{User: user, UUID: "browser", RegistrationID: "browser_registration",
+				Type: model.DeviceTypeChrome, State: model.DeviceStateLinked}
+			s.Devices().CreateDevice(&browser)
+			w = testPairing(s, &user, &browser, "/approve", approvePairing{Code: "ABCDEFGH"})
+			assert.Equal(t, http.StatusForbidden, w.Code)
+
+			w = testPairing(s, &user, &phone, "/approve", approvePairing{Code: "ABCDEFGH"})
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+			var res controller.Error
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			assert.Equal(t, pairing.ErrInvalidCode.Error(), res.Error)
+		})
+
+		g.It("Should reject a claim with the wrong secret", func() {
+			session, _ := pairing.Start(s, pairing.Device{RegistrationID: "r", Name: "Chrome", Type: model.DeviceTypeChrome})
+			w := testPairing(s, &user, nil, "/claim/"+session.UUID, claimPairing{Secret: "wrong"})
+			assert.Equal(t, http.StatusForbidden, w.Code)
+
+			fromDB, _ := s.PairingSessions().FindSession(&model.PairingSession{UUID: session.UUID})
+			assert.Equal(t, 1, fromDB.Attempts)
+		})
+	})
+}
+
+func testPairing(s store.Store, user *model.User, device *model.Device, path string, input interface{}) *httptest.ResponseRecorder {
+	// Setup mock Google server/client
+	server, client := util.TestHTTP(func(*http.Request) {}, 200, `{"notification_key":"key","success":1,"failure":0}`)
+	defer server.Close()
+	gcmEndpoint = server.URL
+	gcmSendEndpoint = server.URL
+
+	r := testutil.TestRouter(
+		middleware.SetWebClient(client.HTTPClient),
+		middleware.SetStore(s),
+	)
+
+	r.POST("/start", StartPairingEndpoint)
+	r.POST("/claim/:session_id", ClaimPairingEndpoint)
+	r.POST("/approve", func(c *gin.Context) {
+		context.UserToContext(c, user)
+		if device != nil {
+			context.DeviceToContext(c, device)
+		}
+		ApprovePairingEndpoint(c)
+	})
+	w := httptest.NewRecorder()
+
+	body, _ := json.Marshal(input)
+	req, _ := http.NewRequest("POST", path, bytes.NewBuffer(body))
+	r.ServeHTTP(w, req)
+	return w
+}
@@ -0,0 +1,97 @@
+package user
+
+import (
+	"portal-server/model"
+	"portal-server/store"
+)
+
+// contactMatch names a participant by the user's contact with their number.
+type contactMatch struct {
+	Number    string `json:"number"`
+	Name      string `json:"name"`
+	ContactID string `json:"cid"`
+}
+
+// contactDirectory finds the user's contacts by number. Numbers are matched
+// as they are recorded, in E.164 format where possible.
+type contactDirectory map[string]model.Contact
+
+// findContacts looks up the user's contacts with any of the numbers. When
+// several have the same number, the one added first is used.
+func findContacts(s store.Store, user *model.User, numbers []string) (contactDirectory, error) {
+	seen := make(map[string]bool)
+	var unique []string
+	for _, number := range numbers {
+		if !seen[number] {
+			seen[number] = true
+			unique = append(unique, number)
+		}
+	}
+	contacts, err := s.Contacts().GetContactsByNumbers(user, unique)
+	if err != nil {
+		return nil, err
+	}
+	directory := make(contactDirectory)
+	for _, contact := range contacts {
+		for _, phone := range contact.PhoneNumbers {
+			if _, found := directory[phone.Number]; !found {
+				directory[phone.Number] = contact
+			}
+		}
+	}
+	return directory, nil
+}
+
+// matches names those of the participants who are the user's contacts.
+func (d contactDirectory) matches(participants []string) []contactMatch {
+	var matches []contactMatch
+	for _, number := range participants {
+		if contact, found := d[number]; found {
+			matches = append(matches, contactMatch{
+				Number:    number,
+				Name:      contact.Name,
+				ContactID: contact.UUID,
+			})
+		}
+	}
+	return matches
+}
+
+// renderNamedMessages renders messages with their participants named by the
+// user's contacts.
+func renderNamedMessages(s store.Store, user *model.User, messages []model.Message) ([]messageBody, error) {
+	var numbers []string
+	for _, message := range messages {
+		numbers = append(numbers, message.Participants()...)
+	}
+	directory, err := findContacts(s, user, numbers)
+	if err != nil {
+		return nil, err
+	}
+	bodies := renderMessages(messages)
+	for i := range bodies {
+		bodies[i].Contacts = directory.matches(messages[i].Participants())
+	}
+	return bodies, nil
+}
+
+// renderNamedConversations renders conversations with their participants
+// named by the user's contacts.
+func renderNamedConversations(s store.Store, user *model.User, conversations []model.Conversation) ([]conversationBody, error) {
+	var numbers []string
+	for _, conversation := range conversations {
+		numbers = append(numbers, conversation.Participants()...)
+	}
+	directory, err := findContacts(s, user, numbers)
+	if err != nil {
+		return nil, err
+	}
+	bodies := make([]conversationBody, 0, len(conversations))
+	for _, conversation := range conversations {
+		body := renderConversation(conversation)
+		body.Contacts = directory.matches(conversation.Participants())
+		body.LastMessage.Contacts = directory.matches(conversation.LastMessage.Participants())
+		bodies = append(bodies, body)
+	}
+	return bodies, nil
+}
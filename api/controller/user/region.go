@@ -0,0 +1,48 @@
+package user
+
+import (
+	"net/http"
+	"portal-server/api/controller"
+	"portal-server/api/controller/context"
+	"portal-server/api/errs"
+	"portal-server/model"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+type regionBody struct {
+	// Region is an ISO 3166-1 alpha-2 code, such as US or GB
+	Region string `json:"region" valid:"required"`
+}
+
+// GetRegionEndpoint reports the region the user's phone numbers are
+// normalized for.
+func GetRegionEndpoint(c *gin.Context) {
+	user := context.UserFromContext(c)
+	c.JSON(http.StatusOK, regionBody{Region: user.PhoneRegion()})
+}
+
+// UpdateRegionEndpoint changes the region the user's phone numbers are
+// normalized for. Numbers dialed without a country calling code are written
+// in E.164 format for it as contacts and messages are recorded; those already
+// recorded are left as they are.
+func UpdateRegionEndpoint(c *gin.Context) {
+	var body regionBody
+	if !controller.ValidJSON(c, &body) {
+		return
+	}
+	region := strings.ToUpper(strings.TrimSpace(body.Region))
+	if !model.ValidRegion(region) {
+		c.JSON(http.StatusBadRequest, controller.RenderError(errs.ErrInvalidRegion))
+		return
+	}
+	user := context.UserFromContext(c)
+	s := context.StoreFromContext(c)
+	user.Region = region
+	if err := s.Users().SaveUser(user); err != nil {
+		controller.InternalServiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, regionBody{Region: region})
+}
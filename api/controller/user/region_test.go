@@ -0,0 +1,89 @@
+package user
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"portal-server/api/controller"
+	"portal-server/api/controller/context"
+	"portal-server/api/errs"
+	"portal-server/api/middleware"
+	"portal-server/api/testutil"
+	"portal-server/model"
+	"portal-server/store"
+	"testing"
+
+	"github.com/franela/goblin"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegion(t *testing.T) {
+	var s store.Store
+	var user model.User
+	g := goblin.Goblin(t)
+
+	g.Describe("Region", func() {
+		g.BeforeEach(func() {
+			s = store.GetTestStore()
+			user = model.User{Email: "test@portal.com"}
+			s.Users().CreateUser(&user)
+		})
+
+		g.AfterEach(func() {
+			store.TeardownTestStore(s)
+		})
+
+		g.It("Should default to the US", func() {
+			w := testRegion(s, &user, "GET", "")
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.JSONEq(t, `{"region":"US"}`, w.Body.String())
+		})
+
+		g.It("Should normalize numbers written after the region changes", func() {
+			w := testRegion(s, &user, "PUT", `{"region":"gb"}`)
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.JSONEq(t, `{"region":"GB"}`, w.Body.String())
+
+			saved, _ := s.Users().FindUser(&model.User{Email: user.Email})
+			assert.Equal(t, "GB", saved.Region)
+
+			message := &model.Message{
+				UserID:    user.ID,
+				To:        "07700 900123",
+				MessageID: "1",
+				Body:      "hello",
+				Status:    model.MessageStatusSent,
+			}
+			s.Messages().CreateMessage(message)
+			assert.Equal(t, "+447700900123", message.To)
+		})
+
+		g.It("Should reject an unknown region", func() {
+			w := testRegion(s, &user, "PUT", `{"region":"Narnia"}`)
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+			var res controller.Error
+			json.Unmarshal(w.Body.Bytes(), &res)
+			assert.Equal(t, errs.ErrInvalidRegion.Error(), res.Error)
+		})
+	})
+}
+
+func testRegion(s store.Store, user *model.User, method string, body string) *httptest.ResponseRecorder {
+	r := testutil.TestRouter(middleware.SetStore(s))
+
+	// Set the user context
+	r.Use(func(c *gin.Context) {
+		context.UserToContext(c, user)
+		c.Next()
+	})
+
+	r.GET("/", GetRegionEndpoint)
+	r.PUT("/", UpdateRegionEndpoint)
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequest(method, "/", bytes.NewBufferString(body))
+	r.ServeHTTP(w, req)
+	return w
+}
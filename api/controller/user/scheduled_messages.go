@@ -0,0 +1,253 @@
+package user
+
+import (
+	"net/http"
+	"portal-server/api/controller"
+	"portal-server/api/controller/context"
+	"portal-server/api/errs"
+	"portal-server/bus"
+	"portal-server/model"
+	"portal-server/store"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type scheduleMessage struct {
+	MessageID string           `json:"mid" valid:"required,uuidv4"`
+	To        model.Recipients `json:"to" valid:"required"`
+	Body      string           `json:"body" valid:"required"`
+	SendAt    int64            `json:"send_at" valid:"required"`
+
+	// Nonce and KeyVersion are sent with encrypted bodies
+	Nonce      string `json:"nonce"`
+	KeyVersion int    `json:"key_version"`
+}
+
+type updateScheduledMessage struct {
+	To     model.Recipients `json:"to" valid:"required"`
+	Body   string           `json:"body" valid:"required"`
+	SendAt int64            `json:"send_at" valid:"required"`
+
+	Nonce      string `json:"nonce"`
+	KeyVersion int    `json:"key_version"`
+}
+
+type scheduledMessageBody struct {
+	MessageID     string   `json:"mid"`
+	To            []string `json:"to"`
+	Body          string   `json:"body"`
+	SendAt        int64    `json:"send_at"`
+	Status        string   `json:"status"`
+	FailureReason string   `json:"failure_reason,omitempty"`
+	Nonce         string   `json:"nonce,omitempty"`
+	KeyVersion    int      `json:"key_version,omitempty"`
+}
+
+type scheduledMessagesResponse struct {
+	ScheduledMessages []scheduledMessageBody `json:"scheduled_messages"`
+}
+
+// ScheduleMessageEndpoint schedules a message for the user's phone to send
+// later. When it is due the gcm service queues it like a sent message with the
+// same mid. Scheduling the same message again returns it unchanged, so that
+// clients may safely retry.
+func ScheduleMessageEndpoint(c *gin.Context) {
+	var body scheduleMessage
+	if !controller.ValidJSON(c, &body) {
+		return
+	}
+	user := context.UserFromContext(c)
+	s := context.StoreFromContext(c)
+
+	sendAt := time.Unix(body.SendAt, 0)
+	if !sendAt.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, controller.RenderError(errs.ErrInvalidSendAt))
+		return
+	}
+	if s.Devices().DeviceCount(&model.Device{
+		UserID: user.ID,
+		Type:   model.DeviceTypePhone,
+		State:  model.DeviceStateLinked,
+	}) == 0 {
+		c.JSON(http.StatusBadRequest, controller.RenderError(errs.ErrNoLinkedPhone))
+		return
+	}
+
+	var scheduled *model.ScheduledMessage
+	created := false
+	s.Transaction(func(store store.Store) error {
+		if existing, found := store.ScheduledMessages().FindScheduledMessage(&model.ScheduledMessage{
+			MessageID: body.MessageID,
+		}); found {
+			if existing.UserID != user.ID || !sameAddresses(existing.RecipientAddresses(), body.To) || existing.Body != body.Body || existing.Nonce != body.Nonce || !existing.SendAt.Equal(sendAt) {
+				c.JSON(http.StatusConflict, controller.RenderError(errs.ErrMessageConflict))
+				return errs.ErrMessageConflict
+			}
+			scheduled = existing
+			return nil
+		}
+		if _, found := store.Messages().FindMessageByMessageID(body.MessageID); found {
+			c.JSON(http.StatusConflict, controller.RenderError(errs.ErrMessageConflict))
+			return errs.ErrMessageConflict
+		}
+		proto := &model.ScheduledMessage{
+			UserID:     user.ID,
+			MessageID:  body.MessageID,
+			Body:       body.Body,
+			SendAt:     sendAt,
+			Status:     model.ScheduleStatusPending,
+			Nonce:      body.Nonce,
+			KeyVersion: body.KeyVersion,
+		}
+		proto.SetRecipients(body.To)
+		if err := store.EncryptionKeys().CheckEnvelope(user, proto.Message()); err != nil {
+			c.JSON(http.StatusBadRequest, controller.RenderError(err))
+			return err
+		}
+		if err := store.ScheduledMessages().CreateScheduledMessage(proto); err != nil {
+			controller.InternalServiceError(c, err)
+			return err
+		}
+		if err := enqueueSchedule(store, proto); err != nil {
+			controller.InternalServiceError(c, err)
+			return err
+		}
+		scheduled = proto
+		created = true
+		return nil
+	})
+	if scheduled == nil {
+		return
+	}
+	if created {
+		c.JSON(http.StatusCreated, renderScheduledMessage(*scheduled))
+		return
+	}
+	c.JSON(http.StatusOK, renderScheduledMessage(*scheduled))
+}
+
+// GetScheduledMessagesEndpoint lists the user's scheduled messages, soonest
+// first, including those already dispatched, canceled, or failed.
+func GetScheduledMessagesEndpoint(c *gin.Context) {
+	user := context.UserFromContext(c)
+	s := context.StoreFromContext(c)
+
+	scheduled, err := s.ScheduledMessages().GetScheduledMessages(user)
+	if err != nil {
+		controller.InternalServiceError(c, err)
+		return
+	}
+	bodies := make([]scheduledMessageBody, 0, len(scheduled))
+	for _, value := range scheduled {
+		bodies = append(bodies, renderScheduledMessage(value))
+	}
+	c.JSON(http.StatusOK, scheduledMessagesResponse{ScheduledMessages: bodies})
+}
+
+// UpdateScheduledMessageEndpoint replaces the recipients, body, and time of a
+// scheduled message that is still pending.
+func UpdateScheduledMessageEndpoint(c *gin.Context) {
+	var body updateScheduledMessage
+	if !controller.ValidJSON(c, &body) {
+		return
+	}
+	user := context.UserFromContext(c)
+	s := context.StoreFromContext(c)
+
+	sendAt := time.Unix(body.SendAt, 0)
+	if !sendAt.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, controller.RenderError(errs.ErrInvalidSendAt))
+		return
+	}
+
+	var scheduled *model.ScheduledMessage
+	s.Transaction(func(store store.Store) error {
+		existing, err := findPendingSchedule(c, store, user)
+		if err != nil {
+			return err
+		}
+		existing.SetRecipients(body.To)
+		existing.Body = body.Body
+		existing.SendAt = sendAt
+		existing.Nonce = body.Nonce
+		existing.KeyVersion = body.KeyVersion
+		if err := store.EncryptionKeys().CheckEnvelope(user, existing.Message()); err != nil {
+			c.JSON(http.StatusBadRequest, controller.RenderError(err))
+			return err
+		}
+		if err := store.ScheduledMessages().SaveScheduledMessage(existing); err != nil {
+			controller.InternalServiceError(c, err)
+			return err
+		}
+		if err := enqueueSchedule(store, existing); err != nil {
+			controller.InternalServiceError(c, err)
+			return err
+		}
+		scheduled = existing
+		return nil
+	})
+	if scheduled == nil {
+		return
+	}
+	c.JSON(http.StatusOK, renderScheduledMessage(*scheduled))
+}
+
+// CancelScheduledMessageEndpoint cancels a scheduled message that is still
+// pending. Canceled messages are kept so that every device sees why they were
+// never sent.
+func CancelScheduledMessageEndpoint(c *gin.Context) {
+	user := context.UserFromContext(c)
+	s := context.StoreFromContext(c)
+
+	s.Transaction(func(store store.Store) error {
+		scheduled, err := findPendingSchedule(c, store, user)
+		if err != nil {
+			return err
+		}
+		scheduled.Status = model.ScheduleStatusCanceled
+		if err := store.ScheduledMessages().SaveScheduledMessage(scheduled); err != nil {
+			controller.InternalServiceError(c, err)
+			return err
+		}
+		c.JSON(http.StatusOK, controller.RenderSuccess(true))
+		return nil
+	})
+}
+
+// findPendingSchedule finds and locks the user's scheduled message named by
+// the id parameter, rendering an error unless it is still pending.
+func findPendingSchedule(c *gin.Context, store store.Store, user *model.User) (*model.ScheduledMessage, error) {
+	scheduled, found := store.ScheduledMessages().LockScheduledMessage(c.Param("id"))
+	if !found || scheduled.UserID != user.ID {
+		c.JSON(http.StatusNotFound, controller.RenderError(errs.ErrScheduledMessageNotFound))
+		return nil, errs.ErrScheduledMessageNotFound
+	}
+	if scheduled.Status != model.ScheduleStatusPending {
+		c.JSON(http.StatusConflict, controller.RenderError(errs.ErrScheduleNotPending))
+		return nil, errs.ErrScheduleNotPending
+	}
+	return scheduled, nil
+}
+
+// enqueueSchedule tells the gcm service when a scheduled message is due.
+func enqueueSchedule(store store.Store, scheduled *model.ScheduledMessage) error {
+	return bus.Enqueue(store, bus.MessageScheduled{
+		UserID:    scheduled.UserID,
+		MessageID: scheduled.MessageID,
+		SendAt:    scheduled.SendAt,
+	})
+}
+
+func renderScheduledMessage(scheduled model.ScheduledMessage) scheduledMessageBody {
+	return scheduledMessageBody{
+		MessageID:     scheduled.MessageID,
+		To:            scheduled.RecipientAddresses(),
+		Body:          scheduled.Body,
+		SendAt:        scheduled.SendAt.Unix(),
+		Status:        scheduled.Status,
+		FailureReason: scheduled.FailureReason,
+		Nonce:         scheduled.Nonce,
+		KeyVersion:    scheduled.KeyVersion,
+	}
+}
@@ -0,0 +1,259 @@
+package user
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"portal-server/api/controller"
+	"portal-server/api/controller/context"
+	"portal-server/api/errs"
+	"portal-server/api/middleware"
+	"portal-server/api/testutil"
+	"portal-server/bus"
+	"portal-server/model"
+	"portal-server/store"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/franela/goblin"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScheduledMessages(t *testing.T) {
+	var s store.Store
+	var user model.User
+	g := goblin.Goblin(t)
+
+	mid := "2b1d2b8e-5a4f-4c36-9d4a-0c2f2f5a8f11"
+	sendAt := time.Now().Add(time.Hour).Unix()
+	scheduleBody := func(mid string, body string, sendAt int64) string {
+		return `{"mid":"` + mid + `","to":"justin","body":"` + body + `","send_at":` + strconv.FormatInt(sendAt, 10) + `}`
+	}
+
+	g.Describe("Scheduled messages", func() {
+		g.BeforeEach(func() {
+			s = store.GetTestStore()
+			user = model.User{Email: "test@portal.com"}
+			s.Users().CreateUser(&user)
+			key := model.NotificationKey{
+				User:      user,
+				GroupName: "group",
+				Key:       "notification_key",
+			}
+			s.NotificationKeys().CreateKey(&key)
+			s.Devices().CreateDevice(&model.Device{
+				User:            user,
+				NotificationKey: key,
+				RegistrationID:  "phone",
+				Type:            model.DeviceTypePhone,
+				State:           model.DeviceStateLinked,
+			})
+		})
+
+		g.AfterEach(func() {
+			store.TeardownTestStore(s)
+		})
+
+		g.Describe("POST /user/messages/scheduled", func() {
+			g.It("Should schedule the message without sending it", func() {
+				w := testScheduledMessages(s, &user, "POST", "/", ScheduleMessageEndpoint, scheduleBody(mid, "hello", sendAt))
+				assert.Equal(t, http.StatusCreated, w.Code)
+				var res scheduledMessageBody
+				assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+				assert.Equal(t, mid, res.MessageID)
+				assert.Equal(t, []string{"justin"}, res.To)
+				assert.Equal(t, sendAt, res.SendAt)
+				assert.Equal(t, model.ScheduleStatusPending, res.Status)
+
+				_, found := s.Messages().FindMessageByMessageID(mid)
+				assert.False(t, found)
+
+				queued := enqueuedEvents(s)
+				assert.Len(t, queued, 1)
+				scheduled := queued[0].(bus.MessageScheduled)
+				assert.Equal(t, user.ID, scheduled.UserID)
+				assert.Equal(t, mid, scheduled.MessageID)
+				assert.Equal(t, sendAt, scheduled.SendAt.Unix())
+			})
+
+			g.It("Should return a repeated schedule unchanged", func() {
+				testScheduledMessages(s, &user, "POST", "/", ScheduleMessageEndpoint, scheduleBody(mid, "hello", sendAt))
+
+				w := testScheduledMessages(s, &user, "POST", "/", ScheduleMessageEndpoint, scheduleBody(mid, "hello", sendAt))
+				assert.Equal(t, http.StatusOK, w.Code)
+				assert.Len(t, enqueuedEvents(s), 1)
+			})
+
+			g.It("Should reject a conflicting message id", func() {
+				testScheduledMessages(s, &user, "POST", "/", ScheduleMessageEndpoint, scheduleBody(mid, "hello", sendAt))
+
+				w := testScheduledMessages(s, &user, "POST", "/", ScheduleMessageEndpoint, scheduleBody(mid, "goodbye", sendAt))
+				assert.Equal(t, http.StatusConflict, w.Code)
+				var res controller.Error
+				json.Unmarshal(w.Body.Bytes(), &res)
+				assert.Equal(t, errs.ErrMessageConflict.Error(), res.Error)
+			})
+
+			g.It("Should reject the id of a sent message", func() {
+				testSendMessage(s, &user, `{"mid":"`+mid+`","to":"justin","body":"hello"}`, func(*http.Request) {})
+
+				w := testScheduledMessages(s, &user, "POST", "/", ScheduleMessageEndpoint, scheduleBody(mid, "hello", sendAt))
+				assert.Equal(t, http.StatusConflict, w.Code)
+
+				w = testSendMessage(s, &user, `{"mid":"`+mid+`","to":"justin","body":"hello"}`, func(*http.Request) {})
+				assert.Equal(t, http.StatusOK, w.Code)
+			})
+
+			g.It("Should keep a scheduled message id from being sent now", func() {
+				testScheduledMessages(s, &user, "POST", "/", ScheduleMessageEndpoint, scheduleBody(mid, "hello", sendAt))
+
+				w := testSendMessage(s, &user, `{"mid":"`+mid+`","to":"justin","body":"hello"}`, func(*http.Request) {
+					t.Fail() // Should not tell the phone to send it
+				})
+				assert.Equal(t, http.StatusConflict, w.Code)
+			})
+
+			g.It("Should require a time in the future", func() {
+				w := testScheduledMessages(s, &user, "POST", "/", ScheduleMessageEndpoint, scheduleBody(mid, "hello", time.Now().Add(-time.Minute).Unix()))
+				assert.Equal(t, http.StatusBadRequest, w.Code)
+				var res controller.Error
+				json.Unmarshal(w.Body.Bytes(), &res)
+				assert.Equal(t, errs.ErrInvalidSendAt.Error(), res.Error)
+			})
+
+			g.It("Should require a linked phone", func() {
+				other := model.User{Email: "other@portal.com"}
+				s.Users().CreateUser(&other)
+
+				w := testScheduledMessages(s, &other, "POST", "/", ScheduleMessageEndpoint, scheduleBody(mid, "hello", sendAt))
+				assert.Equal(t, http.StatusBadRequest, w.Code)
+				var res controller.Error
+				json.Unmarshal(w.Body.Bytes(), &res)
+				assert.Equal(t, errs.ErrNoLinkedPhone.Error(), res.Error)
+			})
+
+			g.It("Should require encryption once the user opts in", func() {
+				user.EncryptedMessages = true
+				s.Users().SaveUser(&user)
+
+				w := testScheduledMessages(s, &user, "POST", "/", ScheduleMessageEndpoint, scheduleBody(mid, "hello", sendAt))
+				assert.Equal(t, http.StatusBadRequest, w.Code)
+				var res controller.Error
+				json.Unmarshal(w.Body.Bytes(), &res)
+				assert.Equal(t, errs.ErrEncryptionRequired.Error(), res.Error)
+			})
+		})
+
+		g.Describe("GET /user/messages/scheduled", func() {
+			g.It("Should list scheduled messages soonest first", func() {
+				later := "9c7f7a8e-2d1b-4e6a-8f3c-1a2b3c4d5e6f"
+				testScheduledMessages(s, &user, "POST", "/", ScheduleMessageEndpoint, scheduleBody(later, "later", sendAt+60))
+				testScheduledMessages(s, &user, "POST", "/", ScheduleMessageEndpoint, scheduleBody(mid, "sooner", sendAt))
+
+				w := testScheduledMessages(s, &user, "GET", "/", GetScheduledMessagesEndpoint, "")
+				assert.Equal(t, http.StatusOK, w.Code)
+				var res scheduledMessagesResponse
+				assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+				assert.Len(t, res.ScheduledMessages, 2)
+				assert.Equal(t, "sooner", res.ScheduledMessages[0].Body)
+				assert.Equal(t, "later", res.ScheduledMessages[1].Body)
+			})
+
+			g.It("Should return an empty list", func() {
+				w := testScheduledMessages(s, &user, "GET", "/", GetScheduledMessagesEndpoint, "")
+				assert.Equal(t, http.StatusOK, w.Code)
+				assert.JSONEq(t, `{"scheduled_messages":[]}`, w.Body.String())
+			})
+		})
+
+		g.Describe("PUT /user/messages/scheduled/:id", func() {
+			g.BeforeEach(func() {
+				testScheduledMessages(s, &user, "POST", "/", ScheduleMessageEndpoint, scheduleBody(mid, "hello", sendAt))
+			})
+
+			g.It("Should edit a pending message", func() {
+				w := testScheduledMessages(s, &user, "PUT", "/"+mid, UpdateScheduledMessageEndpoint, `{"to":["justin","5551234"],"body":"goodbye","send_at":`+strconv.FormatInt(sendAt+60, 10)+`}`)
+				assert.Equal(t, http.StatusOK, w.Code)
+				var res scheduledMessageBody
+				assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+				assert.Equal(t, []string{"justin", "5551234"}, res.To)
+				assert.Equal(t, "goodbye", res.Body)
+				assert.Equal(t, sendAt+60, res.SendAt)
+
+				queued := enqueuedEvents(s)
+				assert.Len(t, queued, 2)
+				assert.Equal(t, sendAt+60, queued[1].(bus.MessageScheduled).SendAt.Unix())
+			})
+
+			g.It("Should not edit a message that is no longer pending", func() {
+				scheduled, _ := s.ScheduledMessages().FindScheduledMessage(&model.ScheduledMessage{MessageID: mid})
+				scheduled.Status = model.ScheduleStatusDispatched
+				s.ScheduledMessages().SaveScheduledMessage(scheduled)
+
+				w := testScheduledMessages(s, &user, "PUT", "/"+mid, UpdateScheduledMessageEndpoint, `{"to":"justin","body":"goodbye","send_at":`+strconv.FormatInt(sendAt, 10)+`}`)
+				assert.Equal(t, http.StatusConflict, w.Code)
+				var res controller.Error
+				json.Unmarshal(w.Body.Bytes(), &res)
+				assert.Equal(t, errs.ErrScheduleNotPending.Error(), res.Error)
+			})
+
+			g.It("Should not find another user's message", func() {
+				other := model.User{Email: "other@portal.com"}
+				s.Users().CreateUser(&other)
+
+				w := testScheduledMessages(s, &other, "PUT", "/"+mid, UpdateScheduledMessageEndpoint, `{"to":"justin","body":"goodbye","send_at":`+strconv.FormatInt(sendAt, 10)+`}`)
+				assert.Equal(t, http.StatusNotFound, w.Code)
+				var res controller.Error
+				json.Unmarshal(w.Body.Bytes(), &res)
+				assert.Equal(t, errs.ErrScheduledMessageNotFound.Error(), res.Error)
+			})
+		})
+
+		g.Describe("DELETE /user/messages/scheduled/:id", func() {
+			g.BeforeEach(func() {
+				testScheduledMessages(s, &user, "POST", "/", ScheduleMessageEndpoint, scheduleBody(mid, "hello", sendAt))
+			})
+
+			g.It("Should cancel a pending message", func() {
+				w := testScheduledMessages(s, &user, "DELETE", "/"+mid, CancelScheduledMessageEndpoint, "")
+				assert.Equal(t, http.StatusOK, w.Code)
+
+				scheduled, _ := s.ScheduledMessages().FindScheduledMessage(&model.ScheduledMessage{MessageID: mid})
+				assert.Equal(t, model.ScheduleStatusCanceled, scheduled.Status)
+
+				w = testScheduledMessages(s, &user, "DELETE", "/"+mid, CancelScheduledMessageEndpoint, "")
+				assert.Equal(t, http.StatusConflict, w.Code)
+			})
+
+			g.It("Should not find an unknown message", func() {
+				w := testScheduledMessages(s, &user, "DELETE", "/unknown", CancelScheduledMessageEndpoint, "")
+				assert.Equal(t, http.StatusNotFound, w.Code)
+			})
+		})
+	})
+}
+
+func testScheduledMessages(s store.Store, user *model.User, method string, path string, endpoint gin.HandlerFunc, body string) *httptest.ResponseRecorder {
+	r := testutil.TestRouter(middleware.SetStore(s))
+
+	// Set the user context
+	r.Use(func(c *gin.Context) {
+		context.UserToContext(c, user)
+		c.Next()
+	})
+
+	if path == "/" {
+		r.Handle(method, "/", endpoint)
+	} else {
+		r.Handle(method, "/:id", endpoint)
+	}
+	w := httptest.NewRecorder()
+
+	// Send the input
+	req, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+	r.ServeHTTP(w, req)
+	return w
+}
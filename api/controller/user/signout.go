@@ -4,7 +4,9 @@ import (
 	"net/http"
 	"portal-server/api/controller"
 	"portal-server/api/controller/context"
+	"portal-server/bus"
 	"portal-server/model"
+	"portal-server/store"
 
 	"github.com/gin-gonic/gin"
 )
@@ -32,7 +34,12 @@ func SignoutEndpoint(c *gin.Context) {
 		device, found := s.Devices().FindDevice(&model.Device{UserID: user.ID, UUID: body.DeviceID})
 		if found {
 			device.State = model.DeviceStateUnlinked
-			s.Devices().SaveDevice(device)
+			s.Transaction(func(store store.Store) error {
+				if err := store.Devices().SaveDevice(device); err != nil {
+					return err
+				}
+				return bus.Enqueue(store, bus.DeviceUnlinked{UserID: user.ID, DeviceID: device.UUID})
+			})
 		}
 	}
 
@@ -0,0 +1,214 @@
+package user
+
+import (
+	"encoding/base64"
+	"net/http"
+	"portal-server/api/controller"
+	"portal-server/api/controller/context"
+	"portal-server/api/errs"
+	"portal-server/model"
+	"portal-server/store"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+// maxWrappedKeyLength bounds the size of a base64 encoded wrapped key.
+const maxWrappedKeyLength = 1024
+
+type pendingDeviceListResponse struct {
+	Devices []pendingDevice `json:"devices"`
+}
+
+type pendingDevice struct {
+	DeviceID  string `json:"device_id"`
+	CreatedAt int64  `json:"created_at"`
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	PublicKey string `json:"public_key"`
+}
+
+type uploadWrappedKeys struct {
+	Keys []wrappedKeyBody `json:"keys" valid:"required"`
+}
+
+type wrappedKeyBody struct {
+	Version int    `json:"version"`
+	Key     string `json:"wrapped_key"`
+}
+
+type wrappedKeyListResponse struct {
+	Keys []relayedKey `json:"keys"`
+}
+
+type relayedKey struct {
+	Version         int    `json:"version"`
+	Key             string `json:"wrapped_key"`
+	SenderID        string `json:"sender_id"`
+	SenderPublicKey string `json:"sender_public_key"`
+}
+
+type deviceApprovedPayload struct {
+	DeviceID string `json:"device_id"`
+}
+
+// GetPendingDevicesEndpoint lists linked devices that are waiting for an
+// existing device to wrap the user's content key for them.
+func GetPendingDevicesEndpoint(c *gin.Context) {
+	user := context.UserFromContext(c)
+	s := context.StoreFromContext(c)
+	devices, err := s.Devices().GetPendingDevices(user)
+	if err != nil {
+		controller.InternalServiceError(c, err)
+		return
+	}
+	pendingDevices := make([]pendingDevice, 0, len(devices))
+	for _, value := range devices {
+		pendingDevices = append(pendingDevices, pendingDevice{
+			DeviceID:  value.UUID,
+			CreatedAt: value.CreatedAt.Unix(),
+			Name:      value.Name,
+			Type:      value.Type,
+			PublicKey: value.PublicKey,
+		})
+	}
+	c.JSON(http.StatusOK, pendingDeviceListResponse{
+		Devices: pendingDevices,
+	})
+}
+
+// UploadWrappedKeysEndpoint stores content keys wrapped for the given device
+// by the approved device making the request, approving the given device if it
+// was pending. Keys it already has are not replaced.
+func UploadWrappedKeysEndpoint(c *gin.Context) {
+	var body uploadWrappedKeys
+	if !controller.ValidJSON(c, &body) {
+		return
+	}
+	if !validWrappedKeys(body.Keys) {
+		c.JSON(http.StatusBadRequest, controller.RenderError(errs.ErrInvalidWrappedKeys))
+		return
+	}
+
+	user := context.UserFromContext(c)
+	s := context.StoreFromContext(c)
+	s.Transaction(func(txStore store.Store) error {
+		recipient, found := findLinkedDevice(txStore, user, c.Param("device_id"))
+		if !found {
+			c.JSON(http.StatusNotFound, controller.RenderError(errs.ErrDeviceNotFound))
+			return errs.ErrDeviceNotFound
+		}
+		if recipient.PublicKey == "" {
+			c.JSON(http.StatusBadRequest, controller.RenderError(errs.ErrMissingPublicKey))
+			return errs.ErrMissingPublicKey
+		}
+
+		// Only the device making the request can vouch for the keys it wrapped
+		sender, found := context.DeviceFromContext(c)
+		if !found || sender.KeyState != model.DeviceKeyStateApproved {
+			c.JSON(http.StatusBadRequest, controller.RenderError(errs.ErrDeviceNotApproved))
+			return errs.ErrDeviceNotApproved
+		}
+
+		for _, key := range body.Keys {
+			err := txStore.WrappedKeys().CreateWrappedKey(&model.WrappedKey{
+				UserID:         user.ID,
+				DeviceID:       recipient.ID,
+				SenderDeviceID: sender.ID,
+				Version:        key.Version,
+				Key:            key.Key,
+			})
+			if err == store.ErrWrappedKeyExists {
+				c.JSON(http.StatusConflict, controller.RenderError(errs.ErrWrappedKeyExists))
+				return errs.ErrWrappedKeyExists
+			}
+			if err != nil {
+				controller.InternalServiceError(c, err)
+				return err
+			}
+		}
+
+		if recipient.KeyState == model.DeviceKeyStatePending {
+			recipient.KeyState = model.DeviceKeyStateApproved
+			if err := txStore.Devices().SaveDevice(recipient); err != nil {
+				controller.InternalServiceError(c, err)
+				return err
+			}
+			if err := notifyDevices(c, txStore, user, notificationDeviceApproved, deviceApprovedPayload{
+				DeviceID: recipient.UUID,
+			}); err != nil {
+				c.Error(err)
+			}
+		}
+
+		c.JSON(http.StatusOK, controller.RenderSuccess(true))
+		return nil
+	})
+}
+
+// GetWrappedKeysEndpoint retrieves the content keys wrapped for the given
+// device, along with the public keys of the devices that wrapped them.
+func GetWrappedKeysEndpoint(c *gin.Context) {
+	user := context.UserFromContext(c)
+	s := context.StoreFromContext(c)
+	device, found := findLinkedDevice(s, user, c.Param("device_id"))
+	if !found {
+		c.JSON(http.StatusNotFound, controller.RenderError(errs.ErrDeviceNotFound))
+		return
+	}
+	keys, err := s.WrappedKeys().GetKeysForDevice(device)
+	if err != nil {
+		controller.InternalServiceError(c, err)
+		return
+	}
+
+	senders := make(map[uint]*model.Device)
+	relayedKeys := make([]relayedKey, 0, len(keys))
+	for _, value := range keys {
+		sender, cached := senders[value.SenderDeviceID]
+		if !cached {
+			sender, _ = s.Devices().FindDevice(&model.Device{
+				Model: gorm.Model{ID: value.SenderDeviceID},
+			})
+			senders[value.SenderDeviceID] = sender
+		}
+		if sender == nil {
+			continue
+		}
+		relayedKeys = append(relayedKeys, relayedKey{
+			Version:         value.Version,
+			Key:             value.Key,
+			SenderID:        sender.UUID,
+			SenderPublicKey: sender.PublicKey,
+		})
+	}
+	c.JSON(http.StatusOK, wrappedKeyListResponse{
+		Keys: relayedKeys,
+	})
+}
+
+func findLinkedDevice(store store.Store, user *model.User, deviceID string) (*model.Device, bool) {
+	if deviceID == "" {
+		return nil, false
+	}
+	return store.Devices().FindDevice(&model.Device{
+		UserID: user.ID,
+		UUID:   deviceID,
+		State:  model.DeviceStateLinked,
+	})
+}
+
+func validWrappedKeys(keys []wrappedKeyBody) bool {
+	if len(keys) == 0 {
+		return false
+	}
+	for _, key := range keys {
+		if key.Version < 1 || key.Key == "" || len(key.Key) > maxWrappedKeyLength {
+			return false
+		}
+		if _, err := base64.StdEncoding.DecodeString(key.Key); err != nil {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,197 @@
+package user
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"portal-server/api/controller"
+	"portal-server/api/controller/context"
+	"portal-server/api/errs"
+	"portal-server/api/middleware"
+	"portal-server/api/testutil"
+	"portal-server/api/util"
+	"portal-server/model"
+	"portal-server/store"
+	"testing"
+
+	"github.com/franela/goblin"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	senderPublicKey    = "c2VuZGVyX3B1YmxpY19rZXlfMzJfYnl0ZXNfbG9uZyE="
+	recipientPublicKey = "cmVjaXBpZW50X3B1YmxpY19rZXlfMzJfYnl0ZXNsb25n"
+)
+
+func TestWrappedKeys(t *testing.T) {
+	var s store.Store
+	var user model.User
+	var sender, recipient model.Device
+	g := goblin.Goblin(t)
+
+	g.Describe("Wrapped keys", func() {
+		g.BeforeEach(func() {
+			s = store.GetTestStore()
+			user = model.User{Email: "test@portal.com"}
+			s.Users().CreateUser(&user)
+			sender = model.Device{
+				User:           user,
+				UUID:           "sender",
+				RegistrationID: "1",
+				State:          model.DeviceStateLinked,
+				PublicKey:      senderPublicKey,
+				KeyState:       model.DeviceKeyStateApproved,
+			}
+			s.Devices().CreateDevice(&sender)
+			recipient = model.Device{
+				User:           user,
+				UUID:           "recipient",
+				RegistrationID: "2",
+				State:          model.DeviceStateLinked,
+				PublicKey:      recipientPublicKey,
+				KeyState:       model.DeviceKeyStatePending,
+			}
+			s.Devices().CreateDevice(&recipient)
+		})
+
+		g.AfterEach(func() {
+			store.TeardownTestStore(s)
+		})
+
+		g.It("Should list devices pending approval", func() {
+			w := testWrappedKeys(s, &user, nil, "GET", "/pending", nil)
+			assert.Equal(t, 200, w.Code)
+
+			var res pendingDeviceListResponse
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			assert.Equal(t, 1, len(res.Devices))
+			assert.Equal(t, "recipient", res.Devices[0].DeviceID)
+			assert.Equal(t, recipientPublicKey, res.Devices[0].PublicKey)
+		})
+
+		g.It("Should store wrapped keys and approve the recipient", func() {
+			w := testWrappedKeys(s, &user, &sender, "POST", "/wrapped/recipient", uploadWrappedKeys{
+				Keys: []wrappedKeyBody{
+					{Version: 1, Key: "d3JhcHBlZF8x"},
+					{Version: 2, Key: "d3JhcHBlZF8y"},
+				},
+			})
+			assert.Equal(t, 200, w.Code)
+
+			device, _ := s.Devices().FindDevice(&model.Device{UUID: "recipient"})
+			assert.Equal(t, model.DeviceKeyStateApproved, device.KeyState)
+
+			w = testWrappedKeys(s, &user, nil, "GET", "/wrapped/recipient", nil)
+			assert.Equal(t, 200, w.Code)
+
+			var res wrappedKeyListResponse
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			assert.Equal(t, 2, len(res.Keys))
+			assert.Equal(t, 1, res.Keys[0].Version)
+			assert.Equal(t, "d3JhcHBlZF8x", res.Keys[0].Key)
+			assert.Equal(t, "sender", res.Keys[0].SenderID)
+			assert.Equal(t, senderPublicKey, res.Keys[0].SenderPublicKey)
+			assert.Equal(t, 2, res.Keys[1].Version)
+		})
+
+		g.It("Should not replace a wrapped key uploaded again for the same version", func() {
+			testWrappedKeys(s, &user, &sender, "POST", "/wrapped/recipient", uploadWrappedKeys{
+				Keys: []wrappedKeyBody{{Version: 1, Key: "b2xk"}},
+			})
+			w := testWrappedKeys(s, &user, &sender, "POST", "/wrapped/recipient", uploadWrappedKeys{
+				Keys: []wrappedKeyBody{{Version: 1, Key: "bmV3"}},
+			})
+			assert.Equal(t, 409, w.Code)
+
+			var res controller.Error
+			json.Unmarshal(w.Body.Bytes(), &res)
+			assert.Equal(t, errs.ErrWrappedKeyExists.Error(), res.Error)
+
+			keys, _ := s.WrappedKeys().GetKeysForDevice(&recipient)
+			assert.Equal(t, 1, len(keys))
+			assert.Equal(t, "b2xk", keys[0].Key)
+		})
+
+		g.It("Should not accept wrapped keys from a pending device", func() {
+			w := testWrappedKeys(s, &user, &recipient, "POST", "/wrapped/sender", uploadWrappedKeys{
+				Keys: []wrappedKeyBody{{Version: 1, Key: "d3JhcHBlZA=="}},
+			})
+			assert.Equal(t, 400, w.Code)
+
+			var res controller.Error
+			json.Unmarshal(w.Body.Bytes(), &res)
+			assert.Equal(t, errs.ErrDeviceNotApproved.Error(), res.Error)
+		})
+
+		g.It("Should not accept wrapped keys without the device making the request", func() {
+			w := testWrappedKeys(s, &user, nil, "POST", "/wrapped/recipient", uploadWrappedKeys{
+				Keys: []wrappedKeyBody{{Version: 1, Key: "d3JhcHBlZA=="}},
+			})
+			assert.Equal(t, 400, w.Code)
+
+			var res controller.Error
+			json.Unmarshal(w.Body.Bytes(), &res)
+			assert.Equal(t, errs.ErrDeviceNotApproved.Error(), res.Error)
+
+			device, _ := s.Devices().FindDevice(&model.Device{UUID: "recipient"})
+			assert.Equal(t, model.DeviceKeyStatePending, device.KeyState)
+		})
+
+		g.It("Should not accept malformed wrapped keys", func() {
+			w := testWrappedKeys(s, &user, &sender, "POST", "/wrapped/recipient", uploadWrappedKeys{
+				Keys: []wrappedKeyBody{{Version: 1, Key: "not base64!"}},
+			})
+			assert.Equal(t, 400, w.Code)
+
+			var res controller.Error
+			json.Unmarshal(w.Body.Bytes(), &res)
+			assert.Equal(t, errs.ErrInvalidWrappedKeys.Error(), res.Error)
+		})
+
+		g.It("Should give a 404 for an unknown device", func() {
+			w := testWrappedKeys(s, &user, nil, "GET", "/wrapped/unknown", nil)
+			assert.Equal(t, 404, w.Code)
+
+			var res controller.Error
+			json.Unmarshal(w.Body.Bytes(), &res)
+			assert.Equal(t, errs.ErrDeviceNotFound.Error(), res.Error)
+		})
+	})
+}
+
+func testWrappedKeys(s store.Store, user *model.User, device *model.Device, method, path string, input interface{}) *httptest.ResponseRecorder {
+	// Setup mock Google server/client
+	server, client := util.TestHTTP(func(*http.Request) {}, 200, `{"success":1,"failure":0}`)
+	defer server.Close()
+	gcmSendEndpoint = server.URL
+
+	r := testutil.TestRouter(
+		middleware.SetWebClient(client.HTTPClient),
+		middleware.SetStore(s),
+	)
+
+	// Set the user and device context
+	r.Use(func(c *gin.Context) {
+		context.UserToContext(c, user)
+		if device != nil {
+			context.DeviceToContext(c, device)
+		}
+		c.Next()
+	})
+
+	r.GET("/pending", GetPendingDevicesEndpoint)
+	r.GET("/wrapped/:device_id", GetWrappedKeysEndpoint)
+	r.POST("/wrapped/:device_id", UploadWrappedKeysEndpoint)
+	w := httptest.NewRecorder()
+
+	// Send the input
+	var body []byte
+	if input != nil {
+		body, _ = json.Marshal(input)
+	}
+	req, _ := http.NewRequest(method, path, bytes.NewBuffer(body))
+	r.ServeHTTP(w, req)
+	return w
+}
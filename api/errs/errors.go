@@ -36,6 +36,61 @@ var (
 // Message errors
 var (
 	ErrMessageNotFound = errors.New("message_not_found")
+	ErrInvalidCursor   = errors.New("invalid_cursor")
+	ErrInvalidLimit    = errors.New("invalid_limit")
+	ErrInvalidSequence = errors.New("invalid_sequence")
+	ErrMessageConflict = errors.New("message_conflict")
+	ErrNoLinkedPhone   = errors.New("no_linked_phone")
+
+	ErrInvalidSearchQuery = errors.New("invalid_search_query")
+	ErrInvalidDateRange   = errors.New("invalid_date_range")
+	ErrSearchUnavailable  = errors.New("search_unavailable")
+)
+
+// Encrypted message errors
+var (
+	ErrEncryptionRequired = errors.New("encryption_required")
+	ErrInvalidEnvelope    = errors.New("invalid_envelope")
+)
+
+// Attachment errors
+var (
+	ErrAttachmentNotFound     = errors.New("attachment_not_found")
+	ErrAttachmentTooLarge     = errors.New("attachment_too_large")
+	ErrEmptyAttachment        = errors.New("empty_attachment")
+	ErrUnsupportedContentType = errors.New("unsupported_content_type")
+)
+
+// Conversation errors
+var (
+	ErrConversationNotFound = errors.New("conversation_not_found")
+)
+
+// Scheduled message errors
+var (
+	ErrScheduledMessageNotFound = errors.New("scheduled_message_not_found")
+	ErrInvalidSendAt            = errors.New("invalid_send_at")
+	ErrScheduleNotPending       = errors.New("schedule_not_pending")
+)
+
+// Draft errors
+var (
+	ErrDraftNotFound    = errors.New("draft_not_found")
+	ErrInvalidDraftTime = errors.New("invalid_draft_time")
+	ErrStaleDraft       = errors.New("stale_draft")
+)
+
+// Region errors
+var (
+	ErrInvalidRegion = errors.New("invalid_region")
+)
+
+// Archive errors
+var (
+	ErrInvalidArchiveFormat = errors.New("invalid_archive_format")
+	ErrArchiveTooLarge      = errors.New("archive_too_large")
+	ErrEmptyArchive         = errors.New("empty_archive")
+	ErrImportNotFound       = errors.New("import_not_found")
 )
 
 // GCMError wraps an error from Google regarding GCM registration
@@ -50,5 +105,16 @@ var (
 	ErrInvalidRegistrationToken = errors.New("invalid_registration_token")
 	ErrDuplicateDeviceToken     = errors.New("duplicate_device_token")
 	ErrUnableToRegisterDevice   = errors.New("unable_to_register_device")
+	ErrEmptyNotificationGroup   = errors.New("empty_notification_group")
 	ErrGCMServiceUnavailable    = GCMError("gcm_service_unavailable")
+	ErrPairingRequired          = errors.New("pairing_required")
+)
+
+// Device key errors
+var (
+	ErrDeviceNotFound     = errors.New("device_not_found")
+	ErrMissingPublicKey   = errors.New("missing_public_key")
+	ErrDeviceNotApproved  = errors.New("device_not_approved")
+	ErrInvalidWrappedKeys = errors.New("invalid_wrapped_keys")
+	ErrWrappedKeyExists   = errors.New("wrapped_key_exists")
 )
@@ -18,6 +18,11 @@ const (
 	UserIDHeader    = "X-USER-ID"
 )
 
+// DeviceIDHeader optionally identifies the linked device making an
+// authenticated request, so that its last seen time can be updated and
+// endpoints can act on its behalf.
+const DeviceIDHeader = "X-DEVICE-ID"
+
 // AuthenticationMiddleware handles authentication for protected user
 // endpoints by checking for valid user id and user token headers.
 func AuthenticationMiddleware() gin.HandlerFunc {
@@ -40,6 +45,12 @@ func AuthenticationMiddleware() gin.HandlerFunc {
 			return
 		}
 
+		if deviceUUID := c.Request.Header.Get(DeviceIDHeader); deviceUUID != "" {
+			if device, found := touchDevice(store, user, deviceUUID); found {
+				context.DeviceToContext(c, device)
+			}
+		}
+
 		context.UserToContext(c, user)
 		context.UserTokenToContext(c, userToken)
 		c.Next()
@@ -72,3 +83,15 @@ func authenticate(store store.Store, token, uuid string) (*model.User, *model.Us
 
 	return user, userToken, nil
 }
+
+func touchDevice(store store.Store, user *model.User, uuid string) (*model.Device, bool) {
+	device, found := store.Devices().FindDevice(&model.Device{
+		UserID: user.ID,
+		UUID:   uuid,
+		State:  model.DeviceStateLinked,
+	})
+	if found {
+		store.Devices().TouchDevice(device, time.Now())
+	}
+	return device, found
+}
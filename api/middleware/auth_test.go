@@ -8,6 +8,7 @@ import (
 	"portal-server/model"
 	"portal-server/store"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
@@ -92,3 +93,25 @@ func TestAuthentication_VerifiedUser(t *testing.T) {
 	assert.Equal(t, http.StatusOK, w.Code)
 	assert.Equal(t, expectedResponse, w.Body.String())
 }
+
+func TestAuthentication_TouchesDevice(t *testing.T) {
+	user, _ := authStore.Users().FindUser(&model.User{UUID: "2"})
+	authStore.Devices().CreateDevice(&model.Device{
+		User:           *user,
+		UUID:           "device_2",
+		RegistrationID: "registration_2",
+		State:          model.DeviceStateLinked,
+	})
+	before := time.Now().Add(-time.Second)
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Add("X-USER-ID", "2")
+	req.Header.Add("X-USER-TOKEN", "user_token_2")
+	req.Header.Add("X-DEVICE-ID", "device_2")
+	w := httptest.NewRecorder()
+	auth.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	device, _ := authStore.Devices().FindDevice(&model.Device{UUID: "device_2"})
+	assert.True(t, device.LastSeenAt.After(before))
+}
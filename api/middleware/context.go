@@ -3,6 +3,8 @@ package middleware
 import (
 	"net/http"
 	"portal-server/api/controller/context"
+	"portal-server/blob"
+	"portal-server/events"
 	"portal-server/store"
 
 	"github.com/gin-gonic/gin"
@@ -16,6 +18,23 @@ func SetStore(s store.Store) gin.HandlerFunc {
 	}
 }
 
+// SetBlobStore injects the attachment blob store into every gin context
+func SetBlobStore(blobs blob.BlobStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		context.BlobStoreToContext(c, blobs)
+		c.Next()
+	}
+}
+
+// SetEvents injects the hub delivering events to this process's clients
+// into every gin context
+func SetEvents(hub *events.Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		context.EventHubToContext(c, hub)
+		c.Next()
+	}
+}
+
 // SetWebClient injects an HTTP client into every gin context
 func SetWebClient(client *http.Client) gin.HandlerFunc {
 	return func(c *gin.Context) {
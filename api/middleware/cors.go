@@ -22,6 +22,7 @@ func CORSMiddleware() gin.HandlerFunc {
 			"origin",
 			UserTokenHeader,
 			UserIDHeader,
+			DeviceIDHeader,
 		}
 		c.Writer.Header().Set("Access-Control-Allow-Headers", strings.Join(allowedHeaders, ", "))
 
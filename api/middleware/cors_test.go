@@ -32,6 +32,7 @@ func checkHeaders(t *testing.T, header http.Header) {
 	assert.Contains(t, allowedHeaders, "origin")
 	assert.Contains(t, allowedHeaders, "X-USER-ID")
 	assert.Contains(t, allowedHeaders, "X-USER-TOKEN")
+	assert.Contains(t, allowedHeaders, "X-DEVICE-ID")
 }
 
 func TestCORS_Headers(t *testing.T) {
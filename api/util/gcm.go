@@ -5,8 +5,10 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"portal-server/api/errs"
+	"time"
 )
 
 var (
@@ -14,6 +16,15 @@ var (
 	GcmSenderID = os.Getenv("GCM_SENDER_ID")
 )
 
+// GCM HTTP endpoints for device group management and downstream messages
+const (
+	GcmNotificationEndpoint = "https://android.googleapis.com/gcm/notification"
+	GcmSendEndpoint         = "https://gcm-http.googleapis.com/gcm/send"
+)
+
+// GCM error message for device group operations on an unknown group
+const gcmKeyNotFound = "notification_key not found"
+
 type notificationGroup struct {
 	Operation string   `json:"operation"`
 	KeyName   string   `json:"notification_key_name"`
@@ -26,6 +37,12 @@ type gcmResponse struct {
 	Error string
 }
 
+type downstreamMessage struct {
+	To         string      `json:"to"`
+	Data       interface{} `json:"data"`
+	TimeToLive int         `json:"time_to_live,omitempty"`
+}
+
 // CreateNotificationGroup contacts Google GCM to create a new
 // Cloud Messaging group, based on the given key and registration ID.
 func CreateNotificationGroup(wc *WebClient, keyName, registrationID string) (string, error) {
@@ -41,28 +58,77 @@ func CreateNotificationGroup(wc *WebClient, keyName, registrationID string) (str
 	return res.Key, nil
 }
 
-// AddNotificationGroup contacts Google GCM to add a user device to an
+// AddNotificationGroup contacts Google GCM to add user devices to an
 // existing registration group.
-func AddNotificationGroup(wc *WebClient, keyName, key, registrationID string) error {
+func AddNotificationGroup(wc *WebClient, keyName, key string, registrationIDs ...string) error {
 	data := &notificationGroup{
 		Operation: "add",
 		KeyName:   keyName,
 		Key:       key,
-		Tokens:    []string{registrationID},
+		Tokens:    registrationIDs,
 	}
 	_, err := handleRequest(wc, data)
 	return err
 }
 
+// GetNotificationGroup contacts Google GCM to retrieve the notification key
+// of an existing registration group by its name.
+func GetNotificationGroup(wc *WebClient, keyName string) (string, error) {
+	query := url.Values{"notification_key_name": {keyName}}
+	body, err := request(wc, "GET", wc.BaseURL+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	res, err := parseResponse(body)
+	if err != nil {
+		return "", err
+	}
+	return res.Key, nil
+}
+
+// IsKeyNotFoundError returns true if GCM has no group for a given name or key.
+func IsKeyNotFoundError(err error) bool {
+	return err == errs.GCMError(gcmKeyNotFound)
+}
+
+// SendDownstream contacts Google GCM to send a data message to a device or
+// to every device in a notification group.
+func SendDownstream(wc *WebClient, to string, data interface{}) error {
+	return SendExpiringDownstream(wc, to, data, 0)
+}
+
+// SendExpiringDownstream sends a data message that GCM discards if it cannot
+// be delivered within ttl. A zero ttl keeps the GCM default of four weeks.
+func SendExpiringDownstream(wc *WebClient, to string, data interface{}, ttl time.Duration) error {
+	payload, err := json.Marshal(&downstreamMessage{
+		To:         to,
+		Data:       data,
+		TimeToLive: int(ttl / time.Second),
+	})
+	if err != nil {
+		return err
+	}
+	body, err := request(wc, "POST", wc.BaseURL, payload)
+	if err != nil {
+		return err
+	}
+	_, err = parseResponse(body)
+	return err
+}
+
 func handleRequest(wc *WebClient, data *notificationGroup) (*gcmResponse, error) {
 	payload, err := json.Marshal(data)
 	if err != nil {
 		return nil, err
 	}
-	body, err := request(wc, payload)
+	body, err := request(wc, "POST", wc.BaseURL, payload)
 	if err != nil {
 		return nil, err
 	}
+	return parseResponse(body)
+}
+
+func parseResponse(body []byte) (*gcmResponse, error) {
 	var res gcmResponse
 	if err := json.Unmarshal(body, &res); err != nil {
 		return nil, err
@@ -73,8 +139,11 @@ func handleRequest(wc *WebClient, data *notificationGroup) (*gcmResponse, error)
 	return &res, nil
 }
 
-func request(wc *WebClient, payload []byte) ([]byte, error) {
-	req, err := http.NewRequest("POST", wc.BaseURL, bytes.NewBuffer(payload))
+func request(wc *WebClient, method, endpoint string, payload []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, endpoint, bytes.NewBuffer(payload))
+	if err != nil {
+		return nil, err
+	}
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", "key="+GcmApiKey)
 	req.Header.Set("project_id", GcmSenderID)
@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"portal-server/api/errs"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -141,3 +142,73 @@ func TestGCM_AddNotificationGroup_GoogleError(t *testing.T) {
 	assert.True(t, isGCMError)
 	assert.EqualError(t, err, "gcm_service_unavailable")
 }
+
+func TestGCM_GetNotificationGroup(t *testing.T) {
+	notificationKeyName := "notificationKeyName"
+	requestTest := func(r *http.Request) {
+		assert.Equal(t, "GET", r.Method)
+		assert.Equal(t, "key="+GcmApiKey, r.Header.Get("Authorization"))
+		assert.Equal(t, notificationKeyName, r.URL.Query().Get("notification_key_name"))
+	}
+	mockResponse, _ := json.Marshal(map[string]string{
+		"notification_key": "a_notification_key",
+	})
+
+	server, client := TestHTTP(requestTest, 200, string(mockResponse))
+	defer server.Close()
+
+	notificationKey, err := GetNotificationGroup(client, notificationKeyName)
+	assert.NoError(t, err)
+	assert.Equal(t, "a_notification_key", notificationKey)
+}
+
+func TestGCM_GetNotificationGroup_NotFound(t *testing.T) {
+	mockResponse, _ := json.Marshal(map[string]string{
+		"error": "notification_key not found",
+	})
+
+	server, client := TestHTTP(func(*http.Request) {}, 400, string(mockResponse))
+	defer server.Close()
+
+	_, err := GetNotificationGroup(client, "notificationKeyName")
+	assert.True(t, IsKeyNotFoundError(err))
+}
+
+func TestGCM_SendDownstream(t *testing.T) {
+	requestTest := expectRequest(t, map[string]interface{}{
+		"to": "notificationKey",
+		"data": map[string]string{
+			"type": "a_type",
+		},
+	})
+
+	server, client := TestHTTP(requestTest, 200, `{"success":2,"failure":0}`)
+	defer server.Close()
+
+	err := SendDownstream(client, "notificationKey", map[string]string{"type": "a_type"})
+	assert.NoError(t, err)
+}
+
+func TestGCM_SendExpiringDownstream(t *testing.T) {
+	requestTest := expectRequest(t, map[string]interface{}{
+		"to": "notificationKey",
+		"data": map[string]string{
+			"type": "a_type",
+		},
+		"time_to_live": 600,
+	})
+
+	server, client := TestHTTP(requestTest, 200, `{"success":2,"failure":0}`)
+	defer server.Close()
+
+	err := SendExpiringDownstream(client, "notificationKey", map[string]string{"type": "a_type"}, 10*time.Minute)
+	assert.NoError(t, err)
+}
+
+func TestGCM_SendDownstream_GoogleError(t *testing.T) {
+	server, client := TestHTTP(func(*http.Request) {}, 500, "")
+	defer server.Close()
+
+	err := SendDownstream(client, "notificationKey", map[string]string{"type": "a_type"})
+	assert.EqualError(t, err, "gcm_service_unavailable")
+}
@@ -0,0 +1,91 @@
+package util
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"portal-server/api/errs"
+	"portal-server/model"
+	"portal-server/store"
+)
+
+// NewNotificationGroupName generates a random name for a new GCM
+// notification group.
+func NewNotificationGroupName() (string, error) {
+	bytes := make([]byte, 48)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes), nil
+}
+
+// RecoverNotificationGroup re-syncs a stored notification key with GCM. If GCM
+// still knows the group by name, the stored key is updated to match and every
+// linked device is re-added. If the group is gone, a fresh group is created
+// from the user's linked devices and replaces the stored one. Any extra
+// registration IDs are added to the group as well.
+func RecoverNotificationGroup(s store.Store, wc *WebClient, key *model.NotificationKey, extraIDs ...string) error {
+	registrationIDs, err := groupRegistrationIDs(s, key, extraIDs)
+	if err != nil {
+		return err
+	}
+	if len(registrationIDs) == 0 {
+		return errs.ErrEmptyNotificationGroup
+	}
+
+	current, err := GetNotificationGroup(wc, key.GroupName)
+	if err == nil {
+		if err := AddNotificationGroup(wc, key.GroupName, current, registrationIDs...); err != nil {
+			return err
+		}
+		key.Key = current
+		return s.NotificationKeys().SaveKey(key)
+	}
+	if !IsKeyNotFoundError(err) {
+		return err
+	}
+
+	// The group no longer exists: rebuild it under a new name
+	groupName, err := NewNotificationGroupName()
+	if err != nil {
+		return err
+	}
+	newKey, err := CreateNotificationGroup(wc, groupName, registrationIDs[0])
+	if err != nil {
+		return err
+	}
+	if len(registrationIDs) > 1 {
+		if err := AddNotificationGroup(wc, groupName, newKey, registrationIDs[1:]...); err != nil {
+			return err
+		}
+	}
+	key.GroupName = groupName
+	key.Key = newKey
+	return s.NotificationKeys().SaveKey(key)
+}
+
+func groupRegistrationIDs(s store.Store, key *model.NotificationKey, extraIDs []string) ([]string, error) {
+	user, err := s.NotificationKeys().GetRelatedUser(key)
+	if err != nil {
+		return nil, err
+	}
+	devices, err := s.Devices().GetAllLinkedDevices(user)
+	if err != nil {
+		return nil, err
+	}
+	candidates := make([]string, 0, len(devices)+len(extraIDs))
+	for _, device := range devices {
+		candidates = append(candidates, device.RegistrationID)
+	}
+	candidates = append(candidates, extraIDs...)
+
+	// Remove duplicates, preserving order
+	seen := make(map[string]bool)
+	registrationIDs := make([]string, 0, len(candidates))
+	for _, id := range candidates {
+		if !seen[id] {
+			seen[id] = true
+			registrationIDs = append(registrationIDs, id)
+		}
+	}
+	return registrationIDs, nil
+}
@@ -0,0 +1,139 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"portal-server/model"
+	"portal-server/store"
+	"testing"
+
+	"github.com/franela/goblin"
+	"github.com/stretchr/testify/assert"
+)
+
+// groupServer mocks the GCM device group endpoint, tracking the groups
+// that exist by name.
+type groupServer struct {
+	groups     map[string]string
+	members    map[string][]string
+	operations []string
+}
+
+func (gs *groupServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		gs.operations = append(gs.operations, "get")
+		name := r.URL.Query().Get("notification_key_name")
+		if key, found := gs.groups[name]; found {
+			json.NewEncoder(w).Encode(map[string]string{"notification_key": key})
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": gcmKeyNotFound})
+		return
+	}
+	var data notificationGroup
+	json.NewDecoder(r.Body).Decode(&data)
+	gs.operations = append(gs.operations, data.Operation)
+	switch data.Operation {
+	case "create":
+		key := fmt.Sprintf("key_%d", len(gs.groups)+1)
+		gs.groups[data.KeyName] = key
+		gs.members[key] = data.Tokens
+		json.NewEncoder(w).Encode(map[string]string{"notification_key": key})
+	case "add":
+		if gs.groups[data.KeyName] != data.Key {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": gcmKeyNotFound})
+			return
+		}
+		gs.members[data.Key] = append(gs.members[data.Key], data.Tokens...)
+		json.NewEncoder(w).Encode(map[string]string{"notification_key": data.Key})
+	}
+}
+
+func TestRecoverNotificationGroup(t *testing.T) {
+	var s store.Store
+	var gs *groupServer
+	var server *httptest.Server
+	var client *WebClient
+	var user model.User
+	var key model.NotificationKey
+	g := goblin.Goblin(t)
+
+	g.Describe("RecoverNotificationGroup", func() {
+		g.BeforeEach(func() {
+			s = store.GetTestStore()
+			gs = &groupServer{
+				groups:  make(map[string]string),
+				members: make(map[string][]string),
+			}
+			server = httptest.NewServer(gs)
+			client = &WebClient{server.URL, http.DefaultClient}
+
+			user = model.User{Email: "test@portal.com"}
+			s.Users().CreateUser(&user)
+			key = model.NotificationKey{
+				User:      user,
+				GroupName: "group",
+				Key:       "stale_key",
+			}
+			s.NotificationKeys().CreateKey(&key)
+			s.Devices().CreateDevice(&model.Device{
+				User:            user,
+				NotificationKey: key,
+				UUID:            "1",
+				RegistrationID:  "registration_1",
+				State:           model.DeviceStateLinked,
+			})
+			s.Devices().CreateDevice(&model.Device{
+				User:            user,
+				NotificationKey: key,
+				UUID:            "2",
+				RegistrationID:  "registration_2",
+				State:           model.DeviceStateUnlinked,
+			})
+		})
+
+		g.AfterEach(func() {
+			server.Close()
+			store.TeardownTestStore(s)
+		})
+
+		g.It("Should re-sync the stored key if the group still exists", func() {
+			gs.groups["group"] = "current_key"
+			err := RecoverNotificationGroup(s, client, &key, "registration_3")
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"get", "add"}, gs.operations)
+			assert.Equal(t, []string{"registration_1", "registration_3"}, gs.members["current_key"])
+
+			fromDB, _ := s.NotificationKeys().FindKey(&model.NotificationKey{UserID: user.ID})
+			assert.Equal(t, "group", fromDB.GroupName)
+			assert.Equal(t, "current_key", fromDB.Key)
+		})
+
+		g.It("Should rebuild the group from linked devices if it no longer exists", func() {
+			err := RecoverNotificationGroup(s, client, &key, "registration_3")
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"get", "create", "add"}, gs.operations)
+
+			fromDB, _ := s.NotificationKeys().FindKey(&model.NotificationKey{UserID: user.ID})
+			assert.NotEqual(t, "group", fromDB.GroupName)
+			assert.Equal(t, gs.groups[fromDB.GroupName], fromDB.Key)
+			assert.Equal(t, []string{"registration_1", "registration_3"}, gs.members[fromDB.Key])
+			assert.Equal(t, 1, s.NotificationKeys().GetCount(&model.NotificationKey{UserID: user.ID}))
+		})
+
+		g.It("Should not rebuild a group with no devices", func() {
+			other := model.User{Email: "other@portal.com"}
+			s.Users().CreateUser(&other)
+			otherKey := model.NotificationKey{User: other, GroupName: "other", Key: "other"}
+			s.NotificationKeys().CreateKey(&otherKey)
+
+			err := RecoverNotificationGroup(s, client, &otherKey)
+			assert.Error(t, err)
+			assert.Empty(t, gs.operations)
+		})
+	})
+}
@@ -0,0 +1,142 @@
+// Package archive exports a user's messages to files other messaging apps
+// understand, and imports them back: the XML written by SMS Backup & Restore
+// on Android, and a flat CSV. Large archives are imported by background jobs
+// that report their progress.
+package archive
+
+import (
+	"errors"
+	"io"
+	"portal-server/model"
+	"strings"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+// Formats
+const (
+	FormatXML = "xml"
+	FormatCSV = "csv"
+)
+
+// addressSeparator joins the addresses of group messages, as SMS Backup &
+// Restore does.
+const addressSeparator = "~"
+
+// Errors
+var (
+	ErrUnknownFormat  = errors.New("unknown_archive_format")
+	ErrInvalidArchive = errors.New("invalid_archive")
+	ErrUserNotFound   = errors.New("user_not_found")
+)
+
+// importNamespace derives MessageIDs for imported messages that had none, so
+// that importing the same archive twice yields the same ids.
+var importNamespace = uuid.NewV5(uuid.NamespaceURL, "https://portal.com/archive")
+
+// A Record is a message as it is kept in an archive.
+type Record struct {
+	MessageID string
+	Direction string
+
+	// Addresses are the other parties to the message, starting with the
+	// sender of an incoming message
+	Addresses []string
+	Body      string
+	Status    string
+	Read      bool
+	At        time.Time
+}
+
+// NewRecord archives a message.
+func NewRecord(message model.Message) Record {
+	at := message.ClientCreatedAt
+	if at.IsZero() {
+		at = message.CreatedAt
+	}
+	return Record{
+		MessageID: message.MessageID,
+		Direction: message.Direction,
+		Addresses: message.Participants(),
+		Body:      message.Body,
+		Status:    message.Status,
+		Read:      !message.Unread(),
+		At:        at,
+	}
+}
+
+// Message restores an archived message for the user. Records without a
+// MessageID are given one derived from their content.
+func (r Record) Message(user *model.User) *model.Message {
+	message := &model.Message{
+		UserID:          user.ID,
+		MessageID:       r.MessageID,
+		Direction:       r.Direction,
+		Status:          r.Status,
+		Body:            r.Body,
+		Read:            r.Read || r.Direction == model.MessageDirectionOutgoing,
+		ClientCreatedAt: r.At,
+	}
+	addresses := r.Addresses
+	if r.Direction == model.MessageDirectionIncoming && len(addresses) > 0 {
+		message.From = addresses[0]
+		addresses = addresses[1:]
+	}
+	message.SetRecipients(addresses)
+	if message.MessageID == "" {
+		message.MessageID = uuid.NewV5(importNamespace, user.UUID+message.ContentHash()).String()
+	}
+	return message
+}
+
+// A Writer writes records to an archive. Close must be called to complete it.
+type Writer interface {
+	Write(record Record) error
+	Close() error
+}
+
+// NewWriter starts an archive of count records in a format.
+func NewWriter(format string, w io.Writer, count int) (Writer, error) {
+	switch format {
+	case FormatXML:
+		return newXMLWriter(w, count)
+	case FormatCSV:
+		return newCSVWriter(w)
+	}
+	return nil, ErrUnknownFormat
+}
+
+// Read reads every record in an archive. Messages that were never sent, such
+// as drafts, are left out.
+func Read(format string, r io.Reader) ([]Record, error) {
+	switch format {
+	case FormatXML:
+		return readXML(r)
+	case FormatCSV:
+		return readCSV(r)
+	}
+	return nil, ErrUnknownFormat
+}
+
+// ContentType is the media type of an archive format.
+func ContentType(format string) string {
+	if format == FormatCSV {
+		return "text/csv; charset=utf-8"
+	}
+	return "application/xml; charset=utf-8"
+}
+
+func joinAddresses(addresses []string) string {
+	return strings.Join(addresses, addressSeparator)
+}
+
+func splitAddresses(addresses string) []string {
+	var split []string
+	for _, address := range strings.Split(addresses, addressSeparator) {
+		if address = strings.TrimSpace(address); address != "" {
+			split = append(split, address)
+		}
+	}
+	return split
+}
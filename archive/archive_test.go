@@ -0,0 +1,304 @@
+package archive
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"portal-server/blob"
+	"portal-server/model"
+	"portal-server/store"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/franela/goblin"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+)
+
+const backup = `<?xml version='1.0' encoding='UTF-8' standalone='yes' ?>
+<smses count="6">
+  <sms protocol="0" address="5551234" date="1460000000000" type="1" subject="null" body="hi there" toa="null" sc_toa="null" service_center="null" read="1" status="-1" locked="0" date_sent="1460000000000" readable_date="Apr 7, 2016 3:33:20 AM" contact_name="Justin" />
+  <sms protocol="0" address="5551234" date="1460000060000" type="2" subject="null" body="hello" toa="null" sc_toa="null" service_center="null" read="1" status="0" locked="0" date_sent="0" readable_date="Apr 7, 2016 3:34:20 AM" contact_name="Justin" />
+  <sms protocol="0" address="5551234" date="1460000120000" type="3" subject="null" body="a draft" toa="null" sc_toa="null" service_center="null" read="1" status="-1" locked="0" date_sent="0" readable_date="Apr 7, 2016 3:35:20 AM" contact_name="Justin" />
+  <sms protocol="0" address="5551234" date="1460000180000" type="5" subject="null" body="oops" toa="null" sc_toa="null" service_center="null" read="1" status="64" locked="0" date_sent="0" readable_date="Apr 7, 2016 3:36:20 AM" contact_name="Justin" />
+  <mms date="1460000240000" msg_box="1" address="5551234~5559876" read="0" text_only="1" m_type="132" readable_date="Apr 7, 2016 3:37:20 AM" contact_name="Justin, Ray">
+    <parts>
+      <part seq="-1" ct="application/smil" text="null" />
+      <part seq="0" ct="text/plain" text="group hello" />
+    </parts>
+    <addrs>
+      <addr address="5559876" type="137" charset="106" />
+      <addr address="5551234" type="151" charset="106" />
+    </addrs>
+  </mms>
+  <mms date="1460000300000" msg_box="1" address="5559876" read="1" text_only="0" m_type="132" readable_date="Apr 7, 2016 3:38:20 AM" contact_name="Ray">
+    <parts>
+      <part seq="0" ct="image/jpeg" />
+    </parts>
+    <addrs>
+      <addr address="5559876" type="137" charset="106" />
+    </addrs>
+  </mms>
+</smses>`
+
+func TestArchive(t *testing.T) {
+	g := goblin.Goblin(t)
+
+	g.Describe("XML archives", func() {
+		g.It("Should read sent and received messages from SMS Backup & Restore", func() {
+			records, err := Read(FormatXML, strings.NewReader(backup))
+			assert.NoError(t, err)
+			assert.Len(t, records, 4)
+
+			assert.Equal(t, Record{
+				Direction: model.MessageDirectionIncoming,
+				Addresses: []string{"5551234"},
+				Body:      "hi there",
+				Status:    model.MessageStatusReceived,
+				Read:      true,
+				At:        time.Unix(1460000000, 0),
+			}, records[0])
+			assert.Equal(t, model.MessageDirectionOutgoing, records[1].Direction)
+			assert.Equal(t, model.MessageStatusDelivered, records[1].Status)
+			assert.Equal(t, model.MessageStatusFailed, records[2].Status)
+
+			// The sender of a group message comes first
+			assert.Equal(t, []string{"5559876", "5551234"}, records[3].Addresses)
+			assert.Equal(t, "group hello", records[3].Body)
+			assert.False(t, records[3].Read)
+		})
+
+		g.It("Should write messages that read back the same", func() {
+			records := []Record{
+				{
+					Direction: model.MessageDirectionOutgoing,
+					Addresses: []string{"5551234"},
+					Body:      `<"quoted"> & escaped`,
+					Status:    model.MessageStatusSent,
+					Read:      true,
+					At:        time.Unix(1460000000, 0),
+				},
+				{
+					Direction: model.MessageDirectionIncoming,
+					Addresses: []string{"5559876", "5551234"},
+					Body:      "group hello",
+					Status:    model.MessageStatusReceived,
+					At:        time.Unix(1460000060, 0),
+				},
+				{
+					Direction: model.MessageDirectionOutgoing,
+					Addresses: []string{"5551234", "5559876"},
+					Body:      "group reply",
+					Status:    model.MessageStatusSent,
+					Read:      true,
+					At:        time.Unix(1460000120, 0),
+				},
+			}
+			var buf bytes.Buffer
+			writer, err := NewWriter(FormatXML, &buf, len(records))
+			assert.NoError(t, err)
+			for _, record := range records {
+				assert.NoError(t, writer.Write(record))
+			}
+			assert.NoError(t, writer.Close())
+			assert.Contains(t, buf.String(), `<smses count="3">`)
+
+			read, err := Read(FormatXML, &buf)
+			assert.NoError(t, err)
+			assert.Equal(t, records, read)
+		})
+
+		g.It("Should reject a file that is not a backup", func() {
+			_, err := Read(FormatXML, strings.NewReader("<html><body>hi</body></html>"))
+			assert.Equal(t, ErrInvalidArchive, err)
+			_, err = Read(FormatXML, strings.NewReader(`<smses><sms date="soon"/></smses>`))
+			assert.Equal(t, ErrInvalidArchive, err)
+		})
+	})
+
+	g.Describe("CSV archives", func() {
+		g.It("Should write messages that read back the same", func() {
+			records := []Record{
+				{
+					MessageID: "0c7e5f1a-2b3d-4c5e-8f60-718293a4b5c6",
+					Direction: model.MessageDirectionIncoming,
+					Addresses: []string{"5559876", "5551234"},
+					Body:      "hello, \"you\"\nhow are you?",
+					Status:    model.MessageStatusReceived,
+					At:        time.Unix(1460000000, 0).UTC(),
+				},
+			}
+			var buf bytes.Buffer
+			writer, _ := NewWriter(FormatCSV, &buf, len(records))
+			writer.Write(records[0])
+			assert.NoError(t, writer.Close())
+			assert.True(t, strings.HasPrefix(buf.String(), "mid,date,direction,address,body,status,read\n"))
+
+			read, err := Read(FormatCSV, &buf)
+			assert.NoError(t, err)
+			assert.Equal(t, records, read)
+		})
+
+		g.It("Should read columns by name and default what is left out", func() {
+			records, err := Read(FormatCSV, strings.NewReader("body,address,direction,date\nhi,5551234,outgoing,2016-04-07T03:33:20Z\n"))
+			assert.NoError(t, err)
+			assert.Len(t, records, 1)
+			assert.Equal(t, model.MessageStatusSent, records[0].Status)
+			assert.Equal(t, "", records[0].MessageID)
+		})
+
+		g.It("Should reject rows it cannot read", func() {
+			_, err := Read(FormatCSV, strings.NewReader("date,direction,address,body\nyesterday,outgoing,5551234,hi\n"))
+			assert.Equal(t, ErrInvalidArchive, err)
+			_, err = Read(FormatCSV, strings.NewReader("date,direction,address,body\n2016-04-07T03:33:20Z,sideways,5551234,hi\n"))
+			assert.Equal(t, ErrInvalidArchive, err)
+			_, err = Read(FormatCSV, strings.NewReader("date,body\n"))
+			assert.Equal(t, ErrInvalidArchive, err)
+		})
+
+		g.It("Should reject statuses that do not fit the direction", func() {
+			_, err := Read(FormatCSV, strings.NewReader("date,direction,address,body,status\n2016-04-07T03:33:20Z,incoming,5551234,hi,delivered\n"))
+			assert.Equal(t, ErrInvalidArchive, err)
+			_, err = Read(FormatCSV, strings.NewReader("date,direction,address,body,status\n2016-04-07T03:33:20Z,outgoing,5551234,hi,received\n"))
+			assert.Equal(t, ErrInvalidArchive, err)
+			_, err = Read(FormatCSV, strings.NewReader("date,direction,address,body,status\n2016-04-07T03:33:20Z,outgoing,5551234,hi,lost\n"))
+			assert.Equal(t, ErrInvalidArchive, err)
+		})
+
+		g.It("Should derive mids again for rows with malformed ones", func() {
+			records, err := Read(FormatCSV, strings.NewReader("mid,date,direction,address,body\nnot-a-mid,2016-04-07T03:33:20Z,outgoing,5551234,hi\n"))
+			assert.NoError(t, err)
+			assert.Len(t, records, 1)
+			assert.Equal(t, "", records[0].MessageID)
+		})
+	})
+
+	g.Describe("Formats", func() {
+		g.It("Should refuse an unknown format", func() {
+			_, err := Read("json", strings.NewReader("{}"))
+			assert.Equal(t, ErrUnknownFormat, err)
+			_, err = NewWriter("json", ioutil.Discard, 0)
+			assert.Equal(t, ErrUnknownFormat, err)
+		})
+	})
+}
+
+func TestImport(t *testing.T) {
+	var s store.Store
+	var blobs blob.BlobStore
+	var dir string
+	var user model.User
+	g := goblin.Goblin(t)
+
+	startImport := func(format string, content string) *model.ImportJob {
+		job := &model.ImportJob{
+			UserID: user.ID,
+			UUID:   "6f1c3e52-8a9d-4b7e-9f2a-3c4d5e6f7a8b",
+			Format: format,
+			Status: model.ImportStatusPending,
+		}
+		blobs.Put(Key(job), strings.NewReader(content))
+		s.ImportJobs().CreateImportJob(job)
+		return job
+	}
+
+	g.Describe("Import", func() {
+		g.BeforeEach(func() {
+			s = store.GetTestStore()
+			dir, _ = ioutil.TempDir("", "archive")
+			blobs = &blob.FileStore{Dir: dir}
+			user = model.User{UUID: "1", Email: "test@portal.com"}
+			s.Users().CreateUser(&user)
+		})
+
+		g.AfterEach(func() {
+			store.TeardownTestStore(s)
+			os.RemoveAll(dir)
+		})
+
+		g.It("Should import the messages in an archive and delete it", func() {
+			job := startImport(FormatXML, backup)
+			assert.NoError(t, Import(s, blobs, job))
+			assert.Equal(t, model.ImportStatusCompleted, job.Status)
+			assert.Equal(t, 4, job.Total)
+			assert.Equal(t, 4, job.Processed)
+			assert.Equal(t, 4, job.Imported)
+			assert.Equal(t, 0, job.Skipped)
+
+			saved, _ := s.ImportJobs().FindImportJob(&model.ImportJob{UUID: job.UUID})
+			assert.Equal(t, model.ImportStatusCompleted, saved.Status)
+			assert.Equal(t, 4, saved.Imported)
+			_, err := blobs.Get(Key(job))
+			assert.Equal(t, blob.ErrBlobNotFound, err)
+
+			messages, _ := s.Messages().GetMessagesPage(&user, store.MessagePage{Limit: 10})
+			assert.Len(t, messages, 4)
+			group := messages[0]
+			assert.Equal(t, "group hello", group.Body)
+			assert.Equal(t, "5559876", group.From)
+			assert.Equal(t, []string{"5551234"}, group.RecipientAddresses())
+			assert.True(t, group.Unread())
+			assert.Equal(t, time.Unix(1460000240, 0).Unix(), group.ClientCreatedAt.Unix())
+		})
+
+		g.It("Should skip messages the user already has", func() {
+			s.Messages().CreateMessage(&model.Message{
+				User:            user,
+				MessageID:       "2b1d2b8e-5a4f-4c36-9d4a-0c2f2f5a8f11",
+				Direction:       model.MessageDirectionIncoming,
+				From:            "5551234",
+				Body:            "hi there",
+				Status:          model.MessageStatusReceived,
+				ClientCreatedAt: time.Unix(1460000000, 0),
+			})
+			job := startImport(FormatXML, backup)
+			Import(s, blobs, job)
+			assert.Equal(t, 3, job.Imported)
+			assert.Equal(t, 1, job.Skipped)
+
+			// Importing again finds every message by its derived mid
+			job.ID = 0
+			job.UUID = "0a1b2c3d-4e5f-4a6b-8c7d-9e0f1a2b3c4d"
+			job.Status = model.ImportStatusPending
+			job.Processed, job.Imported, job.Skipped = 0, 0, 0
+			blobs.Put(Key(job), strings.NewReader(backup))
+			s.ImportJobs().CreateImportJob(job)
+			Import(s, blobs, job)
+			assert.Equal(t, 0, job.Imported)
+			assert.Equal(t, 4, job.Skipped)
+		})
+
+		g.It("Should keep newer messages the latest in their conversations", func() {
+			latest := &model.Message{
+				User:            user,
+				MessageID:       "2b1d2b8e-5a4f-4c36-9d4a-0c2f2f5a8f11",
+				To:              "5551234",
+				Body:            "see you soon",
+				Status:          model.MessageStatusSent,
+				ClientCreatedAt: time.Now(),
+			}
+			s.Messages().CreateMessage(latest)
+			Import(s, blobs, startImport(FormatXML, backup))
+
+			conversation, _ := s.Conversations().FindConversation(&model.Conversation{Model: gorm.Model{ID: latest.ConversationID}})
+			assert.Equal(t, latest.ID, conversation.LastMessageID)
+		})
+
+		g.It("Should fail an archive it cannot read", func() {
+			job := startImport(FormatCSV, backup)
+			assert.Equal(t, ErrInvalidArchive, Import(s, blobs, job))
+			saved, _ := s.ImportJobs().FindImportJob(&model.ImportJob{UUID: job.UUID})
+			assert.Equal(t, model.ImportStatusFailed, saved.Status)
+			assert.Equal(t, ErrInvalidArchive.Error(), saved.Error)
+		})
+
+		g.It("Should resume unfinished imports", func() {
+			job := startImport(FormatXML, backup)
+			ResumeImports(s, blobs)
+			saved, _ := s.ImportJobs().FindImportJob(&model.ImportJob{UUID: job.UUID})
+			assert.Equal(t, model.ImportStatusCompleted, saved.Status)
+			assert.Equal(t, 4, saved.Imported)
+		})
+	})
+}
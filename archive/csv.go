@@ -0,0 +1,140 @@
+package archive
+
+import (
+	"encoding/csv"
+	"io"
+	"portal-server/model"
+	"strconv"
+	"time"
+
+	"github.com/asaskevich/govalidator"
+)
+
+// csvHeader names the columns of a CSV archive. Columns are found by name
+// when reading, so they may be reordered, and mid, status and read may be
+// left out.
+var csvHeader = []string{"mid", "date", "direction", "address", "body", "status", "read"}
+
+// csvOutgoingStatuses are the statuses a message the user sent may be
+// archived with. Received messages are only ever received.
+var csvOutgoingStatuses = map[string]bool{
+	model.MessageStatusQueued:    true,
+	model.MessageStatusStarted:   true,
+	model.MessageStatusSent:      true,
+	model.MessageStatusDelivered: true,
+	model.MessageStatusFailed:    true,
+}
+
+type csvWriter struct {
+	writer *csv.Writer
+}
+
+func newCSVWriter(w io.Writer) (Writer, error) {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(csvHeader); err != nil {
+		return nil, err
+	}
+	return csvWriter{writer}, nil
+}
+
+func (w csvWriter) Write(record Record) error {
+	return w.writer.Write([]string{
+		record.MessageID,
+		record.At.UTC().Format(time.RFC3339),
+		record.Direction,
+		joinAddresses(record.Addresses),
+		record.Body,
+		record.Status,
+		strconv.FormatBool(record.Read),
+	})
+}
+
+func (w csvWriter) Close() error {
+	w.writer.Flush()
+	return w.writer.Error()
+}
+
+func readCSV(r io.Reader) ([]Record, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, ErrInvalidArchive
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[name] = i
+	}
+	for _, name := range []string{"date", "direction", "address", "body"} {
+		if _, found := columns[name]; !found {
+			return nil, ErrInvalidArchive
+		}
+	}
+
+	var records []Record
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, ErrInvalidArchive
+		}
+		field := func(name string) string {
+			if i, found := columns[name]; found && i < len(row) {
+				return row[i]
+			}
+			return ""
+		}
+
+		at, err := time.Parse(time.RFC3339, field("date"))
+		if err != nil {
+			return nil, ErrInvalidArchive
+		}
+		record := Record{
+			MessageID: field("mid"),
+			Direction: field("direction"),
+			Addresses: splitAddresses(field("address")),
+			Body:      field("body"),
+			Status:    field("status"),
+			At:        at,
+		}
+		if read := field("read"); read != "" {
+			if record.Read, err = strconv.ParseBool(read); err != nil {
+				return nil, ErrInvalidArchive
+			}
+		}
+		// Mids that clients could not have chosen are derived again, as for
+		// rows without one
+		if !govalidator.IsUUIDv4(record.MessageID) {
+			record.MessageID = ""
+		}
+		switch record.Direction {
+		case model.MessageDirectionIncoming:
+			if record.Status == "" {
+				record.Status = model.MessageStatusReceived
+			}
+			if record.Status != model.MessageStatusReceived {
+				return nil, ErrInvalidArchive
+			}
+		case model.MessageDirectionOutgoing:
+			if record.Status == "" {
+				record.Status = model.MessageStatusSent
+			}
+			if !csvOutgoingStatuses[record.Status] {
+				return nil, ErrInvalidArchive
+			}
+		default:
+			return nil, ErrInvalidArchive
+		}
+		if len(record.Addresses) == 0 {
+			return nil, ErrInvalidArchive
+		}
+		// Messages that were never sent are left out, as in the XML format
+		if record.Status == model.MessageStatusQueued || record.Status == model.MessageStatusStarted {
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
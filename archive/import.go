@@ -0,0 +1,104 @@
+package archive
+
+import (
+	"log"
+	"portal-server/blob"
+	"portal-server/model"
+	"portal-server/store"
+
+	"github.com/jinzhu/gorm"
+)
+
+// importBatch is the most messages imported in one transaction. Progress is
+// saved after each batch, so an interrupted job resumes from the last one.
+const importBatch = 500
+
+// Import runs an import job to completion, importing the messages in its
+// archive that the user does not already have. The job is saved as it
+// progresses and is failed if its archive cannot be read. Its archive is
+// deleted once it finishes.
+func Import(s store.Store, blobs blob.BlobStore, job *model.ImportJob) error {
+	user, found := s.Users().FindUser(&model.User{Model: gorm.Model{ID: job.UserID}})
+	if !found {
+		return finish(s, blobs, job, ErrUserNotFound)
+	}
+	content, err := blobs.Get(Key(job))
+	if err != nil {
+		return finish(s, blobs, job, err)
+	}
+	records, err := Read(job.Format, content)
+	content.Close()
+	if err != nil {
+		return finish(s, blobs, job, err)
+	}
+
+	job.Status = model.ImportStatusRunning
+	job.Total = len(records)
+	if err := s.ImportJobs().SaveImportJob(job); err != nil {
+		return err
+	}
+	for job.Processed < len(records) {
+		end := job.Processed + importBatch
+		if end > len(records) {
+			end = len(records)
+		}
+		messages := make([]*model.Message, 0, end-job.Processed)
+		for _, record := range records[job.Processed:end] {
+			messages = append(messages, record.Message(user))
+		}
+
+		progress := *job
+		s.Transaction(func(store store.Store) error {
+			var imported int
+			if imported, err = store.Messages().ImportMessages(user, messages); err != nil {
+				return err
+			}
+			progress.Imported += imported
+			progress.Skipped += len(messages) - imported
+			progress.Processed = end
+			err = store.ImportJobs().SaveImportJob(&progress)
+			return err
+		})
+		if err != nil {
+			return finish(s, blobs, job, err)
+		}
+		*job = progress
+	}
+	return finish(s, blobs, job, nil)
+}
+
+// Key is where the archive of an import job is kept in the blob store.
+func Key(job *model.ImportJob) string {
+	return "import_" + job.UUID
+}
+
+// ResumeImports runs the import jobs left unfinished, such as by a restart,
+// one after another.
+func ResumeImports(s store.Store, blobs blob.BlobStore) {
+	jobs, err := s.ImportJobs().GetUnfinishedImportJobs()
+	if err != nil {
+		log.Printf("Unable to find unfinished imports: %v\n", err)
+		return
+	}
+	for i := range jobs {
+		if err := Import(s, blobs, &jobs[i]); err != nil {
+			log.Printf("Unable to import %v: %v\n", jobs[i].UUID, err)
+		}
+	}
+}
+
+// finish completes a job, or fails it with an error, and deletes its archive.
+func finish(s store.Store, blobs blob.BlobStore, job *model.ImportJob, cause error) error {
+	job.Status = model.ImportStatusCompleted
+	if cause != nil {
+		job.Status = model.ImportStatusFailed
+		job.Error = cause.Error()
+	}
+	if err := s.ImportJobs().SaveImportJob(job); err != nil {
+		return err
+	}
+	if err := blobs.Delete(Key(job)); err != nil && err != blob.ErrBlobNotFound {
+		log.Printf("Unable to delete the archive of %v: %v\n", job.UUID, err)
+	}
+	return cause
+}
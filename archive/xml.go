@@ -0,0 +1,329 @@
+package archive
+
+import (
+	"encoding/xml"
+	"io"
+	"portal-server/model"
+	"strconv"
+	"time"
+)
+
+// Android message boxes, used as the type of an sms and the msg_box of an
+// mms. Drafts, the outbox and queued messages were never sent.
+const (
+	boxInbox  = 1
+	boxSent   = 2
+	boxDraft  = 3
+	boxOutbox = 4
+	boxFailed = 5
+	boxQueued = 6
+)
+
+// Android sms statuses
+const (
+	smsStatusNone     = -1
+	smsStatusComplete = 0
+	smsStatusPending  = 32
+	smsStatusFailed   = 64
+)
+
+// Android mms address types, and the placeholder standing in for the user's
+// own number
+const (
+	mmsAddrFrom  = 137
+	mmsAddrTo    = 151
+	mmsAddrSelf  = "insert-address-token"
+	mmsCharset   = 106
+	mmsRetrieved = 132
+	mmsSendReq   = 128
+)
+
+const (
+	readableDate = "Jan 2, 2006 3:04:05 PM"
+	unknownName  = "(Unknown)"
+)
+
+// smsElement is a message with a single other party.
+type smsElement struct {
+	XMLName       xml.Name `xml:"sms"`
+	Protocol      int      `xml:"protocol,attr"`
+	Address       string   `xml:"address,attr"`
+	Date          int64    `xml:"date,attr"`
+	Type          int      `xml:"type,attr"`
+	Subject       string   `xml:"subject,attr"`
+	Body          string   `xml:"body,attr"`
+	TOA           string   `xml:"toa,attr"`
+	SCTOA         string   `xml:"sc_toa,attr"`
+	ServiceCenter string   `xml:"service_center,attr"`
+	Read          int      `xml:"read,attr"`
+	Status        int      `xml:"status,attr"`
+	Locked        int      `xml:"locked,attr"`
+	DateSent      int64    `xml:"date_sent,attr"`
+	ReadableDate  string   `xml:"readable_date,attr"`
+	ContactName   string   `xml:"contact_name,attr"`
+}
+
+// mmsElement is a group message, with its text in a part and every party in
+// its addresses.
+type mmsElement struct {
+	XMLName      xml.Name  `xml:"mms"`
+	Date         int64     `xml:"date,attr"`
+	MessageBox   int       `xml:"msg_box,attr"`
+	Address      string    `xml:"address,attr"`
+	Read         int       `xml:"read,attr"`
+	TextOnly     int       `xml:"text_only,attr"`
+	MessageType  int       `xml:"m_type,attr"`
+	ReadableDate string    `xml:"readable_date,attr"`
+	ContactName  string    `xml:"contact_name,attr"`
+	Parts        []mmsPart `xml:"parts>part"`
+	Addrs        []mmsAddr `xml:"addrs>addr"`
+}
+
+type mmsPart struct {
+	Seq         int    `xml:"seq,attr"`
+	ContentType string `xml:"ct,attr"`
+	Text        string `xml:"text,attr"`
+}
+
+type mmsAddr struct {
+	Address string `xml:"address,attr"`
+	Type    int    `xml:"type,attr"`
+	Charset int    `xml:"charset,attr"`
+}
+
+type xmlWriter struct {
+	encoder *xml.Encoder
+}
+
+func newXMLWriter(w io.Writer, count int) (Writer, error) {
+	if _, err := io.WriteString(w, "<?xml version='1.0' encoding='UTF-8' standalone='yes' ?>\n"); err != nil {
+		return nil, err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.EncodeToken(xml.StartElement{
+		Name: xml.Name{Local: "smses"},
+		Attr: []xml.Attr{{Name: xml.Name{Local: "count"}, Value: strconv.Itoa(count)}},
+	}); err != nil {
+		return nil, err
+	}
+	return xmlWriter{encoder}, nil
+}
+
+func (w xmlWriter) Write(record Record) error {
+	box := messageBox(record)
+	read := 0
+	if record.Read {
+		read = 1
+	}
+	date := record.At.UnixNano() / int64(time.Millisecond)
+	readable := record.At.UTC().Format(readableDate)
+	if len(record.Addresses) <= 1 {
+		var address string
+		if len(record.Addresses) == 1 {
+			address = record.Addresses[0]
+		}
+		return w.encoder.Encode(smsElement{
+			Address:       address,
+			Date:          date,
+			Type:          box,
+			Subject:       "null",
+			Body:          record.Body,
+			TOA:           "null",
+			SCTOA:         "null",
+			ServiceCenter: "null",
+			Read:          read,
+			Status:        smsStatus(record.Status),
+			DateSent:      date,
+			ReadableDate:  readable,
+			ContactName:   unknownName,
+		})
+	}
+
+	messageType, addrs := mmsSendReq, []mmsAddr{{Address: mmsAddrSelf, Type: mmsAddrFrom, Charset: mmsCharset}}
+	recipients := record.Addresses
+	if record.Direction == model.MessageDirectionIncoming {
+		messageType = mmsRetrieved
+		addrs = []mmsAddr{{Address: record.Addresses[0], Type: mmsAddrFrom, Charset: mmsCharset}}
+		recipients = record.Addresses[1:]
+	}
+	for _, address := range recipients {
+		addrs = append(addrs, mmsAddr{Address: address, Type: mmsAddrTo, Charset: mmsCharset})
+	}
+	return w.encoder.Encode(mmsElement{
+		Date:         date,
+		MessageBox:   box,
+		Address:      joinAddresses(record.Addresses),
+		Read:         read,
+		TextOnly:     1,
+		MessageType:  messageType,
+		ReadableDate: readable,
+		ContactName:  unknownName,
+		Parts:        []mmsPart{{ContentType: "text/plain", Text: record.Body}},
+		Addrs:        addrs,
+	})
+}
+
+func (w xmlWriter) Close() error {
+	if err := w.encoder.EncodeToken(xml.EndElement{Name: xml.Name{Local: "smses"}}); err != nil {
+		return err
+	}
+	return w.encoder.Flush()
+}
+
+func readXML(r io.Reader) ([]Record, error) {
+	decoder := xml.NewDecoder(r)
+	var (
+		records []Record
+		root    bool
+	)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, ErrInvalidArchive
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch start.Name.Local {
+		case "smses":
+			root = true
+		case "sms":
+			var sms smsElement
+			if err := decoder.DecodeElement(&sms, &start); err != nil {
+				return nil, ErrInvalidArchive
+			}
+			if record, ok := sms.record(); ok {
+				records = append(records, record)
+			}
+		case "mms":
+			var mms mmsElement
+			if err := decoder.DecodeElement(&mms, &start); err != nil {
+				return nil, ErrInvalidArchive
+			}
+			if record, ok := mms.record(); ok {
+				records = append(records, record)
+			}
+		}
+	}
+	if !root {
+		return nil, ErrInvalidArchive
+	}
+	return records, nil
+}
+
+// record restores an sms, unless it was never sent.
+func (e smsElement) record() (Record, bool) {
+	record := Record{
+		Addresses: splitAddresses(e.Address),
+		Body:      e.Body,
+		Read:      e.Read != 0,
+		At:        fromMillis(e.Date),
+	}
+	if !restoreBox(&record, e.Type) {
+		return record, false
+	}
+	if record.Status == model.MessageStatusSent {
+		switch e.Status {
+		case smsStatusComplete:
+			record.Status = model.MessageStatusDelivered
+		case smsStatusFailed:
+			record.Status = model.MessageStatusFailed
+		}
+	}
+	return record, true
+}
+
+// record restores the text of an mms, unless it was never sent or has none.
+// Its sender comes first among the addresses of an incoming message.
+func (e mmsElement) record() (Record, bool) {
+	record := Record{
+		Read: e.Read != 0,
+		At:   fromMillis(e.Date),
+	}
+	if !restoreBox(&record, e.MessageBox) {
+		return record, false
+	}
+	for _, part := range e.Parts {
+		if part.ContentType == "text/plain" && part.Text != "" && part.Text != "null" {
+			record.Body = part.Text
+			break
+		}
+	}
+	if record.Body == "" {
+		return record, false
+	}
+
+	addresses := splitAddresses(e.Address)
+	if record.Direction == model.MessageDirectionIncoming {
+		for _, addr := range e.Addrs {
+			if addr.Type != mmsAddrFrom || addr.Address == mmsAddrSelf {
+				continue
+			}
+			others := []string{addr.Address}
+			for _, address := range addresses {
+				if address != addr.Address {
+					others = append(others, address)
+				}
+			}
+			addresses = others
+			break
+		}
+	}
+	record.Addresses = addresses
+	return record, len(addresses) > 0
+}
+
+// restoreBox sets the direction and status of a record kept in a message
+// box, and reports whether the message was ever sent or received.
+func restoreBox(record *Record, box int) bool {
+	switch box {
+	case boxInbox:
+		record.Direction = model.MessageDirectionIncoming
+		record.Status = model.MessageStatusReceived
+	case boxSent:
+		record.Direction = model.MessageDirectionOutgoing
+		record.Status = model.MessageStatusSent
+	case boxFailed:
+		record.Direction = model.MessageDirectionOutgoing
+		record.Status = model.MessageStatusFailed
+	default:
+		return false
+	}
+	return true
+}
+
+func messageBox(record Record) int {
+	if record.Direction == model.MessageDirectionIncoming {
+		return boxInbox
+	}
+	switch record.Status {
+	case model.MessageStatusQueued:
+		return boxQueued
+	case model.MessageStatusStarted:
+		return boxOutbox
+	case model.MessageStatusFailed:
+		return boxFailed
+	}
+	return boxSent
+}
+
+func smsStatus(status string) int {
+	switch status {
+	case model.MessageStatusDelivered:
+		return smsStatusComplete
+	case model.MessageStatusQueued, model.MessageStatusStarted:
+		return smsStatusPending
+	case model.MessageStatusFailed:
+		return smsStatusFailed
+	}
+	return smsStatusNone
+}
+
+func fromMillis(millis int64) time.Time {
+	return time.Unix(millis/1000, millis%1000*int64(time.Millisecond))
+}
@@ -0,0 +1,34 @@
+// Package blob stores opaque binary content, such as message attachments,
+// outside of the database.
+package blob
+
+import (
+	"errors"
+	"io"
+)
+
+// Errors
+var (
+	ErrBlobNotFound = errors.New("blob_not_found")
+	ErrInvalidKey   = errors.New("invalid_blob_key")
+)
+
+// A BlobStore saves and retrieves content by key. Keys are chosen by the
+// caller and may only contain letters, digits, dashes and underscores.
+type BlobStore interface {
+	Put(key string, content io.Reader) error
+	Get(key string) (io.ReadCloser, error)
+	Delete(key string) error
+}
+
+func validKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, r := range key {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,69 @@
+package blob
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/franela/goblin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileStore(t *testing.T) {
+	var (
+		dir string
+		fs  *FileStore
+	)
+	g := goblin.Goblin(t)
+
+	g.Describe("File blob store", func() {
+		g.BeforeEach(func() {
+			dir, _ = ioutil.TempDir("", "blobs")
+			fs, _ = NewFileStore(dir)
+		})
+
+		g.AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		g.It("Should store and retrieve content", func() {
+			assert.NoError(t, fs.Put("0b3c5e8a-key", bytes.NewBufferString("content")))
+
+			r, err := fs.Get("0b3c5e8a-key")
+			assert.NoError(t, err)
+			content, _ := ioutil.ReadAll(r)
+			r.Close()
+			assert.Equal(t, "content", string(content))
+		})
+
+		g.It("Should replace content stored again under a key", func() {
+			fs.Put("key", bytes.NewBufferString("first"))
+			fs.Put("key", bytes.NewBufferString("second"))
+
+			r, _ := fs.Get("key")
+			content, _ := ioutil.ReadAll(r)
+			r.Close()
+			assert.Equal(t, "second", string(content))
+		})
+
+		g.It("Should report missing and deleted content", func() {
+			_, err := fs.Get("missing")
+			assert.Equal(t, ErrBlobNotFound, err)
+
+			fs.Put("key", bytes.NewBufferString("content"))
+			assert.NoError(t, fs.Delete("key"))
+			_, err = fs.Get("key")
+			assert.Equal(t, ErrBlobNotFound, err)
+			assert.NoError(t, fs.Delete("key"))
+		})
+
+		g.It("Should reject keys that could escape the directory", func() {
+			for _, key := range []string{"", "../key", "a/b", ".."} {
+				assert.Equal(t, ErrInvalidKey, fs.Put(key, bytes.NewBufferString("content")))
+				_, err := fs.Get(key)
+				assert.Equal(t, ErrInvalidKey, err)
+			}
+		})
+	})
+}
@@ -0,0 +1,244 @@
+// Package bus carries events between the processes serving a user, so that
+// each can react to changes recorded by the others instead of polling for
+// them. Events are written to an outbox in the transaction making the change
+// they describe, and relayed to the bus once it commits.
+package bus
+
+import (
+	"encoding/json"
+	"errors"
+	"portal-server/model"
+	"sync"
+	"time"
+)
+
+// Topics
+const (
+	TopicMessageRecorded    = "message_recorded"
+	TopicStatusUpdated      = "status_updated"
+	TopicMessageDeleted     = "message_deleted"
+	TopicDeviceLinked       = "device_linked"
+	TopicDeviceUnlinked     = "device_unlinked"
+	TopicContactsChanged    = "contacts_changed"
+	TopicCommandQueued      = "command_queued"
+	TopicConversationRead   = "conversation_read"
+	TopicMessageScheduled   = "message_scheduled"
+	TopicDraftChanged       = "draft_changed"
+	TopicConversationMerged = "conversation_merged"
+)
+
+// Commands
+const (
+	CommandSend = "send"
+)
+
+// Errors
+var (
+	ErrUnknownTopic = errors.New("unknown_topic")
+)
+
+// An Event is published on the bus under its topic. Events are delivered at
+// least once, so handlers must tolerate seeing an event again.
+type Event interface {
+	Topic() string
+}
+
+// MessageRecorded is published when a message is recorded, whether queued by
+// a user or reported by their phone.
+type MessageRecorded struct {
+	UserID    uint   `json:"user_id"`
+	MessageID string `json:"mid"`
+	Status    string `json:"status"`
+	Seq       uint64 `json:"seq"`
+}
+
+// StatusUpdated is published when a message moves to a new status.
+type StatusUpdated struct {
+	UserID    uint   `json:"user_id"`
+	MessageID string `json:"mid"`
+	Status    string `json:"status"`
+	Seq       uint64 `json:"seq"`
+}
+
+// MessageDeleted is published when a user deletes a message.
+type MessageDeleted struct {
+	UserID    uint   `json:"user_id"`
+	MessageID string `json:"mid"`
+}
+
+// DeviceLinked is published when a device is linked to a user.
+type DeviceLinked struct {
+	UserID   uint   `json:"user_id"`
+	DeviceID string `json:"device_id"`
+}
+
+// DeviceUnlinked is published when a device signs out.
+type DeviceUnlinked struct {
+	UserID   uint   `json:"user_id"`
+	DeviceID string `json:"device_id"`
+}
+
+// ContactsChanged is published when a user's contacts are uploaded.
+type ContactsChanged struct {
+	UserID uint `json:"user_id"`
+}
+
+// CommandQueued is published when a command is queued for a user's phone,
+// such as sending a message. The command fails if it is not carried out by
+// Expires.
+type CommandQueued struct {
+	UserID    uint      `json:"user_id"`
+	MessageID string    `json:"mid"`
+	Command   string    `json:"command"`
+	Expires   time.Time `json:"expires"`
+}
+
+// ConversationRead is published when a conversation's read marker moves
+// forward to a message.
+type ConversationRead struct {
+	UserID         uint   `json:"user_id"`
+	ConversationID string `json:"conversation_id"`
+	MessageID      string `json:"mid"`
+	UnreadCount    int    `json:"unread_count"`
+}
+
+// MessageScheduled is published when a message is scheduled to be sent, or
+// its schedule is changed.
+type MessageScheduled struct {
+	UserID    uint      `json:"user_id"`
+	MessageID string    `json:"mid"`
+	SendAt    time.Time `json:"send_at"`
+}
+
+// DraftChanged is published when a user's draft in a conversation is edited
+// or deleted.
+type DraftChanged struct {
+	UserID         uint   `json:"user_id"`
+	ConversationID string `json:"conversation_id"`
+	Deleted        bool   `json:"deleted"`
+}
+
+// ConversationMerged is published when one of a user's conversations turns
+// out to be with the same participants as another, and is merged into it.
+type ConversationMerged struct {
+	UserID         uint   `json:"user_id"`
+	ConversationID string `json:"conversation_id"`
+	MergedInto     string `json:"merged_into"`
+}
+
+// NewMessageRecorded describes a message that was just recorded.
+func NewMessageRecorded(message *model.Message) MessageRecorded {
+	return MessageRecorded{
+		UserID:    message.UserID,
+		MessageID: message.MessageID,
+		Status:    message.Status,
+		Seq:       message.Seq,
+	}
+}
+
+// NewStatusUpdated describes a message that just moved to a new status.
+func NewStatusUpdated(message *model.Message) StatusUpdated {
+	return StatusUpdated{
+		UserID:    message.UserID,
+		MessageID: message.MessageID,
+		Status:    message.Status,
+		Seq:       message.Seq,
+	}
+}
+
+func (MessageRecorded) Topic() string    { return TopicMessageRecorded }
+func (StatusUpdated) Topic() string      { return TopicStatusUpdated }
+func (MessageDeleted) Topic() string     { return TopicMessageDeleted }
+func (DeviceLinked) Topic() string       { return TopicDeviceLinked }
+func (DeviceUnlinked) Topic() string     { return TopicDeviceUnlinked }
+func (ContactsChanged) Topic() string    { return TopicContactsChanged }
+func (CommandQueued) Topic() string      { return TopicCommandQueued }
+func (ConversationRead) Topic() string   { return TopicConversationRead }
+func (MessageScheduled) Topic() string   { return TopicMessageScheduled }
+func (DraftChanged) Topic() string       { return TopicDraftChanged }
+func (ConversationMerged) Topic() string { return TopicConversationMerged }
+
+// Decode decodes the JSON payload of an event published under a topic.
+func Decode(topic string, payload []byte) (Event, error) {
+	switch topic {
+	case TopicMessageRecorded:
+		var event MessageRecorded
+		err := json.Unmarshal(payload, &event)
+		return event, err
+	case TopicStatusUpdated:
+		var event StatusUpdated
+		err := json.Unmarshal(payload, &event)
+		return event, err
+	case TopicMessageDeleted:
+		var event MessageDeleted
+		err := json.Unmarshal(payload, &event)
+		return event, err
+	case TopicDeviceLinked:
+		var event DeviceLinked
+		err := json.Unmarshal(payload, &event)
+		return event, err
+	case TopicDeviceUnlinked:
+		var event DeviceUnlinked
+		err := json.Unmarshal(payload, &event)
+		return event, err
+	case TopicContactsChanged:
+		var event ContactsChanged
+		err := json.Unmarshal(payload, &event)
+		return event, err
+	case TopicCommandQueued:
+		var event CommandQueued
+		err := json.Unmarshal(payload, &event)
+		return event, err
+	case TopicConversationRead:
+		var event ConversationRead
+		err := json.Unmarshal(payload, &event)
+		return event, err
+	case TopicMessageScheduled:
+		var event MessageScheduled
+		err := json.Unmarshal(payload, &event)
+		return event, err
+	case TopicDraftChanged:
+		var event DraftChanged
+		err := json.Unmarshal(payload, &event)
+		return event, err
+	case TopicConversationMerged:
+		var event ConversationMerged
+		err := json.Unmarshal(payload, &event)
+		return event, err
+	}
+	return nil, ErrUnknownTopic
+}
+
+// A Handler reacts to events on the topic it subscribed to.
+type Handler func(event Event)
+
+// A Bus delivers published events to the handlers subscribed to their topic
+// in every process.
+type Bus interface {
+	Publish(event Event) error
+	Subscribe(topic string, handler Handler)
+}
+
+// handlers dispatches events to the handlers subscribed in this process.
+type handlers struct {
+	mutex  sync.RWMutex
+	topics map[string][]Handler
+}
+
+func (h *handlers) Subscribe(topic string, handler Handler) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.topics == nil {
+		h.topics = make(map[string][]Handler)
+	}
+	h.topics[topic] = append(h.topics[topic], handler)
+}
+
+func (h *handlers) dispatch(event Event) {
+	h.mutex.RLock()
+	subscribed := h.topics[event.Topic()]
+	h.mutex.RUnlock()
+	for _, handler := range subscribed {
+		handler(event)
+	}
+}
@@ -0,0 +1,64 @@
+package bus
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/franela/goblin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBus(t *testing.T) {
+	g := goblin.Goblin(t)
+
+	g.Describe("Decode", func() {
+		g.It("Should decode each event from its topic", func() {
+			expires := time.Unix(1351700038, 0).UTC()
+			for _, event := range []Event{
+				MessageRecorded{UserID: 1, MessageID: "mid", Status: "queued", Seq: 2},
+				StatusUpdated{UserID: 1, MessageID: "mid", Status: "sent", Seq: 3},
+				MessageDeleted{UserID: 1, MessageID: "mid"},
+				DeviceLinked{UserID: 1, DeviceID: "device"},
+				DeviceUnlinked{UserID: 1, DeviceID: "device"},
+				ContactsChanged{UserID: 1},
+				CommandQueued{UserID: 1, MessageID: "mid", Command: CommandSend, Expires: expires},
+				ConversationRead{UserID: 1, ConversationID: "conversation", MessageID: "mid", UnreadCount: 2},
+				MessageScheduled{UserID: 1, MessageID: "mid", SendAt: expires},
+				DraftChanged{UserID: 1, ConversationID: "conversation", Deleted: true},
+				ConversationMerged{UserID: 1, ConversationID: "old", MergedInto: "conversation"},
+			} {
+				payload, _ := json.Marshal(event)
+				decoded, err := Decode(event.Topic(), payload)
+				assert.NoError(t, err)
+				assert.Equal(t, event, decoded)
+			}
+		})
+
+		g.It("Should reject unknown topics", func() {
+			_, err := Decode("unknown", []byte("{}"))
+			assert.Equal(t, ErrUnknownTopic, err)
+		})
+
+		g.It("Should reject malformed payloads", func() {
+			_, err := Decode(TopicContactsChanged, []byte(`{"user_id":"one"}`))
+			assert.Error(t, err)
+		})
+	})
+
+	g.Describe("Memory bus", func() {
+		g.It("Should deliver events to the handlers of their topic", func() {
+			b := NewMemoryBus()
+			var first, second, other []Event
+			b.Subscribe(TopicContactsChanged, func(event Event) { first = append(first, event) })
+			b.Subscribe(TopicContactsChanged, func(event Event) { second = append(second, event) })
+			b.Subscribe(TopicMessageDeleted, func(event Event) { other = append(other, event) })
+
+			event := ContactsChanged{UserID: 1}
+			assert.NoError(t, b.Publish(event))
+			assert.Equal(t, []Event{event}, first)
+			assert.Equal(t, []Event{event}, second)
+			assert.Empty(t, other)
+		})
+	})
+}
@@ -0,0 +1,18 @@
+package bus
+
+// A MemoryBus delivers events within a single process, calling handlers
+// before Publish returns. It suits tests, and running the API and GCM
+// service in one process.
+type MemoryBus struct {
+	handlers
+}
+
+// NewMemoryBus creates a bus without any subscribers.
+func NewMemoryBus() *MemoryBus {
+	return &MemoryBus{}
+}
+
+func (b *MemoryBus) Publish(event Event) error {
+	b.dispatch(event)
+	return nil
+}
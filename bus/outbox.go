@@ -0,0 +1,78 @@
+package bus
+
+import (
+	"encoding/json"
+	"log"
+	"portal-server/model"
+	"portal-server/store"
+	"time"
+)
+
+// relayBatch is the most events relayed in one transaction
+const relayBatch = 100
+
+// RelayInterval is how often RelayEvery checks the outbox for new events
+var RelayInterval = 500 * time.Millisecond
+
+// Enqueue adds an event to the outbox. Given the store of a transaction, the
+// event is only relayed if the transaction commits.
+func Enqueue(s store.Store, event Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return s.Outbox().AddEvent(&model.OutboxEvent{
+		Topic:   event.Topic(),
+		Payload: string(payload),
+	})
+}
+
+// Relay publishes events waiting in the outbox to a bus, returning how many
+// were relayed. Events are only marked as relayed once all of them have been
+// published, so a failure means they are published again next time.
+func Relay(s store.Store, b Bus) (int, error) {
+	var (
+		relayed int
+		err     error
+	)
+	s.Transaction(func(store store.Store) error {
+		var pending []model.OutboxEvent
+		pending, err = store.Outbox().GetUnrelayedEvents(relayBatch)
+		if err != nil {
+			return err
+		}
+		for _, queued := range pending {
+			event, decodeErr := Decode(queued.Topic, []byte(queued.Payload))
+			if decodeErr != nil {
+				// Retrying cannot help, so drop the event
+				log.Printf("Unable to decode outbox event %v: %v\n", queued.ID, decodeErr)
+				continue
+			}
+			if err = b.Publish(event); err != nil {
+				return err
+			}
+		}
+		if err = store.Outbox().MarkRelayed(pending, time.Now()); err != nil {
+			return err
+		}
+		relayed = len(pending)
+		return nil
+	})
+	return relayed, err
+}
+
+// RelayEvery relays events from the outbox to a bus as they are added,
+// checking at the given interval. It never returns.
+func RelayEvery(s store.Store, b Bus, interval time.Duration) {
+	for {
+		relayed, err := Relay(s, b)
+		if err != nil {
+			log.Printf("Unable to relay events: %v\n", err)
+		}
+		// Keep going while there is a backlog
+		if err == nil && relayed == relayBatch {
+			continue
+		}
+		time.Sleep(interval)
+	}
+}
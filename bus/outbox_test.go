@@ -0,0 +1,84 @@
+package bus
+
+import (
+	"errors"
+	"portal-server/store"
+	"testing"
+
+	"github.com/franela/goblin"
+	"github.com/stretchr/testify/assert"
+)
+
+// failingBus fails to publish anything
+type failingBus struct {
+	handlers
+}
+
+func (*failingBus) Publish(Event) error {
+	return errors.New("unavailable")
+}
+
+func TestOutbox(t *testing.T) {
+	var (
+		s        store.Store
+		b        *MemoryBus
+		received []Event
+	)
+	g := goblin.Goblin(t)
+
+	g.Describe("Outbox", func() {
+		g.BeforeEach(func() {
+			s = store.GetTestStore()
+			b = NewMemoryBus()
+			received = nil
+			b.Subscribe(TopicContactsChanged, func(event Event) {
+				received = append(received, event)
+			})
+		})
+
+		g.AfterEach(func() {
+			store.TeardownTestStore(s)
+		})
+
+		g.It("Should relay committed events once", func() {
+			s.Transaction(func(store store.Store) error {
+				return Enqueue(store, ContactsChanged{UserID: 1})
+			})
+			Enqueue(s, ContactsChanged{UserID: 2})
+
+			relayed, err := Relay(s, b)
+			assert.NoError(t, err)
+			assert.Equal(t, 2, relayed)
+			assert.Equal(t, []Event{ContactsChanged{UserID: 1}, ContactsChanged{UserID: 2}}, received)
+
+			relayed, err = Relay(s, b)
+			assert.NoError(t, err)
+			assert.Equal(t, 0, relayed)
+			assert.Len(t, received, 2)
+		})
+
+		g.It("Should never relay events from a rolled back transaction", func() {
+			s.Transaction(func(store store.Store) error {
+				Enqueue(store, ContactsChanged{UserID: 1})
+				return errors.New("rollback")
+			})
+
+			relayed, err := Relay(s, b)
+			assert.NoError(t, err)
+			assert.Equal(t, 0, relayed)
+			assert.Empty(t, received)
+		})
+
+		g.It("Should relay events again if publishing fails", func() {
+			Enqueue(s, ContactsChanged{UserID: 1})
+
+			_, err := Relay(s, &failingBus{})
+			assert.Error(t, err)
+
+			relayed, err := Relay(s, b)
+			assert.NoError(t, err)
+			assert.Equal(t, 1, relayed)
+			assert.Equal(t, []Event{ContactsChanged{UserID: 1}}, received)
+		})
+	})
+}
@@ -0,0 +1,83 @@
+package bus
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// postgresChannel is the notification channel events are published on
+const postgresChannel = "portal_bus"
+
+// envelope carries an event through a notification along with its topic
+type envelope struct {
+	Topic string          `json:"topic"`
+	Event json.RawMessage `json:"event"`
+}
+
+// A PostgresBus delivers events to every process listening on the database
+// through Postgres notifications.
+type PostgresBus struct {
+	handlers
+	db       *sql.DB
+	conninfo string
+}
+
+// NewPostgresBus connects a bus to the database described by a connection
+// string. Handlers are only called once Listen is running.
+func NewPostgresBus(conninfo string) (*PostgresBus, error) {
+	db, err := sql.Open("postgres", conninfo)
+	if err != nil {
+		return nil, err
+	}
+	return &PostgresBus{db: db, conninfo: conninfo}, nil
+}
+
+func (b *PostgresBus) Publish(event Event) error {
+	encoded, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	notification, err := json.Marshal(envelope{event.Topic(), encoded})
+	if err != nil {
+		return err
+	}
+	_, err = b.db.Exec("SELECT pg_notify($1, $2)", postgresChannel, string(notification))
+	return err
+}
+
+// Listen calls the subscribed handlers for events published by any process.
+// The listener reconnects whenever its connection drops, so Listen only
+// returns if it cannot start listening.
+func (b *PostgresBus) Listen() error {
+	listener := pq.NewListener(b.conninfo, time.Second, time.Minute, func(_ pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("Bus listener connection failed: %v\n", err)
+		}
+	})
+	if err := listener.Listen(postgresChannel); err != nil {
+		return err
+	}
+	for notification := range listener.Notify {
+		// A nil notification follows a reconnection, and events sent while
+		// disconnected are lost. Subscribers recover from the database.
+		if notification == nil {
+			continue
+		}
+		var received envelope
+		if err := json.Unmarshal([]byte(notification.Extra), &received); err != nil {
+			log.Printf("Unable to decode notification %q: %v\n", notification.Extra, err)
+			continue
+		}
+		event, err := Decode(received.Topic, received.Event)
+		if err != nil {
+			log.Printf("Unable to decode %v event: %v\n", received.Topic, err)
+			continue
+		}
+		b.dispatch(event)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+// Package events delivers changes to a user's data to their connected
+// clients as they happen. Changes reach each process through the bus.
+package events
+
+import "encoding/json"
+
+// Event types
+const (
+	TypeMessageCreated     = "message_created"
+	TypeStatusChanged      = "status_changed"
+	TypeMessageDeleted     = "message_deleted"
+	TypeDeviceLinked       = "device_linked"
+	TypeDeviceUnlinked     = "device_unlinked"
+	TypeContactsChanged    = "contacts_changed"
+	TypeConversationRead   = "conversation_read"
+	TypeDraftChanged       = "draft_changed"
+	TypeConversationMerged = "conversation_merged"
+)
+
+// An Event tells a user's clients that something changed. Events only
+// identify what changed: clients fetch the details, such as from the message
+// changes feed, so that events stay small.
+type Event struct {
+	UserID uint            `json:"user_id"`
+	Type   string          `json:"type"`
+	Data   json.RawMessage `json:"data"`
+}
+
+type messageData struct {
+	MessageID string `json:"mid"`
+	Status    string `json:"status,omitempty"`
+	Seq       uint64 `json:"seq,omitempty"`
+}
+
+type readData struct {
+	ConversationID string `json:"conversation_id"`
+	MessageID      string `json:"mid"`
+	UnreadCount    int    `json:"unread_count"`
+}
+
+type draftData struct {
+	ConversationID string `json:"conversation_id"`
+	Deleted        bool   `json:"deleted"`
+}
+
+type mergeData struct {
+	ConversationID string `json:"conversation_id"`
+	MergedInto     string `json:"merged_into"`
+}
+
+type deviceData struct {
+	DeviceID string `json:"device_id"`
+}
+
+func newEvent(userID uint, typ string, data interface{}) Event {
+	// The data types always encode
+	encoded, _ := json.Marshal(data)
+	return Event{
+		UserID: userID,
+		Type:   typ,
+		Data:   encoded,
+	}
+}
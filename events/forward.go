@@ -0,0 +1,61 @@
+package events
+
+import "portal-server/bus"
+
+// Forward publishes the events on a bus which concern clients to the hub.
+func Forward(b bus.Bus, hub *Hub) {
+	b.Subscribe(bus.TopicMessageRecorded, func(e bus.Event) {
+		event := e.(bus.MessageRecorded)
+		hub.Publish(newEvent(event.UserID, TypeMessageCreated, messageData{
+			MessageID: event.MessageID,
+			Status:    event.Status,
+			Seq:       event.Seq,
+		}))
+	})
+	b.Subscribe(bus.TopicStatusUpdated, func(e bus.Event) {
+		event := e.(bus.StatusUpdated)
+		hub.Publish(newEvent(event.UserID, TypeStatusChanged, messageData{
+			MessageID: event.MessageID,
+			Status:    event.Status,
+			Seq:       event.Seq,
+		}))
+	})
+	b.Subscribe(bus.TopicMessageDeleted, func(e bus.Event) {
+		event := e.(bus.MessageDeleted)
+		hub.Publish(newEvent(event.UserID, TypeMessageDeleted, messageData{MessageID: event.MessageID}))
+	})
+	b.Subscribe(bus.TopicDeviceLinked, func(e bus.Event) {
+		event := e.(bus.DeviceLinked)
+		hub.Publish(newEvent(event.UserID, TypeDeviceLinked, deviceData{DeviceID: event.DeviceID}))
+	})
+	b.Subscribe(bus.TopicDeviceUnlinked, func(e bus.Event) {
+		event := e.(bus.DeviceUnlinked)
+		hub.Publish(newEvent(event.UserID, TypeDeviceUnlinked, deviceData{DeviceID: event.DeviceID}))
+	})
+	b.Subscribe(bus.TopicContactsChanged, func(e bus.Event) {
+		event := e.(bus.ContactsChanged)
+		hub.Publish(newEvent(event.UserID, TypeContactsChanged, struct{}{}))
+	})
+	b.Subscribe(bus.TopicConversationRead, func(e bus.Event) {
+		event := e.(bus.ConversationRead)
+		hub.Publish(newEvent(event.UserID, TypeConversationRead, readData{
+			ConversationID: event.ConversationID,
+			MessageID:      event.MessageID,
+			UnreadCount:    event.UnreadCount,
+		}))
+	})
+	b.Subscribe(bus.TopicDraftChanged, func(e bus.Event) {
+		event := e.(bus.DraftChanged)
+		hub.Publish(newEvent(event.UserID, TypeDraftChanged, draftData{
+			ConversationID: event.ConversationID,
+			Deleted:        event.Deleted,
+		}))
+	})
+	b.Subscribe(bus.TopicConversationMerged, func(e bus.Event) {
+		event := e.(bus.ConversationMerged)
+		hub.Publish(newEvent(event.UserID, TypeConversationMerged, mergeData{
+			ConversationID: event.ConversationID,
+			MergedInto:     event.MergedInto,
+		}))
+	})
+}
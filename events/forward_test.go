@@ -0,0 +1,83 @@
+package events
+
+import (
+	"portal-server/bus"
+	"testing"
+
+	"github.com/franela/goblin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForward(t *testing.T) {
+	var (
+		hub *Hub
+		b   *bus.MemoryBus
+		sub *Subscription
+	)
+	g := goblin.Goblin(t)
+
+	g.Describe("Forwarding bus events", func() {
+		g.BeforeEach(func() {
+			hub = NewHub()
+			b = bus.NewMemoryBus()
+			Forward(b, hub)
+			sub = hub.Subscribe(1)
+		})
+
+		g.AfterEach(func() {
+			sub.Close()
+		})
+
+		g.It("Should tell clients about recorded messages", func() {
+			b.Publish(bus.MessageRecorded{UserID: 1, MessageID: "mid", Status: "queued", Seq: 3})
+			event := <-sub.Events
+			assert.Equal(t, TypeMessageCreated, event.Type)
+			assert.JSONEq(t, `{"mid":"mid","status":"queued","seq":3}`, string(event.Data))
+		})
+
+		g.It("Should tell clients about status updates", func() {
+			b.Publish(bus.StatusUpdated{UserID: 1, MessageID: "mid", Status: "sent", Seq: 4})
+			event := <-sub.Events
+			assert.Equal(t, TypeStatusChanged, event.Type)
+			assert.JSONEq(t, `{"mid":"mid","status":"sent","seq":4}`, string(event.Data))
+		})
+
+		g.It("Should tell clients about unlinked devices", func() {
+			b.Publish(bus.DeviceUnlinked{UserID: 1, DeviceID: "device"})
+			event := <-sub.Events
+			assert.Equal(t, TypeDeviceUnlinked, event.Type)
+			assert.JSONEq(t, `{"device_id":"device"}`, string(event.Data))
+		})
+
+		g.It("Should tell clients about read markers", func() {
+			b.Publish(bus.ConversationRead{UserID: 1, ConversationID: "conversation", MessageID: "mid", UnreadCount: 2})
+			event := <-sub.Events
+			assert.Equal(t, TypeConversationRead, event.Type)
+			assert.JSONEq(t, `{"conversation_id":"conversation","mid":"mid","unread_count":2}`, string(event.Data))
+		})
+
+		g.It("Should tell clients about drafts", func() {
+			b.Publish(bus.DraftChanged{UserID: 1, ConversationID: "conversation"})
+			event := <-sub.Events
+			assert.Equal(t, TypeDraftChanged, event.Type)
+			assert.JSONEq(t, `{"conversation_id":"conversation","deleted":false}`, string(event.Data))
+		})
+
+		g.It("Should tell clients about merged conversations", func() {
+			b.Publish(bus.ConversationMerged{UserID: 1, ConversationID: "old", MergedInto: "conversation"})
+			event := <-sub.Events
+			assert.Equal(t, TypeConversationMerged, event.Type)
+			assert.JSONEq(t, `{"conversation_id":"old","merged_into":"conversation"}`, string(event.Data))
+		})
+
+		g.It("Should only tell the event's user", func() {
+			b.Publish(bus.ContactsChanged{UserID: 2})
+			assert.Empty(t, sub.Events)
+		})
+
+		g.It("Should not tell clients about queued commands", func() {
+			b.Publish(bus.CommandQueued{UserID: 1, MessageID: "mid", Command: bus.CommandSend})
+			assert.Empty(t, sub.Events)
+		})
+	})
+}
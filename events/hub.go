@@ -0,0 +1,82 @@
+package events
+
+import "sync"
+
+// subscriptionBuffer is how many events a subscriber may fall behind by
+// before it is dropped.
+const subscriptionBuffer = 32
+
+// A Hub delivers events published in this process to subscribers of the
+// user they belong to.
+type Hub struct {
+	mutex       sync.Mutex
+	subscribers map[uint]map[*Subscription]bool
+}
+
+// A Subscription receives a user's events on Events until it is closed,
+// either by the subscriber or by the hub if the subscriber falls behind.
+type Subscription struct {
+	Events <-chan Event
+	events chan Event
+	userID uint
+	hub    *Hub
+}
+
+// NewHub creates a hub without any subscribers.
+func NewHub() *Hub {
+	return &Hub{subscribers: make(map[uint]map[*Subscription]bool)}
+}
+
+// Subscribe starts receiving the events of a user.
+func (h *Hub) Subscribe(userID uint) *Subscription {
+	events := make(chan Event, subscriptionBuffer)
+	sub := &Subscription{
+		Events: events,
+		events: events,
+		userID: userID,
+		hub:    h,
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.subscribers[userID] == nil {
+		h.subscribers[userID] = make(map[*Subscription]bool)
+	}
+	h.subscribers[userID][sub] = true
+	return sub
+}
+
+// Publish delivers an event to its user's subscribers without waiting for
+// them. Subscribers that have fallen behind are closed rather than silently
+// missing events, and should catch up from the changes feed once they
+// subscribe again.
+func (h *Hub) Publish(event Event) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for sub := range h.subscribers[event.UserID] {
+		select {
+		case sub.events <- event:
+		default:
+			h.unsubscribe(sub)
+		}
+	}
+}
+
+// Close stops the subscription, closing its Events channel. It is safe to
+// close a subscription more than once.
+func (s *Subscription) Close() {
+	s.hub.mutex.Lock()
+	defer s.hub.mutex.Unlock()
+	s.hub.unsubscribe(s)
+}
+
+func (h *Hub) unsubscribe(sub *Subscription) {
+	subs := h.subscribers[sub.userID]
+	if !subs[sub] {
+		return
+	}
+	delete(subs, sub)
+	if len(subs) == 0 {
+		delete(h.subscribers, sub.userID)
+	}
+	close(sub.events)
+}
@@ -0,0 +1,62 @@
+package events
+
+import (
+	"testing"
+
+	"github.com/franela/goblin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHub(t *testing.T) {
+	var hub *Hub
+	g := goblin.Goblin(t)
+
+	g.Describe("Event hub", func() {
+		g.BeforeEach(func() {
+			hub = NewHub()
+		})
+
+		g.It("Should deliver events to the user's subscribers", func() {
+			first := hub.Subscribe(1)
+			second := hub.Subscribe(1)
+			other := hub.Subscribe(2)
+			defer other.Close()
+
+			event := newEvent(1, TypeMessageDeleted, messageData{MessageID: "mid"})
+			hub.Publish(event)
+			assert.Equal(t, event, <-first.Events)
+			assert.Equal(t, event, <-second.Events)
+			assert.Empty(t, other.Events)
+		})
+
+		g.It("Should stop delivering to closed subscriptions", func() {
+			sub := hub.Subscribe(1)
+			sub.Close()
+			sub.Close()
+			hub.Publish(newEvent(1, TypeContactsChanged, struct{}{}))
+
+			_, open := <-sub.Events
+			assert.False(t, open)
+			assert.Empty(t, hub.subscribers)
+		})
+
+		g.It("Should close subscribers that fall behind", func() {
+			slow := hub.Subscribe(1)
+			for i := 0; i <= subscriptionBuffer; i++ {
+				hub.Publish(newEvent(1, TypeContactsChanged, struct{}{}))
+			}
+			received := 0
+			for range slow.Events {
+				received++
+			}
+			assert.Equal(t, subscriptionBuffer, received)
+
+			// Subscribing again starts afresh
+			sub := hub.Subscribe(1)
+			defer sub.Close()
+			hub.Publish(newEvent(1, TypeContactsChanged, struct{}{}))
+			assert.Len(t, sub.Events, 1)
+		})
+
+	})
+}
@@ -3,7 +3,9 @@ package main
 import (
 	"log"
 	"os"
+	"portal-server/bus"
 	"portal-server/store"
+	"time"
 
 	"github.com/google/go-gcm"
 )
@@ -32,8 +34,20 @@ func main() {
 		log.Fatalln("Missing DB_NAME, DB_GCM_USER, or DB_GCM_PASSWORD environment variables")
 	}
 
+	b, err := bus.NewPostgresBus(store.ConnInfo(dbName, user, password))
+	if err != nil {
+		log.Fatalf("Unable to connect to the event bus: %v\n", err)
+	}
 	store := store.GetStore(dbName, user, password)
 	ccs := &GoogleCCS{senderID, apiKey}
 	service := GCMService{Store: store, CCS: ccs}
+	b.Subscribe(bus.TopicCommandQueued, service.OnCommandQueued)
+	b.Subscribe(bus.TopicMessageScheduled, service.OnMessageScheduled)
+	go func() {
+		log.Fatal(b.Listen())
+	}()
+	go bus.RelayEvery(store, b, bus.RelayInterval)
+	go service.expireQueuedMessages(time.Minute)
+	go service.dispatchScheduledMessages(time.Minute)
 	log.Fatal(service.CCS.Listen(service.OnMessageReceived, nil))
 }
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"log"
+	"portal-server/bus"
+	"portal-server/model"
+	"portal-server/store"
+	"time"
+)
+
+// scheduleBatch is the most scheduled messages dispatched in one pass.
+const scheduleBatch = 100
+
+// OnMessageScheduled dispatches a message scheduled on the bus as soon as it
+// is due. Messages rescheduled for later are left pending when the earlier
+// time comes, and canceled ones are skipped.
+func (s GCMService) OnMessageScheduled(event bus.Event) {
+	scheduled := event.(bus.MessageScheduled)
+	time.AfterFunc(scheduled.SendAt.Sub(time.Now()), func() {
+		s.dispatchMessages(time.Now())
+	})
+}
+
+// dispatchScheduledMessages periodically dispatches due scheduled messages.
+// This catches messages scheduled while the service was not listening to the
+// bus, such as across restarts.
+func (s GCMService) dispatchScheduledMessages(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		s.dispatchMessages(now)
+	}
+}
+
+func (s GCMService) dispatchMessages(now time.Time) {
+	dispatched, err := s.dispatchDueMessages(now)
+	if err != nil {
+		log.Printf("Unable to dispatch scheduled messages: %v\n", err)
+	} else if dispatched > 0 {
+		log.Printf("Dispatched %v scheduled messages\n", dispatched)
+	}
+}
+
+// dispatchDueMessages dispatches the pending scheduled messages due by now,
+// returning how many it handled.
+func (s GCMService) dispatchDueMessages(now time.Time) (int, error) {
+	due, err := s.Store.ScheduledMessages().GetDueScheduledMessages(now, scheduleBatch)
+	if err != nil {
+		return 0, err
+	}
+	for i := range due {
+		if err := s.dispatchScheduledMessage(due[i].MessageID, now); err != nil {
+			log.Printf("Unable to dispatch scheduled message %v: %v\n", due[i].MessageID, err)
+		}
+	}
+	return len(due), nil
+}
+
+// dispatchScheduledMessage queues a due scheduled message and tells the
+// user's phone to send it, or fails it if it can no longer be sent. The
+// schedule is locked and marked dispatching as the message is queued, so that
+// it cannot be edited or canceled once it is on its way. Like messages queued
+// by the api, the phone is only told once the message is committed. The
+// schedule stays dispatching until the phone has been told, and the phone is
+// told again on later passes until then or until the message expires.
+func (s GCMService) dispatchScheduledMessage(messageID string, now time.Time) error {
+	var (
+		scheduled *model.ScheduledMessage
+		message   *model.Message
+		reason    string
+		err       error
+	)
+	s.Store.Transaction(func(store store.Store) error {
+		var found bool
+		scheduled, found = store.ScheduledMessages().LockScheduledMessage(messageID)
+		if found && scheduled.Status == model.ScheduleStatusDispatching {
+			// Queued by an earlier pass that could not tell the phone
+			if message, found = store.Messages().FindMessageByMessageID(messageID); !found {
+				err = ErrMessageNotFound
+				return err
+			}
+			err = store.Messages().LoadDetails(message)
+			return err
+		}
+		if !found || scheduled.Status != model.ScheduleStatusPending {
+			// Canceled or dispatched since it was found due
+			scheduled = nil
+			return nil
+		}
+		if reason = scheduleFailure(store, scheduled, now); reason != "" {
+			err = store.ScheduledMessages().MarkFailed(scheduled, reason)
+			return err
+		}
+		message = scheduled.Message()
+		if err = store.Messages().CreateMessage(message); err != nil {
+			return err
+		}
+		if err = bus.Enqueue(store, bus.NewMessageRecorded(message)); err != nil {
+			return err
+		}
+		if err = bus.Enqueue(store, bus.CommandQueued{
+			UserID:    message.UserID,
+			MessageID: message.MessageID,
+			Command:   bus.CommandSend,
+			Expires:   message.CreatedAt.Add(model.QueuedMessageTTL),
+		}); err != nil {
+			return err
+		}
+		err = store.ScheduledMessages().MarkDispatching(scheduled, now)
+		return err
+	})
+	if err != nil || scheduled == nil {
+		return err
+	}
+	if reason != "" {
+		s.notifyScheduleFailed(scheduled)
+		return nil
+	}
+
+	// Messages the phone has started, or that expired, need no more telling
+	if ttl := message.CreatedAt.Add(model.QueuedMessageTTL).Sub(now); message.Status == model.MessageStatusQueued && ttl > 0 {
+		key, found := s.Store.NotificationKeys().FindKey(&model.NotificationKey{UserID: scheduled.UserID})
+		if !found {
+			return ErrUnregisteredDevice
+		}
+		if err := s.sendExpiringDownstream(key.Key, typeSendMessage, message.Render(), ttl); err != nil {
+			return err
+		}
+	}
+	return s.Store.ScheduledMessages().MarkDispatched(scheduled)
+}
+
+// scheduleFailure returns why a due scheduled message cannot be dispatched,
+// or an empty string if it can.
+func scheduleFailure(store store.Store, scheduled *model.ScheduledMessage, now time.Time) string {
+	if now.Sub(scheduled.SendAt) > model.ScheduleGrace {
+		return model.ScheduleFailureMissed
+	}
+	if store.Devices().DeviceCount(&model.Device{
+		UserID: scheduled.UserID,
+		Type:   model.DeviceTypePhone,
+		State:  model.DeviceStateLinked,
+	}) == 0 {
+		return model.ScheduleFailureNoPhone
+	}
+	if _, found := store.NotificationKeys().FindKey(&model.NotificationKey{UserID: scheduled.UserID}); !found {
+		return model.ScheduleFailureNoPhone
+	}
+	return ""
+}
+
+// failScheduleOf fails the scheduled message a failed message was dispatched
+// for, if any.
+func failScheduleOf(store store.Store, message *model.Message, reason string) error {
+	scheduled, found := store.ScheduledMessages().FindScheduledMessage(&model.ScheduledMessage{MessageID: message.MessageID})
+	if !found || scheduled.Status == model.ScheduleStatusCanceled || scheduled.Status == model.ScheduleStatusFailed {
+		return nil
+	}
+	return store.ScheduledMessages().MarkFailed(scheduled, reason)
+}
+
+// notifyScheduleFailed tells the user's devices that a scheduled message
+// could not be dispatched. Failures after dispatch are reported as the
+// message failing instead.
+func (s GCMService) notifyScheduleFailed(scheduled *model.ScheduledMessage) {
+	key, found := s.Store.NotificationKeys().FindKey(&model.NotificationKey{UserID: scheduled.UserID})
+	if !found {
+		return
+	}
+	if err := s.sendDownstream(key.Key, typeScheduleFailed, map[string]string{
+		"mid":    scheduled.MessageID,
+		"reason": scheduled.FailureReason,
+	}); err != nil {
+		log.Printf("Unable to notify devices that scheduled message %v failed: %v\n", scheduled.MessageID, err)
+	}
+}
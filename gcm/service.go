@@ -4,17 +4,22 @@ import (
 	"encoding/json"
 	"errors"
 	"log"
+	"portal-server/bus"
 	"portal-server/model"
+	"portal-server/pairing"
 	"portal-server/store"
+	"time"
 
 	"github.com/asaskevich/govalidator"
 	"github.com/google/go-gcm"
+	"github.com/jinzhu/gorm"
 	"github.com/satori/go.uuid"
 )
 
 // A GCMService handles upstream messages from a CloudConnectionService
 // and sends appropriate responses downstream to clients. It also performs
-// message validation and persistence.
+// message validation and persistence, adding events for the changes it
+// records to the outbox.
 type GCMService struct {
 	Store store.Store
 	CCS   CloudConnectionServer
@@ -28,8 +33,25 @@ const (
 
 // Discriminator types
 const (
-	typeMessage = "message"
-	typeStatus  = "status"
+	typeMessage  = "message"
+	typeStatus   = "status"
+	typeIncoming = "incoming"
+	typePing     = "ping"
+	typePair     = "pair"
+	typeEncrypt  = "encrypt"
+	typeRead     = "read"
+	typeDraft    = "draft"
+)
+
+// Downstream types
+const (
+	typePairingApproved  = "pairing_approved"
+	typeAck              = "ack"
+	typeIncomingMessage  = "incoming_message"
+	typeConversationRead = "conversation_read"
+	typeSendMessage      = "send"
+	typeScheduleFailed   = "scheduled_message_failed"
+	typeDraftChanged     = "draft_changed"
 )
 
 // Errors
@@ -38,40 +60,179 @@ var (
 	ErrInvalidMessageType    = errors.New("invalid_message_type")
 	ErrUnregisteredDevice    = errors.New("unregistered_device")
 	ErrMessageNotFound       = errors.New("message_not_found")
+	ErrStaleStatus           = errors.New("stale_status")
+	ErrInvalidTransition     = errors.New("invalid_status_transition")
+	ErrConflictingMessage    = errors.New("conflicting_message")
+	ErrInvalidAttachment     = errors.New("invalid_attachment")
+	ErrEncryptionRequired    = store.ErrEncryptionRequired
+	ErrEncryptionDisabled    = errors.New("encryption_disabled")
+	ErrInvalidEnvelope       = store.ErrInvalidEnvelope
+	ErrConversationNotFound  = errors.New("conversation_not_found")
+	ErrStaleDraft            = errors.New("stale_draft")
 )
 
 // MessagePayload is the message structure sent when a Portal client creates
 // a new message and has broadcast it out to its device group.
 type MessagePayload struct {
-	MessageID string `json:"mid" valid:"required,uuidv4"`
-	To        string `json:"to" valid:"required"`
-	Status    string `json:"status" valid:"required,matches(started|sent|delivered|failed)"`
-	Body      string `json:"body" valid:"required"`
-	At        int    `json:"at" valid:"required"`
+	MessageID string           `json:"mid" valid:"required,uuidv4"`
+	To        model.Recipients `json:"to" valid:"required"`
+	Status    string           `json:"status" valid:"required,matches(started|sent|delivered|failed)"`
+	Body      string           `json:"body"`
+	At        int              `json:"at" valid:"required"`
+
+	// Attachments lists the IDs of attachments uploaded for the message
+	Attachments []string `json:"attachments"`
+
+	// Nonce and KeyVersion are sent with encrypted bodies
+	Nonce      string `json:"nonce"`
+	KeyVersion int    `json:"key_version"`
+}
+
+func (m MessagePayload) validate() error {
+	if err := requireContent(m.Body, m.Attachments); err != nil {
+		return err
+	}
+	return checkAttachmentIDs(m.Attachments)
 }
 
 // StatusPayload is the message structure sent when a Portal client updates
 // the status of an existing message.
 type StatusPayload struct {
 	MessageID string `json:"mid" valid:"required,uuidv4"`
-	Status    string `json:"status" valid:"required,matches(sent|delivered|failed)"`
+	Status    string `json:"status" valid:"required,matches(started|sent|delivered|failed)"`
+	At        int    `json:"at" valid:"required"`
+}
+
+// IncomingPayload is the message structure sent when a phone receives a new
+// message.
+type IncomingPayload struct {
+	MessageID string `json:"mid" valid:"required,uuidv4"`
+	From      string `json:"from" valid:"required"`
+	Body      string `json:"body"`
 	At        int    `json:"at" valid:"required"`
+	Read      bool   `json:"read"`
+
+	// To lists the other recipients of a group message
+	To          model.Recipients `json:"to"`
+	Attachments []string         `json:"attachments"`
+	Nonce       string           `json:"nonce"`
+	KeyVersion  int              `json:"key_version"`
+}
+
+func (m IncomingPayload) validate() error {
+	if err := requireContent(m.Body, m.Attachments); err != nil {
+		return err
+	}
+	return checkAttachmentIDs(m.Attachments)
+}
+
+// requireContent checks that a message has a body or attachments, as picture
+// messages may be sent without any text.
+func requireContent(body string, attachments []string) error {
+	if body == "" && len(attachments) == 0 {
+		return errors.New("body: non zero value required")
+	}
+	return nil
+}
+
+// checkAttachmentIDs ensures that attachments are referred to by the IDs
+// they were uploaded with.
+func checkAttachmentIDs(attachments []string) error {
+	for _, id := range attachments {
+		if !govalidator.IsUUIDv4(id) {
+			return ErrInvalidAttachment
+		}
+	}
+	return nil
+}
+
+// EncryptPayload is the message structure sent when a device re-uploads the
+// body of a message recorded in plaintext as ciphertext, migrating existing
+// history once the user opts in to encrypted messages.
+type EncryptPayload struct {
+	MessageID  string `json:"mid" valid:"required,uuidv4"`
+	Body       string `json:"body" valid:"required"`
+	Nonce      string `json:"nonce" valid:"required"`
+	KeyVersion int    `json:"key_version" valid:"required"`
+}
+
+// ReadPayload is the message structure sent when the user reads a
+// conversation on the phone, up to and including the given message.
+type ReadPayload struct {
+	MessageID string `json:"mid" valid:"required,uuidv4"`
+}
+
+// DraftPayload is the message structure sent when the user edits the draft
+// in a conversation on the phone, which names the conversation by its
+// participants. An empty body deletes the draft.
+type DraftPayload struct {
+	To   model.Recipients `json:"to" valid:"required"`
+	Body string           `json:"body"`
+	At   int              `json:"at" valid:"required"`
+
+	// Nonce and KeyVersion are sent with encrypted bodies
+	Nonce      string `json:"nonce"`
+	KeyVersion int    `json:"key_version"`
+}
+
+// PairPayload is the message structure sent when a phone approves pairing a
+// new device, either by scanning its QR code or entering its short code.
+type PairPayload struct {
+	SessionID string `json:"session_id"`
+	Code      string `json:"code" valid:"required"`
 }
 
 // OnMessageReceived handles all incoming GCM messages, performing
 // validation and sending responses as necessary.
 func (s GCMService) OnMessageReceived(cm gcm.CcsMessage) error {
 	log.Printf("msg %v from %v\n", cm.Data, cm.From)
+	device, seen := s.touchDevice(cm.From)
 	d := cm.Data
 	switch d[discriminator] {
 	case typeMessage:
 		var message MessagePayload
+		err := getPayload(d[payload], &message)
+		if err == ErrInvalidAttachment {
+			return s.acknowledge(cm, message.MessageID, err)
+		}
+		if err != nil {
+			s.errorMessage(cm.From, ErrInvalidMessagePayload, err.Error())
+			return nil
+		}
+		return s.acknowledge(cm, message.MessageID, s.recordMessage(cm, message))
+	case typeIncoming:
+		var message IncomingPayload
+		err := getPayload(d[payload], &message)
+		if err == ErrInvalidAttachment {
+			return s.acknowledge(cm, message.MessageID, err)
+		}
+		if err != nil {
+			s.errorMessage(cm.From, ErrInvalidMessagePayload, err.Error())
+			return nil
+		}
+		return s.acknowledge(cm, message.MessageID, s.recordIncoming(cm, message))
+	case typeEncrypt:
+		var message EncryptPayload
 		if err := getPayload(d[payload], &message); err != nil {
 			s.errorMessage(cm.From, ErrInvalidMessagePayload, err.Error())
 			return nil
 		}
-		if err := s.recordMessage(cm, message); err == ErrUnregisteredDevice {
-			s.errorMessage(cm.From, err, "device not found")
+		return s.acknowledge(cm, message.MessageID, s.encryptMessage(cm, message))
+	case typeRead:
+		var message ReadPayload
+		if err := getPayload(d[payload], &message); err != nil {
+			s.errorMessage(cm.From, ErrInvalidMessagePayload, err.Error())
+			return nil
+		}
+		return s.acknowledge(cm, message.MessageID, s.markRead(cm, message))
+	case typeDraft:
+		var message DraftPayload
+		if err := getPayload(d[payload], &message); err != nil {
+			s.errorMessage(cm.From, ErrInvalidMessagePayload, err.Error())
+			return nil
+		}
+		if err := s.saveDraft(cm, message); err != nil {
+			s.errorMessage(cm.From, err, "draft not saved")
 			return nil
 		}
 	case typeStatus:
@@ -89,8 +250,74 @@ func (s GCMService) OnMessageReceived(cm gcm.CcsMessage) error {
 			s.errorMessage(cm.From, err, "message not found")
 			return nil
 		}
+		if err == ErrStaleStatus {
+			s.errorMessage(cm.From, err, "message "+message.MessageID+" already has a later status")
+			return nil
+		}
+		if err == ErrInvalidTransition {
+			s.errorMessage(cm.From, err, "message "+message.MessageID+" cannot become "+message.Status)
+			return nil
+		}
+	case typePing:
+		if !seen {
+			s.errorMessage(cm.From, ErrUnregisteredDevice, "device not found")
+		}
+	case typePair:
+		var message PairPayload
+		if err := getPayload(d[payload], &message); err != nil {
+			s.errorMessage(cm.From, ErrInvalidMessagePayload, err.Error())
+			return nil
+		}
+		if !seen {
+			s.errorMessage(cm.From, ErrUnregisteredDevice, "device not found")
+			return nil
+		}
+		if err := s.approvePairing(device, message); err != nil {
+			s.errorMessage(cm.From, err, "pairing not approved")
+			return nil
+		}
 	default:
-		s.errorMessage(cm.From, ErrInvalidMessageType, "must be 'message' or 'status'")
+		s.errorMessage(cm.From, ErrInvalidMessageType, "must be 'message', 'status', 'incoming', 'encrypt', 'read', 'draft', 'ping' or 'pair'")
+	}
+	return nil
+}
+
+// acknowledge tells a device whether the message it uploaded was recorded,
+// so that it can stop retrying.
+func (s GCMService) acknowledge(cm gcm.CcsMessage, messageID string, err error) error {
+	if err == ErrUnregisteredDevice {
+		s.errorMessage(cm.From, err, "device not found")
+		return nil
+	}
+	if err == ErrConflictingMessage {
+		s.errorMessage(cm.From, err, "message "+messageID+" was already recorded with different contents")
+		return nil
+	}
+	if err == ErrInvalidAttachment {
+		s.errorMessage(cm.From, err, "message "+messageID+" refers to an unknown or used attachment")
+		return nil
+	}
+	if err == ErrMessageNotFound {
+		s.errorMessage(cm.From, err, "message not found")
+		return nil
+	}
+	if err == ErrEncryptionRequired {
+		s.errorMessage(cm.From, err, "message "+messageID+" must be encrypted")
+		return nil
+	}
+	if err == ErrEncryptionDisabled {
+		s.errorMessage(cm.From, err, "encrypted messages are not enabled")
+		return nil
+	}
+	if err == ErrInvalidEnvelope {
+		s.errorMessage(cm.From, err, "message "+messageID+" has a malformed envelope or unknown key version")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := s.sendDownstream(cm.From, typeAck, map[string]string{"mid": messageID}); err != nil {
+		log.Printf("Unable to acknowledge message %v: %v\n", messageID, err)
 	}
 	return nil
 }
@@ -103,6 +330,31 @@ func (s GCMService) sendMessage(m *gcm.XmppMessage) (string, error) {
 	return messageID, nil
 }
 
+// sendDownstream sends a message of the given type to a device, encoding its
+// payload the same way upstream payloads are.
+func (s GCMService) sendDownstream(to string, typ string, data interface{}) error {
+	return s.sendExpiringDownstream(to, typ, data, 0)
+}
+
+// sendExpiringDownstream sends a message to a device that is dropped if it
+// cannot be delivered within ttl.
+func (s GCMService) sendExpiringDownstream(to string, typ string, data interface{}, ttl time.Duration) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = s.sendMessage(&gcm.XmppMessage{
+		To:         to,
+		MessageId:  uuid.NewV4().String(),
+		TimeToLive: uint(ttl / time.Second),
+		Data: map[string]interface{}{
+			discriminator: typ,
+			payload:       string(encoded),
+		},
+	})
+	return err
+}
+
 func (s GCMService) errorMessage(to string, err error, reason string) {
 	s.sendMessage(&gcm.XmppMessage{
 		To:        to,
@@ -125,26 +377,338 @@ func getPayload(payload interface{}, result interface{}) error {
 	if _, err := govalidator.ValidateStruct(result); err != nil {
 		return err
 	}
+	if v, ok := result.(interface {
+		validate() error
+	}); ok {
+		return v.validate()
+	}
 	return nil
 }
 
+// touchDevice marks the linked device with the given registration ID as
+// seen now, returning false if no such device exists.
+func (s GCMService) touchDevice(registrationID string) (*model.Device, bool) {
+	device, found := s.Store.Devices().FindDevice(&model.Device{
+		RegistrationID: registrationID,
+		State:          model.DeviceStateLinked,
+	})
+	if !found {
+		return nil, false
+	}
+	if err := s.Store.Devices().TouchDevice(device, time.Now()); err != nil {
+		log.Printf("Unable to update last seen for device %v: %v\n", device.UUID, err)
+	}
+	return device, true
+}
+
 func (s GCMService) recordMessage(cm gcm.CcsMessage, m MessagePayload) error {
-	registrationID := cm.From
+	message := &model.Message{
+		MessageID:       m.MessageID,
+		Status:          m.Status,
+		Direction:       model.MessageDirectionOutgoing,
+		Body:            m.Body,
+		ClientCreatedAt: time.Unix(int64(m.At), 0),
+		Nonce:           m.Nonce,
+		KeyVersion:      m.KeyVersion,
+	}
+	message.SetRecipients(m.To)
+	_, _, err := s.storeMessage(cm.From, message, m.Attachments)
+	return err
+}
+
+// recordIncoming records a message received by the phone, and notifies the
+// user's other devices the first time it arrives.
+func (s GCMService) recordIncoming(cm gcm.CcsMessage, m IncomingPayload) error {
+	message := &model.Message{
+		MessageID:       m.MessageID,
+		Status:          model.MessageStatusReceived,
+		Direction:       model.MessageDirectionIncoming,
+		From:            m.From,
+		Body:            m.Body,
+		ClientCreatedAt: time.Unix(int64(m.At), 0),
+		Read:            m.Read,
+		Nonce:           m.Nonce,
+		KeyVersion:      m.KeyVersion,
+	}
+	message.SetRecipients(m.To)
+	device, created, err := s.storeMessage(cm.From, message, m.Attachments)
+	if err != nil || !created {
+		return err
+	}
+	s.notifyIncoming(device, message, m.Attachments)
+	return nil
+}
+
+// storeMessage records a message uploaded by a device for its user with the
+// attachments it refers to, and reports whether it was new.
+func (s GCMService) storeMessage(registrationID string, message *model.Message, attachmentIDs []string) (*model.Device, bool, error) {
 	device, found := s.Store.Devices().FindDevice(&model.Device{
 		RegistrationID: registrationID,
 		State:          model.DeviceStateLinked,
 	})
+	if !found {
+		return nil, false, ErrUnregisteredDevice
+	}
+	user, err := s.Store.Devices().GetRelatedUser(device)
+	if err != nil {
+		return nil, false, err
+	}
+	message.UserID = device.UserID
+	// Addresses are recorded in E.164 format, so compare retries in it too
+	message.NormalizeAddresses(user.PhoneRegion())
+	created := false
+	s.Store.Transaction(func(txStore store.Store) error {
+		// Phones retry until acknowledged, so a message may arrive again
+		if existing, found := txStore.Messages().FindMessageByMessageID(message.MessageID); found {
+			if !sameMessage(existing, message) {
+				err = ErrConflictingMessage
+			}
+			return err
+		}
+		if err = txStore.EncryptionKeys().CheckEnvelope(user, message); err != nil {
+			return err
+		}
+		if err = txStore.Messages().CreateMessage(message); err != nil {
+			return err
+		}
+		err = txStore.Attachments().LinkAttachments(message, attachmentIDs)
+		if err == store.ErrAttachmentNotFound || err == store.ErrAttachmentInUse {
+			err = ErrInvalidAttachment
+		}
+		if err != nil {
+			return err
+		}
+		if err = bus.Enqueue(txStore, bus.NewMessageRecorded(message)); err != nil {
+			return err
+		}
+		created = true
+		return nil
+	})
+	return device, created, err
+}
+
+// notifyIncoming sends a newly received message to the user's devices other
+// than the phone that received it, so that they can show a notification.
+func (s GCMService) notifyIncoming(phone *model.Device, message *model.Message, attachmentIDs []string) {
+	user, err := s.Store.Devices().GetRelatedUser(phone)
+	if err != nil {
+		log.Printf("Unable to find the owner of device %v: %v\n", phone.UUID, err)
+		return
+	}
+	devices, err := s.Store.Devices().GetAllLinkedDevices(user)
+	if err != nil {
+		log.Printf("Unable to find devices to notify of message %v: %v\n", message.MessageID, err)
+		return
+	}
+	notification := map[string]interface{}{
+		"mid":  message.MessageID,
+		"from": message.From,
+		"body": message.Body,
+		"at":   message.ClientCreatedAt.Unix(),
+	}
+	if message.Encrypted() {
+		notification["nonce"] = message.Nonce
+		notification["key_version"] = message.KeyVersion
+	}
+	if recipients := message.RecipientAddresses(); len(recipients) > 0 {
+		notification["to"] = recipients
+	}
+	if len(attachmentIDs) > 0 {
+		notification["attachments"] = attachmentIDs
+	}
+	for _, device := range devices {
+		if device.ID == phone.ID {
+			continue
+		}
+		if err := s.sendDownstream(device.RegistrationID, typeIncomingMessage, notification); err != nil {
+			log.Printf("Unable to notify device %v of message %v: %v\n", device.UUID, message.MessageID, err)
+		}
+	}
+}
+
+// sameMessage reports whether a recorded message matches a repeated upload.
+// The status may have moved on since, so it is not compared.
+func sameMessage(recorded *model.Message, upload *model.Message) bool {
+	return recorded.UserID == upload.UserID &&
+		recorded.Direction == upload.Direction &&
+		recorded.From == upload.From &&
+		recorded.To == upload.To &&
+		recorded.Body == upload.Body &&
+		recorded.Nonce == upload.Nonce &&
+		recorded.ClientCreatedAt.Equal(upload.ClientCreatedAt)
+}
+
+// encryptMessage replaces the plaintext body of a recorded message with
+// ciphertext uploaded by a device. The message is issued a new change
+// sequence number so that other devices fetch the ciphertext too.
+func (s GCMService) encryptMessage(cm gcm.CcsMessage, m EncryptPayload) error {
+	device, found := s.Store.Devices().FindDevice(&model.Device{
+		RegistrationID: cm.From,
+		State:          model.DeviceStateLinked,
+	})
 	if !found {
 		return ErrUnregisteredDevice
 	}
-	message := &model.Message{
-		UserID:    device.UserID,
-		MessageID: m.MessageID,
-		Status:    m.Status,
-		To:        m.To,
-		Body:      m.Body,
+	user, err := s.Store.Devices().GetRelatedUser(device)
+	if err != nil {
+		return err
 	}
-	return s.Store.Messages().CreateMessage(message)
+	if !user.EncryptedMessages {
+		return ErrEncryptionDisabled
+	}
+	s.Store.Transaction(func(txStore store.Store) error {
+		message, found := txStore.Messages().FindMessage(&model.Message{UserID: device.UserID, MessageID: m.MessageID})
+		if !found {
+			err = ErrMessageNotFound
+			return err
+		}
+		upload := &model.Message{
+			Body:       m.Body,
+			Nonce:      m.Nonce,
+			KeyVersion: m.KeyVersion,
+		}
+		if err = txStore.EncryptionKeys().CheckEnvelope(user, upload); err != nil {
+			return err
+		}
+		if message.Body == upload.Body && message.Nonce == upload.Nonce {
+			// Repeated uploads are acknowledged without changing anything
+			return nil
+		}
+		message.Body = upload.Body
+		message.Nonce = upload.Nonce
+		message.KeyVersion = upload.KeyVersion
+		err = txStore.Messages().SaveMessage(message)
+		return err
+	})
+	return err
+}
+
+// markRead moves the read marker of a message's conversation forward to it,
+// and tells all of the user's devices through their notification group.
+func (s GCMService) markRead(cm gcm.CcsMessage, m ReadPayload) error {
+	device, found := s.Store.Devices().FindDevice(&model.Device{
+		RegistrationID: cm.From,
+		State:          model.DeviceStateLinked,
+	})
+	if !found {
+		return ErrUnregisteredDevice
+	}
+	var (
+		conversation *model.Conversation
+		moved        bool
+		err          error
+	)
+	s.Store.Transaction(func(txStore store.Store) error {
+		message, found := txStore.Messages().FindMessage(&model.Message{UserID: device.UserID, MessageID: m.MessageID})
+		if !found {
+			err = ErrMessageNotFound
+			return err
+		}
+		conversation, found = txStore.Conversations().FindConversation(&model.Conversation{
+			Model:  gorm.Model{ID: message.ConversationID},
+			UserID: device.UserID,
+		})
+		if !found {
+			err = ErrMessageNotFound
+			return err
+		}
+		if moved, err = txStore.Conversations().MarkRead(conversation, message); err != nil || !moved {
+			return err
+		}
+		err = bus.Enqueue(txStore, bus.ConversationRead{
+			UserID:         device.UserID,
+			ConversationID: conversation.UUID,
+			MessageID:      message.MessageID,
+			UnreadCount:    conversation.UnreadCount,
+		})
+		return err
+	})
+	if err == nil && moved {
+		s.notifyRead(device.UserID, conversation, m.MessageID)
+	}
+	return err
+}
+
+// notifyRead tells the user's devices that a conversation was read, so that
+// they can clear its notifications and unread state.
+func (s GCMService) notifyRead(userID uint, conversation *model.Conversation, messageID string) {
+	key, found := s.Store.NotificationKeys().FindKey(&model.NotificationKey{UserID: userID})
+	if !found {
+		return
+	}
+	if err := s.sendDownstream(key.Key, typeConversationRead, map[string]interface{}{
+		"conversation_id": conversation.UUID,
+		"mid":             messageID,
+		"unread_count":    conversation.UnreadCount,
+	}); err != nil {
+		log.Printf("Unable to notify devices that conversation %v was read: %v\n", conversation.UUID, err)
+	}
+}
+
+// saveDraft records the phone's edit to the draft in a conversation, unless
+// another device edited it later, and tells the user's devices about it.
+func (s GCMService) saveDraft(cm gcm.CcsMessage, m DraftPayload) error {
+	device, found := s.Store.Devices().FindDevice(&model.Device{
+		RegistrationID: cm.From,
+		State:          model.DeviceStateLinked,
+	})
+	if !found {
+		return ErrUnregisteredDevice
+	}
+	draft := &model.Draft{
+		UserID:          device.UserID,
+		Body:            m.Body,
+		ClientUpdatedAt: time.Unix(int64(m.At), 0),
+	}
+	if !draft.Deleted() {
+		draft.Nonce = m.Nonce
+		draft.KeyVersion = m.KeyVersion
+	}
+	user, err := s.Store.Devices().GetRelatedUser(device)
+	if err != nil {
+		return err
+	}
+	var conversation *model.Conversation
+	s.Store.Transaction(func(txStore store.Store) error {
+		conversation, found = txStore.Conversations().FindConversation(&model.Conversation{
+			UserID:      device.UserID,
+			Participant: model.ConversationKey(model.E164Addresses(m.To, user.PhoneRegion())),
+		})
+		if !found {
+			err = ErrConversationNotFound
+			return err
+		}
+		draft.ConversationID = conversation.ID
+		if err = txStore.EncryptionKeys().CheckEnvelope(user, draft.Message()); err != nil {
+			return err
+		}
+		var saved bool
+		if saved, err = txStore.Drafts().SaveDraft(draft); err != nil {
+			return err
+		}
+		if !saved {
+			err = ErrStaleDraft
+			return err
+		}
+		err = bus.Enqueue(txStore, bus.DraftChanged{
+			UserID:         device.UserID,
+			ConversationID: conversation.UUID,
+			Deleted:        draft.Deleted(),
+		})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	key, found := s.Store.NotificationKeys().FindKey(&model.NotificationKey{UserID: device.UserID})
+	if !found {
+		return nil
+	}
+	if err := s.sendDownstream(key.Key, typeDraftChanged, draft.Render(*conversation)); err != nil {
+		log.Printf("Unable to notify devices of the draft in conversation %v: %v\n", conversation.UUID, err)
+	}
+	return nil
 }
 
 func (s GCMService) updateMessage(cm gcm.CcsMessage, m StatusPayload) error {
@@ -156,10 +720,127 @@ func (s GCMService) updateMessage(cm gcm.CcsMessage, m StatusPayload) error {
 	if !found {
 		return ErrUnregisteredDevice
 	}
-	message, found := s.Store.Messages().FindMessage(&model.Message{UserID: device.UserID, MessageID: m.MessageID})
-	if !found {
-		return ErrMessageNotFound
+	var err error
+	s.Store.Transaction(func(store store.Store) error {
+		message, found := store.Messages().FindMessage(&model.Message{UserID: device.UserID, MessageID: m.MessageID})
+		if !found {
+			err = ErrMessageNotFound
+			return err
+		}
+		clientAt := time.Unix(int64(m.At), 0)
+		if err = checkTransition(store, message, m.Status, clientAt); err != nil {
+			return err
+		}
+		if message.Status == m.Status {
+			// Repeated updates are acknowledged without changing anything
+			return nil
+		}
+		if err = store.Messages().UpdateMessageStatus(message, m.Status, clientAt); err != nil {
+			return err
+		}
+		err = bus.Enqueue(store, bus.NewStatusUpdated(message))
+		return err
+	})
+	return err
+}
+
+// failExpiredMessages fails the messages queued by the server that no phone
+// started sending within model.QueuedMessageTTL, along with any scheduled
+// messages they were dispatched for.
+func (s GCMService) failExpiredMessages(now time.Time) (int, error) {
+	var (
+		failed int
+		err    error
+	)
+	s.Store.Transaction(func(store store.Store) error {
+		var messages []model.Message
+		messages, err = store.Messages().GetMessagesByStatus(model.MessageStatusQueued, now.Add(-model.QueuedMessageTTL))
+		if err != nil {
+			return err
+		}
+		for i := range messages {
+			if err = store.Messages().UpdateMessageStatus(&messages[i], model.MessageStatusFailed, now); err != nil {
+				return err
+			}
+			if err = bus.Enqueue(store, bus.NewStatusUpdated(&messages[i])); err != nil {
+				return err
+			}
+			if err = failScheduleOf(store, &messages[i], model.ScheduleFailurePhoneOffline); err != nil {
+				return err
+			}
+		}
+		failed = len(messages)
+		return nil
+	})
+	return failed, err
+}
+
+// expireQueuedMessages periodically fails expired queued messages. This
+// catches commands queued while the service was not listening to the bus.
+func (s GCMService) expireQueuedMessages(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		s.expireMessages(now)
 	}
-	message.Status = m.Status
-	return s.Store.Messages().SaveMessage(message)
+}
+
+// expiryGrace is how long after a command expires its message is failed,
+// allowing for the clocks of the processes involved to differ slightly.
+var expiryGrace = time.Second
+
+// OnCommandQueued fails the message of a command queued on the bus as soon as
+// the command expires, unless a phone has started sending it by then.
+func (s GCMService) OnCommandQueued(event bus.Event) {
+	command := event.(bus.CommandQueued)
+	if command.Command != bus.CommandSend {
+		return
+	}
+	time.AfterFunc(command.Expires.Sub(time.Now())+expiryGrace, func() {
+		s.expireMessages(time.Now())
+	})
+}
+
+func (s GCMService) expireMessages(now time.Time) {
+	failed, err := s.failExpiredMessages(now)
+	if err != nil {
+		log.Printf("Unable to expire queued messages: %v\n", err)
+	} else if failed > 0 {
+		log.Printf("Failed %v expired queued messages\n", failed)
+	}
+}
+
+// checkTransition ensures a message may move to the reported status. Going
+// back to an earlier status, or reporting a status from before the current
+// one was reached by the client's clock, is stale.
+func checkTransition(store store.Store, message *model.Message, status string, clientAt time.Time) error {
+	if message.Status == status {
+		return nil
+	}
+	if !model.CanTransition(message.Status, status) {
+		if model.CanTransition(status, message.Status) {
+			return ErrStaleStatus
+		}
+		return ErrInvalidTransition
+	}
+	events, err := store.Messages().GetStatusEvents(message)
+	if err != nil {
+		return err
+	}
+	if len(events) > 0 && clientAt.Before(events[len(events)-1].ClientAt) {
+		return ErrStaleStatus
+	}
+	return nil
+}
+
+// approvePairing approves a pairing session from the phone and tells the
+// waiting device it can claim it.
+func (s GCMService) approvePairing(device *model.Device, m PairPayload) error {
+	session, err := pairing.Approve(s.Store, device, m.SessionID, m.Code)
+	if err != nil {
+		return err
+	}
+	// The device also polls for approval, so a failed notification is not fatal
+	if err := s.sendDownstream(session.RegistrationID, typePairingApproved, map[string]string{"session_id": session.UUID}); err != nil {
+		log.Printf("Unable to notify paired device for session %v: %v\n", session.UUID, err)
+	}
+	return nil
 }
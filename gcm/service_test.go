@@ -3,10 +3,13 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"portal-server/bus"
 	"portal-server/gcm/testutil"
 	"portal-server/model"
+	"portal-server/pairing"
 	"portal-server/store"
 	"testing"
+	"time"
 
 	"github.com/franela/goblin"
 	"github.com/google/go-gcm"
@@ -41,7 +44,7 @@ func TestService(t *testing.T) {
 					return "message_id", 200, nil
 				},
 			}
-			service := GCMService{s, ccs}
+			service := GCMService{Store: s, CCS: ccs}
 			messageID, err := service.sendMessage(&message)
 
 			assert.NoError(t, err)
@@ -56,7 +59,7 @@ func TestService(t *testing.T) {
 					return "", 400, errors.New("gcm_error")
 				},
 			}
-			service := GCMService{s, ccs}
+			service := GCMService{Store: s, CCS: ccs}
 			messageID, err := service.sendMessage(&message)
 
 			assert.EqualError(t, err, "gcm_error")
@@ -83,7 +86,7 @@ func TestService(t *testing.T) {
 					return "message_id", 200, nil
 				},
 			}
-			service := GCMService{s, ccs}
+			service := GCMService{Store: s, CCS: ccs}
 			service.errorMessage(registrationID, ErrInvalidMessageType, errorReason)
 		})
 
@@ -100,13 +103,17 @@ func TestService(t *testing.T) {
 				Type:           model.DeviceTypePhone,
 				State:          model.DeviceStateLinked,
 			})
+			acks := 0
 			ccs := testutil.TestCCS{
 				XMPPFunc: func(m *gcm.XmppMessage) (string, int, error) {
-					t.Fail() // Should not have to send a failure message
+					// Should only acknowledge the message, not send a failure
+					assert.Equal(t, registrationID, m.To)
+					assert.Equal(t, "ack", m.Data["type"])
+					acks++
 					return "", 200, nil
 				},
 			}
-			service := GCMService{s, ccs}
+			service := GCMService{Store: s, CCS: ccs}
 			payload, _ := json.Marshal(map[string]interface{}{
 				"mid":    messageID,
 				"status": "started",
@@ -126,6 +133,119 @@ func TestService(t *testing.T) {
 			assert.Equal(t, "started", fromDB.Status)
 			assert.Equal(t, "encrypted_phone_number", fromDB.To)
 			assert.Equal(t, "encrypted_body", fromDB.Body)
+			assert.Equal(t, int64(1351700038), fromDB.ClientCreatedAt.Unix())
+		})
+
+		g.Describe("Repeated messages", func() {
+			var (
+				registrationID string
+				messageID      string
+				user           model.User
+			)
+
+			upload := func(service GCMService, body string) {
+				payload, _ := json.Marshal(map[string]interface{}{
+					"mid":    messageID,
+					"status": "started",
+					"at":     1351700038,
+					"to":     "encrypted_phone_number",
+					"body":   body,
+				})
+				service.OnMessageReceived(gcm.CcsMessage{
+					From: registrationID,
+					Data: map[string]interface{}{
+						"type":    "message",
+						"payload": string(payload),
+					},
+				})
+			}
+
+			g.BeforeEach(func() {
+				registrationID = "registration_id"
+				messageID = uuid.NewV4().String()
+				user = model.User{Email: "test@test.com"}
+				s.Users().CreateUser(&user)
+				s.Devices().CreateDevice(&model.Device{
+					User:           user,
+					RegistrationID: registrationID,
+					Type:           model.DeviceTypePhone,
+					State:          model.DeviceStateLinked,
+				})
+			})
+
+			g.It("Should send an ack carrying the message id", func() {
+				var data map[string]interface{}
+				ccs := testutil.TestCCS{
+					XMPPFunc: func(m *gcm.XmppMessage) (string, int, error) {
+						data = m.Data
+						return "", 200, nil
+					},
+				}
+				upload(GCMService{Store: s, CCS: ccs}, "encrypted_body")
+				assert.Equal(t, "ack", data["type"])
+				var ack map[string]string
+				assert.NoError(t, json.Unmarshal([]byte(data["payload"].(string)), &ack))
+				assert.Equal(t, messageID, ack["mid"])
+			})
+
+			g.It("Should ignore and ack an identical duplicate", func() {
+				var sent []map[string]interface{}
+				ccs := testutil.TestCCS{
+					XMPPFunc: func(m *gcm.XmppMessage) (string, int, error) {
+						sent = append(sent, m.Data)
+						return "", 200, nil
+					},
+				}
+				service := GCMService{Store: s, CCS: ccs}
+				upload(service, "encrypted_body")
+				message, _ := s.Messages().FindMessage(&model.Message{MessageID: messageID})
+				s.Messages().UpdateMessageStatus(message, model.MessageStatusSent, time.Unix(1351700039, 0))
+				upload(service, "encrypted_body")
+
+				assert.Len(t, sent, 2)
+				assert.Equal(t, "ack", sent[1]["type"])
+				fromDB, _ := s.Messages().FindMessage(&model.Message{MessageID: messageID})
+				assert.Equal(t, model.MessageStatusSent, fromDB.Status)
+				events, _ := s.Messages().GetStatusEvents(fromDB)
+				assert.Len(t, events, 2)
+			})
+
+			g.It("Should ack a duplicate of a message that was since deleted", func() {
+				var sent []map[string]interface{}
+				ccs := testutil.TestCCS{
+					XMPPFunc: func(m *gcm.XmppMessage) (string, int, error) {
+						sent = append(sent, m.Data)
+						return "", 200, nil
+					},
+				}
+				service := GCMService{Store: s, CCS: ccs}
+				upload(service, "encrypted_body")
+				s.Messages().DeleteMessages(&model.Message{MessageID: messageID})
+				upload(service, "encrypted_body")
+
+				assert.Len(t, sent, 2)
+				assert.Equal(t, "ack", sent[1]["type"])
+				_, found := s.Messages().FindMessage(&model.Message{MessageID: messageID})
+				assert.False(t, found)
+			})
+
+			g.It("Should report a conflicting duplicate without changing the message", func() {
+				var sent []map[string]interface{}
+				ccs := testutil.TestCCS{
+					XMPPFunc: func(m *gcm.XmppMessage) (string, int, error) {
+						sent = append(sent, m.Data)
+						return "", 200, nil
+					},
+				}
+				service := GCMService{Store: s, CCS: ccs}
+				upload(service, "encrypted_body")
+				upload(service, "different_body")
+
+				assert.Len(t, sent, 2)
+				assert.Equal(t, ErrConflictingMessage.Error(), sent[1]["error"])
+				fromDB, _ := s.Messages().FindMessage(&model.Message{MessageID: messageID})
+				assert.Equal(t, "encrypted_body", fromDB.Body)
+			})
 		})
 
 		g.It("Should not record a new message if the sending device is not found and send an error downstream", func() {
@@ -137,7 +257,7 @@ func TestService(t *testing.T) {
 					return "", 200, nil
 				},
 			}
-			service := GCMService{s, ccs}
+			service := GCMService{Store: s, CCS: ccs}
 			payload, _ := json.Marshal(map[string]interface{}{
 				"mid":    messageID,
 				"status": "started",
@@ -165,7 +285,7 @@ func TestService(t *testing.T) {
 					return "", 200, nil
 				},
 			}
-			service := GCMService{s, ccs}
+			service := GCMService{Store: s, CCS: ccs}
 			payload, _ := json.Marshal(map[string]interface{}{
 				"mid":    messageID,
 				"status": "started",
@@ -193,7 +313,7 @@ func TestService(t *testing.T) {
 					return "", 200, nil
 				},
 			}
-			service := GCMService{s, ccs}
+			service := GCMService{Store: s, CCS: ccs}
 			service.OnMessageReceived(gcm.CcsMessage{
 				From: registrationID,
 				Data: map[string]interface{}{
@@ -231,7 +351,7 @@ func TestService(t *testing.T) {
 					return "", 200, nil
 				},
 			}
-			service := GCMService{s, ccs}
+			service := GCMService{Store: s, CCS: ccs}
 			payload, _ := json.Marshal(map[string]interface{}{
 				"mid":    messageID,
 				"status": "sent",
@@ -247,6 +367,1287 @@ func TestService(t *testing.T) {
 			fromDB, _ := s.Messages().FindMessage(&model.Message{MessageID: messageID})
 			assert.NotNil(t, fromDB)
 			assert.Equal(t, "sent", fromDB.Status)
+
+			events, _ := s.Messages().GetStatusEvents(fromDB)
+			assert.Equal(t, 2, len(events))
+			assert.Equal(t, "started", events[0].Status)
+			assert.Equal(t, "sent", events[1].Status)
+			assert.Equal(t, int64(1351700038), events[1].ClientAt.Unix())
+		})
+		g.Describe("Status transitions", func() {
+			registrationID := "registration_id"
+			var messageID string
+
+			sendStatus := func(status string, at int) string {
+				var sentError string
+				ccs := testutil.TestCCS{
+					XMPPFunc: func(m *gcm.XmppMessage) (string, int, error) {
+						sentError, _ = m.Data["error"].(string)
+						return "", 200, nil
+					},
+				}
+				service := GCMService{Store: s, CCS: ccs}
+				payload, _ := json.Marshal(map[string]interface{}{
+					"mid":    messageID,
+					"status": status,
+					"at":     at,
+				})
+				service.OnMessageReceived(gcm.CcsMessage{
+					From: registrationID,
+					Data: map[string]interface{}{
+						"type":    "status",
+						"payload": string(payload),
+					},
+				})
+				return sentError
+			}
+			currentStatus := func() string {
+				fromDB, _ := s.Messages().FindMessage(&model.Message{MessageID: messageID})
+				return fromDB.Status
+			}
+			eventCount := func() int {
+				fromDB, _ := s.Messages().FindMessage(&model.Message{MessageID: messageID})
+				events, _ := s.Messages().GetStatusEvents(fromDB)
+				return len(events)
+			}
+
+			g.BeforeEach(func() {
+				messageID = uuid.NewV4().String()
+				user := model.User{
+					Email: "test@test.com",
+				}
+				s.Users().CreateUser(&user)
+				s.Devices().CreateDevice(&model.Device{
+					User:           user,
+					RegistrationID: registrationID,
+					Type:           model.DeviceTypePhone,
+					State:          model.DeviceStateLinked,
+				})
+				s.Messages().CreateMessage(&model.Message{
+					User:            user,
+					MessageID:       messageID,
+					To:              "to",
+					Body:            "body",
+					Status:          "started",
+					ClientCreatedAt: time.Unix(100, 0),
+				})
+			})
+
+			g.It("Should follow started, sent and delivered", func() {
+				assert.Equal(t, "", sendStatus("sent", 110))
+				assert.Equal(t, "", sendStatus("delivered", 120))
+				assert.Equal(t, "delivered", currentStatus())
+			})
+
+			g.It("Should accept a skipped intermediate status", func() {
+				assert.Equal(t, "", sendStatus("delivered", 120))
+				assert.Equal(t, "delivered", currentStatus())
+			})
+
+			g.It("Should reject a regression as stale", func() {
+				sendStatus("delivered", 120)
+				assert.Equal(t, "stale_status", sendStatus("sent", 110))
+				assert.Equal(t, "delivered", currentStatus())
+			})
+
+			g.It("Should reject a status from before the current one as stale", func() {
+				sendStatus("sent", 110)
+				assert.Equal(t, "stale_status", sendStatus("failed", 105))
+				assert.Equal(t, "sent", currentStatus())
+			})
+
+			g.It("Should reject a transition out of a final status", func() {
+				sendStatus("failed", 110)
+				assert.Equal(t, "invalid_status_transition", sendStatus("delivered", 120))
+				assert.Equal(t, "failed", currentStatus())
+			})
+
+			g.It("Should accept a repeated status without side effects", func() {
+				sendStatus("sent", 110)
+				assert.Equal(t, 2, eventCount())
+				assert.Equal(t, "", sendStatus("sent", 110))
+				assert.Equal(t, 2, eventCount())
+			})
+		})
+
+		g.Describe("Attachments", func() {
+			registrationID := "registration_id"
+			attachmentID := "9b2f6c1e-3d4a-4e5b-8f6a-7c8d9e0f1a2b"
+			var (
+				messageID string
+				user      model.User
+			)
+
+			upload := func(body string, attachments []string) map[string]interface{} {
+				var sent map[string]interface{}
+				ccs := testutil.TestCCS{
+					XMPPFunc: func(m *gcm.XmppMessage) (string, int, error) {
+						sent = m.Data
+						return "", 200, nil
+					},
+				}
+				payload, _ := json.Marshal(map[string]interface{}{
+					"mid":         messageID,
+					"status":      "sent",
+					"at":          1351700038,
+					"to":          "5551234",
+					"body":        body,
+					"attachments": attachments,
+				})
+				GCMService{Store: s, CCS: ccs}.OnMessageReceived(gcm.CcsMessage{
+					From: registrationID,
+					Data: map[string]interface{}{
+						"type":    "message",
+						"payload": string(payload),
+					},
+				})
+				return sent
+			}
+
+			g.BeforeEach(func() {
+				messageID = uuid.NewV4().String()
+				user = model.User{Email: "test@test.com"}
+				s.Users().CreateUser(&user)
+				s.Devices().CreateDevice(&model.Device{
+					User:           user,
+					RegistrationID: registrationID,
+					Type:           model.DeviceTypePhone,
+					State:          model.DeviceStateLinked,
+				})
+				s.Attachments().CreateAttachment(&model.Attachment{
+					User:        user,
+					UUID:        attachmentID,
+					ContentType: "image/png",
+					Size:        10,
+				})
+			})
+
+			g.It("Should link uploaded attachments to a message without a body", func() {
+				sent := upload("", []string{attachmentID})
+				assert.Equal(t, "ack", sent["type"])
+
+				message, found := s.Messages().FindMessage(&model.Message{MessageID: messageID})
+				assert.True(t, found)
+				attachments, _ := s.Attachments().GetAttachments(message)
+				assert.Len(t, attachments, 1)
+				assert.Equal(t, attachmentID, attachments[0].UUID)
+			})
+
+			g.It("Should not record a message with an unknown attachment", func() {
+				sent := upload("hello", []string{attachmentID, uuid.NewV4().String()})
+				assert.Equal(t, ErrInvalidAttachment.Error(), sent["error"])
+
+				_, found := s.Messages().FindMessage(&model.Message{MessageID: messageID})
+				assert.False(t, found)
+				attachment, _ := s.Attachments().FindAttachment(&model.Attachment{UUID: attachmentID})
+				assert.Zero(t, attachment.MessageID)
+			})
+
+			g.It("Should not link an attachment used by another message", func() {
+				upload("hello", []string{attachmentID})
+				messageID = uuid.NewV4().String()
+				sent := upload("again", []string{attachmentID})
+				assert.Equal(t, ErrInvalidAttachment.Error(), sent["error"])
+			})
+
+			g.It("Should reject malformed attachment IDs", func() {
+				sent := upload("hello", []string{"attachment"})
+				assert.Equal(t, ErrInvalidAttachment.Error(), sent["error"])
+
+				_, found := s.Messages().FindMessage(&model.Message{MessageID: messageID})
+				assert.False(t, found)
+			})
+
+			g.It("Should require a body or attachments", func() {
+				sent := upload("", nil)
+				assert.Equal(t, ErrInvalidMessagePayload.Error(), sent["error"])
+			})
+		})
+
+		g.Describe("Events", func() {
+			registrationID := "registration_id"
+			var (
+				service GCMService
+				user    model.User
+			)
+
+			receive := func(typ string, message map[string]interface{}) {
+				payload, _ := json.Marshal(message)
+				service.OnMessageReceived(gcm.CcsMessage{
+					From: registrationID,
+					Data: map[string]interface{}{
+						"type":    typ,
+						"payload": string(payload),
+					},
+				})
+			}
+
+			// relay publishes the events in the outbox, returning them
+			relay := func() []bus.Event {
+				b := bus.NewMemoryBus()
+				var relayed []bus.Event
+				for _, topic := range []string{bus.TopicMessageRecorded, bus.TopicStatusUpdated} {
+					b.Subscribe(topic, func(event bus.Event) {
+						relayed = append(relayed, event)
+					})
+				}
+				_, err := bus.Relay(s, b)
+				assert.NoError(t, err)
+				return relayed
+			}
+
+			g.BeforeEach(func() {
+				ccs := testutil.TestCCS{
+					XMPPFunc: func(m *gcm.XmppMessage) (string, int, error) {
+						return "", 200, nil
+					},
+				}
+				service = GCMService{Store: s, CCS: ccs}
+				user = model.User{Email: "test@test.com"}
+				s.Users().CreateUser(&user)
+				s.Devices().CreateDevice(&model.Device{
+					User:           user,
+					RegistrationID: registrationID,
+					Type:           model.DeviceTypePhone,
+					State:          model.DeviceStateLinked,
+				})
+			})
+
+			g.It("Should add recorded messages and status changes to the outbox once", func() {
+				messageID := uuid.NewV4().String()
+				message := map[string]interface{}{
+					"mid":    messageID,
+					"status": "started",
+					"at":     1351700038,
+					"to":     "5551234",
+					"body":   "hello",
+				}
+				receive("message", message)
+				receive("message", message)
+				status := map[string]interface{}{
+					"mid":    messageID,
+					"status": "sent",
+					"at":     1351700039,
+				}
+				receive("status", status)
+				receive("status", status)
+
+				fromDB, _ := s.Messages().FindMessage(&model.Message{MessageID: messageID})
+				assert.Equal(t, []bus.Event{
+					bus.MessageRecorded{UserID: user.ID, MessageID: messageID, Status: "started", Seq: fromDB.Seq - 1},
+					bus.StatusUpdated{UserID: user.ID, MessageID: messageID, Status: "sent", Seq: fromDB.Seq},
+				}, relay())
+				assert.Empty(t, relay())
+			})
+
+			g.It("Should add received messages to the outbox", func() {
+				receive("incoming", map[string]interface{}{
+					"mid":  uuid.NewV4().String(),
+					"from": "5551234",
+					"body": "hello",
+					"at":   1351700038,
+				})
+				relayed := relay()
+				assert.Len(t, relayed, 1)
+				assert.Equal(t, model.MessageStatusReceived, relayed[0].(bus.MessageRecorded).Status)
+			})
+
+			g.It("Should not add rejected messages to the outbox", func() {
+				receive("message", map[string]interface{}{
+					"mid":         uuid.NewV4().String(),
+					"status":      "started",
+					"at":          1351700038,
+					"to":          "5551234",
+					"attachments": []string{uuid.NewV4().String()},
+				})
+				assert.Empty(t, relay())
+			})
+
+			g.It("Should add expired messages failing to the outbox", func() {
+				s.Messages().CreateMessage(&model.Message{
+					User:      user,
+					MessageID: uuid.NewV4().String(),
+					Status:    model.MessageStatusQueued,
+					To:        "5551234",
+					Body:      "hello",
+				})
+				failed, err := service.failExpiredMessages(time.Now().Add(model.QueuedMessageTTL + time.Minute))
+				assert.NoError(t, err)
+				assert.Equal(t, 1, failed)
+				relayed := relay()
+				assert.Len(t, relayed, 1)
+				assert.Equal(t, model.MessageStatusFailed, relayed[0].(bus.StatusUpdated).Status)
+			})
+
+			g.It("Should fail a queued message once its command expires", func() {
+				defer func(ttl, grace time.Duration) {
+					model.QueuedMessageTTL = ttl
+					expiryGrace = grace
+				}(model.QueuedMessageTTL, expiryGrace)
+				model.QueuedMessageTTL = 0
+				expiryGrace = 0
+				message := &model.Message{
+					User:      user,
+					MessageID: uuid.NewV4().String(),
+					Status:    model.MessageStatusQueued,
+					To:        "5551234",
+					Body:      "hello",
+				}
+				s.Messages().CreateMessage(message)
+
+				b := bus.NewMemoryBus()
+				b.Subscribe(bus.TopicCommandQueued, service.OnCommandQueued)
+				b.Publish(bus.CommandQueued{
+					UserID:    user.ID,
+					MessageID: message.MessageID,
+					Command:   bus.CommandSend,
+					Expires:   time.Now(),
+				})
+				time.Sleep(100 * time.Millisecond)
+
+				fromDB, _ := s.Messages().FindMessage(&model.Message{MessageID: message.MessageID})
+				assert.Equal(t, model.MessageStatusFailed, fromDB.Status)
+			})
+		})
+
+		g.Describe("Read markers", func() {
+			registrationID := "registration_id"
+			var (
+				user model.User
+				mids []string
+			)
+
+			// send delivers an upstream message, returning the messages sent
+			// downstream in reply
+			send := func(typ string, message map[string]interface{}) []*gcm.XmppMessage {
+				var sent []*gcm.XmppMessage
+				ccs := testutil.TestCCS{
+					XMPPFunc: func(m *gcm.XmppMessage) (string, int, error) {
+						sent = append(sent, m)
+						return "", 200, nil
+					},
+				}
+				payload, _ := json.Marshal(message)
+				GCMService{Store: s, CCS: ccs}.OnMessageReceived(gcm.CcsMessage{
+					From: registrationID,
+					Data: map[string]interface{}{
+						"type":    typ,
+						"payload": string(payload),
+					},
+				})
+				return sent
+			}
+
+			g.BeforeEach(func() {
+				user = model.User{Email: "test@test.com"}
+				s.Users().CreateUser(&user)
+				s.Devices().CreateDevice(&model.Device{
+					User:           user,
+					RegistrationID: registrationID,
+					Type:           model.DeviceTypePhone,
+					State:          model.DeviceStateLinked,
+				})
+				s.NotificationKeys().CreateKey(&model.NotificationKey{
+					User:      user,
+					GroupName: "group",
+					Key:       "notification_key",
+				})
+				mids = nil
+				for i := 0; i < 3; i++ {
+					mid := uuid.NewV4().String()
+					s.Messages().CreateMessage(&model.Message{
+						User:      user,
+						From:      "5551234",
+						MessageID: mid,
+						Body:      "hello",
+						Status:    model.MessageStatusReceived,
+						Direction: model.MessageDirectionIncoming,
+					})
+					mids = append(mids, mid)
+				}
+			})
+
+			g.It("Should mark the conversation read and tell all devices", func() {
+				sent := send("read", map[string]interface{}{"mid": mids[1]})
+				assert.Len(t, sent, 2)
+				assert.Equal(t, "notification_key", sent[0].To)
+				assert.Equal(t, "conversation_read", sent[0].Data["type"])
+				var notified map[string]interface{}
+				json.Unmarshal([]byte(sent[0].Data["payload"].(string)), &notified)
+				assert.Equal(t, mids[1], notified["mid"])
+				assert.Equal(t, float64(1), notified["unread_count"])
+				assert.Equal(t, registrationID, sent[1].To)
+				assert.Equal(t, "ack", sent[1].Data["type"])
+
+				conversation, _ := s.Conversations().FindConversation(&model.Conversation{UserID: user.ID})
+				assert.Equal(t, conversation.UUID, notified["conversation_id"])
+				assert.Equal(t, 1, conversation.UnreadCount)
+				read, _ := s.Messages().FindMessage(&model.Message{MessageID: mids[0]})
+				assert.True(t, read.Read)
+			})
+
+			g.It("Should acknowledge stale markers without telling devices", func() {
+				send("read", map[string]interface{}{"mid": mids[2]})
+				sent := send("read", map[string]interface{}{"mid": mids[0]})
+				assert.Len(t, sent, 1)
+				assert.Equal(t, "ack", sent[0].Data["type"])
+			})
+
+			g.It("Should reject unknown messages", func() {
+				sent := send("read", map[string]interface{}{"mid": uuid.NewV4().String()})
+				assert.Len(t, sent, 1)
+				assert.Equal(t, ErrMessageNotFound.Error(), sent[0].Data["error"])
+			})
+
+			g.It("Should require a message", func() {
+				sent := send("read", map[string]interface{}{})
+				assert.Len(t, sent, 1)
+				assert.Equal(t, ErrInvalidMessagePayload.Error(), sent[0].Data["error"])
+			})
+		})
+
+		g.Describe("Drafts", func() {
+			registrationID := "registration_id"
+			var user model.User
+
+			// send delivers an upstream draft, returning the messages sent
+			// downstream in reply
+			send := func(message map[string]interface{}) []*gcm.XmppMessage {
+				var sent []*gcm.XmppMessage
+				ccs := testutil.TestCCS{
+					XMPPFunc: func(m *gcm.XmppMessage) (string, int, error) {
+						sent = append(sent, m)
+						return "", 200, nil
+					},
+				}
+				payload, _ := json.Marshal(message)
+				GCMService{Store: s, CCS: ccs}.OnMessageReceived(gcm.CcsMessage{
+					From: registrationID,
+					Data: map[string]interface{}{
+						"type":    "draft",
+						"payload": string(payload),
+					},
+				})
+				return sent
+			}
+
+			g.BeforeEach(func() {
+				user = model.User{Email: "test@test.com"}
+				s.Users().CreateUser(&user)
+				s.Devices().CreateDevice(&model.Device{
+					User:           user,
+					RegistrationID: registrationID,
+					Type:           model.DeviceTypePhone,
+					State:          model.DeviceStateLinked,
+				})
+				s.NotificationKeys().CreateKey(&model.NotificationKey{
+					User:      user,
+					GroupName: "group",
+					Key:       "notification_key",
+				})
+				s.Messages().CreateMessage(&model.Message{
+					User:      user,
+					From:      "+1 (555) 123-4567",
+					MessageID: uuid.NewV4().String(),
+					Body:      "hello",
+					Status:    model.MessageStatusReceived,
+					Direction: model.MessageDirectionIncoming,
+				})
+			})
+
+			g.It("Should save the draft and tell all devices", func() {
+				at := time.Now().Unix()
+				sent := send(map[string]interface{}{"to": "+15551234567", "body": "hel", "at": at})
+				assert.Len(t, sent, 1)
+				assert.Equal(t, "notification_key", sent[0].To)
+				assert.Equal(t, typeDraftChanged, sent[0].Data["type"])
+				var notified model.DraftBody
+				json.Unmarshal([]byte(sent[0].Data["payload"].(string)), &notified)
+				assert.Equal(t, "hel", notified.Body)
+				assert.Equal(t, at, notified.At)
+				assert.False(t, notified.Deleted)
+
+				conversation, _ := s.Conversations().FindConversation(&model.Conversation{UserID: user.ID})
+				assert.Equal(t, conversation.UUID, notified.ConversationID)
+				draft, found := s.Drafts().FindDraft(&model.Draft{UserID: user.ID, ConversationID: conversation.ID})
+				assert.True(t, found)
+				assert.Equal(t, "hel", draft.Body)
+			})
+
+			g.It("Should delete the draft with an empty body", func() {
+				at := time.Now().Unix()
+				send(map[string]interface{}{"to": "+15551234567", "body": "hel", "at": at})
+				sent := send(map[string]interface{}{"to": "+15551234567", "body": "", "at": at + 1})
+				var notified model.DraftBody
+				json.Unmarshal([]byte(sent[0].Data["payload"].(string)), &notified)
+				assert.True(t, notified.Deleted)
+
+				draft, _ := s.Drafts().FindDraft(&model.Draft{UserID: user.ID})
+				assert.True(t, draft.Deleted())
+			})
+
+			g.It("Should reject an edit older than the saved draft", func() {
+				at := time.Now().Unix()
+				send(map[string]interface{}{"to": "+15551234567", "body": "hello", "at": at})
+				sent := send(map[string]interface{}{"to": "+15551234567", "body": "hel", "at": at - 5})
+				assert.Len(t, sent, 1)
+				assert.Equal(t, ErrStaleDraft.Error(), sent[0].Data["error"])
+
+				draft, _ := s.Drafts().FindDraft(&model.Draft{UserID: user.ID})
+				assert.Equal(t, "hello", draft.Body)
+			})
+
+			g.It("Should reject a draft for an unknown conversation", func() {
+				sent := send(map[string]interface{}{"to": "5550000", "body": "hel", "at": time.Now().Unix()})
+				assert.Len(t, sent, 1)
+				assert.Equal(t, ErrConversationNotFound.Error(), sent[0].Data["error"])
+			})
+		})
+
+		g.Describe("Encrypted messages", func() {
+			registrationID := "registration_id"
+			ciphertext := "c2VhbGVkIG1lc3NhZ2UgYm9keQ=="
+			nonce := "AAECAwQFBgcICQoL"
+			var (
+				messageID string
+				user      model.User
+			)
+
+			send := func(typ string, message map[string]interface{}) map[string]interface{} {
+				var sent map[string]interface{}
+				ccs := testutil.TestCCS{
+					XMPPFunc: func(m *gcm.XmppMessage) (string, int, error) {
+						sent = m.Data
+						return "", 200, nil
+					},
+				}
+				payload, _ := json.Marshal(message)
+				GCMService{Store: s, CCS: ccs}.OnMessageReceived(gcm.CcsMessage{
+					From: registrationID,
+					Data: map[string]interface{}{
+						"type":    typ,
+						"payload": string(payload),
+					},
+				})
+				return sent
+			}
+			upload := func(body, nonce string, keyVersion int) map[string]interface{} {
+				return send("message", map[string]interface{}{
+					"mid":         messageID,
+					"status":      "sent",
+					"at":          1351700038,
+					"to":          "5551234",
+					"body":        body,
+					"nonce":       nonce,
+					"key_version": keyVersion,
+				})
+			}
+			optIn := func() {
+				user.EncryptedMessages = true
+				s.Users().SaveUser(&user)
+			}
+
+			g.BeforeEach(func() {
+				messageID = uuid.NewV4().String()
+				user = model.User{Email: "test@test.com"}
+				s.Users().CreateUser(&user)
+				s.Devices().CreateDevice(&model.Device{
+					User:           user,
+					RegistrationID: registrationID,
+					Type:           model.DeviceTypePhone,
+					State:          model.DeviceStateLinked,
+				})
+				s.EncryptionKeys().CreateKey(&model.EncryptionKey{
+					User:    user,
+					Version: 1,
+					Current: true,
+					Key:     "key",
+				})
+			})
+
+			g.It("Should record ciphertext untouched", func() {
+				optIn()
+				sent := upload(ciphertext, nonce, 1)
+				assert.Equal(t, "ack", sent["type"])
+
+				message, found := s.Messages().FindMessage(&model.Message{MessageID: messageID})
+				assert.True(t, found)
+				assert.Equal(t, ciphertext, message.Body)
+				assert.Equal(t, nonce, message.Nonce)
+				assert.Equal(t, 1, message.KeyVersion)
+			})
+
+			g.It("Should reject plaintext once the user opts in", func() {
+				optIn()
+				sent := upload("hello", "", 0)
+				assert.Equal(t, ErrEncryptionRequired.Error(), sent["error"])
+				_, found := s.Messages().FindMessage(&model.Message{MessageID: messageID})
+				assert.False(t, found)
+			})
+
+			g.It("Should reject a malformed envelope or unknown key version", func() {
+				optIn()
+				assert.Equal(t, ErrInvalidEnvelope.Error(), upload("hello", nonce, 1)["error"])
+				assert.Equal(t, ErrInvalidEnvelope.Error(), upload(ciphertext, "bm9uY2U=", 1)["error"])
+				assert.Equal(t, ErrInvalidEnvelope.Error(), upload(ciphertext, nonce, 0)["error"])
+				assert.Equal(t, ErrInvalidEnvelope.Error(), upload(ciphertext, nonce, 2)["error"])
+				_, found := s.Messages().FindMessage(&model.Message{MessageID: messageID})
+				assert.False(t, found)
+			})
+
+			g.It("Should migrate a plaintext message to ciphertext", func() {
+				upload("hello", "", 0)
+				recorded, _ := s.Messages().FindMessage(&model.Message{MessageID: messageID})
+				optIn()
+
+				reupload := map[string]interface{}{
+					"mid":         messageID,
+					"body":        ciphertext,
+					"nonce":       nonce,
+					"key_version": 1,
+				}
+				sent := send("encrypt", reupload)
+				assert.Equal(t, "ack", sent["type"])
+
+				message, _ := s.Messages().FindMessage(&model.Message{MessageID: messageID})
+				assert.Equal(t, ciphertext, message.Body)
+				assert.Equal(t, nonce, message.Nonce)
+				assert.Equal(t, recorded.ConversationID, message.ConversationID)
+				assert.True(t, message.Seq > recorded.Seq)
+				assert.Equal(t, 0, s.Messages().GetPlaintextCount(&user))
+
+				// Repeated uploads are acknowledged without a new change
+				sent = send("encrypt", reupload)
+				assert.Equal(t, "ack", sent["type"])
+				repeated, _ := s.Messages().FindMessage(&model.Message{MessageID: messageID})
+				assert.Equal(t, message.Seq, repeated.Seq)
+			})
+
+			g.It("Should only migrate messages once the user opts in", func() {
+				upload("hello", "", 0)
+				sent := send("encrypt", map[string]interface{}{
+					"mid":         messageID,
+					"body":        ciphertext,
+					"nonce":       nonce,
+					"key_version": 1,
+				})
+				assert.Equal(t, ErrEncryptionDisabled.Error(), sent["error"])
+				message, _ := s.Messages().FindMessage(&model.Message{MessageID: messageID})
+				assert.Equal(t, "hello", message.Body)
+			})
+
+			g.It("Should not migrate an unknown message", func() {
+				optIn()
+				sent := send("encrypt", map[string]interface{}{
+					"mid":         messageID,
+					"body":        ciphertext,
+					"nonce":       nonce,
+					"key_version": 1,
+				})
+				assert.Equal(t, ErrMessageNotFound.Error(), sent["error"])
+			})
+		})
+
+		g.Describe("Group messages", func() {
+			registrationID := "registration_id"
+			var user model.User
+
+			record := func(typ string, payload map[string]interface{}) {
+				encoded, _ := json.Marshal(payload)
+				ccs := testutil.TestCCS{
+					XMPPFunc: func(m *gcm.XmppMessage) (string, int, error) {
+						assert.Nil(t, m.Data["error"])
+						return "", 200, nil
+					},
+				}
+				GCMService{Store: s, CCS: ccs}.OnMessageReceived(gcm.CcsMessage{
+					From: registrationID,
+					Data: map[string]interface{}{
+						"type":    typ,
+						"payload": string(encoded),
+					},
+				})
+			}
+
+			g.BeforeEach(func() {
+				user = model.User{Email: "test@test.com"}
+				s.Users().CreateUser(&user)
+				s.Devices().CreateDevice(&model.Device{
+					User:           user,
+					RegistrationID: registrationID,
+					Type:           model.DeviceTypePhone,
+					State:          model.DeviceStateLinked,
+				})
+			})
+
+			g.It("Should record every recipient and share a conversation with replies", func() {
+				sentID := uuid.NewV4().String()
+				record("message", map[string]interface{}{
+					"mid":    sentID,
+					"to":     []string{"555-1234", "+1 555 6789"},
+					"status": "sent",
+					"at":     1351700038,
+					"body":   "hello all",
+				})
+				record("incoming", map[string]interface{}{
+					"mid":  uuid.NewV4().String(),
+					"from": "+15556789",
+					"to":   []string{"5551234"},
+					"at":   1351700040,
+					"body": "hi",
+				})
+
+				sent, _ := s.Messages().FindMessage(&model.Message{MessageID: sentID})
+				s.Messages().LoadDetails(sent)
+				assert.Equal(t, []string{"5551234", "+15556789"}, sent.RecipientAddresses())
+				assert.Equal(t, "5551234, +15556789", sent.To)
+
+				conversations, _ := s.Conversations().GetConversationsByUser(&user)
+				assert.Len(t, conversations, 1)
+				assert.Equal(t, []string{"+15556789", "5551234"}, conversations[0].Participants())
+				assert.Equal(t, []string{"5551234"}, conversations[0].LastMessage.RecipientAddresses())
+			})
+		})
+
+		g.Describe("Incoming messages", func() {
+			registrationID := "registration_id"
+			var (
+				messageID string
+				user      model.User
+			)
+
+			receive := func(service GCMService, body string) {
+				payload, _ := json.Marshal(map[string]interface{}{
+					"mid":  messageID,
+					"from": "+15551234567",
+					"at":   1351700038,
+					"body": body,
+				})
+				service.OnMessageReceived(gcm.CcsMessage{
+					From: registrationID,
+					Data: map[string]interface{}{
+						"type":    "incoming",
+						"payload": string(payload),
+					},
+				})
+			}
+
+			g.BeforeEach(func() {
+				messageID = uuid.NewV4().String()
+				user = model.User{Email: "test@test.com"}
+				s.Users().CreateUser(&user)
+				s.Devices().CreateDevice(&model.Device{
+					User:           user,
+					RegistrationID: registrationID,
+					Type:           model.DeviceTypePhone,
+					State:          model.DeviceStateLinked,
+				})
+				s.Devices().CreateDevice(&model.Device{
+					User:           user,
+					RegistrationID: "desktop",
+					Type:           model.DeviceTypeDesktop,
+					State:          model.DeviceStateLinked,
+				})
+			})
+
+			g.It("Should record an unread message and notify the other devices", func() {
+				sent := map[string]gcm.Data{}
+				ccs := testutil.TestCCS{
+					XMPPFunc: func(m *gcm.XmppMessage) (string, int, error) {
+						sent[m.To] = m.Data
+						return "", 200, nil
+					},
+				}
+				receive(GCMService{Store: s, CCS: ccs}, "hello")
+
+				fromDB, found := s.Messages().FindMessage(&model.Message{MessageID: messageID})
+				assert.True(t, found)
+				assert.Equal(t, model.MessageDirectionIncoming, fromDB.Direction)
+				assert.Equal(t, model.MessageStatusReceived, fromDB.Status)
+				assert.Equal(t, "+15551234567", fromDB.From)
+				assert.Equal(t, "hello", fromDB.Body)
+				assert.True(t, fromDB.Unread())
+				conversation, _ := s.Conversations().FindConversation(&model.Conversation{UserID: user.ID})
+				assert.Equal(t, "+15551234567", conversation.Participant)
+				assert.Equal(t, 1, conversation.UnreadCount)
+
+				assert.Len(t, sent, 2)
+				assert.Equal(t, "ack", sent[registrationID]["type"])
+				assert.Equal(t, "incoming_message", sent["desktop"]["type"])
+				var notification map[string]interface{}
+				assert.NoError(t, json.Unmarshal([]byte(sent["desktop"]["payload"].(string)), &notification))
+				assert.Equal(t, messageID, notification["mid"])
+				assert.Equal(t, "+15551234567", notification["from"])
+				assert.Equal(t, "hello", notification["body"])
+			})
+
+			g.It("Should not notify the other devices of a repeated message", func() {
+				var sent []string
+				ccs := testutil.TestCCS{
+					XMPPFunc: func(m *gcm.XmppMessage) (string, int, error) {
+						sent = append(sent, m.To)
+						return "", 200, nil
+					},
+				}
+				service := GCMService{Store: s, CCS: ccs}
+				receive(service, "hello")
+				receive(service, "hello")
+				assert.Equal(t, []string{"desktop", registrationID, registrationID}, sent)
+			})
+
+			g.It("Should report a conflicting repeated message", func() {
+				var sentError string
+				ccs := testutil.TestCCS{
+					XMPPFunc: func(m *gcm.XmppMessage) (string, int, error) {
+						sentError, _ = m.Data["error"].(string)
+						return "", 200, nil
+					},
+				}
+				service := GCMService{Store: s, CCS: ccs}
+				receive(service, "hello")
+				receive(service, "goodbye")
+				assert.Equal(t, ErrConflictingMessage.Error(), sentError)
+			})
+		})
+
+		g.Describe("Queued messages", func() {
+			registrationID := "registration_id"
+			var messageID string
+
+			g.BeforeEach(func() {
+				messageID = uuid.NewV4().String()
+				user := model.User{
+					Email: "test@test.com",
+				}
+				s.Users().CreateUser(&user)
+				s.Devices().CreateDevice(&model.Device{
+					User:           user,
+					RegistrationID: registrationID,
+					Type:           model.DeviceTypePhone,
+					State:          model.DeviceStateLinked,
+				})
+				s.Messages().CreateMessage(&model.Message{
+					User:      user,
+					MessageID: messageID,
+					To:        "to",
+					Body:      "body",
+					Status:    model.MessageStatusQueued,
+				})
+			})
+
+			g.It("Should let the phone start sending a queued message", func() {
+				ccs := testutil.TestCCS{
+					XMPPFunc: func(m *gcm.XmppMessage) (string, int, error) {
+						t.Fail() // Should not have to send a failure message
+						return "", 200, nil
+					},
+				}
+				service := GCMService{Store: s, CCS: ccs}
+				for _, status := range []string{"started", "sent"} {
+					payload, _ := json.Marshal(map[string]interface{}{
+						"mid":    messageID,
+						"status": status,
+						"at":     time.Now().Unix(),
+					})
+					service.OnMessageReceived(gcm.CcsMessage{
+						From: registrationID,
+						Data: map[string]interface{}{
+							"type":    "status",
+							"payload": string(payload),
+						},
+					})
+				}
+				fromDB, _ := s.Messages().FindMessage(&model.Message{MessageID: messageID})
+				assert.Equal(t, model.MessageStatusSent, fromDB.Status)
+			})
+
+			g.It("Should fail queued messages once they expire", func() {
+				service := GCMService{Store: s, CCS: testutil.TestCCS{}}
+
+				failed, err := service.failExpiredMessages(time.Now())
+				assert.NoError(t, err)
+				assert.Equal(t, 0, failed)
+
+				failed, err = service.failExpiredMessages(time.Now().Add(model.QueuedMessageTTL + time.Second))
+				assert.NoError(t, err)
+				assert.Equal(t, 1, failed)
+				fromDB, _ := s.Messages().FindMessage(&model.Message{MessageID: messageID})
+				assert.Equal(t, model.MessageStatusFailed, fromDB.Status)
+				events, _ := s.Messages().GetStatusEvents(fromDB)
+				assert.Len(t, events, 2)
+			})
+
+			g.It("Should not fail messages a phone has started", func() {
+				service := GCMService{Store: s, CCS: testutil.TestCCS{}}
+				message, _ := s.Messages().FindMessage(&model.Message{MessageID: messageID})
+				s.Messages().UpdateMessageStatus(message, model.MessageStatusStarted, time.Now())
+
+				failed, err := service.failExpiredMessages(time.Now().Add(model.QueuedMessageTTL + time.Second))
+				assert.NoError(t, err)
+				assert.Equal(t, 0, failed)
+			})
+		})
+
+		g.Describe("Scheduled messages", func() {
+			var (
+				user      model.User
+				messageID string
+				sent      []*gcm.XmppMessage
+				service   GCMService
+			)
+
+			schedule := func(sendAt time.Time) {
+				scheduled := &model.ScheduledMessage{
+					UserID:    user.ID,
+					MessageID: messageID,
+					Body:      "body",
+					SendAt:    sendAt,
+					Status:    model.ScheduleStatusPending,
+				}
+				scheduled.SetRecipients([]string{"justin", "5551234"})
+				s.ScheduledMessages().CreateScheduledMessage(scheduled)
+			}
+
+			findSchedule := func() *model.ScheduledMessage {
+				scheduled, _ := s.ScheduledMessages().FindScheduledMessage(&model.ScheduledMessage{MessageID: messageID})
+				return scheduled
+			}
+
+			g.BeforeEach(func() {
+				messageID = uuid.NewV4().String()
+				sent = nil
+				service = GCMService{Store: s, CCS: testutil.TestCCS{
+					XMPPFunc: func(m *gcm.XmppMessage) (string, int, error) {
+						sent = append(sent, m)
+						return "", 200, nil
+					},
+				}}
+				user = model.User{Email: "test@test.com"}
+				s.Users().CreateUser(&user)
+				key := model.NotificationKey{User: user, GroupName: "group", Key: "notification_key"}
+				s.NotificationKeys().CreateKey(&key)
+				s.Devices().CreateDevice(&model.Device{
+					User:            user,
+					NotificationKey: key,
+					RegistrationID:  "registration_id",
+					Type:            model.DeviceTypePhone,
+					State:           model.DeviceStateLinked,
+				})
+			})
+
+			g.It("Should leave messages pending until they are due", func() {
+				schedule(time.Now().Add(time.Hour))
+
+				dispatched, err := service.dispatchDueMessages(time.Now())
+				assert.NoError(t, err)
+				assert.Equal(t, 0, dispatched)
+				assert.Empty(t, sent)
+				assert.Equal(t, model.ScheduleStatusPending, findSchedule().Status)
+			})
+
+			g.It("Should queue a due message and tell the phone to send it", func() {
+				schedule(time.Now().Add(-time.Second))
+
+				dispatched, err := service.dispatchDueMessages(time.Now())
+				assert.NoError(t, err)
+				assert.Equal(t, 1, dispatched)
+
+				message, found := s.Messages().FindMessage(&model.Message{MessageID: messageID})
+				assert.True(t, found)
+				assert.Equal(t, model.MessageStatusQueued, message.Status)
+				assert.Equal(t, "body", message.Body)
+				assert.Equal(t, "justin, 5551234", message.To)
+
+				assert.Len(t, sent, 1)
+				assert.Equal(t, "notification_key", sent[0].To)
+				assert.Equal(t, typeSendMessage, sent[0].Data[discriminator])
+				assert.InDelta(t, model.QueuedMessageTTL.Seconds(), float64(sent[0].TimeToLive), 1)
+				var payload model.MessageBody
+				assert.NoError(t, json.Unmarshal([]byte(sent[0].Data["payload"].(string)), &payload))
+				assert.Equal(t, messageID, payload.MessageID)
+				assert.Equal(t, model.MessageDirectionOutgoing, payload.Direction)
+				assert.Equal(t, []string{"justin", "5551234"}, payload.Recipients)
+
+				scheduled := findSchedule()
+				assert.Equal(t, model.ScheduleStatusDispatched, scheduled.Status)
+				assert.NotNil(t, scheduled.DispatchedAt)
+
+				// Dispatched messages are not sent again
+				dispatched, err = service.dispatchDueMessages(time.Now())
+				assert.NoError(t, err)
+				assert.Equal(t, 0, dispatched)
+				assert.Len(t, sent, 1)
+			})
+
+			g.It("Should tell the phone again when telling it fails", func() {
+				schedule(time.Now().Add(-time.Second))
+				service.CCS = testutil.TestCCS{
+					XMPPFunc: func(m *gcm.XmppMessage) (string, int, error) {
+						return "", 500, errors.New("unavailable")
+					},
+				}
+				dispatched, err := service.dispatchDueMessages(time.Now())
+				assert.NoError(t, err)
+				assert.Equal(t, 1, dispatched)
+				assert.Equal(t, model.ScheduleStatusDispatching, findSchedule().Status)
+				message, found := s.Messages().FindMessage(&model.Message{MessageID: messageID})
+				assert.True(t, found)
+				assert.Equal(t, model.MessageStatusQueued, message.Status)
+
+				service.CCS = testutil.TestCCS{
+					XMPPFunc: func(m *gcm.XmppMessage) (string, int, error) {
+						sent = append(sent, m)
+						return "", 200, nil
+					},
+				}
+				dispatched, err = service.dispatchDueMessages(time.Now())
+				assert.NoError(t, err)
+				assert.Equal(t, 1, dispatched)
+				assert.Len(t, sent, 1)
+				var payload model.MessageBody
+				assert.NoError(t, json.Unmarshal([]byte(sent[0].Data["payload"].(string)), &payload))
+				assert.Equal(t, messageID, payload.MessageID)
+				assert.Equal(t, model.ScheduleStatusDispatched, findSchedule().Status)
+			})
+
+			g.It("Should fail a message the phone could not be told about once it expires", func() {
+				schedule(time.Now().Add(-time.Second))
+				service.CCS = testutil.TestCCS{
+					XMPPFunc: func(m *gcm.XmppMessage) (string, int, error) {
+						return "", 500, errors.New("unavailable")
+					},
+				}
+				service.dispatchDueMessages(time.Now())
+				assert.Equal(t, model.ScheduleStatusDispatching, findSchedule().Status)
+
+				failed, err := service.failExpiredMessages(time.Now().Add(model.QueuedMessageTTL + time.Second))
+				assert.NoError(t, err)
+				assert.Equal(t, 1, failed)
+				assert.Equal(t, model.ScheduleStatusFailed, findSchedule().Status)
+				assert.Equal(t, model.ScheduleFailurePhoneOffline, findSchedule().FailureReason)
+
+				// Failed messages are not sent again
+				dispatched, err := service.dispatchDueMessages(time.Now())
+				assert.NoError(t, err)
+				assert.Equal(t, 0, dispatched)
+			})
+
+			g.It("Should not let a message be canceled once it is dispatched", func() {
+				schedule(time.Now().Add(-time.Second))
+				canceled := false
+				service.CCS = testutil.TestCCS{
+					XMPPFunc: func(m *gcm.XmppMessage) (string, int, error) {
+						// Cancel as the api does while the phone is being told
+						s.Transaction(func(txStore store.Store) error {
+							scheduled, _ := txStore.ScheduledMessages().LockScheduledMessage(messageID)
+							if scheduled.Status == model.ScheduleStatusPending {
+								scheduled.Status = model.ScheduleStatusCanceled
+								canceled = true
+								return txStore.ScheduledMessages().SaveScheduledMessage(scheduled)
+							}
+							return nil
+						})
+						sent = append(sent, m)
+						return "", 200, nil
+					},
+				}
+				service.dispatchDueMessages(time.Now())
+				assert.Len(t, sent, 1)
+				assert.False(t, canceled)
+				assert.Equal(t, model.ScheduleStatusDispatched, findSchedule().Status)
+			})
+
+			g.It("Should not overwrite a cancel made before the message is dispatched", func() {
+				schedule(time.Now().Add(-time.Second))
+				due, _ := s.ScheduledMessages().GetDueScheduledMessages(time.Now(), scheduleBatch)
+				assert.Len(t, due, 1)
+
+				// Canceled after the message was found due
+				scheduled := findSchedule()
+				scheduled.Status = model.ScheduleStatusCanceled
+				s.ScheduledMessages().SaveScheduledMessage(scheduled)
+
+				assert.NoError(t, service.dispatchScheduledMessage(messageID, time.Now()))
+				assert.Empty(t, sent)
+				assert.Equal(t, model.ScheduleStatusCanceled, findSchedule().Status)
+				_, found := s.Messages().FindMessage(&model.Message{MessageID: messageID})
+				assert.False(t, found)
+			})
+
+			g.It("Should fail a message missed by more than the grace period", func() {
+				schedule(time.Now().Add(-model.ScheduleGrace - time.Minute))
+
+				_, err := service.dispatchDueMessages(time.Now())
+				assert.NoError(t, err)
+				scheduled := findSchedule()
+				assert.Equal(t, model.ScheduleStatusFailed, scheduled.Status)
+				assert.Equal(t, model.ScheduleFailureMissed, scheduled.FailureReason)
+				_, found := s.Messages().FindMessage(&model.Message{MessageID: messageID})
+				assert.False(t, found)
+
+				assert.Len(t, sent, 1)
+				assert.Equal(t, typeScheduleFailed, sent[0].Data[discriminator])
+			})
+
+			g.It("Should fail a message once the user has no linked phone", func() {
+				schedule(time.Now().Add(-time.Second))
+				device, _ := s.Devices().FindDevice(&model.Device{RegistrationID: "registration_id"})
+				device.State = model.DeviceStateUnlinked
+				s.Devices().SaveDevice(device)
+
+				_, err := service.dispatchDueMessages(time.Now())
+				assert.NoError(t, err)
+				scheduled := findSchedule()
+				assert.Equal(t, model.ScheduleStatusFailed, scheduled.Status)
+				assert.Equal(t, model.ScheduleFailureNoPhone, scheduled.FailureReason)
+			})
+
+			g.It("Should skip canceled messages", func() {
+				schedule(time.Now().Add(-time.Second))
+				scheduled := findSchedule()
+				scheduled.Status = model.ScheduleStatusCanceled
+				s.ScheduledMessages().SaveScheduledMessage(scheduled)
+
+				dispatched, err := service.dispatchDueMessages(time.Now())
+				assert.NoError(t, err)
+				assert.Equal(t, 0, dispatched)
+				assert.Empty(t, sent)
+			})
+
+			g.It("Should fail a dispatched message the phone never started", func() {
+				schedule(time.Now().Add(-time.Second))
+				service.dispatchDueMessages(time.Now())
+
+				failed, err := service.failExpiredMessages(time.Now().Add(model.QueuedMessageTTL + time.Second))
+				assert.NoError(t, err)
+				assert.Equal(t, 1, failed)
+				scheduled := findSchedule()
+				assert.Equal(t, model.ScheduleStatusFailed, scheduled.Status)
+				assert.Equal(t, model.ScheduleFailurePhoneOffline, scheduled.FailureReason)
+			})
+		})
+
+		g.It("Should mark the sending device as seen on a ping", func() {
+			registrationID := "registration_id"
+			user := model.User{
+				Email: "test@test.com",
+			}
+			s.Users().CreateUser(&user)
+			s.Devices().CreateDevice(&model.Device{
+				User:           user,
+				RegistrationID: registrationID,
+				Type:           model.DeviceTypePhone,
+				State:          model.DeviceStateLinked,
+			})
+			ccs := testutil.TestCCS{
+				XMPPFunc: func(m *gcm.XmppMessage) (string, int, error) {
+					t.Fail() // Should not have to send a failure message
+					return "", 200, nil
+				},
+			}
+			service := GCMService{Store: s, CCS: ccs}
+			before := time.Now().Add(-time.Second)
+			service.OnMessageReceived(gcm.CcsMessage{
+				From: registrationID,
+				Data: map[string]interface{}{
+					"type": "ping",
+				},
+			})
+			device, _ := s.Devices().FindDevice(&model.Device{RegistrationID: registrationID})
+			assert.True(t, device.LastSeenAt.After(before))
+		})
+
+		g.It("Should send an error downstream on a ping from an unregistered device", func() {
+			sent := false
+			ccs := testutil.TestCCS{
+				XMPPFunc: func(m *gcm.XmppMessage) (string, int, error) {
+					assert.Equal(t, m.Data["error"], "unregistered_device")
+					sent = true
+					return "", 200, nil
+				},
+			}
+			service := GCMService{Store: s, CCS: ccs}
+			service.OnMessageReceived(gcm.CcsMessage{
+				From: "unregistered_device",
+				Data: map[string]interface{}{
+					"type": "ping",
+				},
+			})
+			assert.True(t, sent)
+		})
+
+		g.It("Should approve a pairing session from a phone and notify the new device", func() {
+			user := model.User{
+				Email: "test@test.com",
+			}
+			s.Users().CreateUser(&user)
+			s.Devices().CreateDevice(&model.Device{
+				User:           user,
+				RegistrationID: "phone_registration",
+				Type:           model.DeviceTypePhone,
+				State:          model.DeviceStateLinked,
+			})
+			session, _ := pairing.Start(s, pairing.Device{
+				RegistrationID: "chrome_registration",
+				Name:           "Chrome",
+				Type:           model.DeviceTypeChrome,
+			})
+			var notified string
+			ccs := testutil.TestCCS{
+				XMPPFunc: func(m *gcm.XmppMessage) (string, int, error) {
+					assert.Equal(t, "pairing_approved", m.Data["type"])
+					notified = m.To
+					return "", 200, nil
+				},
+			}
+			service := GCMService{Store: s, CCS: ccs}
+			payload, _ := json.Marshal(map[string]interface{}{
+				"code": session.Code,
+			})
+			service.OnMessageReceived(gcm.CcsMessage{
+				From: "phone_registration",
+				Data: map[string]interface{}{
+					"type":    "pair",
+					"payload": string(payload),
+				},
+			})
+			assert.Equal(t, "chrome_registration", notified)
+			fromDB, _ := s.PairingSessions().FindSession(&model.PairingSession{UUID: session.UUID})
+			assert.Equal(t, model.PairingStateApproved, fromDB.State)
+			assert.Equal(t, user.ID, fromDB.UserID)
+		})
+
+		g.It("Should send an error downstream for an invalid pairing code", func() {
+			user := model.User{
+				Email: "test@test.com",
+			}
+			s.Users().CreateUser(&user)
+			s.Devices().CreateDevice(&model.Device{
+				User:           user,
+				RegistrationID: "phone_registration",
+				Type:           model.DeviceTypePhone,
+				State:          model.DeviceStateLinked,
+			})
+			sent := false
+			ccs := testutil.TestCCS{
+				XMPPFunc: func(m *gcm.XmppMessage) (string, int, error) {
+					assert.Equal(t, "invalid_pairing_code", m.Data["error"])
+					sent = true
+					return "", 200, nil
+				},
+			}
+			service := GCMService{Store: s, CCS: ccs}
+			payload, _ := json.Marshal(map[string]interface{}{
+				"code": "ABCDEFGH",
+			})
+			service.OnMessageReceived(gcm.CcsMessage{
+				From: "phone_registration",
+				Data: map[string]interface{}{
+					"type":    "pair",
+					"payload": string(payload),
+				},
+			})
+			assert.True(t, sent)
 		})
 	})
 
@@ -264,12 +1665,37 @@ func TestService(t *testing.T) {
 			err := getPayload(string(payload), &m)
 			assert.NoError(t, err)
 			assert.Equal(t, mid, m.MessageID)
-			assert.Equal(t, "phone_number", m.To)
+			assert.Equal(t, model.Recipients{"phone_number"}, m.To)
 			assert.Equal(t, "started", m.Status)
 			assert.Equal(t, "hello", m.Body)
 			assert.Equal(t, 1351700038, m.At)
 		})
 
+		g.It("Should marshall a list of recipients into a MessagePayload struct", func() {
+			payload, _ := json.Marshal(map[string]interface{}{
+				"mid":    uuid.NewV4().String(),
+				"to":     []string{"5551234", "5556789"},
+				"status": "started",
+				"body":   "hello",
+				"at":     1351700038,
+			})
+			var m MessagePayload
+			assert.NoError(t, getPayload(string(payload), &m))
+			assert.Equal(t, model.Recipients{"5551234", "5556789"}, m.To)
+		})
+
+		g.It("Should require at least one recipient", func() {
+			payload, _ := json.Marshal(map[string]interface{}{
+				"mid":    uuid.NewV4().String(),
+				"to":     []string{},
+				"status": "started",
+				"body":   "hello",
+				"at":     1351700038,
+			})
+			var m MessagePayload
+			assert.Error(t, getPayload(string(payload), &m))
+		})
+
 		g.It("Should return an error for an invalid new message json body", func() {
 			payload := "message_id"
 			var m MessagePayload
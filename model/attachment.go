@@ -0,0 +1,31 @@
+package model
+
+import "github.com/jinzhu/gorm"
+
+// An Attachment is a file sent with a message, such as the picture in an
+// MMS. Its content is kept in a blob store under its UUID. Attachments are
+// uploaded first and linked to their message when it is recorded.
+type Attachment struct {
+	gorm.Model
+	User        User
+	UserID      uint   `sql:"not null; index"`
+	MessageID   uint   `sql:"index"`
+	UUID        string `sql:"not null; type:uuid; unique_index"`
+	ContentType string `sql:"not null"`
+	Size        int64  `sql:"not null"`
+}
+
+// An AttachmentBody is how clients are told about an attachment.
+type AttachmentBody struct {
+	AttachmentID string `json:"attachment_id"`
+	ContentType  string `json:"content_type"`
+	Size         int64  `json:"size"`
+}
+
+func (a Attachment) Render() AttachmentBody {
+	return AttachmentBody{
+		AttachmentID: a.UUID,
+		ContentType:  a.ContentType,
+		Size:         a.Size,
+	}
+}
@@ -0,0 +1,13 @@
+package model
+
+import "github.com/jinzhu/gorm"
+
+// A ChangeSequence numbers the changes to a user's messages. Seq is the
+// latest change issued, while deleted messages with a sequence number up to
+// PrunedSeq have been removed for good.
+type ChangeSequence struct {
+	gorm.Model
+	UserID    uint   `sql:"not null; unique_index"`
+	Seq       uint64 `sql:"not null"`
+	PrunedSeq uint64 `sql:"not null"`
+}
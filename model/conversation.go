@@ -0,0 +1,63 @@
+package model
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// A Conversation groups a user's messages by the normalized numbers of the
+// other participants, which are kept as a conversation key. Its read marker
+// is the latest message the user has read through on any device.
+type Conversation struct {
+	gorm.Model
+	User          User
+	UserID        uint   `sql:"not null; unique_index:idx_conversation_user_participant"`
+	UUID          string `sql:"not null; type:uuid; unique_index"`
+	Participant   string `sql:"not null; unique_index:idx_conversation_user_participant"`
+	LastMessage   Message
+	LastMessageID uint
+	LastMessageAt time.Time
+	UnreadCount   int `sql:"not null"`
+	ReadMessageID uint
+}
+
+// Participants lists the normalized numbers of the other participants.
+func (c Conversation) Participants() []string {
+	return strings.Split(c.Participant, ",")
+}
+
+// ConversationKey identifies the conversation between a set of participants,
+// in whichever order and format their numbers are given.
+func ConversationKey(participants []string) string {
+	seen := make(map[string]bool)
+	var numbers []string
+	for _, participant := range participants {
+		number := NormalizeNumber(participant)
+		if !seen[number] {
+			seen[number] = true
+			numbers = append(numbers, number)
+		}
+	}
+	sort.Strings(numbers)
+	return strings.Join(numbers, ",")
+}
+
+// NormalizeNumber reduces a phone number to its digits, keeping a leading
+// plus sign, so that differently formatted numbers share a conversation.
+// Addresses without digits, such as short code names, are only lowercased.
+func NormalizeNumber(number string) string {
+	number = strings.TrimSpace(number)
+	var digits []rune
+	for i, r := range number {
+		if (r >= '0' && r <= '9') || (r == '+' && i == 0) {
+			digits = append(digits, r)
+		}
+	}
+	if len(digits) == 0 || (len(digits) == 1 && digits[0] == '+') {
+		return strings.ToLower(number)
+	}
+	return string(digits)
+}
@@ -0,0 +1,12 @@
+package model
+
+import "github.com/jinzhu/gorm"
+
+// A DataKey encrypts server held secrets. It is itself stored encrypted by
+// a master key, identified by MasterKeyID, which never touches the database.
+type DataKey struct {
+	gorm.Model
+	MasterKeyID string `sql:"not null"`
+	Key         string `sql:"not null"`
+	Current     bool   `sql:"not null; default:false"`
+}
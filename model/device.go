@@ -1,6 +1,10 @@
 package model
 
-import "github.com/jinzhu/gorm"
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
 
 const (
 	DeviceStateLinked   = "linked"
@@ -13,6 +17,18 @@ const (
 	DeviceTypeDesktop = "desktop"
 )
 
+const (
+	DevicePresenceOnline  = "online"
+	DevicePresenceOffline = "offline"
+)
+
+// Key states for devices with a public key, which must be approved by
+// an existing device before they can read messages.
+const (
+	DeviceKeyStatePending  = "pending"
+	DeviceKeyStateApproved = "approved"
+)
+
 type Device struct {
 	gorm.Model
 	User              User
@@ -24,4 +40,7 @@ type Device struct {
 	Name              string `sql:"not null"`
 	Type              string `sql:"not null"`
 	State             string `sql:"not null"`
+	LastSeenAt        time.Time
+	PublicKey         string
+	KeyState          string
 }
@@ -0,0 +1,69 @@
+package model
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// A Draft is the message a user has started writing in a conversation, kept
+// so that they can finish it on another device. Devices may edit it while
+// offline, so the edit made last by the clients' clocks wins. A deleted
+// draft is kept with an empty body, so that older edits arriving late do not
+// bring it back.
+type Draft struct {
+	gorm.Model
+	User            User
+	UserID          uint `sql:"not null; unique_index:idx_draft_user_conversation"`
+	Conversation    Conversation
+	ConversationID  uint      `sql:"not null; unique_index:idx_draft_user_conversation"`
+	Body            string    `sql:"type:text; not null; default:''"`
+	ClientUpdatedAt time.Time `sql:"not null"`
+
+	// Nonce and KeyVersion are set when Body is ciphertext sealed by a device
+	// under that version of the user's encryption key.
+	Nonce      string `sql:"not null; default:''"`
+	KeyVersion int    `sql:"not null; default:0"`
+}
+
+// Deleted reports whether the draft was discarded or sent.
+func (d Draft) Deleted() bool {
+	return d.Body == ""
+}
+
+// Message is the draft as an unsent message, such as for checking that its
+// body is sealed like one.
+func (d Draft) Message() *Message {
+	return &Message{
+		UserID:     d.UserID,
+		Body:       d.Body,
+		Nonce:      d.Nonce,
+		KeyVersion: d.KeyVersion,
+	}
+}
+
+// A DraftBody is how clients are told about a draft, both in api responses
+// and in the notifications sent when it changes, so that phones can update
+// it without fetching it.
+type DraftBody struct {
+	ConversationID string   `json:"conversation_id"`
+	Participants   []string `json:"participants"`
+	Body           string   `json:"body"`
+	At             int64    `json:"at"`
+	Deleted        bool     `json:"deleted"`
+	Nonce          string   `json:"nonce,omitempty"`
+	KeyVersion     int      `json:"key_version,omitempty"`
+}
+
+// Render reports the draft as it stands in its conversation.
+func (d Draft) Render(conversation Conversation) DraftBody {
+	return DraftBody{
+		ConversationID: conversation.UUID,
+		Participants:   conversation.Participants(),
+		Body:           d.Body,
+		At:             d.ClientUpdatedAt.Unix(),
+		Deleted:        d.Deleted(),
+		Nonce:          d.Nonce,
+		KeyVersion:     d.KeyVersion,
+	}
+}
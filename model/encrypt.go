@@ -1,10 +1,35 @@
 package model
 
-import "github.com/jinzhu/gorm"
+import (
+	"encoding/base64"
+
+	"github.com/jinzhu/gorm"
+)
 
 type EncryptionKey struct {
 	gorm.Model
-	User   User
-	UserID uint   `sql:"unique_index"`
-	Key    string `sql:"not null"`
+	User    User
+	UserID  uint   `sql:"not null; unique_index:idx_encryption_key_user_version"`
+	Version int    `sql:"not null; default:1; unique_index:idx_encryption_key_user_version"`
+	Current bool   `sql:"not null; default:false"`
+	Key     string `sql:"not null"`
+}
+
+// Devices seal encrypted message bodies with AES-256-GCM, uploading the
+// ciphertext and its nonce base64 encoded.
+const (
+	EnvelopeNonceSize = 12
+	envelopeTagSize   = 16
+)
+
+// ValidEnvelope reports whether a message body and nonce are well formed
+// ciphertext. Only devices hold the keys, so whether they decrypt is not
+// known.
+func ValidEnvelope(body, nonce string) bool {
+	decoded, err := base64.StdEncoding.DecodeString(nonce)
+	if err != nil || len(decoded) != EnvelopeNonceSize {
+		return false
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(body)
+	return err == nil && len(ciphertext) >= envelopeTagSize
 }
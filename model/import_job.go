@@ -0,0 +1,34 @@
+package model
+
+import "github.com/jinzhu/gorm"
+
+// Import job statuses. A job is pending until an importer picks it up, and
+// running until every message in its archive was imported or it failed.
+const (
+	ImportStatusPending   = "pending"
+	ImportStatusRunning   = "running"
+	ImportStatusCompleted = "completed"
+	ImportStatusFailed    = "failed"
+)
+
+// An ImportJob imports the messages in an archive the user uploaded, which is
+// kept in the blob store under the job's UUID until the job finishes. Total
+// is set once the archive is read, and the counts move as it is imported.
+type ImportJob struct {
+	gorm.Model
+	User      User
+	UserID    uint   `sql:"not null; index"`
+	UUID      string `sql:"not null; type:uuid; unique_index"`
+	Format    string `sql:"not null"`
+	Status    string `sql:"not null; index"`
+	Total     int    `sql:"not null; default:0"`
+	Processed int    `sql:"not null; default:0"`
+	Imported  int    `sql:"not null; default:0"`
+	Skipped   int    `sql:"not null; default:0"`
+	Error     string `sql:"not null; default:''"`
+}
+
+// Finished reports whether the job completed or failed.
+func (j ImportJob) Finished() bool {
+	return j.Status == ImportStatusCompleted || j.Status == ImportStatusFailed
+}
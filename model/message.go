@@ -1,20 +1,196 @@
 package model
 
-import "github.com/jinzhu/gorm"
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
 
 const (
+	MessageStatusQueued    = "queued"
 	MessageStatusStarted   = "started"
 	MessageStatusSent      = "sent"
 	MessageStatusDelivered = "delivered"
 	MessageStatusFailed    = "failed"
+	MessageStatusReceived  = "received"
+)
+
+// Outgoing messages are sent by the user, incoming ones received by the
+// user's phone.
+const (
+	MessageDirectionOutgoing = "outgoing"
+	MessageDirectionIncoming = "incoming"
 )
 
+// QueuedMessageTTL is how long a message queued by the server waits for a
+// phone to start sending it before it fails.
+var QueuedMessageTTL = 10 * time.Minute
+
+// statusTransitions lists the legal moves from each status: a message goes
+// from started to sent to delivered, and may fail while started or sent.
+// Messages queued by the server wait for a phone to start them.
+var statusTransitions = map[string][]string{
+	MessageStatusQueued:  {MessageStatusStarted, MessageStatusFailed},
+	MessageStatusStarted: {MessageStatusSent, MessageStatusFailed},
+	MessageStatusSent:    {MessageStatusDelivered, MessageStatusFailed},
+}
+
+// CanTransition reports whether a message may move from one status to
+// another through legal transitions. Intermediate statuses may be skipped,
+// since devices can report them out of order.
+func CanTransition(from, to string) bool {
+	for _, next := range statusTransitions[from] {
+		if next == to || CanTransition(next, to) {
+			return true
+		}
+	}
+	return false
+}
+
 type Message struct {
 	gorm.Model
-	User      User
-	UserID    uint   `sql:"not null"`
-	MessageID string `sql:"not null; unique_index"`
-	Status    string `sql:"not null"`
-	To        string `sql:"not null"`
-	Body      string `sql:"type:text; not null"`
+	User            User
+	UserID          uint      `sql:"not null; index:idx_message_user_seq"`
+	MessageID       string    `sql:"not null; unique_index"`
+	Status          string    `sql:"not null"`
+	Direction       string    `sql:"not null; default:'outgoing'"`
+	From            string    `sql:"not null; default:''"`
+	To              string    `sql:"not null"`
+	Body            string    `sql:"type:text; not null"`
+	Seq             uint64    `sql:"index:idx_message_user_seq"`
+	ConversationID  uint      `sql:"index"`
+	ClientCreatedAt time.Time `sql:"index"`
+	Read            bool      `sql:"not null; default:false"`
+
+	// Nonce and KeyVersion are set when Body is ciphertext sealed by a device
+	// under that version of the user's encryption key.
+	Nonce      string `sql:"not null; default:''"`
+	KeyVersion int    `sql:"not null; default:0"`
+
+	Attachments []Attachment
+	Recipients  []MessageRecipient
+}
+
+// SetRecipients addresses a message to a list of recipients. To keeps them
+// all for clients that do not know about recipient lists.
+func (m *Message) SetRecipients(addresses []string) {
+	m.Recipients = nil
+	for _, address := range addresses {
+		m.Recipients = append(m.Recipients, MessageRecipient{Address: address})
+	}
+	m.To = strings.Join(addresses, ", ")
+}
+
+// RecipientAddresses lists the addresses a message was sent to, falling back
+// to To for messages recorded without a recipient list.
+func (m Message) RecipientAddresses() []string {
+	if len(m.Recipients) == 0 {
+		if m.To == "" {
+			return nil
+		}
+		return []string{m.To}
+	}
+	addresses := make([]string, 0, len(m.Recipients))
+	for _, recipient := range m.Recipients {
+		addresses = append(addresses, recipient.Address)
+	}
+	return addresses
+}
+
+// NormalizeAddresses writes the sender and recipients of a message in E.164
+// format for a region, so that they can be matched to contacts.
+func (m *Message) NormalizeAddresses(region string) {
+	if m.From != "" {
+		m.From = E164(m.From, region)
+	}
+	// Messages to one address are recorded without a recipient list
+	if len(m.Recipients) == 0 {
+		if m.To != "" {
+			m.To = E164(m.To, region)
+		}
+		return
+	}
+	m.SetRecipients(E164Addresses(m.RecipientAddresses(), region))
+}
+
+// A MessageBody is how clients are told about a message, both in api
+// responses and when a phone is told to send it.
+type MessageBody struct {
+	MessageID   string           `json:"mid"`
+	Direction   string           `json:"direction"`
+	From        string           `json:"from,omitempty"`
+	To          string           `json:"to,omitempty"`
+	Recipients  []string         `json:"recipients,omitempty"`
+	Status      string           `json:"status"`
+	Body        string           `json:"body"`
+	At          int64            `json:"at"`
+	Read        bool             `json:"read"`
+	Attachments []AttachmentBody `json:"attachments,omitempty"`
+	Nonce       string           `json:"nonce,omitempty"`
+	KeyVersion  int              `json:"key_version,omitempty"`
+}
+
+// Render reports a message at the time its client created it, or when the
+// server recorded it if the client did not say.
+func (m Message) Render() MessageBody {
+	at := m.ClientCreatedAt
+	if at.IsZero() {
+		at = m.CreatedAt
+	}
+	var attachments []AttachmentBody
+	for _, attachment := range m.Attachments {
+		attachments = append(attachments, attachment.Render())
+	}
+	return MessageBody{
+		MessageID:   m.MessageID,
+		Direction:   m.Direction,
+		From:        m.From,
+		To:          m.To,
+		Recipients:  m.RecipientAddresses(),
+		Status:      m.Status,
+		Body:        m.Body,
+		At:          at.Unix(),
+		Read:        !m.Unread(),
+		Attachments: attachments,
+		Nonce:       m.Nonce,
+		KeyVersion:  m.KeyVersion,
+	}
+}
+
+// Participants are the other parties to a message: its recipients if the
+// user sent it, or its sender and any other recipients if the user received
+// it.
+func (m Message) Participants() []string {
+	if m.Direction == MessageDirectionIncoming {
+		return append([]string{m.From}, m.RecipientAddresses()...)
+	}
+	return m.RecipientAddresses()
+}
+
+// Unread reports whether the user has yet to read a received message.
+func (m Message) Unread() bool {
+	return m.Direction == MessageDirectionIncoming && !m.Read
+}
+
+// Encrypted reports whether a message body is ciphertext the server cannot
+// read.
+func (m Message) Encrypted() bool {
+	return m.Nonce != ""
+}
+
+// ContentHash identifies a message by what it says, who it was between, and
+// when to the second, so that copies of it recorded under different
+// MessageIDs, such as by importing a backup, can be recognized.
+func (m Message) ContentHash() string {
+	sum := sha256.Sum256([]byte(strings.Join([]string{
+		m.Direction,
+		ConversationKey(m.Participants()),
+		strconv.FormatInt(m.ClientCreatedAt.Unix(), 10),
+		m.Body,
+	}, "\x00")))
+	return hex.EncodeToString(sum[:])
 }
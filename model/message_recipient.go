@@ -0,0 +1,42 @@
+package model
+
+import (
+	"encoding/json"
+
+	"github.com/jinzhu/gorm"
+)
+
+// A MessageRecipient is one of the addresses a message was sent to. Group
+// messages have several. Messages recorded before recipients were tracked
+// have none, and are only addressed by Message.To.
+type MessageRecipient struct {
+	gorm.Model
+	MessageID uint   `sql:"not null; index"`
+	Address   string `sql:"not null"`
+}
+
+// Recipients is a list of addresses that may also be given in JSON as a
+// single string, as clients did before group messages.
+type Recipients []string
+
+func (r *Recipients) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*r = nil
+		if single != "" {
+			*r = Recipients{single}
+		}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*r = nil
+	for _, address := range list {
+		if address != "" {
+			*r = append(*r, address)
+		}
+	}
+	return nil
+}
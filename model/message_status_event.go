@@ -0,0 +1,17 @@
+package model
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// A MessageStatusEvent records a status reached by a message. ClientAt is
+// when the device reported it, while CreatedAt is when the server received it.
+type MessageStatusEvent struct {
+	gorm.Model
+	Message   Message
+	MessageID uint   `sql:"not null; index"`
+	Status    string `sql:"not null"`
+	ClientAt  time.Time
+}
@@ -0,0 +1,17 @@
+package model
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// An OutboxEvent is an event waiting to be relayed to other processes. It is
+// written in the same transaction as the change it describes, so an event is
+// relayed if and only if its change is committed.
+type OutboxEvent struct {
+	gorm.Model
+	Topic     string     `sql:"not null"`
+	Payload   string     `sql:"type:text; not null"`
+	RelayedAt *time.Time `sql:"index"`
+}
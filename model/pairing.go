@@ -0,0 +1,40 @@
+package model
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	PairingStatePending   = "pending"
+	PairingStateApproved  = "approved"
+	PairingStateCompleted = "completed"
+	PairingStateExpired   = "expired"
+)
+
+// A PairingSession is started by a new device that wants to link to a user's
+// account. It must be approved from the user's phone, after which the new
+// device can claim it with its secret.
+type PairingSession struct {
+	gorm.Model
+	ExpiresAt        time.Time
+	UUID             string `sql:"not null; type:uuid; unique_index"`
+	Code             string `sql:"not null; index"`
+	Secret           string `sql:"not null"`
+	UserID           uint
+	ApproverDeviceID uint
+	RegistrationID   string `sql:"not null"`
+	Name             string `sql:"not null"`
+	Type             string `sql:"not null"`
+	PublicKey        string
+	State            string `sql:"not null"`
+	Attempts         int    `sql:"not null; default:0"`
+}
+
+// A PairingFailure records a code typed in on a user's phone that matched no
+// session, so that guessing codes can be limited per user.
+type PairingFailure struct {
+	gorm.Model
+	UserID uint `sql:"not null; index"`
+}
@@ -0,0 +1,82 @@
+package model
+
+import "strings"
+
+// DefaultRegion is the region assumed for numbers dialed without a country
+// calling code, until the user chooses another.
+const DefaultRegion = "US"
+
+// A dialingRegion describes how numbers are dialed within a region: its
+// country calling code, the prefixes for dialing nationally and abroad, and
+// the lengths of its national significant numbers. Shorter numbers, such as
+// short codes and numbers without an area code, cannot be written in E.164.
+type dialingRegion struct {
+	callingCode         string
+	trunkPrefix         string
+	internationalPrefix string
+	minLength           int
+	maxLength           int
+}
+
+// dialingRegions are keyed by ISO 3166-1 alpha-2 code.
+var dialingRegions = map[string]dialingRegion{
+	"AU": {"61", "0", "0011", 9, 9},
+	"BE": {"32", "0", "00", 8, 9},
+	"CA": {"1", "1", "011", 10, 10},
+	"CH": {"41", "0", "00", 9, 9},
+	"DE": {"49", "0", "00", 6, 13},
+	"DK": {"45", "", "00", 8, 8},
+	"ES": {"34", "", "00", 9, 9},
+	"FR": {"33", "0", "00", 9, 9},
+	"GB": {"44", "0", "00", 9, 10},
+	"IE": {"353", "0", "00", 7, 9},
+	"IN": {"91", "0", "00", 10, 10},
+	"IT": {"39", "", "00", 6, 11},
+	"JP": {"81", "0", "010", 9, 10},
+	"MX": {"52", "", "00", 10, 10},
+	"NL": {"31", "0", "00", 9, 9},
+	"NO": {"47", "", "00", 8, 8},
+	"NZ": {"64", "0", "00", 8, 10},
+	"PR": {"1", "1", "011", 10, 10},
+	"SE": {"46", "0", "00", 7, 9},
+	"US": {"1", "1", "011", 10, 10},
+}
+
+// ValidRegion reports whether numbers can be normalized for a region.
+func ValidRegion(region string) bool {
+	_, found := dialingRegions[region]
+	return found
+}
+
+// E164 writes a phone number dialed in a region in E.164 format, such as
+// +15551234567, so that the same number is recorded the same way however it
+// was dialed. Numbers that cannot be, such as short codes, are normalized
+// as NormalizeNumber does.
+func E164(number string, region string) string {
+	normalized := NormalizeNumber(number)
+	dialing, found := dialingRegions[region]
+	if !found || strings.HasPrefix(normalized, "+") || strings.Trim(normalized, "0123456789") != "" {
+		return normalized
+	}
+	if strings.HasPrefix(normalized, dialing.internationalPrefix) {
+		return "+" + strings.TrimPrefix(normalized, dialing.internationalPrefix)
+	}
+	national := strings.TrimPrefix(normalized, dialing.trunkPrefix)
+	if len(national) < dialing.minLength || len(national) > dialing.maxLength {
+		return normalized
+	}
+	return "+" + dialing.callingCode + national
+}
+
+// E164Addresses writes each of a list of addresses in E.164 format, as E164
+// does.
+func E164Addresses(addresses []string, region string) []string {
+	if addresses == nil {
+		return nil
+	}
+	normalized := make([]string, len(addresses))
+	for i, address := range addresses {
+		normalized[i] = E164(address, region)
+	}
+	return normalized
+}
@@ -0,0 +1,89 @@
+package model
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Scheduled message statuses. A scheduled message is pending until it is
+// due, when it is dispatched to the user's phone like a queued message. It is
+// dispatching from when the message is queued until the phone has been told
+// to send it. It fails if it cannot be dispatched, or if the phone does not
+// start sending it in time.
+const (
+	ScheduleStatusPending     = "pending"
+	ScheduleStatusDispatching = "dispatching"
+	ScheduleStatusDispatched  = "dispatched"
+	ScheduleStatusCanceled    = "canceled"
+	ScheduleStatusFailed      = "failed"
+)
+
+// Reasons a scheduled message failed
+const (
+	// ScheduleFailureMissed means the message could not be dispatched within
+	// ScheduleGrace of when it was due, such as while the service was down.
+	ScheduleFailureMissed = "missed"
+
+	// ScheduleFailureNoPhone means the user had no linked phone to send it.
+	ScheduleFailureNoPhone = "no_linked_phone"
+
+	// ScheduleFailurePhoneOffline means the phone did not start sending it
+	// within QueuedMessageTTL of being told to.
+	ScheduleFailurePhoneOffline = "phone_offline"
+)
+
+// ScheduleGrace is how late a scheduled message may still be dispatched.
+// Sending one any later is more likely to surprise the user than help them.
+var ScheduleGrace = 15 * time.Minute
+
+// A ScheduledMessage is a message the user wrote to be sent later. Once
+// dispatched it is recorded as a message with the same MessageID, so that
+// dispatching it again does not send it twice.
+type ScheduledMessage struct {
+	gorm.Model
+	User          User
+	UserID        uint      `sql:"not null; index"`
+	MessageID     string    `sql:"not null; unique_index"`
+	Recipients    string    `sql:"type:text; not null"`
+	Body          string    `sql:"type:text; not null"`
+	SendAt        time.Time `sql:"not null; index"`
+	Status        string    `sql:"not null; index"`
+	FailureReason string    `sql:"not null; default:''"`
+	DispatchedAt  *time.Time
+
+	// Nonce and KeyVersion are set when Body is ciphertext sealed by a device
+	// under that version of the user's encryption key.
+	Nonce      string `sql:"not null; default:''"`
+	KeyVersion int    `sql:"not null; default:0"`
+}
+
+// SetRecipients addresses a scheduled message to a list of recipients.
+func (m *ScheduledMessage) SetRecipients(addresses []string) {
+	// A list of strings always encodes
+	encoded, _ := json.Marshal(addresses)
+	m.Recipients = string(encoded)
+}
+
+// RecipientAddresses lists the addresses a scheduled message is sent to.
+func (m ScheduledMessage) RecipientAddresses() []string {
+	var addresses []string
+	json.Unmarshal([]byte(m.Recipients), &addresses)
+	return addresses
+}
+
+// Message is the queued message that sends a scheduled message.
+func (m ScheduledMessage) Message() *Message {
+	message := &Message{
+		UserID:     m.UserID,
+		MessageID:  m.MessageID,
+		Direction:  MessageDirectionOutgoing,
+		Status:     MessageStatusQueued,
+		Body:       m.Body,
+		Nonce:      m.Nonce,
+		KeyVersion: m.KeyVersion,
+	}
+	message.SetRecipients(m.RecipientAddresses())
+	return message
+}
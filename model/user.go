@@ -10,4 +10,20 @@ type User struct {
 	Email     string `sql:"not null; unique_index"`
 	Password  string
 	Verified  bool `sql:"not null; default false"`
+
+	// EncryptedMessages is set once the user opts in to devices encrypting
+	// message bodies before uploading them.
+	EncryptedMessages bool `sql:"not null; default:false"`
+
+	// Region is where the user's phone dials numbers without a country
+	// calling code, as an ISO 3166-1 alpha-2 code.
+	Region string `sql:"not null; default:'US'"`
+}
+
+// PhoneRegion is the region the user's numbers are normalized for.
+func (u User) PhoneRegion() string {
+	if u.Region == "" {
+		return DefaultRegion
+	}
+	return u.Region
 }
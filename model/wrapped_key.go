@@ -0,0 +1,15 @@
+package model
+
+import "github.com/jinzhu/gorm"
+
+// A WrappedKey is a version of a user's content key, encrypted by one of
+// their devices for another device's public key. The server only relays it.
+type WrappedKey struct {
+	gorm.Model
+	User           User
+	UserID         uint   `sql:"not null"`
+	DeviceID       uint   `sql:"not null; unique_index:idx_wrapped_key_device_version"`
+	SenderDeviceID uint   `sql:"not null"`
+	Version        int    `sql:"not null; unique_index:idx_wrapped_key_device_version"`
+	Key            string `sql:"type:text; not null"`
+}
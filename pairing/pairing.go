@@ -0,0 +1,238 @@
+// Package pairing links new devices to an existing account without a
+// password: the new device starts a session, the user's phone approves it by
+// scanning a QR code or typing a short code, and the new device claims it.
+package pairing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"portal-server/model"
+	"portal-server/store"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+const (
+	// CodeLength is the number of characters in a short pairing code
+	CodeLength = 8
+
+	// MaxAttempts is the number of wrong codes or secrets a session
+	// tolerates before it is expired, and the number of codes matching no
+	// session a user may type in within SessionTTL
+	MaxAttempts = 5
+
+	// codeAlphabet omits characters which are easily confused
+	codeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	qrFormat     = "portal://pair?session=%s&code=%s"
+	maxCodeTries = 10
+)
+
+// SessionTTL is how long a session may wait for approval and then for the
+// new device to claim it.
+var SessionTTL = 5 * time.Minute
+
+// Errors
+var (
+	ErrSessionNotFound  = errors.New("pairing_session_not_found")
+	ErrSessionExpired   = errors.New("pairing_session_expired")
+	ErrInvalidCode      = errors.New("invalid_pairing_code")
+	ErrInvalidSecret    = errors.New("invalid_pairing_secret")
+	ErrNotApproved      = errors.New("pairing_not_approved")
+	ErrApproverNotPhone = errors.New("pairing_approver_not_phone")
+	ErrCodeUnavailable  = errors.New("pairing_code_unavailable")
+	ErrAlreadyApproved  = errors.New("pairing_already_approved")
+	ErrTooManyAttempts  = errors.New("pairing_too_many_attempts")
+)
+
+// Device describes the device asking to be paired.
+type Device struct {
+	RegistrationID string
+	Name           string
+	Type           string
+	PublicKey      string
+}
+
+// Start creates a pending session for the device with a short code that is
+// unique among the sessions still waiting for approval.
+func Start(s store.Store, device Device) (*model.PairingSession, error) {
+	secret, err := randomHex(32)
+	if err != nil {
+		return nil, err
+	}
+	session := &model.PairingSession{
+		ExpiresAt:      time.Now().Add(SessionTTL),
+		UUID:           uuid.NewV4().String(),
+		Secret:         secret,
+		RegistrationID: device.RegistrationID,
+		Name:           device.Name,
+		Type:           device.Type,
+		PublicKey:      device.PublicKey,
+		State:          model.PairingStatePending,
+	}
+	for i := 0; i < maxCodeTries && session.Code == ""; i++ {
+		code, err := randomCode()
+		if err != nil {
+			return nil, err
+		}
+		if _, found := findPending(s, &model.PairingSession{Code: code}); !found {
+			session.Code = code
+		}
+	}
+	if session.Code == "" {
+		return nil, ErrCodeUnavailable
+	}
+	if err := s.PairingSessions().CreateSession(session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// QRPayload is the content of the QR code shown by the new device.
+func QRPayload(session *model.PairingSession) string {
+	return fmt.Sprintf(qrFormat, session.UUID, session.Code)
+}
+
+// Approve links a pending session to the user of the approving phone. The
+// session ID is optional when the code is typed in by hand; when it is given
+// wrong codes count towards the session's attempts, and otherwise towards the
+// user's.
+func Approve(s store.Store, approver *model.Device, sessionID, code string) (*model.PairingSession, error) {
+	if approver.Type != model.DeviceTypePhone {
+		return nil, ErrApproverNotPhone
+	}
+	if sessionID == "" {
+		since := time.Now().Add(-SessionTTL)
+		if s.PairingSessions().FailureCount(approver.UserID, since) >= MaxAttempts {
+			return nil, ErrTooManyAttempts
+		}
+		session, found := findPending(s, &model.PairingSession{Code: code})
+		if !found {
+			if err := s.PairingSessions().RecordFailure(approver.UserID, since); err != nil {
+				return nil, err
+			}
+			return nil, ErrInvalidCode
+		}
+		return approve(s, session, approver)
+	}
+
+	session, found := s.PairingSessions().FindSession(&model.PairingSession{UUID: sessionID})
+	if !found {
+		return nil, ErrSessionNotFound
+	}
+	if session.State == model.PairingStateApproved && session.UserID == approver.UserID {
+		// Repeated approvals from a retrying phone are harmless
+		return session, nil
+	}
+	if err := checkActive(s, session, model.PairingStatePending); err != nil {
+		return nil, err
+	}
+	if session.Code != code {
+		return nil, failAttempt(s, session, ErrInvalidCode)
+	}
+	return approve(s, session, approver)
+}
+
+// Claim returns the approved session once the new device proves it started
+// it, and marks it completed so it cannot be claimed twice.
+func Claim(s store.Store, sessionID, secret string) (*model.PairingSession, error) {
+	session, found := s.PairingSessions().FindSession(&model.PairingSession{UUID: sessionID})
+	if !found {
+		return nil, ErrSessionNotFound
+	}
+	if session.State == model.PairingStateCompleted {
+		return nil, ErrSessionExpired
+	}
+	if err := checkActive(s, session, session.State); err != nil {
+		return nil, err
+	}
+	if session.Secret != secret {
+		return nil, failAttempt(s, session, ErrInvalidSecret)
+	}
+	if session.State != model.PairingStateApproved {
+		return nil, ErrNotApproved
+	}
+	session.State = model.PairingStateCompleted
+	if err := s.PairingSessions().SaveSession(session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+func approve(s store.Store, session *model.PairingSession, approver *model.Device) (*model.PairingSession, error) {
+	session.UserID = approver.UserID
+	session.ApproverDeviceID = approver.ID
+	session.State = model.PairingStateApproved
+	if err := s.PairingSessions().SaveSession(session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// checkActive expires the session if it has timed out and ensures it is in
+// the given state.
+func checkActive(s store.Store, session *model.PairingSession, state string) error {
+	if session.State == model.PairingStateExpired {
+		return ErrSessionExpired
+	}
+	if time.Now().After(session.ExpiresAt) {
+		session.State = model.PairingStateExpired
+		if err := s.PairingSessions().SaveSession(session); err != nil {
+			return err
+		}
+		return ErrSessionExpired
+	}
+	if session.State != state {
+		if session.State == model.PairingStateApproved {
+			return ErrAlreadyApproved
+		}
+		return ErrSessionExpired
+	}
+	return nil
+}
+
+// failAttempt records a wrong code or secret, expiring the session once it
+// has seen too many.
+func failAttempt(s store.Store, session *model.PairingSession, err error) error {
+	session.Attempts++
+	if session.Attempts >= MaxAttempts {
+		session.State = model.PairingStateExpired
+	}
+	if saveErr := s.PairingSessions().SaveSession(session); saveErr != nil {
+		return saveErr
+	}
+	return err
+}
+
+func findPending(s store.Store, where *model.PairingSession) (*model.PairingSession, bool) {
+	where.State = model.PairingStatePending
+	session, found := s.PairingSessions().FindSession(where)
+	if !found || time.Now().After(session.ExpiresAt) {
+		return nil, false
+	}
+	return session, true
+}
+
+func randomCode() (string, error) {
+	code := make([]byte, CodeLength)
+	max := big.NewInt(int64(len(codeAlphabet)))
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = codeAlphabet[n.Int64()]
+	}
+	return string(code), nil
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
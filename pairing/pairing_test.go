@@ -0,0 +1,127 @@
+package pairing
+
+import (
+	"portal-server/model"
+	"portal-server/store"
+	"testing"
+	"time"
+
+	"github.com/franela/goblin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPairing(t *testing.T) {
+	var s store.Store
+	var phone model.Device
+	g := goblin.Goblin(t)
+
+	newDevice := Device{
+		RegistrationID: "chrome_registration",
+		Name:           "Chrome",
+		Type:           model.DeviceTypeChrome,
+	}
+
+	g.Describe("Pairing sessions", func() {
+		g.BeforeEach(func() {
+			s = store.GetTestStore()
+			user := model.User{Email: "test@portal.com"}
+			s.Users().CreateUser(&user)
+			phone = model.Device{
+				User:           user,
+				UUID:           "phone",
+				RegistrationID: "phone_registration",
+				Type:           model.DeviceTypePhone,
+				State:          model.DeviceStateLinked,
+			}
+			s.Devices().CreateDevice(&phone)
+		})
+
+		g.AfterEach(func() {
+			store.TeardownTestStore(s)
+		})
+
+		g.It("Should start a pending session with a short code", func() {
+			session, err := Start(s, newDevice)
+			assert.NoError(t, err)
+			assert.Regexp(t, "^["+codeAlphabet+"]{8}$", session.Code)
+			assert.Regexp(t, "^[a-f0-9]{64}$", session.Secret)
+			assert.Equal(t, model.PairingStatePending, session.State)
+			assert.Equal(t, "portal://pair?session="+session.UUID+"&code="+session.Code, QRPayload(session))
+		})
+
+		g.It("Should approve by code and let the device claim it once", func() {
+			session, _ := Start(s, newDevice)
+
+			_, err := Claim(s, session.UUID, session.Secret)
+			assert.Equal(t, ErrNotApproved, err)
+
+			approved, err := Approve(s, &phone, "", session.Code)
+			assert.NoError(t, err)
+			assert.Equal(t, phone.UserID, approved.UserID)
+			assert.Equal(t, phone.ID, approved.ApproverDeviceID)
+
+			// Approving again from the same phone is harmless
+			_, err = Approve(s, &phone, session.UUID, session.Code)
+			assert.NoError(t, err)
+
+			claimed, err := Claim(s, session.UUID, session.Secret)
+			assert.NoError(t, err)
+			assert.Equal(t, model.PairingStateCompleted, claimed.State)
+
+			_, err = Claim(s, session.UUID, session.Secret)
+			assert.Equal(t, ErrSessionExpired, err)
+		})
+
+		g.It("Should only allow phones to approve", func() {
+			session, _ := Start(s, newDevice)
+			phone.Type = model.DeviceTypeChrome
+			_, err := Approve(s, &phone, session.UUID, session.Code)
+			assert.Equal(t, ErrApproverNotPhone, err)
+		})
+
+		g.It("Should expire a session after too many wrong codes", func() {
+			session, _ := Start(s, newDevice)
+			for i := 0; i < MaxAttempts; i++ {
+				_, err := Approve(s, &phone, session.UUID, "WRONG")
+				assert.Equal(t, ErrInvalidCode, err)
+			}
+			_, err := Approve(s, &phone, session.UUID, session.Code)
+			assert.Equal(t, ErrSessionExpired, err)
+		})
+
+		g.It("Should limit the codes a user may guess without a session", func() {
+			session, _ := Start(s, newDevice)
+			for i := 0; i < MaxAttempts; i++ {
+				_, err := Approve(s, &phone, "", "WRONG")
+				assert.Equal(t, ErrInvalidCode, err)
+			}
+			_, err := Approve(s, &phone, "", session.Code)
+			assert.Equal(t, ErrTooManyAttempts, err)
+
+			// The session itself can still be approved from its QR code
+			_, err = Approve(s, &phone, session.UUID, session.Code)
+			assert.NoError(t, err)
+		})
+
+		g.It("Should reject wrong secrets", func() {
+			session, _ := Start(s, newDevice)
+			Approve(s, &phone, session.UUID, session.Code)
+			_, err := Claim(s, session.UUID, "wrong")
+			assert.Equal(t, ErrInvalidSecret, err)
+
+			fromDB, _ := s.PairingSessions().FindSession(&model.PairingSession{UUID: session.UUID})
+			assert.Equal(t, 1, fromDB.Attempts)
+		})
+
+		g.It("Should expire sessions after the TTL", func() {
+			session, _ := Start(s, newDevice)
+			session.ExpiresAt = time.Now().Add(-time.Second)
+			s.PairingSessions().SaveSession(session)
+
+			_, err := Approve(s, &phone, "", session.Code)
+			assert.Equal(t, ErrInvalidCode, err)
+			_, err = Approve(s, &phone, session.UUID, session.Code)
+			assert.Equal(t, ErrSessionExpired, err)
+		})
+	})
+}
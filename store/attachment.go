@@ -0,0 +1,75 @@
+package store
+
+import (
+	"errors"
+	. "portal-server/model"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Errors
+var (
+	ErrAttachmentNotFound = errors.New("attachment_not_found")
+	ErrAttachmentInUse    = errors.New("attachment_in_use")
+)
+
+type AttachmentStore interface {
+	CreateAttachment(proto *Attachment) error
+	FindAttachment(where *Attachment) (*Attachment, error)
+	GetAttachments(message *Message) ([]Attachment, error)
+	LinkAttachments(message *Message, attachmentIDs []string) error
+}
+
+type attachmentStore struct {
+	*gorm.DB
+}
+
+func (db attachmentStore) CreateAttachment(proto *Attachment) error {
+	return db.Create(proto).Error
+}
+
+// FindAttachment finds an attachment, returning ErrAttachmentNotFound if
+// there is none.
+func (db attachmentStore) FindAttachment(where *Attachment) (*Attachment, error) {
+	var attachment Attachment
+	query := db.Where(where).First(&attachment)
+	if query.RecordNotFound() {
+		return nil, ErrAttachmentNotFound
+	}
+	if query.Error != nil {
+		return nil, query.Error
+	}
+	return &attachment, nil
+}
+
+func (db attachmentStore) GetAttachments(message *Message) ([]Attachment, error) {
+	var attachments []Attachment
+	if err := db.Where(&Attachment{
+		MessageID: message.ID,
+	}).Order("id asc").Find(&attachments).Error; err != nil {
+		return nil, err
+	}
+	return attachments, nil
+}
+
+// LinkAttachments links attachments uploaded by the message's user to the
+// message. An attachment belongs to a single message, but may be linked to
+// it again.
+func (db attachmentStore) LinkAttachments(message *Message, attachmentIDs []string) error {
+	for _, id := range attachmentIDs {
+		attachment, err := db.FindAttachment(&Attachment{
+			UserID: message.UserID,
+			UUID:   id,
+		})
+		if err != nil {
+			return err
+		}
+		if attachment.MessageID != 0 && attachment.MessageID != message.ID {
+			return ErrAttachmentInUse
+		}
+		if err := db.Model(attachment).UpdateColumn("message_id", message.ID).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -10,13 +10,26 @@ type ContactStore interface {
 	CreateContact(*Contact) error
 	FindContact(where *Contact) (*Contact, bool)
 	GetContactsByUser(user *User) ([]Contact, error)
+	GetContactsByNumbers(user *User, numbers []string) ([]Contact, error)
 }
 
 type contactStore struct {
 	*gorm.DB
 }
 
+// CreateContact creates or replaces a contact, writing its numbers in E.164
+// format for the user's region so that messages can be matched to it.
 func (db contactStore) CreateContact(proto *Contact) error {
+	if proto.UserID == 0 {
+		proto.UserID = proto.User.ID
+	}
+	region, err := userRegion(db.DB, proto.UserID)
+	if err != nil {
+		return err
+	}
+	for i := range proto.PhoneNumbers {
+		proto.PhoneNumbers[i].Number = E164(proto.PhoneNumbers[i].Number, region)
+	}
 	return db.Where(&Contact{
 		UUID: proto.UUID,
 	}).Assign(proto).FirstOrCreate(&Contact{}).Error
@@ -39,3 +52,17 @@ func (db contactStore) GetContactsByUser(user *User) ([]Contact, error) {
 	}
 	return contacts, nil
 }
+
+// GetContactsByNumbers returns the user's contacts with any of the numbers,
+// which must be normalized as contact numbers are.
+func (db contactStore) GetContactsByNumbers(user *User, numbers []string) ([]Contact, error) {
+	var contacts []Contact
+	if len(numbers) == 0 {
+		return contacts, nil
+	}
+	if err := db.Where("user_id = ? AND id IN (SELECT contact_id FROM contact_phones WHERE number IN (?) AND deleted_at IS NULL)", user.ID, numbers).
+		Order("id asc").Preload("PhoneNumbers").Find(&contacts).Error; err != nil {
+		return nil, err
+	}
+	return contacts, nil
+}
@@ -2,6 +2,7 @@ package store
 
 import (
 	"portal-server/model"
+	"strconv"
 	"testing"
 
 	"github.com/franela/goblin"
@@ -96,6 +97,49 @@ func TestContactStore(t *testing.T) {
 			assertContact(t, db, &user, "contact3", "home", "5")
 			assertContact(t, db, &user, "contact3", "cell", "6")
 		})
+
+		g.It("CreateContact writes numbers in E.164 for the user's region", func() {
+			user := model.User{UUID: "1", Email: "test@portal.com", Region: "GB"}
+			db.Create(&user)
+			store.CreateContact(&model.Contact{
+				UserID: user.ID,
+				Name:   "Justin",
+				UUID:   uuid.NewV4().String(),
+				PhoneNumbers: []model.ContactPhone{
+					{Type: "cell", Number: "07700 900123"},
+					{Type: "work", Number: "+1 (555) 123-4567"},
+					{Type: "other", Number: "61234"},
+				},
+			})
+			assertContact(t, db, &user, "Justin", "cell", "+447700900123")
+			assertContact(t, db, &user, "Justin", "work", "+15551234567")
+			assertContact(t, db, &user, "Justin", "other", "61234")
+		})
+
+		g.It("GetContactsByNumbers finds the user's contacts with any of the numbers", func() {
+			user := model.User{UUID: "1", Email: "test@portal.com"}
+			db.Create(&user)
+			other := model.User{UUID: "2", Email: "other@portal.com"}
+			db.Create(&other)
+			for i, owner := range []model.User{user, user, other} {
+				store.CreateContact(&model.Contact{
+					UserID:       owner.ID,
+					Name:         "contact" + strconv.Itoa(i),
+					UUID:         uuid.NewV4().String(),
+					PhoneNumbers: []model.ContactPhone{{Type: "cell", Number: "555-123-456" + strconv.Itoa(i%2)}},
+				})
+			}
+
+			contacts, err := store.GetContactsByNumbers(&user, []string{"+15551234560", "+15559876543"})
+			assert.NoError(t, err)
+			assert.Len(t, contacts, 1)
+			assert.Equal(t, "contact0", contacts[0].Name)
+			assert.Equal(t, "+15551234560", contacts[0].PhoneNumbers[0].Number)
+
+			contacts, err = store.GetContactsByNumbers(&user, nil)
+			assert.NoError(t, err)
+			assert.Len(t, contacts, 0)
+		})
 	})
 }
 
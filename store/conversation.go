@@ -0,0 +1,149 @@
+package store
+
+import (
+	. "portal-server/model"
+
+	"github.com/jinzhu/gorm"
+	"github.com/satori/go.uuid"
+)
+
+type ConversationStore interface {
+	FindConversation(where *Conversation) (*Conversation, bool)
+	GetConversationsByUser(user *User) ([]Conversation, error)
+	AssignConversation(message *Message) error
+	GetUnreadCount(user *User) (int, error)
+
+	// Marking messages read issues them the next number in the user's
+	// change sequence, so do so in a transaction.
+	MarkRead(conversation *Conversation, through *Message) (bool, error)
+}
+
+type conversationStore struct {
+	*gorm.DB
+}
+
+func (db conversationStore) FindConversation(where *Conversation) (*Conversation, bool) {
+	var conversation Conversation
+	if db.Where(where).Preload("LastMessage.Attachments").Preload("LastMessage.Recipients").First(&conversation).RecordNotFound() {
+		return nil, false
+	}
+	return &conversation, true
+}
+
+// GetConversationsByUser returns the user's conversations with their last
+// message, most recently active first.
+func (db conversationStore) GetConversationsByUser(user *User) ([]Conversation, error) {
+	var conversations []Conversation
+	if err := db.Where(&Conversation{
+		UserID: user.ID,
+	}).Where("last_message_id > 0").Order("last_message_at desc, id desc").
+		Preload("LastMessage.Attachments").Preload("LastMessage.Recipients").Find(&conversations).Error; err != nil {
+		return nil, err
+	}
+	return conversations, nil
+}
+
+// AssignConversation adds an existing message to the conversation with its
+// participant, creating the conversation if needed.
+func (db conversationStore) AssignConversation(message *Message) error {
+	conversation, err := findOrCreateConversation(db.DB, message)
+	if err != nil {
+		return err
+	}
+	if err := db.Model(message).UpdateColumn("conversation_id", conversation.ID).Error; err != nil {
+		return err
+	}
+	if err := refreshConversation(db.DB, conversation.ID); err != nil {
+		return err
+	}
+	return countUnread(db.DB, conversation.ID)
+}
+
+// GetUnreadCount totals the unread messages across the user's conversations.
+func (db conversationStore) GetUnreadCount(user *User) (int, error) {
+	var unread int
+	row := db.Model(&Conversation{}).Where(&Conversation{UserID: user.ID}).
+		Select("coalesce(sum(unread_count), 0)").Row()
+	if err := row.Scan(&unread); err != nil {
+		return 0, err
+	}
+	return unread, nil
+}
+
+// MarkRead moves a conversation's read marker forward to one of its
+// messages, marking the received messages up to it as read. Markers never
+// move back, so that reports arriving out of order do not unread messages,
+// and the result says whether the marker moved.
+func (db conversationStore) MarkRead(conversation *Conversation, through *Message) (bool, error) {
+	if through.ID <= conversation.ReadMessageID {
+		return false, nil
+	}
+	var messages []Message
+	if err := db.Where(&Message{
+		ConversationID: conversation.ID,
+		Direction:      MessageDirectionIncoming,
+	}).Where("read = ? AND id <= ?", false, through.ID).Find(&messages).Error; err != nil {
+		return false, err
+	}
+	for i := range messages {
+		seq, err := nextChangeSeq(db.DB, messages[i].UserID)
+		if err != nil {
+			return false, err
+		}
+		if err := db.Model(&messages[i]).UpdateColumns(map[string]interface{}{
+			"seq":  seq,
+			"read": true,
+		}).Error; err != nil {
+			return false, err
+		}
+	}
+	if err := db.Model(conversation).UpdateColumn("read_message_id", through.ID).Error; err != nil {
+		return false, err
+	}
+	if err := countUnread(db.DB, conversation.ID); err != nil {
+		return false, err
+	}
+	row := db.Model(&Conversation{}).Where("id = ?", conversation.ID).Select("unread_count").Row()
+	return true, row.Scan(&conversation.UnreadCount)
+}
+
+func findOrCreateConversation(db *gorm.DB, message *Message) (*Conversation, error) {
+	var conversation Conversation
+	err := db.Where(&Conversation{
+		UserID:      message.UserID,
+		Participant: ConversationKey(message.Participants()),
+	}).Attrs(&Conversation{
+		UUID: uuid.NewV4().String(),
+	}).FirstOrCreate(&conversation).Error
+	if err != nil {
+		return nil, err
+	}
+	return &conversation, nil
+}
+
+// refreshConversation points a conversation at its latest remaining message.
+func refreshConversation(db *gorm.DB, conversationID uint) error {
+	var last Message
+	err := db.Where(&Message{ConversationID: conversationID}).Order("id desc").First(&last).Error
+	if err != nil && err != gorm.RecordNotFound {
+		return err
+	}
+	return db.Model(&Conversation{}).Where("id = ?", conversationID).UpdateColumns(map[string]interface{}{
+		"last_message_id": last.ID,
+		"last_message_at": last.CreatedAt,
+	}).Error
+}
+
+// countUnread recounts the unread messages in a conversation. Only changes
+// to unread messages affect the count.
+func countUnread(db *gorm.DB, conversationID uint) error {
+	var unread int
+	if err := db.Model(&Message{}).Where(&Message{
+		ConversationID: conversationID,
+		Direction:      MessageDirectionIncoming,
+	}).Where("read = ?", false).Count(&unread).Error; err != nil {
+		return err
+	}
+	return db.Model(&Conversation{}).Where("id = ?", conversationID).
+		UpdateColumn("unread_count", unread).Error
+}
@@ -2,6 +2,7 @@ package store
 
 import (
 	. "portal-server/model"
+	"time"
 
 	"github.com/jinzhu/gorm"
 )
@@ -9,10 +10,12 @@ import (
 type DeviceStore interface {
 	CreateDevice(proto *Device) error
 	SaveDevice(device *Device) error
+	TouchDevice(device *Device, at time.Time) error
 	FindDevice(where *Device) (*Device, bool)
 	DeleteDevice(device *Device) error
 	DeviceCount(where *Device) int
 	GetAllLinkedDevices(user *User) ([]Device, error)
+	GetPendingDevices(user *User) ([]Device, error)
 	GetRelatedUser(device *Device) (*User, error)
 	GetRelatedKey(device *Device) (*NotificationKey, error)
 }
@@ -29,6 +32,11 @@ func (db deviceStore) SaveDevice(device *Device) error {
 	return db.Save(device).Error
 }
 
+func (db deviceStore) TouchDevice(device *Device, at time.Time) error {
+	device.LastSeenAt = at
+	return db.Model(device).UpdateColumn("last_seen_at", at).Error
+}
+
 func (db deviceStore) FindDevice(where *Device) (*Device, bool) {
 	var device Device
 	if db.Where(where).First(&device).RecordNotFound() {
@@ -58,6 +66,18 @@ func (db deviceStore) GetAllLinkedDevices(user *User) ([]Device, error) {
 	return devices, nil
 }
 
+func (db deviceStore) GetPendingDevices(user *User) ([]Device, error) {
+	var devices []Device
+	if err := db.Where(Device{
+		UserID:   user.ID,
+		State:    DeviceStateLinked,
+		KeyState: DeviceKeyStatePending,
+	}).Find(&devices).Error; err != nil {
+		return nil, err
+	}
+	return devices, nil
+}
+
 func (db deviceStore) GetRelatedUser(device *Device) (*User, error) {
 	var user User
 	if err := db.Model(device).Related(&user).Error; err != nil {
@@ -3,6 +3,7 @@ package store
 import (
 	"portal-server/model"
 	"testing"
+	"time"
 
 	"github.com/franela/goblin"
 	"github.com/jinzhu/gorm"
@@ -75,6 +76,24 @@ func TestDeviceStore(t *testing.T) {
 			assert.Equal(t, model.DeviceStateUnlinked, d.State)
 		})
 
+		g.It("TouchDevice", func() {
+			device := model.Device{
+				User:            user,
+				NotificationKey: notificationKey,
+				UUID:            "1",
+				Type:            model.DeviceTypePhone,
+				State:           model.DeviceStateLinked,
+			}
+			db.Create(&device)
+			at := time.Now().Add(time.Minute)
+			assert.NoError(t, store.TouchDevice(&device, at))
+
+			var d model.Device
+			db.Where(&model.Device{UserID: user.ID}).First(&d)
+			assert.Equal(t, at.Unix(), d.LastSeenAt.Unix())
+			assert.Equal(t, device.UpdatedAt.Unix(), d.UpdatedAt.Unix())
+		})
+
 		g.It("FindDevice", func() {
 			db.Create(&model.Device{
 				User:            user,
@@ -0,0 +1,65 @@
+package store
+
+import (
+	. "portal-server/model"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+type DraftStore interface {
+	FindDraft(where *Draft) (*Draft, bool)
+	SaveDraft(draft *Draft) (bool, error)
+}
+
+type draftStore struct {
+	*gorm.DB
+}
+
+func (db draftStore) FindDraft(where *Draft) (*Draft, bool) {
+	var draft Draft
+	if db.Where(where).First(&draft).RecordNotFound() {
+		return nil, false
+	}
+	return &draft, true
+}
+
+// saveDraft inserts a draft or, if the conversation has one, replaces it
+// unless it was edited later. Doing both in one statement keeps two devices
+// saving at once from both inserting, or from replacing a newer edit read
+// before it was committed. The conflict is on idx_draft_user_conversation,
+// which like every index gorm creates leaves out soft deleted rows.
+const saveDraft = `INSERT INTO drafts
+	(created_at, updated_at, user_id, conversation_id, body, client_updated_at, nonce, key_version)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT (user_id, conversation_id) WHERE (drafts.deleted_at IS NULL OR drafts.deleted_at <= '0001-01-02')
+	DO UPDATE SET
+	updated_at = excluded.updated_at, body = excluded.body, client_updated_at = excluded.client_updated_at,
+	nonce = excluded.nonce, key_version = excluded.key_version
+	WHERE drafts.client_updated_at <= excluded.client_updated_at`
+
+// SaveDraft records a user's draft in a conversation, unless another device
+// edited it later by the clients' clocks, reporting whether it was recorded.
+// Edits made at the same time are recorded in the order they arrive. Once
+// saved the draft holds the latest edit either way.
+func (db draftStore) SaveDraft(draft *Draft) (bool, error) {
+	if draft.UserID == 0 {
+		draft.UserID = draft.User.ID
+	}
+	if draft.ConversationID == 0 {
+		draft.ConversationID = draft.Conversation.ID
+	}
+	now := time.Now()
+	result := db.Exec(saveDraft, now, now, draft.UserID, draft.ConversationID, draft.Body,
+		draft.ClientUpdatedAt, draft.Nonce, draft.KeyVersion)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	var saved Draft
+	if err := db.Where(&Draft{UserID: draft.UserID, ConversationID: draft.ConversationID}).
+		First(&saved).Error; err != nil {
+		return false, err
+	}
+	*draft = saved
+	return result.RowsAffected > 0, nil
+}
@@ -0,0 +1,91 @@
+package store
+
+import (
+	"portal-server/model"
+	"testing"
+	"time"
+
+	"github.com/franela/goblin"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDraftStore(t *testing.T) {
+	var db *gorm.DB
+	var store draftStore
+	var user model.User
+	var conversation model.Conversation
+	g := goblin.Goblin(t)
+
+	g.Describe("DraftStore", func() {
+		g.BeforeEach(func() {
+			db = GetTestDB()
+			store = draftStore{db}
+			user = model.User{UUID: "1", Email: "test@portal.com"}
+			db.Create(&user)
+			conversation = model.Conversation{User: user, UUID: "conversation", Participant: "5551234"}
+			db.Create(&conversation)
+		})
+
+		g.AfterEach(func() {
+			TeardownTestDB(db)
+		})
+
+		g.It("SaveDraft keeps the latest edit by the clients' clocks", func() {
+			now := time.Now()
+			saved, err := store.SaveDraft(&model.Draft{User: user, Conversation: conversation, Body: "hel", ClientUpdatedAt: now})
+			assert.NoError(t, err)
+			assert.True(t, saved)
+
+			saved, err = store.SaveDraft(&model.Draft{User: user, Conversation: conversation, Body: "hello", ClientUpdatedAt: now.Add(time.Second)})
+			assert.NoError(t, err)
+			assert.True(t, saved)
+
+			stale := &model.Draft{User: user, Conversation: conversation, Body: "he", ClientUpdatedAt: now}
+			saved, err = store.SaveDraft(stale)
+			assert.NoError(t, err)
+			assert.False(t, saved)
+			assert.Equal(t, "hello", stale.Body)
+
+			draft, found := store.FindDraft(&model.Draft{UserID: user.ID, ConversationID: conversation.ID})
+			assert.True(t, found)
+			assert.Equal(t, "hello", draft.Body)
+		})
+
+		g.It("SaveDraft keeps a deleted draft from coming back", func() {
+			now := time.Now()
+			store.SaveDraft(&model.Draft{User: user, Conversation: conversation, Body: "hello", ClientUpdatedAt: now})
+			saved, err := store.SaveDraft(&model.Draft{User: user, Conversation: conversation, ClientUpdatedAt: now.Add(time.Second)})
+			assert.NoError(t, err)
+			assert.True(t, saved)
+
+			saved, _ = store.SaveDraft(&model.Draft{User: user, Conversation: conversation, Body: "hello", ClientUpdatedAt: now})
+			assert.False(t, saved)
+			draft, _ := store.FindDraft(&model.Draft{UserID: user.ID, ConversationID: conversation.ID})
+			assert.True(t, draft.Deleted())
+		})
+
+		g.It("SaveDraft keeps the newer edit when another device saved the draft in between", func() {
+			now := time.Now()
+			// A newer edit from another device is committed first
+			db.Create(&model.Draft{User: user, Conversation: conversation, Body: "hello", ClientUpdatedAt: now.Add(time.Second)})
+			older := &model.Draft{User: user, Conversation: conversation, Body: "hel", ClientUpdatedAt: now}
+			saved, err := store.SaveDraft(older)
+			assert.NoError(t, err)
+			assert.False(t, saved)
+			assert.Equal(t, "hello", older.Body)
+
+			// An even newer edit replaces it rather than failing to create a second draft
+			newer := &model.Draft{User: user, Conversation: conversation, Body: "hello there", ClientUpdatedAt: now.Add(2 * time.Second)}
+			saved, err = store.SaveDraft(newer)
+			assert.NoError(t, err)
+			assert.True(t, saved)
+
+			var drafts []model.Draft
+			db.Where("user_id = ?", user.ID).Find(&drafts)
+			assert.Len(t, drafts, 1)
+			assert.Equal(t, "hello there", drafts[0].Body)
+			assert.Equal(t, drafts[0].ID, newer.ID)
+		})
+	})
+}
@@ -1,32 +1,74 @@
 package store
 
 import (
+	"errors"
 	. "portal-server/model"
 
 	"github.com/jinzhu/gorm"
 )
 
+// Errors
+var (
+	ErrEncryptionRequired = errors.New("encryption_required")
+	ErrInvalidEnvelope    = errors.New("invalid_envelope")
+)
+
 type EncryptionKeyStore interface {
-	FindKey(where *EncryptionKey) (*EncryptionKey, bool)
+	FindKey(where *EncryptionKey) (*EncryptionKey, bool, error)
 	CreateKey(proto *EncryptionKey) error
+	SaveKey(key *EncryptionKey) error
+	GetKeysByUser(user *User) ([]EncryptionKey, error)
 	GetRelatedUser(key *EncryptionKey) (*User, error)
 	GetCount(where *EncryptionKey) int
+	CheckEnvelope(user *User, message *Message) error
 }
 
+// encryptionKeyStore transparently seals keys as they are written and opens
+// them as they are read.
 type encryptionKeyStore struct {
 	*gorm.DB
+	secrets secretBox
 }
 
-func (db encryptionKeyStore) FindKey(where *EncryptionKey) (*EncryptionKey, bool) {
+// FindKey finds a key and opens it. A key which is found but cannot be
+// opened, such as one sealed under another master key, is an error rather
+// than missing, so that callers do not replace it.
+func (db encryptionKeyStore) FindKey(where *EncryptionKey) (*EncryptionKey, bool, error) {
 	var key EncryptionKey
 	if db.Where(where).First(&key).RecordNotFound() {
-		return nil, false
+		return nil, false, nil
+	}
+	if err := db.openKey(&key); err != nil {
+		return nil, true, err
 	}
-	return &key, true
+	return &key, true, nil
 }
 
 func (db encryptionKeyStore) CreateKey(proto *EncryptionKey) error {
-	return db.Create(proto).Error
+	return db.sealed(proto, func() error {
+		return db.Create(proto).Error
+	})
+}
+
+func (db encryptionKeyStore) SaveKey(key *EncryptionKey) error {
+	return db.sealed(key, func() error {
+		return db.Save(key).Error
+	})
+}
+
+func (db encryptionKeyStore) GetKeysByUser(user *User) ([]EncryptionKey, error) {
+	var keys []EncryptionKey
+	if err := db.Where(&EncryptionKey{
+		UserID: user.ID,
+	}).Order("version asc").Find(&keys).Error; err != nil {
+		return nil, err
+	}
+	for i := range keys {
+		if err := db.openKey(&keys[i]); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
 }
 
 func (db encryptionKeyStore) GetRelatedUser(key *EncryptionKey) (*User, error) {
@@ -42,3 +84,49 @@ func (db encryptionKeyStore) GetCount(where *EncryptionKey) int {
 	db.Model(&EncryptionKey{}).Where(where).Count(&count)
 	return count
 }
+
+// CheckEnvelope ensures that a message body sent as ciphertext is well formed
+// and sealed under one of the user's keys, and that users who opted in to
+// encrypted messages send nothing else. Picture messages without text have no
+// body to encrypt.
+func (db encryptionKeyStore) CheckEnvelope(user *User, message *Message) error {
+	if !message.Encrypted() {
+		if message.Body != "" && user.EncryptedMessages {
+			return ErrEncryptionRequired
+		}
+		return nil
+	}
+	if message.KeyVersion <= 0 || !ValidEnvelope(message.Body, message.Nonce) {
+		return ErrInvalidEnvelope
+	}
+	if db.GetCount(&EncryptionKey{
+		UserID:  user.ID,
+		Version: message.KeyVersion,
+	}) == 0 {
+		return ErrInvalidEnvelope
+	}
+	return nil
+}
+
+// sealed writes a key with its secret sealed, leaving the plaintext in place
+// for the caller afterwards.
+func (db encryptionKeyStore) sealed(key *EncryptionKey, write func() error) error {
+	plaintext := key.Key
+	sealed, err := db.secrets.seal(plaintext)
+	if err != nil {
+		return err
+	}
+	key.Key = sealed
+	err = write()
+	key.Key = plaintext
+	return err
+}
+
+func (db encryptionKeyStore) openKey(key *EncryptionKey) error {
+	plaintext, err := db.secrets.open(key.Key)
+	if err != nil {
+		return err
+	}
+	key.Key = plaintext
+	return nil
+}
@@ -0,0 +1,246 @@
+package store
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	. "portal-server/model"
+	"strconv"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// sealedPrefix marks a secret as encrypted, distinguishing it from legacy
+// plaintext values.
+const sealedPrefix = "enc:v1:"
+
+// Envelope encryption errors
+var (
+	ErrInvalidMasterKey   = errors.New("invalid_master_key")
+	ErrMissingMasterKey   = errors.New("missing_master_key")
+	ErrMasterKeyMismatch  = errors.New("master_key_mismatch")
+	ErrInvalidSealedValue = errors.New("invalid_sealed_value")
+)
+
+// A MasterKey wraps the data keys that encrypt server held secrets.
+type MasterKey struct {
+	ID  string
+	key []byte
+}
+
+// NewMasterKey creates a master key from 32 random bytes. Its ID is derived
+// from the key, so that data keys record which master key wrapped them.
+func NewMasterKey(key []byte) (*MasterKey, error) {
+	if len(key) != 32 {
+		return nil, ErrInvalidMasterKey
+	}
+	sum := sha256.Sum256(key)
+	return &MasterKey{
+		ID:  hex.EncodeToString(sum[:8]),
+		key: key,
+	}, nil
+}
+
+// LoadMasterKey reads a hex encoded master key from the environment variable
+// with the given name, or from the file named by <name>_FILE. It returns nil
+// if neither is set.
+func LoadMasterKey(name string) (*MasterKey, error) {
+	encoded := os.Getenv(name)
+	if path := os.Getenv(name + "_FILE"); encoded == "" && path != "" {
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		encoded = string(contents)
+	}
+	if encoded == "" {
+		return nil, nil
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, ErrInvalidMasterKey
+	}
+	return NewMasterKey(key)
+}
+
+// A secretBox seals secrets under the current data key before they are
+// written, and opens them after they are read. Without a master key,
+// secrets are stored as plaintext.
+type secretBox struct {
+	db        *gorm.DB
+	masterKey *MasterKey
+}
+
+func (b secretBox) seal(plaintext string) (string, error) {
+	if b.masterKey == nil {
+		return plaintext, nil
+	}
+	dataKey, err := b.currentDataKey()
+	if err != nil {
+		return "", err
+	}
+	key, err := b.unwrap(dataKey)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := encrypt(key, []byte(plaintext))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s%d:%s", sealedPrefix, dataKey.ID, sealed), nil
+}
+
+func (b secretBox) open(value string) (string, error) {
+	if !strings.HasPrefix(value, sealedPrefix) {
+		// Legacy plaintext secret
+		return value, nil
+	}
+	if b.masterKey == nil {
+		return "", ErrMissingMasterKey
+	}
+	parts := strings.SplitN(strings.TrimPrefix(value, sealedPrefix), ":", 2)
+	if len(parts) != 2 {
+		return "", ErrInvalidSealedValue
+	}
+	id, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return "", ErrInvalidSealedValue
+	}
+	var dataKey DataKey
+	if err := b.db.Where(&DataKey{Model: gorm.Model{ID: uint(id)}}).First(&dataKey).Error; err != nil {
+		return "", err
+	}
+	key, err := b.unwrap(&dataKey)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := decrypt(key, parts[1])
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// currentDataKey finds the data key for new secrets, creating one if the
+// current master key has none.
+func (b secretBox) currentDataKey() (*DataKey, error) {
+	var dataKey DataKey
+	if !b.db.Where(&DataKey{
+		MasterKeyID: b.masterKey.ID,
+		Current:     true,
+	}).First(&dataKey).RecordNotFound() {
+		return &dataKey, nil
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	wrapped, err := encrypt(b.masterKey.key, key)
+	if err != nil {
+		return nil, err
+	}
+	dataKey = DataKey{
+		MasterKeyID: b.masterKey.ID,
+		Key:         wrapped,
+		Current:     true,
+	}
+	if err := b.db.Create(&dataKey).Error; err != nil {
+		return nil, err
+	}
+	return &dataKey, nil
+}
+
+func (b secretBox) unwrap(dataKey *DataKey) ([]byte, error) {
+	if dataKey.MasterKeyID != b.masterKey.ID {
+		return nil, ErrMasterKeyMismatch
+	}
+	return decrypt(b.masterKey.key, dataKey.Key)
+}
+
+// ReencryptSecrets rewraps every data key under a new master key, for master
+// key rotation. Legacy plaintext encryption keys are sealed along the way.
+func ReencryptSecrets(db *gorm.DB, oldKey, newKey *MasterKey) error {
+	var dataKeys []DataKey
+	if err := db.Find(&dataKeys).Error; err != nil {
+		return err
+	}
+	for _, dataKey := range dataKeys {
+		if dataKey.MasterKeyID == newKey.ID {
+			continue
+		}
+		if oldKey == nil {
+			return ErrMissingMasterKey
+		}
+		key, err := secretBox{db, oldKey}.unwrap(&dataKey)
+		if err != nil {
+			return err
+		}
+		if dataKey.Key, err = encrypt(newKey.key, key); err != nil {
+			return err
+		}
+		dataKey.MasterKeyID = newKey.ID
+		if err := db.Save(&dataKey).Error; err != nil {
+			return err
+		}
+	}
+
+	var keys []EncryptionKey
+	if err := db.Where("key NOT LIKE ?", sealedPrefix+"%").Find(&keys).Error; err != nil {
+		return err
+	}
+	box := secretBox{db, newKey}
+	for _, key := range keys {
+		sealed, err := box.seal(key.Key)
+		if err != nil {
+			return err
+		}
+		if err := db.Model(&key).UpdateColumn("key", sealed).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encrypt seals plaintext with AES-GCM, returning the base64 encoded nonce
+// and ciphertext.
+func encrypt(key, plaintext []byte) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, plaintext, nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func decrypt(key []byte, encoded string) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < gcm.NonceSize() {
+		return nil, ErrInvalidSealedValue
+	}
+	nonce := sealed[:gcm.NonceSize()]
+	return gcm.Open(nil, nonce, sealed[gcm.NonceSize():], nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,129 @@
+package store
+
+import (
+	"bytes"
+	"os"
+	"portal-server/model"
+	"strings"
+	"testing"
+
+	"github.com/franela/goblin"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnvelope(t *testing.T) {
+	var db *gorm.DB
+	var masterKey *MasterKey
+	var user model.User
+	g := goblin.Goblin(t)
+
+	g.Describe("Envelope encryption", func() {
+		g.BeforeEach(func() {
+			db = GetTestDB()
+			masterKey, _ = NewMasterKey(bytes.Repeat([]byte{1}, 32))
+			user = model.User{
+				UUID:  "1",
+				Email: "test@portal.com",
+			}
+			db.Create(&user)
+		})
+
+		g.AfterEach(func() {
+			TeardownTestDB(db)
+		})
+
+		g.It("Should reject master keys of the wrong size", func() {
+			_, err := NewMasterKey([]byte("short"))
+			assert.Equal(t, ErrInvalidMasterKey, err)
+		})
+
+		g.It("Should load a master key from the environment", func() {
+			os.Setenv("TEST_MASTER_KEY", strings.Repeat("01", 32))
+			defer os.Unsetenv("TEST_MASTER_KEY")
+			key, err := LoadMasterKey("TEST_MASTER_KEY")
+			assert.NoError(t, err)
+			assert.Equal(t, masterKey.ID, key.ID)
+
+			key, err = LoadMasterKey("MISSING_MASTER_KEY")
+			assert.NoError(t, err)
+			assert.Nil(t, key)
+		})
+
+		g.It("Should store encryption keys sealed and read them transparently", func() {
+			store := NewWithMasterKey(db, masterKey)
+			key := &model.EncryptionKey{
+				User:    user,
+				Version: 1,
+				Current: true,
+				Key:     "plaintext_key",
+			}
+			assert.NoError(t, store.EncryptionKeys().CreateKey(key))
+			assert.Equal(t, "plaintext_key", key.Key)
+
+			var raw model.EncryptionKey
+			db.First(&raw)
+			assert.True(t, strings.HasPrefix(raw.Key, sealedPrefix))
+			assert.NotContains(t, raw.Key, "plaintext_key")
+
+			found, ok, err := store.EncryptionKeys().FindKey(&model.EncryptionKey{UserID: user.ID})
+			assert.NoError(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, "plaintext_key", found.Key)
+
+			keys, err := store.EncryptionKeys().GetKeysByUser(&user)
+			assert.NoError(t, err)
+			assert.Equal(t, "plaintext_key", keys[0].Key)
+		})
+
+		g.It("Should read legacy plaintext keys", func() {
+			db.Create(&model.EncryptionKey{User: user, Version: 1, Key: "legacy_key"})
+			store := NewWithMasterKey(db, masterKey)
+			found, ok, err := store.EncryptionKeys().FindKey(&model.EncryptionKey{UserID: user.ID})
+			assert.NoError(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, "legacy_key", found.Key)
+		})
+
+		g.It("Should not read sealed keys without the master key", func() {
+			NewWithMasterKey(db, masterKey).EncryptionKeys().CreateKey(&model.EncryptionKey{
+				User:    user,
+				Version: 1,
+				Key:     "plaintext_key",
+			})
+			// The key is there, but unreadable rather than missing
+			_, ok, err := New(db).EncryptionKeys().FindKey(&model.EncryptionKey{UserID: user.ID})
+			assert.True(t, ok)
+			assert.Error(t, err)
+
+			_, ok, err = New(db).EncryptionKeys().FindKey(&model.EncryptionKey{UserID: user.ID, Version: 2})
+			assert.False(t, ok)
+			assert.NoError(t, err)
+		})
+
+		g.It("Should rewrap data keys under a new master key", func() {
+			NewWithMasterKey(db, masterKey).EncryptionKeys().CreateKey(&model.EncryptionKey{
+				User:    user,
+				Version: 1,
+				Key:     "sealed_key",
+			})
+			db.Create(&model.EncryptionKey{User: user, Version: 2, Key: "legacy_key"})
+
+			newKey, _ := NewMasterKey(bytes.Repeat([]byte{2}, 32))
+			assert.NoError(t, ReencryptSecrets(db, masterKey, newKey))
+
+			// The old master key can no longer read any secrets
+			_, _, err := NewWithMasterKey(db, masterKey).EncryptionKeys().FindKey(&model.EncryptionKey{Version: 1})
+			assert.Error(t, err)
+
+			keys, err := NewWithMasterKey(db, newKey).EncryptionKeys().GetKeysByUser(&user)
+			assert.NoError(t, err)
+			assert.Equal(t, "sealed_key", keys[0].Key)
+			assert.Equal(t, "legacy_key", keys[1].Key)
+
+			var raw model.EncryptionKey
+			db.Where(&model.EncryptionKey{Version: 2}).First(&raw)
+			assert.True(t, strings.HasPrefix(raw.Key, sealedPrefix))
+		})
+	})
+}
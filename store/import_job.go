@@ -0,0 +1,48 @@
+package store
+
+import (
+	. "portal-server/model"
+
+	"github.com/jinzhu/gorm"
+)
+
+type ImportJobStore interface {
+	CreateImportJob(proto *ImportJob) error
+	FindImportJob(where *ImportJob) (*ImportJob, bool)
+	GetUnfinishedImportJobs() ([]ImportJob, error)
+	SaveImportJob(job *ImportJob) error
+}
+
+type importJobStore struct {
+	*gorm.DB
+}
+
+func (db importJobStore) CreateImportJob(proto *ImportJob) error {
+	if proto.UserID == 0 {
+		proto.UserID = proto.User.ID
+	}
+	return db.Create(proto).Error
+}
+
+func (db importJobStore) FindImportJob(where *ImportJob) (*ImportJob, bool) {
+	var job ImportJob
+	if db.Where(where).First(&job).RecordNotFound() {
+		return nil, false
+	}
+	return &job, true
+}
+
+// GetUnfinishedImportJobs returns the import jobs of every user that are
+// pending or running, oldest first.
+func (db importJobStore) GetUnfinishedImportJobs() ([]ImportJob, error) {
+	var jobs []ImportJob
+	if err := db.Where("status IN (?)", []string{ImportStatusPending, ImportStatusRunning}).
+		Order("id asc").Find(&jobs).Error; err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+func (db importJobStore) SaveImportJob(job *ImportJob) error {
+	return db.Save(job).Error
+}
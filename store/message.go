@@ -1,18 +1,46 @@
 package store
 
 import (
+	"database/sql"
 	. "portal-server/model"
+	"time"
 
 	"github.com/jinzhu/gorm"
 )
 
+// A MessagePage selects up to Limit messages with IDs strictly before
+// BeforeID or after AfterID. A zero ID leaves that side unbounded. Pages
+// may be restricted to a single conversation.
+type MessagePage struct {
+	ConversationID uint
+	BeforeID       uint
+	AfterID        uint
+	Limit          int
+}
+
 type MessageStore interface {
 	FindMessage(where *Message) (*Message, bool)
-	GetMessagesByUser(user *User, limit int) ([]Message, error)
+	FindMessageByMessageID(messageID string) (*Message, bool)
+	GetMessagesPage(user *User, page MessagePage) ([]Message, error)
 	GetMessagesSince(user *User, messageID string) ([]Message, error)
+	GetMessagesByStatus(status string, before time.Time) ([]Message, error)
+	GetPlaintextCount(user *User) int
+
+	// Creating, saving and deleting messages issues them the next number in
+	// the user's change sequence. Do so in a transaction so that changes
+	// become visible in sequence order.
 	CreateMessage(proto *Message) error
 	SaveMessage(message *Message) error
-	DeleteMessages(where *Message) int
+	UpdateMessageStatus(message *Message, status string, clientAt time.Time) error
+	DeleteMessages(where *Message) (int, error)
+	GetStatusEvents(message *Message) ([]MessageStatusEvent, error)
+	LoadDetails(messages ...*Message) error
+	ImportMessages(user *User, messages []*Message) (int, error)
+
+	SearchMessages(user *User, search MessageSearch) ([]MessageMatch, error)
+	GetChangesSince(user *User, seq uint64, limit int) ([]Message, error)
+	GetChangeSequence(user *User) (*ChangeSequence, error)
+	PruneDeletedMessages(before time.Time) (int, []string, error)
 }
 
 type messageStore struct {
@@ -27,16 +55,63 @@ func (db messageStore) FindMessage(where *Message) (*Message, bool) {
 	return &message, true
 }
 
-func (db messageStore) GetMessagesByUser(user *User, limit int) ([]Message, error) {
+// FindMessageByMessageID finds the message with the given client assigned ID,
+// even if it has since been deleted, as the ID remains taken.
+func (db messageStore) FindMessageByMessageID(messageID string) (*Message, bool) {
+	var message Message
+	if db.Unscoped().Where(&Message{MessageID: messageID}).First(&message).RecordNotFound() {
+		return nil, false
+	}
+	return &message, true
+}
+
+// GetMessagesByStatus returns the messages of every user that have a status
+// and were created before a given time, oldest first.
+func (db messageStore) GetMessagesByStatus(status string, before time.Time) ([]Message, error) {
 	var messages []Message
-	if err := db.Where(&Message{
-		UserID: user.ID,
-	}).Order("id desc").Limit(limit).Find(&messages).Error; err != nil {
+	if err := db.Where("status = ? AND created_at < ?", status, before).
+		Order("id asc").Find(&messages).Error; err != nil {
 		return nil, err
 	}
 	return messages, nil
 }
 
+// GetPlaintextCount counts the user's messages with bodies that have yet to
+// be encrypted.
+func (db messageStore) GetPlaintextCount(user *User) int {
+	var count int
+	db.Model(&Message{}).Where("user_id = ? AND nonce = '' AND body != ''", user.ID).Count(&count)
+	return count
+}
+
+// GetMessagesPage returns a page of the user's messages, newest first. Pages
+// after an ID hold the oldest messages following it, so that paging forward
+// never skips any.
+func (db messageStore) GetMessagesPage(user *User, page MessagePage) ([]Message, error) {
+	query := db.Where(&Message{
+		UserID:         user.ID,
+		ConversationID: page.ConversationID,
+	})
+	if page.BeforeID != 0 {
+		query = query.Where("id < ?", page.BeforeID)
+	}
+	order := "id desc"
+	if page.AfterID != 0 {
+		query = query.Where("id > ?", page.AfterID)
+		order = "id asc"
+	}
+	var messages []Message
+	if err := query.Order(order).Limit(page.Limit).Preload("Attachments").Preload("Recipients").Find(&messages).Error; err != nil {
+		return nil, err
+	}
+	if page.AfterID != 0 {
+		for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+			messages[i], messages[j] = messages[j], messages[i]
+		}
+	}
+	return messages, nil
+}
+
 func (db messageStore) GetMessagesSince(user *User, messageID string) ([]Message, error) {
 	var message Message
 	// Check message exists
@@ -50,20 +125,357 @@ func (db messageStore) GetMessagesSince(user *User, messageID string) ([]Message
 	var messages []Message
 	if err := db.Where(&Message{
 		UserID: user.ID,
-	}).Where("id > ?", message.ID).Order("id desc").Find(&messages).Error; err != nil {
+	}).Where("id > ?", message.ID).Order("id desc").Preload("Attachments").Preload("Recipients").Find(&messages).Error; err != nil {
 		return nil, err
 	}
 	return messages, nil
 }
 
 func (db messageStore) CreateMessage(proto *Message) error {
-	return db.Create(proto).Error
+	if proto.UserID == 0 {
+		proto.UserID = proto.User.ID
+	}
+	// Callers that loaded the user already know their region
+	region := proto.User.PhoneRegion()
+	if proto.User.ID != proto.UserID {
+		var err error
+		if region, err = userRegion(db.DB, proto.UserID); err != nil {
+			return err
+		}
+	}
+	proto.NormalizeAddresses(region)
+	seq, err := nextChangeSeq(db.DB, proto.UserID)
+	if err != nil {
+		return err
+	}
+	proto.Seq = seq
+	conversation, err := findOrCreateConversation(db.DB, proto)
+	if err != nil {
+		return err
+	}
+	proto.ConversationID = conversation.ID
+	// Saving the User association would write the caller's copy of the user
+	// back over their row with every message
+	if err := db.Omit("User").Create(proto).Error; err != nil {
+		return err
+	}
+	if err := createStatusEvent(db.DB, proto, proto.ClientCreatedAt); err != nil {
+		return err
+	}
+	// The new message is the latest in its conversation
+	if err := db.Model(conversation).UpdateColumns(map[string]interface{}{
+		"last_message_id": proto.ID,
+		"last_message_at": proto.CreatedAt,
+	}).Error; err != nil {
+		return err
+	}
+	if proto.Unread() {
+		return countUnread(db.DB, conversation.ID)
+	}
+	return nil
 }
 
 func (db messageStore) SaveMessage(message *Message) error {
+	seq, err := nextChangeSeq(db.DB, message.UserID)
+	if err != nil {
+		return err
+	}
+	message.Seq = seq
 	return db.Save(message).Error
 }
 
-func (db messageStore) DeleteMessages(where *Message) int {
-	return int(db.Where(where).Delete(&Message{}).RowsAffected)
+// UpdateMessageStatus saves a new status for the message and records the
+// transition in its timeline.
+func (db messageStore) UpdateMessageStatus(message *Message, status string, clientAt time.Time) error {
+	message.Status = status
+	if err := db.SaveMessage(message); err != nil {
+		return err
+	}
+	return createStatusEvent(db.DB, message, clientAt)
+}
+
+// GetStatusEvents returns the timeline of a message, oldest first.
+func (db messageStore) GetStatusEvents(message *Message) ([]MessageStatusEvent, error) {
+	var events []MessageStatusEvent
+	if err := db.Where(&MessageStatusEvent{
+		MessageID: message.ID,
+	}).Order("id asc").Find(&events).Error; err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+func createStatusEvent(db *gorm.DB, message *Message, clientAt time.Time) error {
+	return db.Create(&MessageStatusEvent{
+		MessageID: message.ID,
+		Status:    message.Status,
+		ClientAt:  clientAt,
+	}).Error
+}
+
+// DeleteMessages soft deletes the matching messages, keeping them as
+// tombstones in the change sequence until they are pruned.
+func (db messageStore) DeleteMessages(where *Message) (int, error) {
+	var messages []Message
+	if err := db.Where(where).Find(&messages).Error; err != nil {
+		return 0, err
+	}
+	for i := range messages {
+		seq, err := nextChangeSeq(db.DB, messages[i].UserID)
+		if err != nil {
+			return i, err
+		}
+		if err := db.Unscoped().Model(&messages[i]).UpdateColumns(map[string]interface{}{
+			"seq":        seq,
+			"deleted_at": time.Now(),
+		}).Error; err != nil {
+			return i, err
+		}
+		if err := refreshConversation(db.DB, messages[i].ConversationID); err != nil {
+			return i, err
+		}
+		if messages[i].Unread() {
+			if err := countUnread(db.DB, messages[i].ConversationID); err != nil {
+				return i, err
+			}
+		}
+	}
+	return len(messages), nil
+}
+
+// GetChangesSince returns the user's messages changed after the given
+// sequence number in sequence order, including deleted ones.
+func (db messageStore) GetChangesSince(user *User, seq uint64, limit int) ([]Message, error) {
+	var messages []Message
+	if err := db.Unscoped().Where("user_id = ? AND seq > ?", user.ID, seq).
+		Order("seq asc").Limit(limit).Preload("Attachments").Preload("Recipients").Find(&messages).Error; err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+func (db messageStore) GetChangeSequence(user *User) (*ChangeSequence, error) {
+	var sequence ChangeSequence
+	err := db.Where(&ChangeSequence{UserID: user.ID}).First(&sequence).Error
+	if err != nil && err != gorm.RecordNotFound {
+		return nil, err
+	}
+	return &sequence, nil
+}
+
+// PruneDeletedMessages removes tombstones of messages deleted before the
+// given time along with their attachments, recipients and status events,
+// advancing each affected user's pruned sequence number. The content of the
+// attachments is kept outside the database, so their UUIDs are returned for
+// the caller to delete once the prune is committed.
+func (db messageStore) PruneDeletedMessages(before time.Time) (int, []string, error) {
+	rows, err := db.Unscoped().Model(&Message{}).Select("user_id, max(seq)").
+		Where("deleted_at < ?", before).Group("user_id").Rows()
+	if err != nil {
+		return 0, nil, err
+	}
+	pruned := map[uint]uint64{}
+	for rows.Next() {
+		var userID uint
+		var seq uint64
+		if err := rows.Scan(&userID, &seq); err != nil {
+			rows.Close()
+			return 0, nil, err
+		}
+		pruned[userID] = seq
+	}
+	rows.Close()
+
+	for userID, seq := range pruned {
+		if err := db.Model(&ChangeSequence{}).Where("user_id = ? AND pruned_seq < ?", userID, seq).
+			UpdateColumn("pruned_seq", seq).Error; err != nil {
+			return 0, nil, err
+		}
+	}
+
+	const ofPruned = "message_id IN (SELECT id FROM messages WHERE deleted_at < ?)"
+	var attachments []Attachment
+	if err := db.Unscoped().Where(ofPruned, before).Find(&attachments).Error; err != nil {
+		return 0, nil, err
+	}
+	for _, details := range []interface{}{&Attachment{}, &MessageRecipient{}, &MessageStatusEvent{}} {
+		if err := db.Unscoped().Where(ofPruned, before).Delete(details).Error; err != nil {
+			return 0, nil, err
+		}
+	}
+	blobs := make([]string, len(attachments))
+	for i := range attachments {
+		blobs[i] = attachments[i].UUID
+	}
+
+	result := db.Unscoped().Where("deleted_at < ?", before).Delete(&Message{})
+	return int(result.RowsAffected), blobs, result.Error
+}
+
+// nextChangeSeq issues the next number in the user's change sequence. The
+// increment locks the sequence row until the surrounding transaction ends.
+func nextChangeSeq(db *gorm.DB, userID uint) (uint64, error) {
+	var seq uint64
+	err := db.Raw("UPDATE change_sequences SET seq = seq + 1, updated_at = ? WHERE user_id = ? RETURNING seq",
+		time.Now(), userID).Row().Scan(&seq)
+	if err == sql.ErrNoRows {
+		// The user's first change starts their sequence
+		if err := db.Where(&ChangeSequence{UserID: userID}).FirstOrCreate(&ChangeSequence{}).Error; err != nil {
+			return 0, err
+		}
+		return nextChangeSeq(db, userID)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return seq, nil
+}
+
+// LoadDetails fills in the attachments and recipients of messages that were
+// found without preloading them.
+func (db messageStore) LoadDetails(messages ...*Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	ids := make([]uint, len(messages))
+	for i, message := range messages {
+		ids[i] = message.ID
+	}
+	var attachments []Attachment
+	if err := db.Where("message_id IN (?)", ids).Order("id asc").Find(&attachments).Error; err != nil {
+		return err
+	}
+	var recipients []MessageRecipient
+	if err := db.Where("message_id IN (?)", ids).Order("id asc").Find(&recipients).Error; err != nil {
+		return err
+	}
+	for _, message := range messages {
+		message.Attachments = nil
+		for _, attachment := range attachments {
+			if attachment.MessageID == message.ID {
+				message.Attachments = append(message.Attachments, attachment)
+			}
+		}
+		message.Recipients = nil
+		for _, recipient := range recipients {
+			if recipient.MessageID == message.ID {
+				message.Recipients = append(message.Recipients, recipient)
+			}
+		}
+	}
+	return nil
+}
+
+// ImportMessages creates those of the user's messages that were not already
+// recorded, either under the same MessageID or with the same content,
+// returning how many it created. Imported messages are usually older than the
+// ones already in their conversations, so they only become the latest in a
+// conversation if they were sent after its latest message.
+func (db messageStore) ImportMessages(user *User, messages []*Message) (int, error) {
+	if len(messages) == 0 {
+		return 0, nil
+	}
+	// Content hashes compare the addresses as they would be recorded
+	region, err := userRegion(db.DB, user.ID)
+	if err != nil {
+		return 0, err
+	}
+	for _, message := range messages {
+		message.NormalizeAddresses(region)
+	}
+	from, until := messages[0].ClientCreatedAt, messages[0].ClientCreatedAt
+	for _, message := range messages {
+		if message.ClientCreatedAt.Before(from) {
+			from = message.ClientCreatedAt
+		}
+		if message.ClientCreatedAt.After(until) {
+			until = message.ClientCreatedAt
+		}
+	}
+
+	// Content hashes are to the second, so compare with every message
+	// recorded in the seconds spanned by the batch
+	var existing []Message
+	if err := db.Where("user_id = ? AND client_created_at >= ? AND client_created_at < ?", user.ID,
+		from.Truncate(time.Second).UTC(), until.Truncate(time.Second).Add(time.Second).UTC()).
+		Find(&existing).Error; err != nil {
+		return 0, err
+	}
+	recorded := make([]*Message, len(existing))
+	for i := range existing {
+		recorded[i] = &existing[i]
+	}
+	if err := db.LoadDetails(recorded...); err != nil {
+		return 0, err
+	}
+	hashes := make(map[string]bool)
+	for _, message := range recorded {
+		hashes[message.ContentHash()] = true
+	}
+
+	latest := make(map[uint]*Conversation)
+	created := 0
+	for _, message := range messages {
+		message.UserID = user.ID
+		hash := message.ContentHash()
+		if hashes[hash] {
+			continue
+		}
+		if _, found := db.FindMessageByMessageID(message.MessageID); found {
+			continue
+		}
+		conversation, err := findOrCreateConversation(db.DB, message)
+		if err != nil {
+			return created, err
+		}
+		if _, found := latest[conversation.ID]; !found {
+			latest[conversation.ID] = conversation
+		}
+		if err := db.CreateMessage(message); err != nil {
+			return created, err
+		}
+		hashes[hash] = true
+		created++
+	}
+
+	for _, conversation := range latest {
+		if err := keepLatestMessage(db.DB, conversation); err != nil {
+			return created, err
+		}
+	}
+	return created, nil
+}
+
+// keepLatestMessage points a conversation back at the message that was its
+// latest before messages were imported into it, if none of them were sent
+// after it.
+func keepLatestMessage(db *gorm.DB, before *Conversation) error {
+	if before.LastMessageID == 0 {
+		return nil
+	}
+	var previous, imported Message
+	if err := db.First(&previous, before.LastMessageID).Error; err != nil {
+		if err == gorm.RecordNotFound {
+			return nil
+		}
+		return err
+	}
+	if err := db.Where(&Message{ConversationID: before.ID}).Where("id > ?", previous.ID).
+		Order("client_created_at desc").First(&imported).Error; err != nil {
+		if err == gorm.RecordNotFound {
+			return nil
+		}
+		return err
+	}
+	sentAt := previous.ClientCreatedAt
+	if sentAt.IsZero() {
+		sentAt = previous.CreatedAt
+	}
+	if imported.ClientCreatedAt.After(sentAt) {
+		return nil
+	}
+	return db.Model(&Conversation{}).Where("id = ?", before.ID).UpdateColumns(map[string]interface{}{
+		"last_message_id": previous.ID,
+		"last_message_at": before.LastMessageAt,
+	}).Error
 }
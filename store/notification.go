@@ -9,6 +9,8 @@ import (
 type NotificationKeyStore interface {
 	FindKey(where *NotificationKey) (*NotificationKey, bool)
 	CreateKey(proto *NotificationKey) error
+	SaveKey(key *NotificationKey) error
+	GetAllKeys() ([]NotificationKey, error)
 	GetRelatedUser(key *NotificationKey) (*User, error)
 	GetCount(where *NotificationKey) int
 }
@@ -29,6 +31,18 @@ func (db notificationKeyStore) CreateKey(where *NotificationKey) error {
 	return db.Create(where).Error
 }
 
+func (db notificationKeyStore) SaveKey(key *NotificationKey) error {
+	return db.Save(key).Error
+}
+
+func (db notificationKeyStore) GetAllKeys() ([]NotificationKey, error) {
+	var keys []NotificationKey
+	if err := db.Find(&keys).Error; err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
 func (db notificationKeyStore) GetRelatedUser(key *NotificationKey) (*User, error) {
 	var user User
 	if err := db.Model(key).Related(&user).Error; err != nil {
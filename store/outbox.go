@@ -0,0 +1,55 @@
+package store
+
+import (
+	. "portal-server/model"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+type OutboxStore interface {
+	AddEvent(event *OutboxEvent) error
+	GetUnrelayedEvents(limit int) ([]OutboxEvent, error)
+	MarkRelayed(events []OutboxEvent, at time.Time) error
+	PruneRelayedEvents(before time.Time) (int, error)
+}
+
+type outboxStore struct {
+	*gorm.DB
+}
+
+func (db outboxStore) AddEvent(event *OutboxEvent) error {
+	return db.Create(event).Error
+}
+
+// GetUnrelayedEvents returns the oldest events not yet relayed. On Postgres
+// the events stay locked until the transaction ends, so that concurrent
+// relays do not publish the same events.
+func (db outboxStore) GetUnrelayedEvents(limit int) ([]OutboxEvent, error) {
+	query := "SELECT * FROM outbox_events WHERE relayed_at IS NULL AND deleted_at IS NULL ORDER BY id LIMIT ?"
+	if !isSQLite(db.DB) {
+		query += " FOR UPDATE"
+	}
+	var events []OutboxEvent
+	if err := db.Raw(query, limit).Scan(&events).Error; err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+func (db outboxStore) MarkRelayed(events []OutboxEvent, at time.Time) error {
+	if len(events) == 0 {
+		return nil
+	}
+	ids := make([]uint, len(events))
+	for i, event := range events {
+		ids[i] = event.ID
+	}
+	return db.Model(&OutboxEvent{}).Where("id IN (?)", ids).UpdateColumn("relayed_at", at).Error
+}
+
+// PruneRelayedEvents removes events relayed before the given time.
+func (db outboxStore) PruneRelayedEvents(before time.Time) (int, error) {
+	result := db.Unscoped().Where("relayed_at < ?", before).Delete(&OutboxEvent{})
+	return int(result.RowsAffected), result.Error
+}
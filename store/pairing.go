@@ -0,0 +1,60 @@
+package store
+
+import (
+	. "portal-server/model"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+type PairingSessionStore interface {
+	CreateSession(proto *PairingSession) error
+	SaveSession(session *PairingSession) error
+	FindSession(where *PairingSession) (*PairingSession, bool)
+	SessionCount(where *PairingSession) int
+	RecordFailure(userID uint, since time.Time) error
+	FailureCount(userID uint, since time.Time) int
+}
+
+type pairingSessionStore struct {
+	*gorm.DB
+}
+
+func (db pairingSessionStore) CreateSession(proto *PairingSession) error {
+	return db.Create(proto).Error
+}
+
+func (db pairingSessionStore) SaveSession(session *PairingSession) error {
+	return db.Save(session).Error
+}
+
+func (db pairingSessionStore) FindSession(where *PairingSession) (*PairingSession, bool) {
+	var session PairingSession
+	if db.Where(where).First(&session).RecordNotFound() {
+		return nil, false
+	}
+	return &session, true
+}
+
+func (db pairingSessionStore) SessionCount(where *PairingSession) int {
+	var count int
+	db.Model(&PairingSession{}).Where(where).Count(&count)
+	return count
+}
+
+// RecordFailure records a wrong code typed in by the user, forgetting their
+// failures from before since.
+func (db pairingSessionStore) RecordFailure(userID uint, since time.Time) error {
+	if err := db.Unscoped().Where("user_id = ? AND created_at < ?", userID, since).
+		Delete(&PairingFailure{}).Error; err != nil {
+		return err
+	}
+	return db.Create(&PairingFailure{UserID: userID}).Error
+}
+
+// FailureCount counts the wrong codes typed in by the user since a time.
+func (db pairingSessionStore) FailureCount(userID uint, since time.Time) int {
+	var count int
+	db.Model(&PairingFailure{}).Where("user_id = ? AND created_at >= ?", userID, since).Count(&count)
+	return count
+}
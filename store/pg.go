@@ -26,11 +26,33 @@ func init() {
 	}
 }
 
+// GetStore connects to the database, encrypting secrets under the master
+// key from MASTER_KEY or MASTER_KEY_FILE if one is configured.
 func GetStore(dbName, user, password string) Store {
-	return New(GetDB(dbName, user, password))
+	masterKey, err := LoadMasterKey("MASTER_KEY")
+	if err != nil {
+		log.Fatalf("Error loading master key: %v\n", err)
+	}
+	return NewWithMasterKey(GetDB(dbName, user, password), masterKey)
 }
 
 func GetDB(dbName, user, password string) *gorm.DB {
+	// Connect to DB
+	db, err := gorm.Open("postgres", ConnInfo(dbName, user, password))
+	if err != nil {
+		log.Fatalf("Error connecting to database: %v\n", err)
+	}
+
+	// Ping DB
+	if err := pingDatabase(&db); err != nil {
+		log.Fatalf("Database ping attempts failed: %v\n", err)
+	}
+	return &db
+}
+
+// ConnInfo describes how to connect to the database, for connections made
+// outside of the store such as listening for notifications.
+func ConnInfo(dbName, user, password string) string {
 	params := map[string]string{
 		"dbname":   dbName,
 		"host":     host,
@@ -42,19 +64,7 @@ func GetDB(dbName, user, password string) *gorm.DB {
 	for k, v := range params {
 		conn += fmt.Sprintf("%s=%s ", k, v)
 	}
-	conn += "sslmode=disable"
-
-	// Connect to DB
-	db, err := gorm.Open("postgres", conn)
-	if err != nil {
-		log.Fatalf("Error connecting to database: %v\n", err)
-	}
-
-	// Ping DB
-	if err := pingDatabase(&db); err != nil {
-		log.Fatalf("Database ping attempts failed: %v\n", err)
-	}
-	return &db
+	return conn + "sslmode=disable"
 }
 
 func pingDatabase(db *gorm.DB) (err error) {
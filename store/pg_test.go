@@ -1,6 +1,7 @@
 package store
 
 import (
+	"portal-server/model"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -10,3 +11,38 @@ func TestGetStore(t *testing.T) {
 	s := GetStore("postgres", "postgres", "password")
 	assert.NotNil(t, s)
 }
+
+func TestPostgresSearch(t *testing.T) {
+	db := GetDB("postgres", "postgres", "password")
+	tx := db.Begin()
+	defer tx.Rollback()
+
+	// Work in a schema of its own, which the rollback drops
+	assert.NoError(t, tx.Exec("CREATE SCHEMA search_test").Error)
+	assert.NoError(t, tx.Exec("SET LOCAL search_path TO search_test").Error)
+	assert.NoError(t, tx.CreateTable(&model.User{}, &model.Message{}, &model.Attachment{}, &model.MessageRecipient{}).Error)
+	assert.NoError(t, CreateSearchIndex(tx))
+	// The search_vector column is only added once
+	assert.NoError(t, CreateSearchIndex(tx))
+
+	user := model.User{UUID: "a3bb189e-8bf9-4888-9912-ace4e6543002", Email: "test@portal.com"}
+	assert.NoError(t, tx.Create(&user).Error)
+	for mid, body := range map[string]string{
+		"1": `dinner <script>alert(1)</script> & "drinks"`,
+		"2": "running late",
+	} {
+		assert.NoError(t, tx.Create(&model.Message{
+			UserID:    user.ID,
+			MessageID: mid,
+			Body:      body,
+			Status:    model.MessageStatusSent,
+		}).Error)
+	}
+
+	matches, err := messageStore{tx}.SearchMessages(&user, MessageSearch{Query: "dinner", Limit: 10})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(matches))
+	assert.Equal(t, "1", matches[0].MessageID)
+	assert.Contains(t, matches[0].Snippet, "<b>dinner</b>")
+	assert.NotContains(t, matches[0].Snippet, "<script")
+}
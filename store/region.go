@@ -0,0 +1,195 @@
+package store
+
+import (
+	. "portal-server/model"
+
+	"github.com/jinzhu/gorm"
+)
+
+// A ConversationMerge records, by their UUIDs, that a conversation was merged
+// into another with the same participants.
+type ConversationMerge struct {
+	From string
+	Into string
+}
+
+// NormalizeNumbers writes the numbers stored for a user in E.164 format for
+// their region, for data recorded before numbers were. Messages whose
+// addresses change are issued new change sequence numbers so that clients
+// sync them, and conversations that turn out to be with the same
+// participants are merged. The merges are reported so that clients can be
+// told the conversations they knew by the merged UUIDs are gone.
+func NormalizeNumbers(db *gorm.DB, user *User) ([]ConversationMerge, error) {
+	region := user.PhoneRegion()
+	if err := normalizeContactPhones(db, user, region); err != nil {
+		return nil, err
+	}
+	if err := normalizeMessages(db, user, region); err != nil {
+		return nil, err
+	}
+	return normalizeConversations(db, user, region)
+}
+
+func normalizeContactPhones(db *gorm.DB, user *User, region string) error {
+	var phones []ContactPhone
+	if err := db.Unscoped().Where("contact_id IN (SELECT id FROM contacts WHERE user_id = ?)", user.ID).
+		Find(&phones).Error; err != nil {
+		return err
+	}
+	for i := range phones {
+		number := E164(phones[i].Number, region)
+		if number == phones[i].Number {
+			continue
+		}
+		if err := db.Unscoped().Model(&phones[i]).UpdateColumn("number", number).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// normalizeMessages includes deleted messages, which are kept until pruned
+// so that clients learn of the deletion: they move to the merged conversation
+// like the rest, and are synced with the addresses the others now have.
+func normalizeMessages(db *gorm.DB, user *User, region string) error {
+	var messages []Message
+	if err := db.Unscoped().Where(&Message{UserID: user.ID}).Order("id").Preload("Recipients").
+		Find(&messages).Error; err != nil {
+		return err
+	}
+	for i := range messages {
+		message := &messages[i]
+		normalized := *message
+		normalized.NormalizeAddresses(region)
+		changed := normalized.From != message.From || normalized.To != message.To
+		for j, recipient := range normalized.Recipients {
+			if recipient.Address == message.Recipients[j].Address {
+				continue
+			}
+			changed = true
+			if err := db.Unscoped().Model(&message.Recipients[j]).UpdateColumn("address", recipient.Address).Error; err != nil {
+				return err
+			}
+		}
+		if !changed {
+			continue
+		}
+		seq, err := nextChangeSeq(db, user.ID)
+		if err != nil {
+			return err
+		}
+		if err := db.Unscoped().Model(message).UpdateColumns(map[string]interface{}{
+			"from": normalized.From,
+			"to":   normalized.To,
+			"seq":  seq,
+		}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// normalizeConversations rekeys the user's conversations by their normalized
+// participants. Conversations that end up with the same key are merged into
+// the one already keyed that way, or else the oldest.
+func normalizeConversations(db *gorm.DB, user *User, region string) ([]ConversationMerge, error) {
+	var conversations []Conversation
+	if err := db.Where(&Conversation{UserID: user.ID}).Order("id").Find(&conversations).Error; err != nil {
+		return nil, err
+	}
+	var keys []string
+	groups := make(map[string][]*Conversation)
+	for i := range conversations {
+		conversation := &conversations[i]
+		key := ConversationKey(E164Addresses(conversation.Participants(), region))
+		if _, found := groups[key]; !found {
+			keys = append(keys, key)
+		}
+		if conversation.Participant == key {
+			groups[key] = append([]*Conversation{conversation}, groups[key]...)
+		} else {
+			groups[key] = append(groups[key], conversation)
+		}
+	}
+
+	var merges []ConversationMerge
+	for _, key := range keys {
+		group := groups[key]
+		kept := group[0]
+		if len(group) == 1 && kept.Participant == key {
+			continue
+		}
+		for _, merged := range group[1:] {
+			if err := mergeConversation(db, kept, merged); err != nil {
+				return nil, err
+			}
+			merges = append(merges, ConversationMerge{From: merged.UUID, Into: kept.UUID})
+		}
+		if err := db.Model(kept).UpdateColumns(map[string]interface{}{
+			"participant":     key,
+			"read_message_id": kept.ReadMessageID,
+		}).Error; err != nil {
+			return nil, err
+		}
+		if len(group) == 1 {
+			continue
+		}
+		if err := refreshConversation(db, kept.ID); err != nil {
+			return nil, err
+		}
+		if err := countUnread(db, kept.ID); err != nil {
+			return nil, err
+		}
+	}
+	return merges, nil
+}
+
+// mergeConversation moves the messages and draft of one conversation into
+// another and deletes it. Of two drafts, the one edited last is kept.
+func mergeConversation(db *gorm.DB, kept, merged *Conversation) error {
+	if err := db.Unscoped().Model(&Message{}).Where("conversation_id = ?", merged.ID).
+		UpdateColumn("conversation_id", kept.ID).Error; err != nil {
+		return err
+	}
+	if merged.ReadMessageID > kept.ReadMessageID {
+		kept.ReadMessageID = merged.ReadMessageID
+	}
+
+	var drafts []Draft
+	if err := db.Unscoped().Where("conversation_id IN (?)", []uint{kept.ID, merged.ID}).
+		Find(&drafts).Error; err != nil {
+		return err
+	}
+	var keptDraft, mergedDraft *Draft
+	for i := range drafts {
+		if drafts[i].ConversationID == kept.ID {
+			keptDraft = &drafts[i]
+		} else {
+			mergedDraft = &drafts[i]
+		}
+	}
+	switch {
+	case mergedDraft == nil:
+	case keptDraft == nil:
+		if err := db.Unscoped().Model(mergedDraft).UpdateColumn("conversation_id", kept.ID).Error; err != nil {
+			return err
+		}
+	default:
+		if mergedDraft.ClientUpdatedAt.After(keptDraft.ClientUpdatedAt) {
+			if err := db.Unscoped().Model(keptDraft).UpdateColumns(map[string]interface{}{
+				"body":              mergedDraft.Body,
+				"client_updated_at": mergedDraft.ClientUpdatedAt,
+				"nonce":             mergedDraft.Nonce,
+				"key_version":       mergedDraft.KeyVersion,
+			}).Error; err != nil {
+				return err
+			}
+		}
+		if err := db.Unscoped().Delete(mergedDraft).Error; err != nil {
+			return err
+		}
+	}
+
+	// The conversation key stays taken by soft deleted rows
+	return db.Unscoped().Delete(merged).Error
+}
@@ -0,0 +1,101 @@
+package store
+
+import (
+	"portal-server/model"
+	"testing"
+	"time"
+
+	"github.com/franela/goblin"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeNumbers(t *testing.T) {
+	var db *gorm.DB
+	var user model.User
+	g := goblin.Goblin(t)
+
+	g.Describe("NormalizeNumbers", func() {
+		g.BeforeEach(func() {
+			db = GetTestDB()
+			user = model.User{UUID: "1", Email: "test@portal.com"}
+			db.Create(&user)
+		})
+
+		g.AfterEach(func() {
+			TeardownTestDB(db)
+		})
+
+		g.It("Should rewrite stored numbers and merge the conversations they share", func() {
+			contact := model.Contact{User: user, UUID: "contact", Name: "Justin",
+				PhoneNumbers: []model.ContactPhone{{Type: "cell", Number: "(555) 123-4567"}}}
+			db.Create(&contact)
+
+			old := model.Conversation{User: user, UUID: "old", Participant: "5551234567"}
+			db.Create(&old)
+			current := model.Conversation{User: user, UUID: "current", Participant: "+15551234567", ReadMessageID: 1}
+			db.Create(&current)
+			group := model.Conversation{User: user, UUID: "group", Participant: "5551234567,5559876543"}
+			db.Create(&group)
+
+			now := time.Now()
+			received := model.Message{User: user, MessageID: "received", ConversationID: old.ID, Seq: 1,
+				Direction: model.MessageDirectionIncoming, Status: model.MessageStatusReceived,
+				From: "5551234567", Body: "hi"}
+			db.Create(&received)
+			sent := model.Message{User: user, MessageID: "sent", ConversationID: current.ID, Seq: 2,
+				Status: model.MessageStatusSent, To: "+15551234567", Body: "hello"}
+			db.Create(&sent)
+			toGroup := model.Message{User: user, MessageID: "group", ConversationID: group.ID, Seq: 3,
+				Status: model.MessageStatusSent, Body: "hey all"}
+			toGroup.SetRecipients([]string{"5551234567", "5559876543"})
+			db.Create(&toGroup)
+			deleted := model.Message{User: user, MessageID: "deleted", ConversationID: old.ID, Seq: 4,
+				Status: model.MessageStatusSent, To: "5551234567", Body: "oops"}
+			db.Create(&deleted)
+			db.Delete(&deleted)
+			db.Create(&model.ChangeSequence{UserID: user.ID, Seq: 4})
+
+			db.Create(&model.Draft{User: user, ConversationID: old.ID, Body: "later", ClientUpdatedAt: now})
+			db.Create(&model.Draft{User: user, ConversationID: current.ID, Body: "earlier", ClientUpdatedAt: now.Add(-time.Minute)})
+
+			merges, err := NormalizeNumbers(db, &user)
+			assert.NoError(t, err)
+			assert.Equal(t, []ConversationMerge{{From: "old", Into: "current"}}, merges)
+
+			var phone model.ContactPhone
+			db.Where("contact_id = ?", contact.ID).First(&phone)
+			assert.Equal(t, "+15551234567", phone.Number)
+
+			var normalized, unchanged, toAll, tombstone model.Message
+			db.Where("message_id = ?", "received").First(&normalized)
+			assert.Equal(t, "+15551234567", normalized.From)
+			assert.Equal(t, current.ID, normalized.ConversationID)
+			assert.True(t, normalized.Seq > 4)
+			db.Where("message_id = ?", "sent").First(&unchanged)
+			assert.Equal(t, uint64(2), unchanged.Seq)
+			db.Where("message_id = ?", "group").Preload("Recipients").First(&toAll)
+			assert.Equal(t, "+15551234567, +15559876543", toAll.To)
+			assert.Equal(t, []string{"+15551234567", "+15559876543"}, toAll.RecipientAddresses())
+			db.Unscoped().Where("message_id = ?", "deleted").First(&tombstone)
+			assert.Equal(t, "+15551234567", tombstone.To)
+			assert.Equal(t, current.ID, tombstone.ConversationID)
+			assert.True(t, tombstone.Seq > 4)
+
+			var conversations []model.Conversation
+			db.Unscoped().Where("user_id = ?", user.ID).Order("id").Find(&conversations)
+			assert.Len(t, conversations, 2)
+			assert.Equal(t, "current", conversations[0].UUID)
+			assert.Equal(t, "+15551234567", conversations[0].Participant)
+			assert.Equal(t, 1, conversations[0].UnreadCount)
+			assert.Equal(t, uint(1), conversations[0].ReadMessageID)
+			assert.Equal(t, "+15551234567,+15559876543", conversations[1].Participant)
+
+			var drafts []model.Draft
+			db.Unscoped().Where("user_id = ?", user.ID).Find(&drafts)
+			assert.Len(t, drafts, 1)
+			assert.Equal(t, current.ID, drafts[0].ConversationID)
+			assert.Equal(t, "later", drafts[0].Body)
+		})
+	})
+}
@@ -0,0 +1,120 @@
+package store
+
+import (
+	. "portal-server/model"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+type ScheduledMessageStore interface {
+	CreateScheduledMessage(proto *ScheduledMessage) error
+	FindScheduledMessage(where *ScheduledMessage) (*ScheduledMessage, bool)
+	LockScheduledMessage(messageID string) (*ScheduledMessage, bool)
+	GetScheduledMessages(user *User) ([]ScheduledMessage, error)
+	GetDueScheduledMessages(now time.Time, limit int) ([]ScheduledMessage, error)
+	SaveScheduledMessage(scheduled *ScheduledMessage) error
+	MarkDispatching(scheduled *ScheduledMessage, at time.Time) error
+	MarkDispatched(scheduled *ScheduledMessage) error
+	MarkFailed(scheduled *ScheduledMessage, reason string) error
+}
+
+type scheduledMessageStore struct {
+	*gorm.DB
+}
+
+func (db scheduledMessageStore) CreateScheduledMessage(proto *ScheduledMessage) error {
+	if proto.UserID == 0 {
+		proto.UserID = proto.User.ID
+	}
+	return db.Create(proto).Error
+}
+
+func (db scheduledMessageStore) FindScheduledMessage(where *ScheduledMessage) (*ScheduledMessage, bool) {
+	var scheduled ScheduledMessage
+	if db.Where(where).First(&scheduled).RecordNotFound() {
+		return nil, false
+	}
+	return &scheduled, true
+}
+
+// LockScheduledMessage finds a scheduled message by its mid. On Postgres it
+// stays locked until the transaction ends, so that dispatching, editing, and
+// canceling it happen one after another.
+func (db scheduledMessageStore) LockScheduledMessage(messageID string) (*ScheduledMessage, bool) {
+	query := "SELECT * FROM scheduled_messages WHERE message_id = ? AND deleted_at IS NULL LIMIT 1"
+	if !isSQLite(db.DB) {
+		query += " FOR UPDATE"
+	}
+	var scheduled []ScheduledMessage
+	if err := db.Raw(query, messageID).Scan(&scheduled).Error; err != nil || len(scheduled) == 0 {
+		return nil, false
+	}
+	return &scheduled[0], true
+}
+
+// GetScheduledMessages returns all of the user's scheduled messages, soonest
+// first.
+func (db scheduledMessageStore) GetScheduledMessages(user *User) ([]ScheduledMessage, error) {
+	var scheduled []ScheduledMessage
+	if err := db.Where(&ScheduledMessage{
+		UserID: user.ID,
+	}).Order("send_at asc, id asc").Find(&scheduled).Error; err != nil {
+		return nil, err
+	}
+	return scheduled, nil
+}
+
+// GetDueScheduledMessages returns the scheduled messages due by the given
+// time that are pending, or that are dispatching and so need the phone told
+// about them again, longest overdue first.
+func (db scheduledMessageStore) GetDueScheduledMessages(now time.Time, limit int) ([]ScheduledMessage, error) {
+	var scheduled []ScheduledMessage
+	if err := db.Where("status IN (?)", []string{
+		ScheduleStatusPending,
+		ScheduleStatusDispatching,
+	}).Where("send_at <= ?", now).Order("send_at asc, id asc").Limit(limit).Find(&scheduled).Error; err != nil {
+		return nil, err
+	}
+	return scheduled, nil
+}
+
+func (db scheduledMessageStore) SaveScheduledMessage(scheduled *ScheduledMessage) error {
+	return db.Save(scheduled).Error
+}
+
+// MarkDispatching records that a scheduled message was queued for the phone,
+// changing nothing else about it.
+func (db scheduledMessageStore) MarkDispatching(scheduled *ScheduledMessage, at time.Time) error {
+	scheduled.Status = ScheduleStatusDispatching
+	scheduled.DispatchedAt = &at
+	return db.Model(scheduled).UpdateColumns(map[string]interface{}{
+		"status":        scheduled.Status,
+		"dispatched_at": at,
+	}).Error
+}
+
+// MarkDispatched records that the phone was told to send a dispatching
+// scheduled message. Messages that failed in the meantime stay failed.
+func (db scheduledMessageStore) MarkDispatched(scheduled *ScheduledMessage) error {
+	query := db.Model(&ScheduledMessage{}).Where("id = ? AND status = ?", scheduled.ID, ScheduleStatusDispatching).
+		UpdateColumn("status", ScheduleStatusDispatched)
+	if query.Error != nil {
+		return query.Error
+	}
+	if query.RowsAffected > 0 {
+		scheduled.Status = ScheduleStatusDispatched
+	}
+	return nil
+}
+
+// MarkFailed records why a scheduled message failed, changing nothing else
+// about it.
+func (db scheduledMessageStore) MarkFailed(scheduled *ScheduledMessage, reason string) error {
+	scheduled.Status = ScheduleStatusFailed
+	scheduled.FailureReason = reason
+	return db.Model(scheduled).UpdateColumns(map[string]interface{}{
+		"status":         scheduled.Status,
+		"failure_reason": reason,
+	}).Error
+}
@@ -0,0 +1,170 @@
+package store
+
+import (
+	"html"
+	. "portal-server/model"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Markers around matched terms in search snippets
+const (
+	SnippetStart = "<b>"
+	SnippetStop  = "</b>"
+)
+
+// Control characters mark matched terms in the snippets the database writes,
+// so that the body around them can be escaped before they become markup.
+const (
+	matchStart = "\x02"
+	matchStop  = "\x03"
+)
+
+// A MessageSearch finds a user's messages matching a full text query, newest
+// first. Results may be restricted to a conversation and to messages created
+// in [Since, Until) by their clients' clocks, like the dates they are shown
+// with, and are paged with BeforeID like a MessagePage.
+type MessageSearch struct {
+	Query          string
+	ConversationID uint
+	Since          time.Time
+	Until          time.Time
+	BeforeID       uint
+	Limit          int
+}
+
+// A MessageMatch is a message found by a search with a snippet of its body
+// highlighting the matched terms.
+type MessageMatch struct {
+	Message
+	Snippet string
+}
+
+// Postgres keeps a tsvector of each message body up to date with a trigger,
+// using the simple configuration since messages mix languages and slang. The
+// search_vector column is added first if it is missing, as Postgres 9.5
+// cannot add a column only if it does not exist.
+var postgresSearchIndex = []string{
+	`UPDATE messages SET search_vector = to_tsvector('simple', body) WHERE search_vector IS NULL`,
+	`CREATE INDEX IF NOT EXISTS idx_message_search_vector ON messages USING gin(search_vector)`,
+	`DROP TRIGGER IF EXISTS messages_search_vector_update ON messages`,
+	`CREATE TRIGGER messages_search_vector_update BEFORE INSERT OR UPDATE OF body ON messages
+		FOR EACH ROW EXECUTE PROCEDURE tsvector_update_trigger(search_vector, 'pg_catalog.simple', body)`,
+}
+
+// SQLite indexes message bodies in an external content FTS5 table kept in
+// sync by triggers.
+var sqliteSearchIndex = []string{
+	`CREATE VIRTUAL TABLE messages_fts USING fts5(body, content='messages', content_rowid='id')`,
+	`CREATE TRIGGER messages_fts_insert AFTER INSERT ON messages BEGIN
+		INSERT INTO messages_fts(rowid, body) VALUES (new.id, new.body);
+	END`,
+	`CREATE TRIGGER messages_fts_delete AFTER DELETE ON messages BEGIN
+		INSERT INTO messages_fts(messages_fts, rowid, body) VALUES ('delete', old.id, old.body);
+	END`,
+	`CREATE TRIGGER messages_fts_update AFTER UPDATE OF body ON messages BEGIN
+		INSERT INTO messages_fts(messages_fts, rowid, body) VALUES ('delete', old.id, old.body);
+		INSERT INTO messages_fts(rowid, body) VALUES (new.id, new.body);
+	END`,
+}
+
+// CreateSearchIndex adds the full text index over message bodies. It is
+// safe to run again on an existing Postgres database.
+func CreateSearchIndex(db *gorm.DB) error {
+	statements := postgresSearchIndex
+	if isSQLite(db) {
+		statements = sqliteSearchIndex
+	} else {
+		var columns int
+		if err := db.Raw(`SELECT count(*) FROM information_schema.columns
+			WHERE table_schema = current_schema() AND table_name = 'messages' AND column_name = 'search_vector'`).
+			Row().Scan(&columns); err != nil {
+			return err
+		}
+		if columns == 0 {
+			if err := db.Exec(`ALTER TABLE messages ADD COLUMN search_vector tsvector`).Error; err != nil {
+				return err
+			}
+		}
+	}
+	for _, statement := range statements {
+		if err := db.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db messageStore) SearchMessages(user *User, search MessageSearch) ([]MessageMatch, error) {
+	// Ciphertext is indexed like any other body, but matches in it are noise
+	query := db.Table("messages").Where("messages.user_id = ? AND messages.deleted_at IS NULL AND messages.nonce = ''", user.ID)
+	if isSQLite(db.DB) {
+		query = query.Select("messages.*, snippet(messages_fts, 0, ?, ?, '...', 16) AS snippet", matchStart, matchStop).
+			Joins("JOIN messages_fts ON messages_fts.rowid = messages.id").
+			Where("messages_fts MATCH ?", ftsQuery(search.Query))
+	} else {
+		query = query.Select("messages.*, ts_headline('simple', messages.body, plainto_tsquery('simple', ?), ?) AS snippet",
+			search.Query, "StartSel="+matchStart+", StopSel="+matchStop+", MaxFragments=1").
+			Where("messages.search_vector @@ plainto_tsquery('simple', ?)", search.Query)
+	}
+	if search.ConversationID != 0 {
+		query = query.Where("messages.conversation_id = ?", search.ConversationID)
+	}
+	// Messages sent from the api have no client date and are dated when recorded
+	if !search.Since.IsZero() {
+		query = query.Where("messages.client_created_at >= ? OR (messages.client_created_at <= '0001-01-02' AND messages.created_at >= ?)",
+			search.Since, search.Since)
+	}
+	if !search.Until.IsZero() {
+		query = query.Where("messages.client_created_at < ? AND (messages.client_created_at > '0001-01-02' OR messages.created_at < ?)",
+			search.Until, search.Until)
+	}
+	if search.BeforeID != 0 {
+		query = query.Where("messages.id < ?", search.BeforeID)
+	}
+	var matches []MessageMatch
+	if err := query.Order("messages.id desc").Limit(search.Limit).Scan(&matches).Error; err != nil {
+		return nil, err
+	}
+	messages := make([]*Message, len(matches))
+	for i := range matches {
+		matches[i].Snippet = markSnippet(matches[i].Snippet, matches[i].Body)
+		messages[i] = &matches[i].Message
+	}
+	if err := db.LoadDetails(messages...); err != nil {
+		return nil, err
+	}
+	return matches, nil
+}
+
+// markSnippet escapes a snippet of a message body written by the database
+// and marks its matched terms with SnippetStart and SnippetStop. A body that
+// itself holds the database's markers would be ambiguous, so its snippet is
+// left unmarked.
+func markSnippet(snippet, body string) string {
+	if strings.ContainsAny(body, matchStart+matchStop) {
+		unmarked := strings.NewReplacer(matchStart, "", matchStop, "")
+		return html.EscapeString(unmarked.Replace(snippet))
+	}
+	marked := strings.NewReplacer(matchStart, SnippetStart, matchStop, SnippetStop)
+	return marked.Replace(html.EscapeString(snippet))
+}
+
+// ftsQuery quotes each term of a query so that FTS5 matches them all
+// literally, like plainto_tsquery does in Postgres.
+func ftsQuery(query string) string {
+	terms := strings.Fields(query)
+	for i, term := range terms {
+		terms[i] = `"` + strings.Replace(term, `"`, `""`, -1) + `"`
+	}
+	return strings.Join(terms, " ")
+}
+
+// isSQLite reports whether a database, or a transaction on it, is SQLite.
+func isSQLite(db *gorm.DB) bool {
+	return reflect.TypeOf(db.NewScope(nil).Dialect()) == reflect.TypeOf(gorm.NewDialect("sqlite3"))
+}
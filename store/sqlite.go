@@ -5,7 +5,6 @@ import (
 	. "portal-server/model"
 
 	"github.com/jinzhu/gorm"
-	"github.com/mattn/go-sqlite3"
 )
 
 func GetTestStore() Store {
@@ -20,17 +19,25 @@ func GetTestDB() *gorm.DB {
 	db, _ := gorm.Open("sqlite3", ":memory:")
 	db.LogMode(false)
 	db.CreateTable(&User{}, &VerificationToken{}, &LinkedAccount{}, &UserToken{},
-		&NotificationKey{}, &Device{}, &Message{}, &Contact{}, &ContactPhone{}, &EncryptionKey{})
+		&NotificationKey{}, &Device{}, &Message{}, &Contact{}, &ContactPhone{}, &EncryptionKey{},
+		&WrappedKey{}, &DataKey{}, &PairingSession{}, &ChangeSequence{}, &Conversation{},
+		&MessageStatusEvent{}, &Attachment{}, &MessageRecipient{}, &OutboxEvent{}, &ScheduledMessage{}, &Draft{}, &ImportJob{}, &PairingFailure{})
+	if err := CreateSearchIndex(&db); err != nil {
+		log.Fatalf("Unable to create search index: %v\n", err)
+	}
 	return &db
 }
 
 func TeardownTestDB(db *gorm.DB) {
-	if _, valid := db.DB().Driver().(*sqlite3.SQLiteDriver); !valid {
+	if !isSQLite(db) {
 		log.Fatalf("Teardown() should only be used in testing")
 		return
 	}
+	db.Exec("DROP TABLE IF EXISTS messages_fts")
 	db.DropTableIfExists(&User{}, &VerificationToken{}, &LinkedAccount{}, &UserToken{},
-		&NotificationKey{}, &Device{}, &Message{}, &Contact{}, &ContactPhone{}, &EncryptionKey{})
+		&NotificationKey{}, &Device{}, &Message{}, &Contact{}, &ContactPhone{}, &EncryptionKey{},
+		&WrappedKey{}, &DataKey{}, &PairingSession{}, &ChangeSequence{}, &Conversation{},
+		&MessageStatusEvent{}, &Attachment{}, &MessageRecipient{}, &OutboxEvent{}, &ScheduledMessage{}, &Draft{}, &ImportJob{}, &PairingFailure{})
 }
 
 func (s *store) teardown() {
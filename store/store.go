@@ -11,34 +11,51 @@ import (
 // the ORM.
 type Store interface {
 	Transaction(t func(txStore Store) error)
+	Attachments() AttachmentStore
 	Users() UserStore
 	LinkedAccounts() LinkedAccountStore
 	Contacts() ContactStore
+	Conversations() ConversationStore
 	Devices() DeviceStore
+	Drafts() DraftStore
+	ImportJobs() ImportJobStore
 	EncryptionKeys() EncryptionKeyStore
 	Messages() MessageStore
 	NotificationKeys() NotificationKeyStore
+	Outbox() OutboxStore
+	PairingSessions() PairingSessionStore
+	ScheduledMessages() ScheduledMessageStore
 	UserTokens() UserTokenStore
 	VerificationTokens() VerificationTokenStore
+	WrappedKeys() WrappedKeyStore
 	teardown()
 }
 
 type store struct {
 	db                 *gorm.DB
+	masterKey          *MasterKey
+	attachments        attachmentStore
 	users              userStore
 	linkedAccounts     linkedAccountStore
 	contacts           contactStore
+	conversations      conversationStore
 	devices            deviceStore
+	drafts             draftStore
+	importJobs         importJobStore
 	encryptionKeys     encryptionKeyStore
 	messages           messageStore
 	notificationKeys   notificationKeyStore
+	outbox             outboxStore
+	pairingSessions    pairingSessionStore
+	scheduledMessages  scheduledMessageStore
 	userTokens         userTokenStore
 	verificationTokens verificationTokenStore
+	wrappedKeys        wrappedKeyStore
 }
 
 func (s *store) Transaction(t func(txStore Store) error) {
 	tx := s.db.Begin()
-	txStore := New(tx)
+	txStore := NewWithMasterKey(tx, s.masterKey)
 	if err := t(txStore); err != nil {
 		tx.Rollback()
 		log.Printf("Database rollback: %v\n", err)
@@ -47,27 +64,51 @@ func (s *store) Transaction(t func(txStore Store) error) {
 	tx.Commit()
 }
 
+func (s *store) Attachments() AttachmentStore               { return s.attachments }
 func (s *store) Users() UserStore                           { return s.users }
 func (s *store) LinkedAccounts() LinkedAccountStore         { return s.linkedAccounts }
 func (s *store) Contacts() ContactStore                     { return s.contacts }
+func (s *store) Conversations() ConversationStore           { return s.conversations }
 func (s *store) Devices() DeviceStore                       { return s.devices }
+func (s *store) Drafts() DraftStore                         { return s.drafts }
+func (s *store) ImportJobs() ImportJobStore                 { return s.importJobs }
 func (s *store) EncryptionKeys() EncryptionKeyStore         { return s.encryptionKeys }
 func (s *store) Messages() MessageStore                     { return s.messages }
 func (s *store) NotificationKeys() NotificationKeyStore     { return s.notificationKeys }
+func (s *store) Outbox() OutboxStore                        { return s.outbox }
+func (s *store) PairingSessions() PairingSessionStore       { return s.pairingSessions }
+func (s *store) ScheduledMessages() ScheduledMessageStore   { return s.scheduledMessages }
 func (s *store) UserTokens() UserTokenStore                 { return s.userTokens }
 func (s *store) VerificationTokens() VerificationTokenStore { return s.verificationTokens }
+func (s *store) WrappedKeys() WrappedKeyStore               { return s.wrappedKeys }
 
+// New creates a store that keeps secrets as plaintext.
 func New(db *gorm.DB) Store {
+	return NewWithMasterKey(db, nil)
+}
+
+// NewWithMasterKey creates a store that encrypts secrets under data keys
+// wrapped by the given master key.
+func NewWithMasterKey(db *gorm.DB, masterKey *MasterKey) Store {
 	return &store{
 		db:                 db,
+		masterKey:          masterKey,
+		attachments:        attachmentStore{db},
 		users:              userStore{db},
 		linkedAccounts:     linkedAccountStore{db},
 		contacts:           contactStore{db},
+		conversations:      conversationStore{db},
 		devices:            deviceStore{db},
-		encryptionKeys:     encryptionKeyStore{db},
+		drafts:             draftStore{db},
+		importJobs:         importJobStore{db},
+		encryptionKeys:     encryptionKeyStore{db, secretBox{db, masterKey}},
 		messages:           messageStore{db},
 		notificationKeys:   notificationKeyStore{db},
+		outbox:             outboxStore{db},
+		pairingSessions:    pairingSessionStore{db},
+		scheduledMessages:  scheduledMessageStore{db},
 		userTokens:         userTokenStore{db},
 		verificationTokens: verificationTokenStore{db},
+		wrappedKeys:        wrappedKeyStore{db},
 	}
 }
@@ -52,3 +52,12 @@ func (db userStore) UserCount(where *User) int {
 func (db userStore) GetRelated(user *User, related interface{}) error {
 	return db.Model(user).Related(related).Error
 }
+
+// userRegion finds the region a user's numbers are normalized for.
+func userRegion(db *gorm.DB, userID uint) (string, error) {
+	var user User
+	if err := db.Select("region").Where("id = ?", userID).First(&user).Error; err != nil && err != gorm.RecordNotFound {
+		return "", err
+	}
+	return user.PhoneRegion(), nil
+}
@@ -0,0 +1,49 @@
+package store
+
+import (
+	"errors"
+	. "portal-server/model"
+
+	"github.com/jinzhu/gorm"
+)
+
+// ErrWrappedKeyExists is returned when a device already has a wrapped key
+// for a version.
+var ErrWrappedKeyExists = errors.New("wrapped_key_exists")
+
+type WrappedKeyStore interface {
+	CreateWrappedKey(proto *WrappedKey) error
+	GetKeysForDevice(device *Device) ([]WrappedKey, error)
+}
+
+type wrappedKeyStore struct {
+	*gorm.DB
+}
+
+// CreateWrappedKey stores a key wrapped for a device. A version's key is
+// never replaced once a device has it, so that no other device can swap in
+// key material of its own.
+func (db wrappedKeyStore) CreateWrappedKey(proto *WrappedKey) error {
+	var existing WrappedKey
+	query := db.Where(&WrappedKey{
+		DeviceID: proto.DeviceID,
+		Version:  proto.Version,
+	}).First(&existing)
+	if !query.RecordNotFound() {
+		if query.Error != nil {
+			return query.Error
+		}
+		return ErrWrappedKeyExists
+	}
+	return db.Create(proto).Error
+}
+
+func (db wrappedKeyStore) GetKeysForDevice(device *Device) ([]WrappedKey, error) {
+	var keys []WrappedKey
+	if err := db.Where(&WrappedKey{
+		DeviceID: device.ID,
+	}).Order("version asc").Find(&keys).Error; err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
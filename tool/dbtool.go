@@ -3,21 +3,36 @@ package main
 import (
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"portal-server/api/util"
+	"portal-server/blob"
+	"portal-server/bus"
 	. "portal-server/model"
 	"portal-server/store"
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
 )
 
 var (
 	dbName   = os.Getenv("DB_NAME")
 	user     = os.Getenv("DB_DBTOOL_USER")
 	password = os.Getenv("DB_DBTOOL_PASSWORD")
+
+	attachmentDir = os.Getenv("ATTACHMENT_DIR")
 )
 
-func validAction(action string) bool {
-	switch action {
-	case "drop", "create", "migrate":
-		return true
+func validAction(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	switch args[0] {
+	case "drop", "create", "migrate", "reencrypt":
+		return len(args) == 1
+	case "recover", "prune":
+		return len(args) <= 2
 	}
 	return false
 }
@@ -25,8 +40,8 @@ func validAction(action string) bool {
 func main() {
 	args := os.Args[1:]
 
-	if len(args) != 1 || !validAction(args[0]) {
-		fmt.Println("Usage:", os.Args[0], "[drop|create|migrate]")
+	if !validAction(args) {
+		fmt.Println("Usage:", os.Args[0], "[drop|create|migrate|reencrypt|recover [email]|prune [days]]")
 		os.Exit(1)
 	}
 
@@ -41,18 +56,239 @@ func main() {
 	case "drop":
 		db.DropTable(
 			&User{}, &VerificationToken{}, &LinkedAccount{}, &UserToken{},
-			&NotificationKey{}, &Device{}, &Message{}, &Contact{}, &ContactPhone{}, &EncryptionKey{})
+			&NotificationKey{}, &Device{}, &Message{}, &Contact{}, &ContactPhone{}, &EncryptionKey{},
+			&WrappedKey{}, &DataKey{}, &PairingSession{}, &ChangeSequence{}, &Conversation{},
+			&MessageStatusEvent{}, &Attachment{}, &MessageRecipient{}, &OutboxEvent{}, &ScheduledMessage{}, &Draft{}, &ImportJob{}, &PairingFailure{})
 
 	case "create":
 		db.CreateTable(
 			&User{}, &VerificationToken{}, &LinkedAccount{}, &UserToken{},
-			&NotificationKey{}, &Device{}, &Message{}, &Contact{}, &ContactPhone{}, &EncryptionKey{})
+			&NotificationKey{}, &Device{}, &Message{}, &Contact{}, &ContactPhone{}, &EncryptionKey{},
+			&WrappedKey{}, &DataKey{}, &PairingSession{}, &ChangeSequence{}, &Conversation{},
+			&MessageStatusEvent{}, &Attachment{}, &MessageRecipient{}, &OutboxEvent{}, &ScheduledMessage{}, &Draft{}, &ImportJob{}, &PairingFailure{})
 		db.Model(&LinkedAccount{}).AddUniqueIndex("idx_linked_account_type_account_id", "type", "account_id")
+		createSearchIndex(db)
 
 	case "migrate":
 		db.AutoMigrate(
 			&User{}, &VerificationToken{}, &LinkedAccount{}, &UserToken{},
-			&NotificationKey{}, &Device{}, &Message{}, &Contact{}, &ContactPhone{}, &EncryptionKey{})
+			&NotificationKey{}, &Device{}, &Message{}, &Contact{}, &ContactPhone{}, &EncryptionKey{},
+			&WrappedKey{}, &DataKey{}, &PairingSession{}, &ChangeSequence{}, &Conversation{},
+			&MessageStatusEvent{}, &Attachment{}, &MessageRecipient{}, &OutboxEvent{}, &ScheduledMessage{}, &Draft{}, &ImportJob{}, &PairingFailure{})
 		db.Model(&LinkedAccount{}).AddUniqueIndex("idx_linked_account_type_account_id", "type", "account_id")
+
+		// Encryption keys are versioned: allow many per user, and make
+		// pre-existing keys the current version
+		db.Model(&EncryptionKey{}).RemoveIndex("uix_encryption_keys_user_id")
+		db.Exec(`UPDATE encryption_keys SET current = true WHERE user_id NOT IN
+			(SELECT user_id FROM encryption_keys WHERE current)`)
+
+		// Number pre-existing messages in ID order, which keeps each user's
+		// change sequence increasing
+		db.Exec(`UPDATE messages SET seq = id WHERE seq IS NULL OR seq = 0`)
+		db.Exec(`INSERT INTO change_sequences (created_at, updated_at, user_id, seq, pruned_seq)
+			SELECT now(), now(), user_id, max(seq), 0 FROM messages
+			WHERE user_id NOT IN (SELECT user_id FROM change_sequences) GROUP BY user_id`)
+		assignConversations(db)
+		normalizeNumbers(db)
+		createSearchIndex(db)
+
+	case "reencrypt":
+		reencryptSecrets(db)
+
+	case "recover":
+		if util.GcmApiKey == "" || util.GcmSenderID == "" {
+			log.Fatalln("Missing GCM_SENDER_ID or GCM_API_KEY environment variables")
+		}
+		var email string
+		if len(args) == 2 {
+			email = args[1]
+		}
+		masterKey, err := store.LoadMasterKey("MASTER_KEY")
+		if err != nil {
+			log.Fatalf("Error loading master key: %v\n", err)
+		}
+		recoverNotificationGroups(store.NewWithMasterKey(db, masterKey), email)
+
+	case "prune":
+		days := defaultTombstoneDays
+		if len(args) == 2 {
+			var err error
+			if days, err = strconv.Atoi(args[1]); err != nil || days < 0 {
+				log.Fatalf("Invalid number of days: %v\n", args[1])
+			}
+		}
+		if attachmentDir == "" {
+			attachmentDir = "attachments"
+		}
+		blobs, err := blob.NewFileStore(attachmentDir)
+		if err != nil {
+			log.Fatalf("Unable to use ATTACHMENT_DIR: %v\n", err)
+		}
+		pruneDeletedMessages(store.New(db), blobs, days)
+		pruneRelayedEvents(store.New(db), days)
+	}
+}
+
+// createSearchIndex adds or updates the full text index over messages.
+func createSearchIndex(db *gorm.DB) {
+	if err := store.CreateSearchIndex(db); err != nil {
+		log.Fatalf("Unable to create search index: %v\n", err)
+	}
+}
+
+// assignConversations adds messages recorded before conversations existed
+// to the conversation with their participant.
+func assignConversations(db *gorm.DB) {
+	var messages []Message
+	if err := db.Unscoped().Where("conversation_id IS NULL OR conversation_id = 0").
+		Order("id").Find(&messages).Error; err != nil {
+		log.Fatalf("Unable to load messages: %v\n", err)
+	}
+	s := store.New(db)
+	for i := range messages {
+		if err := s.Conversations().AssignConversation(&messages[i]); err != nil {
+			log.Fatalf("Unable to assign message %v to a conversation: %v\n", messages[i].ID, err)
+		}
+	}
+}
+
+// normalizeNumbers writes the numbers stored before they were normalized in
+// E.164 format for each user's region, telling their clients about the
+// conversations merged as a result.
+func normalizeNumbers(db *gorm.DB) {
+	var users []User
+	if err := db.Find(&users).Error; err != nil {
+		log.Fatalf("Unable to load users: %v\n", err)
+	}
+	for i := range users {
+		tx := db.Begin()
+		if err := normalizeUserNumbers(tx, &users[i]); err != nil {
+			tx.Rollback()
+			log.Fatalf("Unable to normalize the numbers of user %v: %v\n", users[i].ID, err)
+		}
+		tx.Commit()
+	}
+}
+
+func normalizeUserNumbers(tx *gorm.DB, user *User) error {
+	merges, err := store.NormalizeNumbers(tx, user)
+	if err != nil {
+		return err
+	}
+	for _, merge := range merges {
+		if err := bus.Enqueue(store.New(tx), bus.ConversationMerged{
+			UserID:         user.ID,
+			ConversationID: merge.From,
+			MergedInto:     merge.Into,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// defaultTombstoneDays is how long deleted messages are kept for clients
+// syncing changes before they are pruned
+const defaultTombstoneDays = 30
+
+// pruneDeletedMessages removes messages deleted more than the given number
+// of days ago, and their attachments. Clients which have not synced since
+// must fully resync.
+func pruneDeletedMessages(s store.Store, blobs blob.BlobStore, days int) {
+	before := time.Now().AddDate(0, 0, -days)
+	var pruned int
+	var attachments []string
+	var err error
+	s.Transaction(func(store store.Store) error {
+		pruned, attachments, err = store.Messages().PruneDeletedMessages(before)
+		return err
+	})
+	if err != nil {
+		log.Fatalf("Unable to prune deleted messages: %v\n", err)
+	}
+	// Nothing refers to the attachments once the prune is committed
+	for _, key := range attachments {
+		if err := blobs.Delete(key); err != nil {
+			log.Printf("Unable to delete attachment %v: %v\n", key, err)
+		}
+	}
+	log.Printf("Pruned %d messages deleted before %v\n", pruned, before)
+}
+
+// pruneRelayedEvents removes outbox events relayed more than the given number
+// of days ago.
+func pruneRelayedEvents(s store.Store, days int) {
+	before := time.Now().AddDate(0, 0, -days)
+	pruned, err := s.Outbox().PruneRelayedEvents(before)
+	if err != nil {
+		log.Fatalf("Unable to prune relayed events: %v\n", err)
+	}
+	log.Printf("Pruned %d events relayed before %v\n", pruned, before)
+}
+
+// reencryptSecrets rewraps all data keys from the master key in OLD_MASTER_KEY
+// to the one in MASTER_KEY, sealing any plaintext secrets along the way.
+func reencryptSecrets(db *gorm.DB) {
+	oldKey, err := store.LoadMasterKey("OLD_MASTER_KEY")
+	if err != nil {
+		log.Fatalf("Error loading old master key: %v\n", err)
+	}
+	newKey, err := store.LoadMasterKey("MASTER_KEY")
+	if err != nil {
+		log.Fatalf("Error loading master key: %v\n", err)
+	}
+	if newKey == nil {
+		log.Fatalln("Missing MASTER_KEY or MASTER_KEY_FILE environment variables")
+	}
+
+	tx := db.Begin()
+	if err := store.ReencryptSecrets(tx, oldKey, newKey); err != nil {
+		tx.Rollback()
+		log.Fatalf("Unable to reencrypt secrets: %v\n", err)
+	}
+	tx.Commit()
+	log.Printf("Reencrypted secrets under master key %v\n", newKey.ID)
+}
+
+// recoverNotificationGroups re-syncs stored notification keys with GCM,
+// rebuilding any groups that no longer exist. If an email is given, only
+// that user's group is recovered.
+func recoverNotificationGroups(s store.Store, email string) {
+	wc := &util.WebClient{
+		BaseURL:    util.GcmNotificationEndpoint,
+		HTTPClient: http.DefaultClient,
+	}
+
+	var keys []NotificationKey
+	if email != "" {
+		u, found := s.Users().FindUser(&User{Email: email})
+		if !found {
+			log.Fatalf("User %v not found\n", email)
+		}
+		key, found := s.NotificationKeys().FindKey(&NotificationKey{UserID: u.ID})
+		if !found {
+			log.Fatalf("User %v has no notification group\n", email)
+		}
+		keys = append(keys, *key)
+	} else {
+		var err error
+		if keys, err = s.NotificationKeys().GetAllKeys(); err != nil {
+			log.Fatalf("Unable to load notification keys: %v\n", err)
+		}
+	}
+
+	failed := 0
+	for i := range keys {
+		key := &keys[i]
+		if err := util.RecoverNotificationGroup(s, wc, key); err != nil {
+			log.Printf("Unable to recover notification group %v: %v\n", key.ID, err)
+			failed++
+			continue
+		}
+		log.Printf("Recovered notification group %v\n", key.ID)
+	}
+	if failed > 0 {
+		log.Fatalf("Failed to recover %d of %d notification groups\n", failed, len(keys))
 	}
 }